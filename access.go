@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// --- Access Control ---
+// Without any users configured the UI is open to whoever can reach it, as
+// before. Once users exist every request needs an access key, sent as a
+// Bearer token or via the cookie set by opening an access link (/?key=...),
+// or a user name in a header set by an authenticating reverse proxy. Each
+// route requires a role (see routes.go):
+//
+//	viewer    read-only: dashboard, history, lists and reports
+//	operator  also runs scrubs, balances, snapshots and other maintenance
+//	admin     everything, including config, deletion, purge and devices
+//
+// State-changing requests a browser makes on behalf of another site are
+// refused, so a page elsewhere can't post to an open UI or ride on the
+// access cookie. Clients like curl send no such headers and are unaffected.
+
+const (
+	rolePublic   = "public" // no access key needed, e.g. signed /share/ links
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+
+	accessCookie = "btrfs_webui_key"
+)
+
+var roleRank = map[string]int{roleViewer: 1, roleOperator: 2, roleAdmin: 3}
+
+type AccessConfig struct {
+	Users []AccessUser `json:"users"`
+	// ProxyHeader names a header, e.g. Remote-User, whose value is trusted
+	// as the user name when it matches a configured user.
+	ProxyHeader string `json:"proxy_header"`
+	// TrustedOrigins are other origins allowed to make requests, e.g.
+	// https://nas.example.com when a reverse proxy rewrites the Host header.
+	TrustedOrigins []string `json:"trusted_origins,omitempty"`
+}
+
+type AccessUser struct {
+	Name    string `json:"name"`
+	Role    string `json:"role"`
+	KeyHash string `json:"key_hash"` // sha256 of the access key, which is only shown once
+}
+
+type accessContextKey struct{}
+
+func hashAccessKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c AccessConfig) validate() error {
+	admins := 0
+	seen := map[string]bool{}
+	for _, u := range c.Users {
+		if u.Name == "" || seen[u.Name] { return fmt.Errorf("user names must be unique and not empty") }
+		seen[u.Name] = true
+		if roleRank[u.Role] == 0 { return fmt.Errorf("user %s: role must be admin, operator or viewer", u.Name) }
+		if u.Role == roleAdmin { admins++ }
+	}
+	if len(c.Users) > 0 && admins == 0 { return fmt.Errorf("at least one admin is required") }
+	_, err := c.crossOriginProtection()
+	return err
+}
+
+// crossOriginProtection checks Sec-Fetch-Site, or Origin against Host, on
+// requests other than GET, HEAD and OPTIONS.
+func (c AccessConfig) crossOriginProtection() (*http.CrossOriginProtection, error) {
+	p := http.NewCrossOriginProtection()
+	for _, o := range c.TrustedOrigins {
+		if err := p.AddTrustedOrigin(o); err != nil { return nil, fmt.Errorf("trusted_origins: %v", err) }
+	}
+	return p, nil
+}
+
+// authenticate returns the user a request belongs to. Without configured
+// users everybody acts as an anonymous admin.
+func authenticate(r *http.Request, cfg AccessConfig) (AccessUser, bool) {
+	if len(cfg.Users) == 0 { return AccessUser{Role: roleAdmin}, true }
+
+	if cfg.ProxyHeader != "" {
+		if name := r.Header.Get(cfg.ProxyHeader); name != "" {
+			for _, u := range cfg.Users {
+				if u.Name == name { return u, true }
+			}
+			return AccessUser{}, false
+		}
+	}
+
+	key := r.URL.Query().Get("key")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	} else if c, err := r.Cookie(accessCookie); err == nil && key == "" {
+		key = c.Value
+	}
+	if key == "" { return AccessUser{}, false }
+	hash := hashAccessKey(key)
+	for _, u := range cfg.Users {
+		if subtle.ConstantTimeCompare([]byte(u.KeyHash), []byte(hash)) == 1 { return u, true }
+	}
+	return AccessUser{}, false
+}
+
+func requestUser(r *http.Request) AccessUser {
+	u, _ := r.Context().Value(accessContextKey{}).(AccessUser)
+	return u
+}
+
+func setAccessCookie(w http.ResponseWriter, r *http.Request, key string) {
+	http.SetCookie(w, &http.Cookie{Name: accessCookie, Value: key, Path: "/", HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteStrictMode, MaxAge: 365 * 24 * 3600})
+}
+
+// withRole enforces role on a handler. Opening a page with ?key= stores the
+// key in a cookie and redirects, so the key doesn't stay in the address bar.
+func withRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if role == rolePublic {
+			h(w, r)
+			return
+		}
+		state.mu.Lock()
+		cfg := state.Config.Access
+		state.mu.Unlock()
+
+		if p, err := cfg.crossOriginProtection(); err == nil {
+			if err := p.Check(r); err != nil {
+				http.Error(w, "Forbidden: cross-origin request (add the origin to trusted_origins if it is yours)", 403)
+				return
+			}
+		}
+		user, ok := authenticate(r, cfg)
+		if !ok {
+			http.Error(w, "Access key required: open the access link you were given", 401)
+			return
+		}
+		if q := r.URL.Query(); q.Get("key") != "" && r.Method == "GET" && !strings.HasPrefix(r.URL.Path, "/api/") {
+			setAccessCookie(w, r, q.Get("key"))
+			q.Del("key")
+			u := *r.URL
+			u.RawQuery = q.Encode()
+			http.Redirect(w, r, u.RequestURI(), 303)
+			return
+		}
+		if roleRank[user.Role] < roleRank[role] {
+			http.Error(w, fmt.Sprintf("Forbidden: requires the %s role", role), 403)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), accessContextKey{}, user)))
+	}
+}
+
+// --- Handlers ---
+
+func handleAccessMe(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	enabled := len(state.Config.Access.Users) > 0
+	state.mu.Unlock()
+	u := requestUser(r)
+	json.NewEncoder(w).Encode(map[string]interface{}{"enabled": enabled, "name": u.Name, "role": u.Role})
+}
+
+func handleListAccessUsers(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	users := []map[string]string{}
+	for _, u := range state.Config.Access.Users { users = append(users, map[string]string{"name": u.Name, "role": u.Role}) }
+	json.NewEncoder(w).Encode(users)
+}
+
+// handleSaveAccessUser creates a user, or changes its role and issues a new
+// key. The key is returned once, with an access link.
+func handleSaveAccessUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), 400)
+		return
+	}
+	b := make([]byte, 24)
+	rand.Read(b)
+	key := hex.EncodeToString(b)
+
+	state.mu.Lock()
+	access := state.Config.Access
+	first := len(access.Users) == 0
+	users := []AccessUser{}
+	for _, u := range access.Users {
+		if u.Name != req.Name { users = append(users, u) }
+	}
+	access.Users = append(users, AccessUser{Name: req.Name, Role: req.Role, KeyHash: hashAccessKey(key)})
+	if err := access.validate(); err != nil {
+		state.mu.Unlock()
+		if first { err = fmt.Errorf("%v: the first user must be an admin", err) }
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	state.Config.Access = access
+	saveState()
+	state.mu.Unlock()
+
+	// Whoever sets up access keeps it in this browser.
+	if first { setAccessCookie(w, r, key) }
+	logHistory("ACCESS", "🔑", req.Name, "Success", fmt.Sprintf("Issued a new %s access key", req.Role))
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": req.Name, "role": req.Role, "key": key, "link": "/?key=" + key})
+}
+
+func handleDeleteAccessUser(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	state.mu.Lock()
+	access := state.Config.Access
+	users := []AccessUser{}
+	for _, u := range access.Users {
+		if u.Name != name { users = append(users, u) }
+	}
+	if len(users) == len(access.Users) {
+		state.mu.Unlock()
+		http.Error(w, "No such user", 404)
+		return
+	}
+	access.Users = users
+	if err := access.validate(); err != nil {
+		state.mu.Unlock()
+		http.Error(w, err.Error()+" (delete the other users first to turn access control off)", 400)
+		return
+	}
+	state.Config.Access = access
+	saveState()
+	state.mu.Unlock()
+	logHistory("ACCESS", "🔑", name, "Success", "Access revoked")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "deleted"})
+}
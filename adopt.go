@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// --- Adopted Snapshots ---
+// Snapshots made by other tools (btrbk, snapper scripts, cron jobs) are
+// named their own way and would be invisible to a job. Adopt patterns let
+// the job recognize them: a regexp on the whole name whose time group is
+// read with name template tokens (see snapname.go). Adopted snapshots are
+// listed, pruned by retention and managed like the job's own; new ones are
+// still named by the job's template.
+
+type AdoptPattern struct {
+	Pattern string `json:"pattern"` // e.g. ^home\.(\d{8}T\d{4})$; the group named time, else the first, holds the time
+	Time    string `json:"time"`    // how that group is spelled, e.g. %Y%m%dT%H%M
+}
+
+type adoptMatcher struct {
+	re     *regexp.Regexp
+	group  int
+	naming *snapshotNaming
+}
+
+var adoptCache sync.Map // pattern + time -> *adoptMatcher
+
+func (p AdoptPattern) matcher() (*adoptMatcher, error) {
+	key := p.Pattern + "\x00" + p.Time
+	if m, ok := adoptCache.Load(key); ok { return m.(*adoptMatcher), nil }
+	re, err := regexp.Compile("^(?:" + p.Pattern + ")$")
+	if err != nil { return nil, fmt.Errorf("invalid pattern %q: %v", p.Pattern, err) }
+	group := re.SubexpIndex("time")
+	if group < 0 { group = 1 }
+	if re.NumSubexp() < group { return nil, fmt.Errorf("pattern %q needs a group around the time", p.Pattern) }
+	n, err := compileNameTemplate(p.Time, "", "")
+	if err != nil { return nil, fmt.Errorf("invalid time %q: %v", p.Time, err) }
+	m := &adoptMatcher{re: re, group: group, naming: n}
+	adoptCache.Store(key, m)
+	return m, nil
+}
+
+func (p AdoptPattern) validate() error {
+	m, err := p.matcher()
+	if err != nil { return err }
+	if err := m.naming.validate(); err != nil { return fmt.Errorf("time %q: %v", p.Time, err) }
+	return nil
+}
+
+func (m *adoptMatcher) parse(name string) (time.Time, bool) {
+	sub := m.re.FindStringSubmatch(name)
+	if sub == nil { return time.Time{}, false }
+	return m.naming.parse(sub[m.group])
+}
+
+// adoptedSnapshotTime reports whether name matches one of the job's adopt
+// patterns (the first one wins) and when it was taken.
+func (j SnapshotJob) adoptedSnapshotTime(name string) (time.Time, bool) {
+	for _, p := range j.Adopt {
+		m, err := p.matcher()
+		if err != nil { continue }
+		if t, ok := m.parse(name); ok { return t, true }
+	}
+	return time.Time{}, false
+}
+
+// adopted reports whether name is another tool's snapshot the job adopted.
+func (j SnapshotJob) adopted(name string) bool {
+	if len(j.Adopt) == 0 { return false }
+	if _, own := j.parseOwnSnapshotTime(name); own { return false }
+	_, ok := j.adoptedSnapshotTime(name)
+	return ok
+}
+
+// --- Handlers ---
+
+// AdoptMatch is how a directory in the job's destination is recognized:
+// Match is "job" for the job's own naming, "adopted" or empty for neither.
+type AdoptMatch struct {
+	Name  string `json:"name"`
+	Match string `json:"match"`
+	Time  string `json:"time,omitempty"` // RFC 3339
+}
+
+// handleAdoptPreview shows which directories in the job's destination its
+// naming and adopt patterns recognize, with {"adopt": [...]} in the body
+// tried instead of the saved patterns.
+func handleAdoptPreview(w http.ResponseWriter, r *http.Request) {
+	job, err := findSnapshotJob(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	var req struct {
+		Adopt *[]AdoptPattern `json:"adopt"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), 400)
+			return
+		}
+	}
+	if req.Adopt != nil { job.Adopt = *req.Adopt }
+	for i, p := range job.Adopt {
+		if err := p.validate(); err != nil {
+			http.Error(w, fmt.Sprintf("adopt pattern %d: %v", i+1, err), 400)
+			return
+		}
+	}
+	entries, err := os.ReadDir(job.Dest)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	times := loadSnapshotTimes(job.Dest)
+	counts := map[string]int{"job": 0, "adopted": 0, "": 0}
+	list := []AdoptMatch{}
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == quarantineDirName || e.Name() == trashDirName { continue }
+		m := AdoptMatch{Name: e.Name()}
+		if t, ok := job.snapshotTime(e.Name(), times); ok {
+			m.Match, m.Time = "job", t.Format(time.RFC3339)
+			if job.adopted(e.Name()) { m.Match = "adopted" }
+		}
+		counts[m.Match]++
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"snapshots": list,
+		"own":       counts["job"],
+		"adopted":   counts["adopted"],
+		"unmatched": counts[""],
+	})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Space Advisor ---
+// Answers "I deleted it, why is the space still used?": for a path inside a
+// job's source it finds which snapshots still hold its extents and how much
+// space each snapshot's expiry would actually release.
+
+const advisorMaxFiles = 20000
+
+type AdvisorSnapshot struct {
+	Name            string `json:"name"`
+	Taken           string `json:"taken"`
+	HasPath         bool   `json:"has_path"`
+	ReferencedBytes uint64 `json:"referenced_bytes"`
+	// FreedOnExpiry is the space released when this snapshot expires,
+	// assuming older snapshots have already expired before it.
+	FreedOnExpiry uint64 `json:"freed_on_expiry"`
+	Expires       string `json:"expires"`
+}
+
+type AdvisorReport struct {
+	Job              string            `json:"job"`
+	Path             string            `json:"path"`
+	LiveExists       bool              `json:"live_exists"`
+	LiveBytes        uint64            `json:"live_bytes"`
+	ReclaimableBytes uint64            `json:"reclaimable_bytes"`
+	Snapshots        []AdvisorSnapshot `json:"snapshots"`
+	FilesScanned     int               `json:"files_scanned"`
+	Truncated        bool              `json:"truncated"`
+}
+
+func handleSpaceAdvisor(w http.ResponseWriter, r *http.Request) {
+	job, err := jobFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	// Accept both "docs/big.iso" and "/host/home/docs/big.iso".
+	rel := r.URL.Query().Get("path")
+	if filepath.IsAbs(rel) {
+		if inside, err := filepath.Rel(job.Source, rel); err == nil && !strings.HasPrefix(inside, "..") {
+			rel = inside
+		}
+	}
+	rel = strings.TrimPrefix(filepath.Clean("/"+rel), "/")
+	if rel == "" {
+		http.Error(w, "path required (relative to the job source)", 400)
+		return
+	}
+
+	report, err := adviseSpace(job, rel)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// extentOwner is one copy of the path: index 0 is the live subvolume,
+// 1..n are the job's snapshots from oldest to newest.
+type extentOwner struct {
+	ranges []physRange
+}
+
+func adviseSpace(job SnapshotJob, rel string) (*AdvisorReport, error) {
+	snaps, err := listManagedSnapshots(job)
+	if err != nil {
+		return nil, err
+	}
+	// Oldest first: the order in which retention expires them.
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Time.Before(snaps[j].Time) })
+
+	report := &AdvisorReport{Job: job.ID, Path: rel}
+	budget := advisorMaxFiles
+
+	owners := make([]extentOwner, len(snaps)+1)
+	live := filepath.Join(job.Source, rel)
+	if _, err := os.Lstat(live); err == nil {
+		report.LiveExists = true
+		owners[0].ranges = collectExtents(live, &budget, report)
+	}
+	for i, s := range snaps {
+		owners[i+1].ranges = collectExtents(filepath.Join(job.Dest, s.Name, rel), &budget, report)
+	}
+
+	referenced, freed := sweepExtents(owners)
+	report.LiveBytes = referenced[0]
+
+	now := time.Now()
+	for i, s := range snaps {
+		item := AdvisorSnapshot{
+			Name:            s.Name,
+			Taken:           s.Time.Format(time.RFC3339),
+			HasPath:         len(owners[i+1].ranges) > 0,
+			ReferencedBytes: referenced[i+1],
+			FreedOnExpiry:   freed[i+1],
+			Expires:         describeExpiry(job.Retention, snaps, i, now),
+		}
+		if _, pinned := snapshotPin(job, s.Name); pinned { item.Expires = "never (pinned)" }
+		report.ReclaimableBytes += item.FreedOnExpiry
+		report.Snapshots = append(report.Snapshots, item)
+	}
+	return report, nil
+}
+
+func collectExtents(root string, budget *int, report *AdvisorReport) []physRange {
+	var ranges []physRange
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if *budget <= 0 {
+			report.Truncated = true
+			return filepath.SkipAll
+		}
+		*budget--
+		report.FilesScanned++
+		if ext, err := fileExtents(p); err == nil {
+			ranges = append(ranges, ext...)
+		}
+		return nil
+	})
+	return ranges
+}
+
+// sweepExtents walks all physical ranges in address order. For every byte it
+// knows which owners reference it: referenced[i] counts bytes owner i uses,
+// and bytes not used by the live copy are credited in freed[] to the newest
+// snapshot holding them, since that is the expiry that releases them.
+func sweepExtents(owners []extentOwner) (referenced, freed []uint64) {
+	type edge struct {
+		pos   uint64
+		owner int
+		delta int
+	}
+	var edges []edge
+	for i, o := range owners {
+		for _, r := range o.ranges {
+			edges = append(edges, edge{r.Start, i, 1}, edge{r.End, i, -1})
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].pos < edges[j].pos })
+
+	referenced = make([]uint64, len(owners))
+	freed = make([]uint64, len(owners))
+	active := make(map[int]int)
+	var prev uint64
+	for _, e := range edges {
+		if length := e.pos - prev; length > 0 && len(active) > 0 {
+			newest := -1
+			for o := range active {
+				referenced[o] += length
+				if o > newest { newest = o }
+			}
+			if active[0] == 0 && newest > 0 {
+				freed[newest] += length
+			}
+		}
+		prev = e.pos
+		active[e.owner] += e.delta
+		if active[e.owner] == 0 { delete(active, e.owner) }
+	}
+	return referenced, freed
+}
+
+// describeExpiry explains when retention will remove snaps[i] (oldest first).
+func describeExpiry(cfg RetentionConfig, snaps []SnapInfo, i int, now time.Time) string {
+	if !cfg.Enabled {
+		return "never (retention disabled)"
+	}
+	switch cfg.Mode {
+	case "count":
+		newer := len(snaps) - 1 - i
+		remaining := cfg.Value - newer
+		if remaining <= 0 {
+			return "at next retention run"
+		}
+		return fmt.Sprintf("after %d more snapshot(s)", remaining)
+	case "time":
+		deletes := selectRetentionDeletes([]SnapInfo{snaps[i]}, cfg, now)
+		if len(deletes) > 0 {
+			return "at next retention run"
+		}
+		// Mirrors the cutoff arithmetic in selectRetentionDeletes.
+		t := snaps[i].Time
+		switch cfg.Unit {
+		case "weeks": t = t.AddDate(0, 0, cfg.Value*7)
+		case "months": t = t.AddDate(0, cfg.Value, 0)
+		case "years": t = t.AddDate(cfg.Value, 0, 0)
+		default: t = t.AddDate(0, 0, cfg.Value)
+		}
+		return t.Format(time.RFC3339)
+	}
+	return "unknown"
+}
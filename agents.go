@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Agents ---
+// Every instance is an agent: it runs the btrfs commands of its own box and
+// serves the API. One with agents configured is also a coordinator: it
+// polls the agents' health, filesystems and activity into one overview and
+// forwards requests under /api/agents/{name}/ to the agent, with the
+// agent's access key, so one UI manages several boxes. The caller needs
+// the role the agent's route requires, checked against the coordinator's
+// users; the agent only sees the coordinator's key.
+
+type AgentConfig struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`                    // e.g. https://nas2.lan:8080
+	Key         string `json:"key,omitempty"`          // access key on the agent, blanked below admin
+	InsecureTLS bool   `json:"insecure_tls,omitempty"` // accept the agent's self-signed certificate
+}
+
+// AgentStatus is what the coordinator knows of an agent; the raw parts are
+// the agent's own answers.
+type AgentStatus struct {
+	Name        string          `json:"name"`
+	URL         string          `json:"url"`
+	Reachable   bool            `json:"reachable"`
+	Error       string          `json:"error,omitempty"`
+	Version     json.RawMessage `json:"version,omitempty"`
+	Health      json.RawMessage `json:"health,omitempty"`
+	Filesystems json.RawMessage `json:"filesystems,omitempty"`
+}
+
+// AgentEntry is a log entry of an agent in the merged activity.
+type AgentEntry struct {
+	Agent string `json:"agent"`
+	LogEntry
+}
+
+const agentTimeout = 10 * time.Second
+
+var agentNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+func validateAgents(agents []AgentConfig) error {
+	seen := map[string]bool{}
+	for _, a := range agents {
+		if !agentNamePattern.MatchString(a.Name) { return fmt.Errorf("agent name %q must be letters, digits, '.', '_' or '-'", a.Name) }
+		if seen[a.Name] { return fmt.Errorf("duplicate agent %q", a.Name) }
+		seen[a.Name] = true
+		u, err := url.Parse(a.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("agent %s: url must be an http:// or https:// address", a.Name)
+		}
+	}
+	return nil
+}
+
+func findAgent(name string) (AgentConfig, bool) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for _, a := range state.Config.Agents {
+		if a.Name == name { return a, true }
+	}
+	return AgentConfig{}, false
+}
+
+func (a AgentConfig) transport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if a.InsecureTLS { t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} }
+	return t
+}
+
+// get fetches path below the agent's /api/v1.
+func (a AgentConfig) get(path string) (json.RawMessage, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(a.URL, "/")+apiV1Prefix+path, nil)
+	if err != nil { return nil, err }
+	if a.Key != "" { req.Header.Set("Authorization", "Bearer "+a.Key) }
+	res, err := (&http.Client{Timeout: agentTimeout, Transport: a.transport()}).Do(req)
+	if err != nil { return nil, err }
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil { return nil, err }
+	if res.StatusCode != 200 { return nil, fmt.Errorf("%s: %s: %s", path, res.Status, strings.TrimSpace(string(body))) }
+	return body, nil
+}
+
+// agentStatus asks a for its version and health, and with detail its
+// filesystems too.
+func agentStatus(a AgentConfig, detail bool) AgentStatus {
+	s := AgentStatus{Name: a.Name, URL: a.URL}
+	var err error
+	if s.Version, err = a.get("/version"); err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.Reachable = true
+	if s.Health, err = a.get("/health"); err != nil { s.Error = err.Error() }
+	if detail {
+		if s.Filesystems, err = a.get("/filesystems/discover"); err != nil && s.Error == "" { s.Error = err.Error() }
+	}
+	return s
+}
+
+// eachAgent runs fn for every configured agent at once and returns the
+// results in config order.
+func eachAgent[T any](fn func(AgentConfig) T) []T {
+	state.mu.Lock()
+	agents := append([]AgentConfig(nil), state.Config.Agents...)
+	state.mu.Unlock()
+	out := make([]T, len(agents))
+	var wg sync.WaitGroup
+	for i, a := range agents {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out[i] = fn(a)
+		}()
+	}
+	wg.Wait()
+	return out
+}
+
+// --- Role Lookup ---
+// A forwarded request needs the role its route has here; agents run the
+// same routes.
+
+var routeRoles struct {
+	once  sync.Once
+	mux   *http.ServeMux
+	roles map[string]string // pattern → role
+}
+
+// redactedBelowAdmin are the routes whose answer is redacted for callers
+// below admin. Through the proxy the agent only sees the coordinator's key,
+// so the coordinator asks admin for them itself.
+var redactedBelowAdmin = map[string]bool{
+	"GET /api/config": true,
+	"GET /api/snapshot-jobs": true,
+	"GET /api/snapshot-jobs/{id}": true,
+	"GET " + apiV1Prefix + "/config": true,
+	"GET " + apiV1Prefix + "/snapshot-jobs": true,
+	"GET " + apiV1Prefix + "/snapshot-jobs/{id}": true,
+}
+
+// requiredRole returns the role a proxied call to the API route method and
+// path match needs.
+func requiredRole(method, path string) (string, bool) {
+	routeRoles.once.Do(func() {
+		routeRoles.mux, routeRoles.roles = http.NewServeMux(), map[string]string{}
+		add := func(pattern, role string) {
+			routeRoles.mux.HandleFunc(pattern, func(http.ResponseWriter, *http.Request) {})
+			routeRoles.roles[pattern] = role
+		}
+		for _, rt := range routeTable() { add(rt.Pattern, rt.Role) }
+		for _, rt := range apiV1Routes() { add(rt.Method+" "+apiV1Prefix+rt.Path, rt.Role) }
+	})
+	_, pattern := routeRoles.mux.Handler(&http.Request{Method: method, URL: &url.URL{Path: path}})
+	if pattern == "" || !strings.Contains(pattern, "/api/") { return "", false }
+	if redactedBelowAdmin[pattern] { return roleAdmin, true }
+	return routeRoles.roles[pattern], true
+}
+
+// --- Handlers ---
+
+// handleListAgents returns the agents with their version and health.
+func handleListAgents(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(eachAgent(func(a AgentConfig) AgentStatus { return agentStatus(a, false) }))
+}
+
+// handleAgentsOverview returns every agent's health and filesystems and
+// their recent activity merged, newest first; ?limit= entries per agent,
+// default 20.
+func handleAgentsOverview(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 { limit = n }
+	type result struct {
+		status  AgentStatus
+		entries []AgentEntry
+	}
+	results := eachAgent(func(a AgentConfig) result {
+		res := result{status: agentStatus(a, true)}
+		if !res.status.Reachable { return res }
+		body, err := a.get(fmt.Sprintf("/history?limit=%d", limit))
+		var page []LogEntry
+		if err == nil { err = json.Unmarshal(body, &page) }
+		if err != nil {
+			if res.status.Error == "" { res.status.Error = err.Error() }
+			return res
+		}
+		for _, e := range page { res.entries = append(res.entries, AgentEntry{Agent: a.Name, LogEntry: e}) }
+		return res
+	})
+
+	agents := []AgentStatus{}
+	history := []AgentEntry{}
+	for _, res := range results {
+		agents = append(agents, res.status)
+		history = append(history, res.entries...)
+	}
+	sort.SliceStable(history, func(i, j int) bool { return entryTime(history[i].LogEntry).After(entryTime(history[j].LogEntry)) })
+	json.NewEncoder(w).Encode(map[string]interface{}{"agents": agents, "history": history})
+}
+
+// handleAgentProxy forwards /api/agents/{name}/{path...} to the agent's
+// /api/{path...}.
+func handleAgentProxy(w http.ResponseWriter, r *http.Request) {
+	a, ok := findAgent(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "Agent not found", 404)
+		return
+	}
+	path := "/api/" + r.PathValue("path")
+	role, ok := requiredRole(r.Method, path)
+	if !ok {
+		http.Error(w, "No such API route: "+r.Method+" "+path, 404)
+		return
+	}
+	if role != rolePublic && roleRank[requestUser(r).Role] < roleRank[role] {
+		http.Error(w, fmt.Sprintf("Forbidden: requires %s role", role), 403)
+		return
+	}
+	target, err := url.Parse(a.URL)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	q := r.URL.Query()
+	q.Del("key")
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.URL.Path = strings.TrimRight(target.Path, "/") + path
+			pr.Out.URL.RawPath = ""
+			pr.Out.URL.RawQuery = q.Encode()
+			// The coordinator has checked the caller; the agent checks
+			// the coordinator.
+			for _, h := range []string{"Cookie", "Authorization", "Origin", "Sec-Fetch-Site"} { pr.Out.Header.Del(h) }
+			if a.Key != "" { pr.Out.Header.Set("Authorization", "Bearer "+a.Key) }
+		},
+		Transport:     a.transport(),
+		FlushInterval: -1, // events and logs stream through
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, fmt.Sprintf("Agent %s: %v", a.Name, err), 502)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
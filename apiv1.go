@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// --- API v1 ---
+// The endpoints under /api/v1/ with REST methods: GET reads, POST runs or
+// creates, PUT and PATCH change, DELETE removes. They reuse the handlers of
+// the /api/ routes, which stay for the dashboard and existing scripts;
+// actions selected with ?action= there get a path of their own here. The
+// OpenAPI document at /api/v1/openapi.json is generated from this table.
+
+const apiV1Prefix = "/api/v1"
+
+const (
+	jsonBody   = "application/json"
+	streamBody = "application/octet-stream"
+)
+
+type apiRoute struct {
+	Method  string
+	Path    string // below /api/v1, with {name} path parameters
+	Role    string
+	Handler http.HandlerFunc
+	Summary string
+	Query   []string // optional query parameters
+	Body    string   // media type of the request body, if any
+}
+
+func apiV1Routes() []apiRoute {
+	targetPath := []string{"path"}
+	historyFilterQuery := []string{"type", "status", "path", "job", "since", "until"}
+	historyQuery := append([]string{"limit", "offset", "before"}, historyFilterQuery...)
+	auditFilterQuery := []string{"user", "endpoint", "failed", "since", "until"}
+	return []apiRoute{
+		{"GET", "/openapi.json", rolePublic, handleOpenAPI, "This document.", nil, ""},
+
+		// Configuration
+		{"GET", "/config", roleViewer, handleConfig, "The configuration; secrets are blanked below admin.", nil, ""},
+		{"PATCH", "/config", roleAdmin, handleConfig, "Change the configuration fields in the body; the others keep their values.", nil, jsonBody},
+		{"GET", "/config/export", roleAdmin, handleExportConfig, "The configuration as a versioned document.", []string{"format", "redact"}, ""},
+		{"POST", "/config/import", roleAdmin, handleImportConfig, "Replace the configuration with an exported document.", []string{"dry_run"}, jsonBody},
+
+		// Activity and Reports
+		{"GET", "/history", roleViewer, handleHistory, "The activity log, newest first, filtered and paged.", historyQuery, ""},
+		{"GET", "/history/export", roleViewer, handleHistoryExport, "Download the filtered activity log as CSV or JSON.", append([]string{"format"}, historyFilterQuery...), ""},
+		{"GET", "/history/{id}/output", roleViewer, handleHistoryOutput, "The whole output of a log entry as text.", []string{"download"}, ""},
+		{"DELETE", "/history", roleAdmin, handleClearLogs, "Clear the activity log.", nil, ""},
+		{"GET", "/events", roleViewer, handleEvents, "Server-Sent Events with the activity log whenever it changes.", nil, ""},
+		{"GET", "/usage", roleViewer, handleUsage, "Parsed filesystem usage of the target drive or path.", targetPath, ""},
+		{"GET", "/usage/history", roleViewer, handleUsageHistory, "Usage samples averaged per resolution, with trends.", []string{"path", "range", "resolution"}, ""},
+		{"GET", "/compression/history", roleViewer, handleCompressionHistory, "Recorded compsize runs with disk usage and ratio per compression type.", []string{"path", "range"}, ""},
+		{"GET", "/reports/latest", roleViewer, handleLatestReport, "Maintenance report of the last range (default report.range, 7d) as JSON or HTML.", []string{"range", "format", "download"}, ""},
+		{"POST", "/usage/report", roleOperator, handleActionUsage, "Record a usage report in the activity log.", targetPath, ""},
+		{"GET", "/health", roleViewer, handleHealth, "The latest health report.", []string{"refresh"}, ""},
+		{"GET", "/kernel-events", roleViewer, handleKernelEvents, "The newest btrfs messages from the kernel log.", []string{"since", "severe", "device"}, ""},
+		{"GET", "/rules", roleViewer, handleGetRules, "The remediation rules, their remaining error budget and the balance hold.", nil, ""},
+		{"PUT", "/rules", roleAdmin, handlePutRules, "Replace the remediation rules.", nil, jsonBody},
+		{"DELETE", "/rules/hold", roleAdmin, handleReleaseBalanceHold, "Let scheduled balances run again after a rule held them.", nil, ""},
+		{"GET", "/version", roleViewer, handleVersion, "Build version and the last update check.", []string{"check"}, ""},
+		{"GET", "/capabilities", roleViewer, handleCapabilities, "The external tools found with their versions, and which features are available.", []string{"refresh"}, ""},
+		{"GET", "/debug/logs", roleAdmin, handleDebugLogs, "The last lines of the server log at any level, newest first.", []string{"level", "op", "q", "limit", "format"}, ""},
+		{"GET", "/metrics", roleViewer, handleMetrics, "Recorded metric samples, oldest first.", []string{"name", "target", "since"}, ""},
+		{"GET", "/schedules/preview", roleViewer, handleSchedulePreview, "Dry run of every enabled schedule.", nil, ""},
+		{"POST", "/schedules/validate", roleViewer, handleValidateSchedule, "Parse a schedule and return its next run times.", nil, jsonBody},
+		{"GET", "/advisor/space", roleViewer, handleSpaceAdvisor, "Which snapshots keep a deleted path's space in use.", []string{"job", "path"}, ""},
+		{"POST", "/notifications/test", roleOperator, handleTestNotification, "Send a test notification to every channel.", nil, ""},
+		{"POST", "/jobs/{id}/kill", roleOperator, handleKillCommand, "Terminate the running command of a log entry.", nil, ""},
+		{"GET", "/jobs", roleViewer, handleListJobs, "Scheduled jobs with their run stats.", nil, ""},
+		{"GET", "/jobs/{id}/runs", roleViewer, handleJobRuns, "Stats and logged runs of a scheduled job, e.g. snapshot:home.", []string{"limit"}, ""},
+
+		// Agents
+		{"GET", "/agents", roleViewer, handleListAgents, "The configured agents with their version and health.", nil, ""},
+		{"GET", "/agents/overview", roleViewer, handleAgentsOverview, "Health, filesystems and merged recent activity of every agent.", []string{"limit"}, ""},
+
+		// Access Control
+		{"GET", "/access/me", roleViewer, handleAccessMe, "The current user and role.", nil, ""},
+		{"GET", "/access/users", roleAdmin, handleListAccessUsers, "Configured users.", nil, ""},
+		{"POST", "/access/users", roleAdmin, handleSaveAccessUser, "Create a user or issue a new key.", nil, jsonBody},
+		{"DELETE", "/access/users/{name}", roleAdmin, handleDeleteAccessUser, "Revoke a user.", nil, ""},
+		{"GET", "/audit", roleAdmin, handleAudit, "Who changed what, newest first.", append([]string{"limit", "offset"}, auditFilterQuery...), ""},
+		{"GET", "/audit/export", roleAdmin, handleAuditExport, "The filtered audit log as CSV or JSON.", append([]string{"format"}, auditFilterQuery...), ""},
+
+		// Snapshots
+		{"GET", "/snapshots", roleViewer, handleListSnapshots, "Snapshots of a job.", []string{"job"}, ""},
+		{"POST", "/snapshots", roleOperator, handleActionSnapshot, "Take a snapshot of a job, or of all jobs.", []string{"job"}, ""},
+		{"DELETE", "/snapshots", roleAdmin, handlePurgeAllSnapshots, "Purge all snapshots of a job; the first call returns the plan and a token to confirm with.", []string{"job", "dry_run", "token"}, jsonBody},
+		{"POST", "/snapshots/retention", roleAdmin, handleRunRetention, "Apply retention; the first call returns the plan and a token to confirm with.", []string{"job", "dry_run", "token"}, jsonBody},
+		{"GET", "/snapshots/diff", roleViewer, handleSnapshotDiff, "What changed between two snapshots.", []string{"job", "from", "to"}, ""},
+		{"DELETE", "/snapshots/{name}", roleAdmin, queryFromPath(handleDeleteSnapshot, "name"), "Delete a snapshot, into the trash when it is enabled.", []string{"job", "break_chains", "permanent"}, ""},
+		{"GET", "/snapshots/trash", roleViewer, handleListTrash, "Snapshots in the trash of a job, or of all jobs, with when they expire.", []string{"job"}, ""},
+		{"POST", "/snapshots/trash/restore", roleAdmin, handleRestoreTrash, "Restore a snapshot from the trash under its name.", []string{"job", "entry"}, ""},
+		{"DELETE", "/snapshots/trash", roleAdmin, handleEmptyTrash, "Delete a snapshot from the trash for good, or the whole trash of a job.", []string{"job", "entry"}, ""},
+		{"POST", "/snapshots/{name}/pin", roleOperator, queryFromPath(handlePinSnapshot, "name"), "Pin a snapshot so retention and purge keep it; the body may carry a note.", []string{"job"}, jsonBody},
+		{"DELETE", "/snapshots/{name}/pin", roleOperator, queryFromPath(handlePinSnapshot, "name"), "Unpin a snapshot.", []string{"job"}, ""},
+		{"GET", "/snapshots/{name}/ls", roleViewer, handleSnapshotLs, "List a directory inside a snapshot.", []string{"job", "path"}, ""},
+		{"GET", "/snapshots/{name}/archive", roleViewer, handleSnapshotArchive, "Download a file from a snapshot, with range requests, or a directory as tar or zip.", []string{"job", "path", "format"}, ""},
+		{"POST", "/snapshots/{name}/restore", roleAdmin, handleSnapshotRestore, "Copy a file or directory back into the snapshot source.", []string{"job"}, jsonBody},
+		{"POST", "/snapshots/{name}/rollback", roleAdmin, handleSnapshotRollback, "Replace the snapshot source with the snapshot; confirmed with a token.", []string{"job"}, jsonBody},
+		{"GET", "/retention/reports", roleViewer, handleRetentionReports, "The latest retention reports.", []string{"job", "limit"}, ""},
+
+		// Snapshot Jobs
+		{"GET", "/snapshot-jobs", roleViewer, handleListSnapshotJobs, "Snapshot jobs.", nil, ""},
+		{"POST", "/snapshot-jobs", roleAdmin, handleCreateSnapshotJob, "Create a snapshot job.", nil, jsonBody},
+		{"GET", "/snapshot-jobs/{id}", roleViewer, handleGetSnapshotJob, "A snapshot job.", nil, ""},
+		{"PUT", "/snapshot-jobs/{id}", roleAdmin, handleUpdateSnapshotJob, "Replace a snapshot job.", nil, jsonBody},
+		{"DELETE", "/snapshot-jobs/{id}", roleAdmin, handleDeleteSnapshotJob, "Delete a snapshot job; its snapshots stay on disk.", nil, ""},
+		{"POST", "/snapshot-jobs/{id}/adopt/preview", roleViewer, handleAdoptPreview, "Which snapshots in the job's destination its naming and adopt patterns recognize.", nil, jsonBody},
+
+		// Receive
+		{"POST", "/receive", roleOperator, handleReceiveSnapshot, "Receive a btrfs send stream into a job.", []string{"job"}, streamBody},
+		{"GET", "/receive/quarantine", roleViewer, handleListQuarantine, "Quarantined uploads.", []string{"job"}, ""},
+		{"DELETE", "/receive/quarantine/{upload}", roleAdmin, handleDiscardQuarantine, "Discard a quarantined upload.", []string{"job"}, ""},
+		{"POST", "/archive", roleOperator, handleActionArchive, "Send a job's new snapshots to its archive tier.", []string{"job"}, ""},
+		{"GET", "/archive/snapshots", roleViewer, handleListArchive, "Snapshots on a job's archive tier.", []string{"job"}, ""},
+		{"POST", "/streams", roleOperator, handleActionStreams, "Send a job's new snapshots as encrypted stream files.", []string{"job"}, ""},
+		{"GET", "/streams", roleViewer, handleListStreams, "The catalog of a job's encrypted streams, as chains.", []string{"job"}, ""},
+		{"POST", "/streams/restore", roleAdmin, handleStreamRestore, "Decrypt and receive a chain of streams up to a snapshot.", nil, jsonBody},
+		{"GET", "/streams/catalog", roleAdmin, handleBrowseStreams, "The stream catalog in a directory or rclone remote, as chains.", []string{"dest", "remote", "rclone_config"}, ""},
+		{"POST", "/verify", roleOperator, handleActionVerify, "Read a sample of a snapshot's files to check they are readable.", []string{"job", "snapshot"}, ""},
+
+		// Maintenance
+		{"GET", "/locks", roleViewer, handleListLocks, "The maintenance locks.", nil, ""},
+		{"POST", "/locks", roleAdmin, handleCreateLock, "Lock the filesystem of a path (default: the target drive) for maintenance.", nil, jsonBody},
+		{"DELETE", "/locks/{uuid}", roleAdmin, handleReleaseLock, "Release a maintenance lock.", nil, ""},
+		{"POST", "/scrub", roleOperator, withAction(handleActionScrub, "start"), "Start a scrub of the target drive.", nil, ""},
+		{"DELETE", "/scrub", roleOperator, withAction(handleActionScrub, "cancel"), "Cancel the running scrub.", nil, ""},
+		{"POST", "/scrub/status", roleOperator, withAction(handleActionScrub, "status"), "Record the scrub status in the activity log.", nil, ""},
+		{"GET", "/scrub/errors", roleViewer, handleScrubErrors, "Scrub errors per device and the damaged files.", targetPath, ""},
+		{"POST", "/balance", roleOperator, withAction(handleActionBalance, "start"), "Start a balance with a preset.", []string{"preset"}, ""},
+		{"DELETE", "/balance", roleOperator, withAction(handleActionBalance, "cancel"), "Cancel the running balance.", nil, ""},
+		{"POST", "/balance/status", roleOperator, withAction(handleActionBalance, "status"), "Record the balance status in the activity log.", nil, ""},
+		{"GET", "/balance/status", roleViewer, handleBalanceStatus, "Balance state and progress of the target drive.", []string{"refresh"}, ""},
+		{"POST", "/balance/pause", roleOperator, withAction(handleActionBalance, "pause"), "Pause the running balance.", nil, ""},
+		{"POST", "/balance/resume", roleOperator, withAction(handleActionBalance, "resume"), "Resume a paused balance.", nil, ""},
+		{"GET", "/balance/presets", roleViewer, handleBalancePresets, "Balance presets.", nil, ""},
+		{"POST", "/dedup", roleOperator, withAction(handleActionDedup, "start"), "Start a dedup run with the configured tool.", nil, ""},
+		{"POST", "/dedup/bees", roleOperator, withAction(handleActionDedup, "status"), "Record the bees counters in the activity log.", nil, ""},
+		{"GET", "/dedup/bees", roleViewer, handleBeesStatus, "The bees status files.", nil, ""},
+		{"POST", "/defrag", roleOperator, handleActionDefrag, "Defragment a path. Recursive runs first return their impact and a confirmation token.", nil, jsonBody},
+		{"POST", "/compsize", roleOperator, handleActionCompsize, "Record a compsize analysis in the activity log.", targetPath, ""},
+		{"POST", "/trim", roleOperator, handleActionTrim, "Trim the free space of the target drive's filesystem with fstrim.", targetPath, ""},
+		{"GET", "/compression", roleViewer, handleGetCompression, "The compression property of a path.", targetPath, ""},
+		{"PUT", "/compression", roleAdmin, handleSetCompression, "Set the compression property of a path.", nil, jsonBody},
+
+		// Quotas
+		{"POST", "/quota/enable", roleAdmin, handleQuotaEnable, "Enable quotas.", targetPath, ""},
+		{"GET", "/qgroups", roleViewer, handleListQgroups, "Qgroups with sizes and limits.", []string{"path", "refresh"}, ""},
+		{"PUT", "/qgroups/limit", roleAdmin, handleQgroupLimit, "Set or remove a qgroup limit.", nil, jsonBody},
+		{"DELETE", "/qgroups/orphans", roleAdmin, handleCleanupQgroups, "Remove qgroups without a subvolume; the first call returns them and a token to confirm with.", targetPath, jsonBody},
+
+		// Subvolumes
+		{"GET", "/subvolumes", roleViewer, handleListSubvolumes, "Subvolumes of the filesystem.", targetPath, ""},
+		{"GET", "/subvolumes/graph", roleViewer, handleSubvolumeGraph, "Subvolumes and their snapshots as a lineage graph.", targetPath, ""},
+		{"POST", "/subvolumes", roleAdmin, handleCreateSubvolume, "Create a subvolume.", nil, jsonBody},
+		{"DELETE", "/subvolumes", roleAdmin, handleDeleteSubvolume, "Delete a subvolume.", nil, jsonBody},
+		{"PUT", "/subvolumes/default", roleAdmin, handleSetDefaultSubvolume, "Set the default subvolume.", nil, jsonBody},
+		{"POST", "/subvolumes/report", roleOperator, handleActionSubvolumes, "Record the subvolume list in the activity log.", targetPath, ""},
+
+		// Inspect
+		{"GET", "/inspect/rootid", roleViewer, handleInspectRootID, "Subvolume ID of a path.", targetPath, ""},
+		{"GET", "/inspect/subvolid-resolve", roleViewer, handleInspectSubvolID, "Path of a subvolume ID.", []string{"path", "id"}, ""},
+		{"GET", "/inspect/inode-resolve", roleViewer, handleInspectInode, "Paths of an inode.", []string{"path", "inode"}, ""},
+		{"GET", "/inspect/logical-resolve", roleViewer, handleInspectLogical, "Files referencing a logical address.", []string{"path", "logical"}, ""},
+		{"GET", "/inspect/scrub-errors", roleViewer, handleInspectScrubErrors, "Corrupt blocks from the kernel log with their files.", targetPath, ""},
+
+		// Devices
+		{"GET", "/filesystems/discover", roleViewer, handleDiscoverFilesystems, "Mounted btrfs filesystems.", nil, ""},
+		{"GET", "/filesystem", roleViewer, handleFilesystem, "Label and UUIDs of the filesystem.", targetPath, ""},
+		{"PUT", "/filesystem/label", roleAdmin, handleSetLabel, "Change the filesystem label.", targetPath, jsonBody},
+		{"POST", "/filesystem/resize", roleAdmin, handleResize, "Grow or shrink a device of the filesystem; confirmed with a token.", targetPath, jsonBody},
+		{"GET", "/devices", roleViewer, handleListDevices, "Devices of the filesystem.", targetPath, ""},
+		{"POST", "/devices", roleAdmin, handleDeviceAdd, "Add a device; confirmed with a token.", nil, jsonBody},
+		{"DELETE", "/devices", roleAdmin, handleDeviceRemove, "Remove a device; confirmed with a token.", nil, jsonBody},
+		{"POST", "/check", roleAdmin, handleCheck, "Run a read-only btrfs check of a device; confirmed with a token.", nil, jsonBody},
+		{"GET", "/convert/check", roleViewer, handleConvertCheck, "Pre-check converting the data and metadata profiles.", append([]string{"data", "metadata", "force"}, targetPath...), ""},
+		{"GET", "/convert", roleViewer, handleConvertStatus, "The last profile conversion and how far it got.", nil, ""},
+		{"POST", "/convert", roleAdmin, handleConvertStart, "Convert the data and metadata profiles; confirmed with a token.", targetPath, jsonBody},
+		{"POST", "/convert/resume", roleAdmin, handleConvertResume, "Resume an unfinished profile conversion.", nil, ""},
+		{"GET", "/replace", roleViewer, handleReplaceStatus, "Progress of a running replace.", targetPath, ""},
+		{"POST", "/replace", roleAdmin, handleReplaceStart, "Start replacing a device; confirmed with a token.", nil, jsonBody},
+		{"DELETE", "/replace", roleAdmin, handleReplaceCancel, "Cancel the running replace.", targetPath, ""},
+		{"GET", "/runbook", roleViewer, handleGetRunbook, "The guided replace and its steps.", nil, ""},
+		{"POST", "/runbook", roleAdmin, handleStartRunbook, "Start a guided replace; confirmed with a token.", nil, jsonBody},
+		{"POST", "/runbook/resume", roleAdmin, handleResumeRunbook, "Retry the failed step.", nil, ""},
+		{"DELETE", "/runbook", roleAdmin, handleAbortRunbook, "Stop the guided replace.", nil, ""},
+
+		// Temporary Access Links
+		{"POST", "/shares", roleAdmin, handleCreateShare, "Create a signed temporary link.", nil, jsonBody},
+		{"DELETE", "/shares", roleAdmin, handleRevokeShares, "Rotate the signing key, invalidating all links.", nil, ""},
+	}
+}
+
+// withAction serves h as if the request had ?action=action.
+func withAction(h http.HandlerFunc, action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		q.Set("action", action)
+		r.URL.RawQuery = q.Encode()
+		h(w, r)
+	}
+}
+
+// queryFromPath hands the path parameter name to h as a query parameter.
+func queryFromPath(h http.HandlerFunc, name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		q.Set(name, r.PathValue(name))
+		r.URL.RawQuery = q.Encode()
+		h(w, r)
+	}
+}
+
+// handleAPIv1Unmatched answers what no v1 route matches instead of the
+// dashboard: 405 with the allowed methods if only the method is wrong.
+func handleAPIv1Unmatched(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, apiV1Prefix), "/")
+	var allowed []string
+	for _, rt := range apiV1Routes() {
+		if pathMatches(strings.Split(rt.Path, "/"), path) { allowed = append(allowed, rt.Method) }
+	}
+	if len(allowed) == 0 {
+		http.Error(w, "Unknown endpoint, see "+apiV1Prefix+"/openapi.json", 404)
+		return
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, "Method not allowed", 405)
+}
+
+func pathMatches(pattern, path []string) bool {
+	if len(pattern) != len(path) { return false }
+	for i, seg := range pattern {
+		if seg != path[i] && !(strings.HasPrefix(seg, "{") && path[i] != "") { return false }
+	}
+	return true
+}
+
+// operationID names an operation after its method and path, e.g.
+// DELETE /snapshots/{name} -> deleteSnapshotsByName.
+func operationID(rt apiRoute) string {
+	id := strings.ToLower(rt.Method)
+	for _, seg := range strings.Split(strings.Trim(rt.Path, "/"), "/") {
+		if strings.HasPrefix(seg, "{") { seg = "by-" + strings.Trim(seg, "{}") }
+		for _, word := range strings.FieldsFunc(seg, func(r rune) bool { return r == '-' || r == '.' || r == '_' }) {
+			id += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return id
+}
+
+func openAPIDocument() map[string]interface{} {
+	paths := map[string]map[string]interface{}{}
+	for _, rt := range apiV1Routes() {
+		var params []map[string]interface{}
+		for _, seg := range strings.Split(rt.Path, "/") {
+			if strings.HasPrefix(seg, "{") {
+				params = append(params, map[string]interface{}{"name": strings.Trim(seg, "{}"), "in": "path", "required": true, "schema": map[string]string{"type": "string"}})
+			}
+		}
+		for _, q := range rt.Query {
+			params = append(params, map[string]interface{}{"name": q, "in": "query", "schema": map[string]string{"type": "string"}})
+		}
+		content := jsonBody
+		if rt.Path == "/events" { content = "text/event-stream" }
+		op := map[string]interface{}{
+			"operationId":     operationID(rt),
+			"summary":         rt.Summary,
+			"tags":            []string{strings.Split(strings.Trim(rt.Path, "/"), "/")[0]},
+			"x-required-role": rt.Role,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{"description": "OK", "content": map[string]interface{}{content: map[string]interface{}{"schema": map[string]interface{}{}}}},
+				"4XX": map[string]interface{}{"description": "Invalid request, missing access key or role, or a conflict; the body is the error message.", "content": map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]string{"type": "string"}}}},
+			},
+		}
+		if params != nil { op["parameters"] = params }
+		if rt.Body != "" {
+			schema := map[string]string{"type": "object"}
+			if rt.Body == streamBody { schema = map[string]string{"type": "string", "format": "binary"} }
+			op["requestBody"] = map[string]interface{}{"content": map[string]interface{}{rt.Body: map[string]interface{}{"schema": schema}}}
+		}
+		if rt.Role == rolePublic { op["security"] = []interface{}{} }
+		if paths[rt.Path] == nil { paths[rt.Path] = map[string]interface{}{} }
+		paths[rt.Path][strings.ToLower(rt.Method)] = op
+	}
+
+	var tags []map[string]string
+	seen := map[string]bool{}
+	for _, p := range sortedKeys(paths) {
+		tag := strings.Split(strings.Trim(p, "/"), "/")[0]
+		if !seen[tag] { tags = append(tags, map[string]string{"name": tag}) }
+		seen[tag] = true
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":       "BTRFS Manager API",
+			"version":     version,
+			"description": "Operations that change something are POST, PUT, PATCH or DELETE; x-required-role names the least role allowed to call each. Without configured users every request is allowed.",
+		},
+		"servers": []map[string]string{{"url": apiV1Prefix}},
+		"tags":    tags,
+		"paths":   paths,
+		"components": map[string]interface{}{"securitySchemes": map[string]interface{}{
+			"accessKey":    map[string]string{"type": "http", "scheme": "bearer"},
+			"accessCookie": map[string]string{"type": "apiKey", "in": "cookie", "name": accessCookie},
+		}},
+		"security": []map[string][]string{{"accessKey": {}}, {"accessCookie": {}}},
+	}
+}
+
+func sortedKeys(m map[string]map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m { keys = append(keys, k) }
+	sort.Strings(keys)
+	return keys
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPIDocument())
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Application Log ---
+// The server log goes through log/slog. Every line has a level and the
+// operation it is about ("op", the [SCRUB] in the text format); lines below
+// the configured level are not written, and `format: json` writes one JSON
+// object per line for log collectors. Whatever the level, the last lines
+// are kept in memory for /api/debug/logs, so debug output can be read
+// without shell access or a restart. API requests are logged too: reads at
+// debug, changes at info and server errors at error.
+
+type LoggingConfig struct {
+	Level  string `json:"level,omitempty"`  // debug, info (default), warn or error; $LOG_LEVEL when empty
+	Format string `json:"format,omitempty"` // text (default) or json; $LOG_FORMAT when empty
+}
+
+// LogLine is a line of the server log as kept in the debug buffer.
+type LogLine struct {
+	Time    time.Time              `json:"time"`
+	Level   string                 `json:"level"`
+	Op      string                 `json:"op,omitempty"`
+	Message string                 `json:"msg"`
+	Attrs   map[string]interface{} `json:"attrs,omitempty"`
+}
+
+const debugLogSize = 2000
+
+var (
+	logLevel  = new(slog.LevelVar)
+	appLog    = slog.New(&appLogHandler{})
+	logWriter = struct {
+		sync.Mutex
+		json bool
+	}{}
+	debugLogs = struct {
+		sync.Mutex
+		lines []LogLine // ring of debugLogSize, next is the oldest once full
+		next  int
+	}{}
+)
+
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug": return slog.LevelDebug, nil
+	case "", "info": return slog.LevelInfo, nil
+	case "warn", "warning": return slog.LevelWarn, nil
+	case "error": return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown level %q (debug, info, warn or error)", s)
+}
+
+func (c LoggingConfig) validate() error {
+	if _, err := parseLogLevel(c.Level); err != nil { return err }
+	if c.Format != "" && c.Format != "text" && c.Format != "json" { return fmt.Errorf("unknown format %q (text or json)", c.Format) }
+	return nil
+}
+
+// configureLogging applies the level and format of cfg, falling back to
+// $LOG_LEVEL and $LOG_FORMAT.
+func configureLogging(cfg LoggingConfig) {
+	if cfg.Level == "" { cfg.Level = os.Getenv("LOG_LEVEL") }
+	if cfg.Format == "" { cfg.Format = os.Getenv("LOG_FORMAT") }
+	level, err := parseLogLevel(cfg.Level)
+	if err != nil { logWarn("SYSTEM", "%v, using info", err) }
+	logLevel.Set(level)
+	logWriter.Lock()
+	logWriter.json = cfg.Format == "json"
+	logWriter.Unlock()
+}
+
+func printDockerLog(opType, msg string, args ...interface{}) {
+	appLog.Info(fmt.Sprintf(msg, args...), "op", opType)
+}
+
+func logWarn(opType, msg string, args ...interface{}) {
+	appLog.Warn(fmt.Sprintf(msg, args...), "op", opType)
+}
+
+func logError(opType, msg string, args ...interface{}) {
+	appLog.Error(fmt.Sprintf(msg, args...), "op", opType)
+}
+
+// logSeparator ends the block of lines a command logged, in the text format.
+func logSeparator() {
+	logWriter.Lock()
+	defer logWriter.Unlock()
+	if !logWriter.json && logLevel.Level() <= slog.LevelInfo {
+		fmt.Fprintln(logOutput, "---------------------------------------------------------------")
+	}
+}
+
+// --- Handler ---
+
+// appLogHandler keeps every record in the debug buffer and writes those at
+// or above logLevel to logOutput.
+type appLogHandler struct {
+	attrs  []slog.Attr
+	prefix string // of the groups opened, e.g. "request."
+}
+
+func (h *appLogHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *appLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append(append([]slog.Attr(nil), h.attrs...), prefixAttrs(h.prefix, attrs)...)
+	return &c
+}
+
+func (h *appLogHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.prefix += name + "."
+	return &c
+}
+
+func prefixAttrs(prefix string, attrs []slog.Attr) []slog.Attr {
+	if prefix == "" { return attrs }
+	out := make([]slog.Attr, len(attrs))
+	for i, a := range attrs { out[i] = slog.Attr{Key: prefix + a.Key, Value: a.Value} }
+	return out
+}
+
+func (h *appLogHandler) Handle(_ context.Context, r slog.Record) error {
+	line := LogLine{Time: r.Time, Level: r.Level.String(), Message: r.Message}
+	add := func(a slog.Attr) bool {
+		v := a.Value.Resolve()
+		if a.Key == "op" {
+			line.Op = v.String()
+			return true
+		}
+		if line.Attrs == nil { line.Attrs = map[string]interface{}{} }
+		switch v.Kind() {
+		case slog.KindDuration: line.Attrs[a.Key] = v.Duration().String()
+		case slog.KindTime: line.Attrs[a.Key] = v.Time().Format(time.RFC3339)
+		default:
+			if err, ok := v.Any().(error); ok {
+				line.Attrs[a.Key] = err.Error()
+			} else {
+				line.Attrs[a.Key] = v.Any()
+			}
+		}
+		return true
+	}
+	for _, a := range h.attrs { add(a) }
+	r.Attrs(func(a slog.Attr) bool { return add(prefixAttrs(h.prefix, []slog.Attr{a})[0]) })
+
+	debugLogs.Lock()
+	if len(debugLogs.lines) < debugLogSize {
+		debugLogs.lines = append(debugLogs.lines, line)
+	} else {
+		debugLogs.lines[debugLogs.next] = line
+		debugLogs.next = (debugLogs.next + 1) % debugLogSize
+	}
+	debugLogs.Unlock()
+
+	if r.Level < logLevel.Level() { return nil }
+	logWriter.Lock()
+	defer logWriter.Unlock()
+	if logWriter.json {
+		obj := map[string]interface{}{}
+		for k, v := range line.Attrs { obj[k] = v }
+		obj["time"], obj["level"], obj["msg"] = line.Time.Format(time.RFC3339Nano), line.Level, line.Message
+		if line.Op != "" { obj["op"] = line.Op }
+		data, _ := json.Marshal(obj)
+		_, err := fmt.Fprintf(logOutput, "%s\n", data)
+		return err
+	}
+	_, err := fmt.Fprintln(logOutput, line.text())
+	return err
+}
+
+// text is the line as "[time] [OP] msg key=value ...", with the level
+// after the op unless it is info.
+func (l LogLine) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] [%s] ", l.Time.Format(time.RFC3339), l.Op)
+	if l.Level != slog.LevelInfo.String() { b.WriteString(l.Level + ": ") }
+	b.WriteString(l.Message)
+	keys := make([]string, 0, len(l.Attrs))
+	for k := range l.Attrs { keys = append(keys, k) }
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := fmt.Sprint(l.Attrs[k])
+		if s, ok := l.Attrs[k].(string); ok && (s == "" || strings.ContainsAny(s, " \"=\n")) { v = strconv.Quote(s) }
+		fmt.Fprintf(&b, " %s=%s", k, v)
+	}
+	return b.String()
+}
+
+// --- Request Log ---
+
+// requestRecorder keeps the status and size of a response. Events and the
+// WebSocket need the flusher and hijacker of the connection underneath.
+type requestRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rr *requestRecorder) WriteHeader(code int) {
+	if rr.status == 0 { rr.status = code }
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+func (rr *requestRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 { rr.status = 200 }
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += n
+	return n, err
+}
+
+func (rr *requestRecorder) Flush() { http.NewResponseController(rr.ResponseWriter).Flush() }
+
+func (rr *requestRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(rr.ResponseWriter).Hijack()
+}
+
+func (rr *requestRecorder) Unwrap() http.ResponseWriter { return rr.ResponseWriter }
+
+// logged logs the requests that reach h. Only the path is logged: queries
+// may carry an access key.
+func logged(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &requestRecorder{ResponseWriter: w}
+		h(rec, r)
+		if rec.status == 0 { rec.status = 200 }
+		// Reading the buffer shouldn't push lines out of it.
+		if strings.HasSuffix(r.URL.Path, "/debug/logs") && rec.status < 500 { return }
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= 500: level = slog.LevelError
+		case r.Method == "GET" || r.Method == "HEAD": level = slog.LevelDebug
+		}
+		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+		appLog.Log(r.Context(), level, r.Method+" "+r.URL.Path, "op", "HTTP", "status", rec.status, "bytes", rec.bytes,
+			"duration", time.Since(start).Round(time.Millisecond), "ip", ip)
+	}
+}
+
+// --- Handlers ---
+
+// handleDebugLogs returns the buffered log lines, newest first: ?level= at
+// least (default debug), ?op=, ?q= (substring of the message), ?limit=
+// (default 200) and ?format=text for plain lines.
+func handleDebugLogs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	min, err := parseLogLevel(q.Get("level"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if q.Get("level") == "" { min = slog.LevelDebug }
+	limit := 200
+	if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 { limit = n }
+	op, text := strings.ToUpper(q.Get("op")), strings.ToLower(q.Get("q"))
+
+	debugLogs.Lock()
+	n := len(debugLogs.lines)
+	lines := []LogLine{}
+	for i := 0; i < n && len(lines) < limit; i++ {
+		l := debugLogs.lines[(debugLogs.next+n-1-i)%n]
+		var level slog.Level
+		if level.UnmarshalText([]byte(l.Level)) != nil || level < min { continue }
+		if op != "" && l.Op != op { continue }
+		if text != "" && !strings.Contains(strings.ToLower(l.Message), text) { continue }
+		lines = append(lines, l)
+	}
+	debugLogs.Unlock()
+
+	if q.Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, l := range lines { fmt.Fprintln(w, l.text()) }
+		return
+	}
+	json.NewEncoder(w).Encode(lines)
+}
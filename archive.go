@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Archive Tier ---
+// A job can copy its snapshots to a second local btrfs pool, e.g. a big slow
+// disk for cold storage. An archive run sends every snapshot newer than the
+// newest archived one, oldest first, with `btrfs send -p <previous> | btrfs
+// receive`, and checks that each copy's Received UUID is the UUID of its
+// source. The archive has its own retention. While archiving is enabled,
+// source retention keeps what is not archived yet and the newest snapshot
+// with a verified copy, which the next incremental send needs as its parent.
+
+type ArchiveConfig struct {
+	Enabled   bool            `json:"enabled"`
+	Dest      string          `json:"dest"` // directory on the archive pool
+	Schedule  ScheduleConfig  `json:"schedule"`
+	Retention RetentionConfig `json:"retention"`
+	Transfer  TransferConfig  `json:"transfer"` // see transfer.go
+}
+
+type ArchiveResult struct {
+	Sent   []ArchivedSnapshot `json:"sent"`
+	Failed string             `json:"failed,omitempty"` // the snapshot that could not be archived
+}
+
+type ArchivedSnapshot struct {
+	Name     string `json:"name"`
+	Parent   string `json:"parent,omitempty"` // empty: sent in full
+	UUID     string `json:"uuid"`             // of the source, the copy's Received UUID
+	Bytes    int64  `json:"bytes"`            // of the send stream
+	Duration string `json:"duration"`
+}
+
+// archiveRuns keeps two runs of a job from sending at the same time.
+var archiveRuns = struct {
+	mu      sync.Mutex
+	running map[string]bool
+}{running: map[string]bool{}}
+
+func validateArchive(j SnapshotJob) error {
+	a := j.Archive
+	if !a.Enabled { return nil }
+	if !filepath.IsAbs(a.Dest) { return fmt.Errorf("archive dest must be an absolute path") }
+	if filepath.Clean(a.Dest) == filepath.Clean(j.Dest) { return fmt.Errorf("archive dest must differ from the job's dest") }
+	if j.Writable { return fmt.Errorf("writable snapshots can't be sent, a writable job can't be archived") }
+	if err := validateWindows(a.Schedule.Windows); err != nil { return fmt.Errorf("archive schedule: %v", err) }
+	if err := validateTransfer(a.Transfer); err != nil { return fmt.Errorf("archive %v", err) }
+	if a.Schedule.Enabled {
+		if _, err := parseSchedule(a.Schedule); err != nil { return fmt.Errorf("invalid archive schedule %q: %v", scheduleSpec(a.Schedule), err) }
+	}
+	return nil
+}
+
+// archiveJob is the job as seen on the archive tier: its copies carry the
+// same names, so listing and retention work unchanged.
+func archiveJob(j SnapshotJob) SnapshotJob {
+	a := j
+	a.Dest, a.Retention = j.Archive.Dest, j.Archive.Retention
+	a.Boot, a.Hooks, a.Archive = BootConfig{}, SnapshotHooks{}, ArchiveConfig{}
+	return a
+}
+
+// inArchive reports whether the archive has a snapshot named name, without
+// verifying it.
+func inArchive(job SnapshotJob, name string) bool {
+	if !job.Archive.Enabled { return false }
+	info, err := os.Stat(snapshotPath(job.Archive.Dest, name))
+	return err == nil && info.IsDir()
+}
+
+// archivedCopy returns the source UUID of name if the archive holds a
+// read-only copy received from it.
+func archivedCopy(job SnapshotJob, name string) (string, bool) {
+	src, err := showSubvolume(snapshotPath(job.Dest, name))
+	if err != nil { return "", false }
+	dst, err := showSubvolume(snapshotPath(job.Archive.Dest, name))
+	if err != nil { return "", false }
+	uuid := src["UUID"]
+	return uuid, uuid != "" && dst["Received UUID"] == uuid && strings.Contains(dst["Flags"], "readonly")
+}
+
+// keepUnarchived drops from deletes (retention candidates of the source)
+// the snapshots not archived yet and the newest one with a verified copy.
+// Older ones were verified when they were sent.
+func keepUnarchived(job SnapshotJob, snaps, deletes []SnapInfo) []SnapInfo {
+	var parent *SnapInfo
+	for i := range snaps {
+		if _, ok := archivedCopy(job, snaps[i].Name); ok {
+			parent = &snaps[i]
+			break
+		}
+	}
+	var deletable []SnapInfo
+	for _, s := range deletes {
+		if parent != nil && s.Time.Before(parent.Time) { deletable = append(deletable, s) }
+	}
+	if held := len(deletes) - len(deletable); held > 0 { printDockerLog("RETENTION", "Job %s: keeping %d snapshots until they are archived, or as the parent of the next archive send", job.ID, held) }
+	return deletable
+}
+
+// pendingArchive returns the snapshots to send, oldest first, and the one
+// to send the first of them against.
+func pendingArchive(job SnapshotJob) ([]SnapInfo, string, error) {
+	snaps, err := listManagedSnapshots(job)
+	if err != nil { return nil, "", err }
+	archived, err := listManagedSnapshots(archiveJob(job))
+	if err != nil && !os.IsNotExist(err) { return nil, "", err }
+	have := map[string]bool{}
+	for _, s := range archived { have[s.Name] = true }
+
+	parent := ""
+	var pending []SnapInfo
+	for _, s := range snaps {
+		if have[s.Name] {
+			parent = s.Name
+			break
+		}
+		pending = append([]SnapInfo{s}, pending...)
+	}
+	return pending, parent, nil
+}
+
+func archiveSendArgs(job SnapshotJob, parent, name string) []string {
+	args := []string{"send", "-q"}
+	if parent != "" { args = append(args, "-p", snapshotPath(job.Dest, parent)) }
+	return append(args, snapshotPath(job.Dest, name))
+}
+
+// sendReceive pipes `btrfs send` into `btrfs receive dir` within the limits
+// of t and returns the output, the priority applied to both and the bytes
+// sent. Neither process keeps the other's end of the pipe, so one failing
+// ends the other.
+func sendReceive(ctx context.Context, t TransferConfig, sendArgs []string, dir string, report func(transferProgress)) (string, string, int64, error) {
+	exited := make(chan struct{})
+	defer close(exited)
+	send := newManagedCommand(ctx, exited, "btrfs", sendArgs...)
+	recv := newManagedCommand(ctx, exited, "btrfs", "receive", dir)
+	limits, releaseSend := prioritize(send, "ARCHIVE")
+	defer releaseSend()
+	_, releaseRecv := prioritize(recv, "ARCHIVE")
+	defer releaseRecv()
+	var sendErr, recvOut bytes.Buffer
+	send.Stderr, recv.Stdout, recv.Stderr = &sendErr, &recvOut, &recvOut
+	n, serr, rerr := pipeTransfer(ctx, t, send, recv, report)
+	out := strings.TrimSpace(sendErr.String() + recvOut.String())
+	if serr != nil { return out, limits, n, fmt.Errorf("send: %v", serr) }
+	if rerr != nil { return out, limits, n, fmt.Errorf("receive: %v", rerr) }
+	return out, limits, n, nil
+}
+
+// runArchive sends the job's pending snapshots to the archive, then applies
+// the archive's retention and the source's, which may now delete what was
+// held back.
+func runArchive(job SnapshotJob, run *JobRun) {
+	archiveRuns.mu.Lock()
+	if archiveRuns.running[job.ID] {
+		archiveRuns.mu.Unlock()
+		printDockerLog("ARCHIVE", "Job %s is still being archived, skipping this run", job.ID)
+		return
+	}
+	archiveRuns.running[job.ID] = true
+	archiveRuns.mu.Unlock()
+	defer func() {
+		archiveRuns.mu.Lock()
+		delete(archiveRuns.running, job.ID)
+		archiveRuns.mu.Unlock()
+	}()
+
+	start := time.Now()
+	dest := job.Archive.Dest
+	visualPath := fmt.Sprintf("%s ➡️ %s", job.Dest, dest)
+	id := startHistory("ARCHIVE", "🧊", visualPath, "Archiving to "+dest)
+	run.tag(id)
+	ctx, cancel := commandContext("ARCHIVE")
+	defer cancel(nil)
+	trackCommand(id, "btrfs", []string{"send", job.Dest}, cancel)
+	defer untrackCommand(id)
+
+	result := &ArchiveResult{Sent: []ArchivedSnapshot{}}
+	var lines []string
+	status := "Success"
+	finish := func() {
+		updateHistory(id, func(e *LogEntry) {
+			e.Status, e.Result = status, &OperationResult{Archive: result}
+			e.Duration = time.Since(start).Round(time.Millisecond).String()
+			e.Output = strings.Join(lines, "\n")
+			if t, ok := terminationOf(ctx); ok {
+				e.Status, e.Termination = t.Status, t.Kind
+				e.Output += "\n\n" + t.Message
+			}
+		})
+	}
+
+	pending, parent, err := pendingArchive(job)
+	if err == nil { err = os.MkdirAll(dest, 0755) }
+	if err != nil {
+		status, lines = "Failed", append(lines, err.Error())
+		finish()
+		return
+	}
+	if len(pending) == 0 { lines = append(lines, "Nothing to archive, the newest snapshot is archived.") }
+
+	times := loadSnapshotTimes(job.Dest)
+	for _, s := range pending {
+		if shuttingDown() || ctx.Err() != nil { break }
+		sendStart := time.Now()
+		printDockerLog("ARCHIVE", "Sending %s (parent: %s) to %s", s.Name, parent, dest)
+		out, limits, n, err := sendReceive(ctx, job.Archive.Transfer, archiveSendArgs(job, parent, s.Name), dest, transferReporter(id, &lines, s.Name))
+		if limits != "" { updateHistory(id, func(e *LogEntry) { e.Limits = limits }) }
+		if out != "" { lines = append(lines, out) }
+		uuid, verified := "", false
+		if err == nil {
+			uuid, verified = archivedCopy(job, s.Name)
+			if !verified { err = fmt.Errorf("the copy's Received UUID does not match the source UUID %s", uuid) }
+		}
+		if err != nil {
+			// A copy that is partial or not verifiably ours must not become the next parent.
+			if _, serr := os.Lstat(snapshotPath(dest, s.Name)); serr == nil { btrfsFS.DeleteSubvolume(snapshotPath(dest, s.Name)) }
+			status, result.Failed = "Failed", s.Name
+			lines = append(lines, fmt.Sprintf("❌ %s: %v", s.Name, err))
+			break
+		}
+		t, ok := times[s.Name]
+		if !ok { t = s.Time }
+		recordSnapshotTime(dest, s.Name, t)
+		result.Sent = append(result.Sent, ArchivedSnapshot{Name: s.Name, Parent: parent, UUID: uuid, Bytes: n, Duration: time.Since(sendStart).Round(time.Millisecond).String()})
+		kind := "full"
+		if parent != "" { kind = "incremental from " + parent }
+		lines = append(lines, fmt.Sprintf("✅ %s (%s), %s, Received UUID %s verified", s.Name, kind, transferSummary(n, time.Since(sendStart)), uuid))
+		parent = s.Name
+	}
+	finish()
+	if len(result.Sent) == 0 { return }
+	setSendParent(job, archiveChain(job), parent)
+
+	enforceArchiveRetention(job, run)
+	enforceRetention(job, run)
+}
+
+// enforceArchiveRetention applies the archive's retention, which never
+// deletes the newest copy, the parent of the next send.
+func enforceArchiveRetention(job SnapshotJob, run *JobRun) {
+	a := archiveJob(job)
+	if !a.Retention.Enabled { return }
+	snaps, err := listManagedSnapshots(a)
+	if err != nil || len(snaps) == 0 { return }
+	now := time.Now()
+	var deletes []SnapInfo
+	for _, s := range selectRetentionDeletes(snaps, a.Retention, now) {
+		if s.Name != snaps[0].Name { deletes = append(deletes, s) }
+	}
+	applyRetentionPlan(a, plannedDeletes(a, deletes, now), run)
+}
+
+func previewArchive(job SnapshotJob) ([]PlannedOp, []string) {
+	if job.Dest == "" { return nil, []string{"snapshot destination not set: job will do nothing"} }
+	pending, parent, err := pendingArchive(job)
+	if err != nil { return nil, []string{"cannot list snapshots: " + err.Error()} }
+	var warnings []string
+	if _, err := os.Stat(job.Archive.Dest); err != nil { warnings = append(warnings, "archive dest not accessible: "+err.Error()) }
+	if len(pending) == 0 { return nil, append(warnings, "nothing to archive yet") }
+	var ops []PlannedOp
+	for _, s := range pending {
+		desc := "Archive " + s.Name + " in full"
+		if parent != "" { desc = "Archive " + s.Name + " incrementally from " + parent }
+		if d := job.Archive.Transfer.describe(); d != "" { desc += " (" + d + ")" }
+		ops = append(ops, PlannedOp{Description: desc, Command: formatCommand("btrfs", archiveSendArgs(job, parent, s.Name)...) + " | " + formatCommand("btrfs", "receive", job.Archive.Dest)})
+		parent = s.Name
+	}
+	return ops, warnings
+}
+
+// --- Handlers ---
+
+func archiveJobFromRequest(w http.ResponseWriter, r *http.Request) (SnapshotJob, bool) {
+	job, err := jobFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return job, false
+	}
+	if !job.Archive.Enabled {
+		http.Error(w, "Archiving is not enabled for this job", 400)
+		return job, false
+	}
+	return job, true
+}
+
+// handleActionArchive starts an archive run of ?job=.
+func handleActionArchive(w http.ResponseWriter, r *http.Request) {
+	job, ok := archiveJobFromRequest(w, r)
+	if !ok { return }
+	go func() {
+		run := newJobRun("archive:"+job.ID, "manual")
+		runArchive(job, run)
+		run.finish()
+	}()
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "triggered", "message": "Archive run initiated"})
+}
+
+// handleListArchive lists the archived copies of ?job=, newest first.
+func handleListArchive(w http.ResponseWriter, r *http.Request) {
+	job, ok := archiveJobFromRequest(w, r)
+	if !ok { return }
+	snaps, err := listManagedSnapshots(archiveJob(job))
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	list := []SnapshotItem{}
+	for _, s := range snaps {
+		list = append(list, SnapshotItem{Name: s.Name, Date: localTime(s.Time).Format("Jan 02, 2006 15:04 MST"), Job: job.ID})
+	}
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Audit Log ---
+// Every request that changes something (any method but GET and HEAD) is
+// recorded with who sent it, from where, what it asked for and how it
+// ended, including ones refused for a missing key or role. The audit log is
+// kept apart from the activity log, which only knows what ran, and goes
+// through the Store like the metrics. Secrets in parameters are redacted.
+
+type AuditEntry struct {
+	Time         time.Time         `json:"time"`
+	User         string            `json:"user,omitempty"` // empty without access control or a valid key
+	Role         string            `json:"role,omitempty"`
+	IP           string            `json:"ip"`
+	ForwardedFor string            `json:"forwarded_for,omitempty"` // X-Forwarded-For, as sent
+	Method       string            `json:"method"`
+	Endpoint     string            `json:"endpoint"`
+	Params       map[string]string `json:"params,omitempty"` // query and JSON body
+	Status       int               `json:"status"`
+	Result       string            `json:"result,omitempty"` // the error of a failed request
+	Duration     string            `json:"duration"`
+}
+
+const (
+	auditRetention = 365 * 24 * time.Hour
+	auditBodyLimit = 8 << 10
+	auditResultMax = 200
+)
+
+// auditSecret reports whether a parameter holds a secret, e.g. password,
+// key, key_hash, token or a webhook url, which often carries a token too.
+func auditSecret(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"password", "secret", "token", "passphrase", "key", "url"} {
+		if strings.Contains(name, s) { return true }
+	}
+	return false
+}
+
+// redactJSON replaces the values of secret fields at any depth.
+func redactJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if auditSecret(k) && val != nil && val != "" {
+				t[k] = "[redacted]"
+			} else {
+				t[k] = redactJSON(val)
+			}
+		}
+	case []interface{}:
+		for i := range t { t[i] = redactJSON(t[i]) }
+	}
+	return v
+}
+
+// auditParams collects the query and a JSON body of up to auditBodyLimit
+// bytes; the body is put back for the handler.
+func auditParams(r *http.Request) map[string]string {
+	params := map[string]string{}
+	for k, v := range r.URL.Query() {
+		params[k] = strings.Join(v, ",")
+		if auditSecret(k) { params[k] = "[redacted]" }
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		peek, _ := io.ReadAll(io.LimitReader(r.Body, auditBodyLimit+1))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(peek), r.Body), r.Body}
+		var body interface{}
+		switch {
+		case len(peek) > auditBodyLimit:
+			params["body"] = fmt.Sprintf("(more than %d KiB, not recorded)", auditBodyLimit>>10)
+		case json.Unmarshal(peek, &body) == nil:
+			data, _ := json.Marshal(redactJSON(body))
+			params["body"] = string(data)
+		case len(peek) > 0:
+			params["body"] = fmt.Sprintf("(%d bytes, not JSON)", len(peek))
+		}
+	}
+	if len(params) == 0 { return nil }
+	return params
+}
+
+// auditRecorder keeps the status and the start of an error response.
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	result []byte
+}
+
+func (a *auditRecorder) WriteHeader(code int) {
+	if a.status == 0 { a.status = code }
+	a.ResponseWriter.WriteHeader(code)
+}
+
+func (a *auditRecorder) Write(b []byte) (int, error) {
+	if a.status == 0 { a.status = 200 }
+	if a.status >= 400 && len(a.result) < auditResultMax { a.result = append(a.result, b...) }
+	return a.ResponseWriter.Write(b)
+}
+
+func (a *auditRecorder) Unwrap() http.ResponseWriter { return a.ResponseWriter }
+
+// audited records the requests that reach h in the audit log.
+func audited(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			h(w, r)
+			return
+		}
+		start := time.Now()
+		e := AuditEntry{Time: start, Method: r.Method, Endpoint: r.URL.Path, ForwardedFor: r.Header.Get("X-Forwarded-For"), Params: auditParams(r)}
+		e.IP, _, _ = net.SplitHostPort(r.RemoteAddr)
+		state.mu.Lock()
+		cfg := state.Config.Access
+		state.mu.Unlock()
+		if len(cfg.Users) > 0 {
+			if u, ok := authenticate(r, cfg); ok { e.User, e.Role = u.Name, u.Role }
+		}
+
+		rec := &auditRecorder{ResponseWriter: w}
+		h(rec, r)
+		e.Status, e.Duration = rec.status, time.Since(start).Round(time.Millisecond).String()
+		if e.Status == 0 { e.Status = 200 }
+		if len(rec.result) > 0 {
+			result := strings.TrimSpace(string(rec.result))
+			if len(result) > auditResultMax { result = result[:auditResultMax] + "..." }
+			e.Result = result
+		}
+		if err := store.AppendAudit(e); err != nil { logError("STORAGE", "Failed to record audit entry: %v", err) }
+	}
+}
+
+type AuditFilter struct {
+	Users    map[string]bool // "-" matches requests without a user
+	Endpoint string          // substring
+	Failed   bool            // only status >= 400
+	Since    time.Time
+	Until    time.Time
+}
+
+func parseAuditFilter(q url.Values) (AuditFilter, error) {
+	f := AuditFilter{Users: listParam(q, "user", strings.TrimSpace), Endpoint: q.Get("endpoint"), Failed: q.Get("failed") == "1"}
+	var err error
+	if s := q.Get("since"); s != "" {
+		if f.Since, err = parseHistoryTime(s, false); err != nil { return f, err }
+	}
+	if s := q.Get("until"); s != "" {
+		if f.Until, err = parseHistoryTime(s, true); err != nil { return f, err }
+	}
+	return f, nil
+}
+
+func (f AuditFilter) match(e AuditEntry) bool {
+	user := e.User
+	if user == "" { user = "-" }
+	if f.Users != nil && !f.Users[user] { return false }
+	if f.Endpoint != "" && !strings.Contains(e.Endpoint, f.Endpoint) { return false }
+	if f.Failed && e.Status < 400 { return false }
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) { return false }
+	return true
+}
+
+// queryAudit returns the matching entries, newest first.
+func queryAudit(f AuditFilter) ([]AuditEntry, error) {
+	entries, err := store.QueryAudit(f.Since)
+	if err != nil { return nil, err }
+	list := []AuditEntry{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if f.match(entries[i]) { list = append(list, entries[i]) }
+	}
+	return list, nil
+}
+
+// handleAudit returns the audit log, newest first, filtered by ?user= ("-"
+// for requests without one), ?endpoint=, ?failed=1, ?since= and ?until=,
+// at most ?limit= entries (default 500) from ?offset=. X-Total-Count is the
+// number of matching entries.
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f, err := parseAuditFilter(q)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	limit, offset := 500, 0
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 { http.Error(w, "limit must be a positive number", 400); return }
+	}
+	if s := q.Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 { http.Error(w, "offset must not be negative", 400); return }
+	}
+	list, err := queryAudit(f)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(list)))
+	if offset > len(list) { offset = len(list) }
+	list = list[offset:]
+	if limit < len(list) { list = list[:limit] }
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleAuditExport downloads the filtered audit log as ?format=csv
+// (default) or json.
+func handleAuditExport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f, err := parseAuditFilter(q)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	format := q.Get("format")
+	if format == "" { format = "csv" }
+	if format != "csv" && format != "json" {
+		http.Error(w, "format must be csv or json", 400)
+		return
+	}
+	list, err := queryAudit(f)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"btrfs-audit-%s.%s\"", time.Now().Format("2006-01-02"), format))
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "user", "role", "ip", "forwarded_for", "method", "endpoint", "params", "status", "result", "duration"})
+	for _, e := range list {
+		keys := make([]string, 0, len(e.Params))
+		for k := range e.Params { keys = append(keys, k) }
+		sort.Strings(keys)
+		var params []string
+		for _, k := range keys { params = append(params, k+"="+e.Params[k]) }
+		cw.Write([]string{e.Time.UTC().Format(time.RFC3339), e.User, e.Role, e.IP, e.ForwardedFor, e.Method, e.Endpoint, strings.Join(params, " "), strconv.Itoa(e.Status), e.Result, e.Duration})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Balance Presets ---
+
+type BalancePreset struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Filters     []string `json:"filters"`
+}
+
+var balancePresets = []BalancePreset{
+	{"reclaim-empty", "Reclaim empty chunks", "Frees completely empty data and metadata chunks. Nearly instant.", []string{"-dusage=0", "-musage=0"}},
+	{"light-weekly", "Light weekly", "Compacts mostly empty chunks to keep unallocated space available.", []string{"-dusage=20", "-musage=10"}},
+	{"metadata-squeeze", "Metadata squeeze", "Compacts half-empty metadata chunks only.", []string{"-musage=50"}},
+	{"full", "Full", "Rewrites every chunk. Slow and I/O heavy.", []string{"--full-balance"}},
+}
+
+const defaultBalancePreset = "full"
+
+// findBalancePreset falls back to the full balance for unknown or empty IDs,
+// which is what the balance action did before presets existed.
+func findBalancePreset(id string) BalancePreset {
+	for _, p := range balancePresets {
+		if p.ID == id { return p }
+	}
+	for _, p := range balancePresets {
+		if p.ID == defaultBalancePreset { return p }
+	}
+	return balancePresets[0]
+}
+
+func validBalancePreset(id string) bool {
+	for _, p := range balancePresets {
+		if p.ID == id { return true }
+	}
+	return id == ""
+}
+
+// balanceVisualPath records the preset and its filters in the log entry.
+func balanceVisualPath(path string, preset BalancePreset) string {
+	return fmt.Sprintf("%s [%s: %s]", path, preset.ID, strings.Join(preset.Filters, " "))
+}
+
+func handleBalancePresets(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(balancePresets)
+}
+
+// --- Balance Progress ---
+// A poller follows `btrfs balance status` on the target drive, every few
+// seconds while a balance runs or is paused and once a minute otherwise, so
+// /api/status/balance can drive a progress bar without running btrfs for
+// every request. Balance actions wake it up right away.
+
+const (
+	balancePollActive = 5 * time.Second
+	balancePollIdle   = time.Minute
+)
+
+type BalanceStatus struct {
+	Path    string         `json:"path"`
+	Balance *BalanceResult `json:"balance"` // nil if the output was not understood
+	Output  string         `json:"output"`
+	Updated time.Time      `json:"updated"`
+}
+
+var balanceProgress = struct {
+	mu     sync.Mutex
+	status *BalanceStatus
+	wake   chan struct{}
+}{wake: make(chan struct{}, 1)}
+
+// pollBalance reads the balance status of path and keeps it for the handler.
+// balance status exits non-zero while a balance exists, so only the output
+// is looked at.
+func pollBalance(path string) *BalanceStatus {
+	out, _ := exec.Command("btrfs", "balance", "status", path).CombinedOutput()
+	s := &BalanceStatus{Path: path, Balance: parseBalance(string(out)), Output: string(out), Updated: time.Now()}
+	balanceProgress.mu.Lock()
+	balanceProgress.status = s
+	balanceProgress.mu.Unlock()
+	return s
+}
+
+func wakeBalancePoller() {
+	select {
+	case balanceProgress.wake <- struct{}{}:
+	default:
+	}
+}
+
+// balanceCommandRunning reports a balance start or resume this app is
+// waiting on; the kernel may not report it as running yet.
+func balanceCommandRunning() bool {
+	runningCommands.mu.Lock()
+	defer runningCommands.mu.Unlock()
+	for _, c := range runningCommands.cmds {
+		if c.Name == "btrfs" && len(c.Args) > 1 && c.Args[0] == "balance" && (c.Args[1] == "start" || c.Args[1] == "resume") { return true }
+	}
+	return false
+}
+
+func runBalancePoller() {
+	for {
+		state.mu.Lock()
+		path := state.Config.TargetDrive
+		state.mu.Unlock()
+		interval := balancePollIdle
+		if path != "" {
+			s := pollBalance(path)
+			if balanceCommandRunning() || (s.Balance != nil && (s.Balance.State == "running" || s.Balance.State == "paused")) { interval = balancePollActive }
+		}
+		select {
+		case <-time.After(interval):
+		case <-balanceProgress.wake:
+		}
+	}
+}
+
+// handleBalanceStatus returns the last polled balance status of the target
+// drive, polling first if there is none yet or ?refresh=1.
+func handleBalanceStatus(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	path := state.Config.TargetDrive
+	state.mu.Unlock()
+	if path == "" { http.Error(w, "Target drive not set", 400); return }
+
+	balanceProgress.mu.Lock()
+	s := balanceProgress.status
+	balanceProgress.mu.Unlock()
+	if s == nil || s.Path != path || r.URL.Query().Get("refresh") == "1" { s = pollBalance(path) }
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// --- Boot Menu ---
+// A job snapshotting the root subvolume can keep a grub-btrfs boot menu in
+// sync: after every snapshot and every deletion the menu is regenerated, so
+// the machine can boot straight into an older snapshot to roll back. The
+// menu itself is grub-btrfs's business; this only triggers the refresh that
+// grub-btrfsd would do.
+
+type BootConfig struct {
+	Enabled bool `json:"enabled"`
+	// Command regenerates the menu, split on spaces. Empty: the grub-btrfs
+	// script if installed, grub-mkconfig otherwise.
+	Command string `json:"command,omitempty"`
+}
+
+const grubBtrfsScript = "/etc/grub.d/41_snapshots-btrfs"
+
+// Jobs finishing at the same time share one refresh at a time.
+var bootMenu sync.Mutex
+
+func bootMenuCommand(cfg BootConfig) []string {
+	if fields := strings.Fields(cfg.Command); len(fields) > 0 { return fields }
+	// grub-btrfs.cfg is only rebuilt by the script once grub.cfg sources it.
+	if _, err := os.Stat(grubBtrfsScript); err == nil {
+		if _, err := os.Stat("/boot/grub/grub-btrfs.cfg"); err == nil { return []string{grubBtrfsScript} }
+	}
+	for _, mk := range []string{"grub-mkconfig", "grub2-mkconfig"} {
+		if _, err := exec.LookPath(mk); err == nil {
+			dir := "/boot/grub"
+			if mk == "grub2-mkconfig" { dir = "/boot/grub2" }
+			return []string{mk, "-o", filepath.Join(dir, "grub.cfg")}
+		}
+	}
+	return nil
+}
+
+// refreshBootMenu regenerates the boot menu of a job with it enabled. Only
+// failures go to the activity log, a refresh follows every snapshot.
+func refreshBootMenu(job SnapshotJob) {
+	if !job.Boot.Enabled { return }
+	argv := bootMenuCommand(job.Boot)
+	if argv == nil {
+		logHistory("BOOT MENU", "🥾", job.Source, "Failed", "Neither grub-btrfs nor grub-mkconfig found; set boot.command of job "+job.ID)
+		return
+	}
+	bootMenu.Lock()
+	defer bootMenu.Unlock()
+	out, err := runWithTimeout("BOOT MENU", argv[0], argv[1:]...)
+	if err != nil {
+		logHistory("BOOT MENU", "🥾", job.Source, "Failed", fmt.Sprintf("%s: %v\n%s", strings.Join(argv, " "), err, out))
+		return
+	}
+	printDockerLog("BOOT MENU", "Refreshed after a change to %s (%s)", job.Dest, strings.Join(argv, " "))
+}
+
+// snapshotBootable reports whether a snapshot shows up as a bootable entry:
+// its job maintains the boot menu and it holds a system root.
+func snapshotBootable(job SnapshotJob, name string) bool {
+	if !job.Boot.Enabled { return false }
+	_, err := os.Stat(filepath.Join(job.Dest, name, "etc", "fstab"))
+	return err == nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Snapshot Browser & Restore ---
+
+type FileItem struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Size    int64  `json:"size"`
+	Mode    string `json:"mode"`
+	ModTime string `json:"mod_time"`
+	Target  string `json:"target,omitempty"`
+}
+
+// snapshotRoot resolves a snapshot name to its directory inside the job's
+// destination, rejecting anything that escapes it.
+func snapshotRoot(job SnapshotJob, name string) (string, error) {
+	dest := job.Dest
+	if dest == "" {
+		return "", fmt.Errorf("destination not configured")
+	}
+	fullPath := filepath.Join(dest, name)
+	if name == "" || filepath.Dir(fullPath) != filepath.Clean(dest) {
+		return "", fmt.Errorf("invalid snapshot name")
+	}
+	return fullPath, nil
+}
+
+// resolveInside joins rel onto root and makes sure the result, after
+// following symlinks, still lives under root. Snapshots may contain absolute
+// symlinks that would otherwise point at the live system.
+func resolveInside(root, rel string) (string, error) {
+	joined := filepath.Join(root, filepath.Clean("/"+rel))
+	real, err := filepath.EvalSymlinks(joined)
+	if err != nil {
+		return "", err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	if real != realRoot && !strings.HasPrefix(real, realRoot+string(os.PathSeparator)) {
+		return "", fmt.Errorf("path escapes snapshot")
+	}
+	return real, nil
+}
+
+func fileType(m os.FileMode) string {
+	switch {
+	case m.IsDir():
+		return "dir"
+	case m&os.ModeSymlink != 0:
+		return "symlink"
+	case m.IsRegular():
+		return "file"
+	default:
+		return "other"
+	}
+}
+
+func handleSnapshotLs(w http.ResponseWriter, r *http.Request) {
+	job, err := jobFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	root, err := snapshotRoot(job, r.PathValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	dir, err := resolveInside(root, r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	list := []FileItem{}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil { continue }
+		item := FileItem{
+			Name:    e.Name(),
+			Type:    fileType(info.Mode()),
+			Size:    info.Size(),
+			Mode:    info.Mode().String(),
+			ModTime: info.ModTime().Format(time.RFC3339),
+		}
+		if item.Type == "symlink" {
+			item.Target, _ = os.Readlink(filepath.Join(dir, e.Name()))
+		}
+		list = append(list, item)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if (list[i].Type == "dir") != (list[j].Type == "dir") {
+			return list[i].Type == "dir"
+		}
+		return list[i].Name < list[j].Name
+	})
+	json.NewEncoder(w).Encode(list)
+}
+
+type RestoreRequest struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Overwrite   bool   `json:"overwrite"`
+}
+
+// handleSnapshotRestore reflink-copies a file or directory from a snapshot
+// back into the job's live source. Destination is relative to the source
+// subvolume and defaults to the same relative path as in the snapshot.
+func handleSnapshotRestore(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	job, err := jobFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	root, err := snapshotRoot(job, name)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	var req RestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), 400)
+		return
+	}
+	if strings.Trim(req.Source, "/") == "" {
+		http.Error(w, "Source path required", 400)
+		return
+	}
+	src, err := resolveInside(root, req.Source)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	live := job.Source
+	if live == "" {
+		http.Error(w, "Snapshot source not configured", 400)
+		return
+	}
+
+	rel := req.Destination
+	if rel == "" {
+		rel = req.Source
+	}
+	dst := filepath.Join(live, filepath.Clean("/"+rel))
+	if dst == filepath.Clean(live) {
+		http.Error(w, "Refusing to restore over the whole subvolume", 400)
+		return
+	}
+	// Whatever part of the destination already exists must stay inside the
+	// live subvolume once symlinks are followed; missing parents are created.
+	parent := filepath.Dir(filepath.Clean("/" + rel))
+	for {
+		if _, err := os.Lstat(filepath.Join(live, parent)); err == nil || parent == "/" {
+			break
+		}
+		parent = filepath.Dir(parent)
+	}
+	if _, err := resolveInside(live, parent); err != nil {
+		http.Error(w, "Invalid destination: "+err.Error(), 400)
+		return
+	}
+	os.MkdirAll(filepath.Dir(dst), 0755)
+
+	if _, err := os.Lstat(dst); err == nil && !req.Overwrite {
+		http.Error(w, "Destination exists (set overwrite to replace)", 409)
+		return
+	}
+
+	args := []string{"-a", "--reflink=always"}
+	if srcInfo.IsDir() {
+		// Copy the directory's contents so an existing destination is merged
+		// into rather than nested inside.
+		os.MkdirAll(dst, srcInfo.Mode().Perm())
+		args = append(args, src+"/.", dst+"/")
+	} else {
+		args = append(args, src, dst)
+	}
+
+	visualPath := fmt.Sprintf("%s:%s ➡️ %s", name, req.Source, dst)
+	id := runCommandAsync("RESTORE", "♻️", visualPath, "cp", args...)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// --- Btrfs Backends ---
+// Subvolume create, delete and list and filesystem info go through a
+// BtrfsBackend rather than parsing btrfs-progs output at each call site. The
+// native backend talks to the kernel with ioctls; the CLI backend runs
+// btrfs-progs as before. The default, auto, uses the native backend and falls
+// back to the CLI for calls the kernel refuses (not btrfs, missing
+// privileges, an ioctl it doesn't know). Everything else (scrub, balance,
+// send/receive, quotas, ...) still runs btrfs-progs.
+
+type BtrfsBackend interface {
+	Name() string
+	CreateSubvolume(path string) error
+	DeleteSubvolume(path string) error
+	// ListSubvolumes lists every subvolume of the filesystem holding path,
+	// like `subvolume list -pcuqR` with the read-only and default flags.
+	ListSubvolumes(path string) ([]Subvolume, error)
+	// SubvolumeID returns the ID of the subvolume whose root is path.
+	SubvolumeID(path string) (uint64, error)
+	DefaultSubvolumeID(path string) (uint64, error)
+	FilesystemInfo(path string) (*FilesystemInfo, error)
+}
+
+type FilesystemInfo struct {
+	UUID       string   `json:"uuid"`
+	Label      string   `json:"label"`
+	NodeSize   uint32   `json:"nodesize,omitempty"`   // native only
+	SectorSize uint32   `json:"sectorsize,omitempty"` // native only
+	Generation uint64   `json:"generation,omitempty"` // native only
+	Devices    []Device `json:"devices"`
+}
+
+var btrfsFS BtrfsBackend = autoBackend{native: nativeBackend{}, cli: cliBackend{}}
+
+// openBackend returns the backend for the btrfs_backend setting: auto
+// (default), native or cli.
+func openBackend(name string) (BtrfsBackend, error) {
+	switch name {
+	case "", "auto":
+		return autoBackend{native: nativeBackend{}, cli: cliBackend{}}, nil
+	case "native":
+		return nativeBackend{}, nil
+	case "cli":
+		return cliBackend{}, nil
+	}
+	return nil, fmt.Errorf("unknown btrfs_backend %q (auto, native or cli)", name)
+}
+
+// startBtrfsOp runs op in the background as an activity log entry, like
+// startCommand does for commands; op may return a parsed result.
+func startBtrfsOp(opType, emoji, path, desc string, op func() (*OperationResult, error)) (int64, <-chan struct{}) {
+	start := time.Now()
+	id := startHistory(opType, emoji, path, desc)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		printDockerLog(opType, "STARTING: %s (%s)", desc, btrfsFS.Name())
+		result, err := op()
+		duration := time.Since(start).Round(time.Millisecond)
+		printDockerLog(opType, "FINISHED in %s", duration)
+		if err != nil { logError(opType, "ERROR: %v", err) }
+		if result != nil { appLog.Debug("parsed result", "op", opType, "result", result) }
+		updateHistory(id, func(e *LogEntry) {
+			e.Duration, e.Status, e.Result = duration.String(), "Success", result
+			if err != nil { e.Status, e.Output = "Failed", e.Output+"\nError: "+err.Error() }
+		})
+	}()
+	return id, done
+}
+
+// --- CLI backend ---
+
+type cliBackend struct{}
+
+func (cliBackend) Name() string { return "cli" }
+
+func runBtrfs(args ...string) (string, error) {
+	start := time.Now()
+	out, err := exec.Command("btrfs", args...).CombinedOutput()
+	attrs := []interface{}{"op", "BTRFS", "duration", time.Since(start).Round(time.Millisecond), "bytes", len(out)}
+	if err != nil { attrs = append(attrs, "error", err) }
+	appLog.Debug("btrfs "+strings.Join(args, " "), attrs...)
+	if err != nil { return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out))) }
+	return string(out), nil
+}
+
+func (cliBackend) CreateSubvolume(path string) error {
+	_, err := runBtrfs("subvolume", "create", path)
+	return err
+}
+
+func (cliBackend) DeleteSubvolume(path string) error {
+	_, err := runBtrfs("subvolume", "delete", path)
+	return err
+}
+
+func (b cliBackend) ListSubvolumes(path string) ([]Subvolume, error) {
+	out, err := runBtrfs("subvolume", "list", "-pcuqR", path)
+	if err != nil { return nil, err }
+	subvols := parseSubvolumeList(out)
+
+	readonly := map[uint64]bool{}
+	if out, err := runBtrfs("subvolume", "list", "-r", path); err == nil {
+		for _, s := range parseSubvolumeList(out) { readonly[s.ID] = true }
+	}
+	def, _ := b.DefaultSubvolumeID(path)
+	for i := range subvols {
+		subvols[i].ReadOnly = readonly[subvols[i].ID]
+		subvols[i].Default = subvols[i].ID == def
+	}
+	return subvols, nil
+}
+
+func (cliBackend) SubvolumeID(path string) (uint64, error) {
+	fields, err := showSubvolume(path)
+	if err != nil { return 0, err }
+	v, ok := fields["Subvolume ID"]
+	if !ok { return 0, fmt.Errorf("%s: no subvolume ID in output", path) }
+	return strconv.ParseUint(v, 10, 64)
+}
+
+// DefaultSubvolumeID parses `subvolume get-default`: "ID 5 (FS_TREE)" or
+// "ID 256 gen 10 top level 5 path home".
+func (cliBackend) DefaultSubvolumeID(path string) (uint64, error) {
+	out, err := runBtrfs("subvolume", "get-default", path)
+	if err != nil { return 0, err }
+	f := strings.Fields(out)
+	if len(f) < 2 || f[0] != "ID" { return 0, fmt.Errorf("unexpected output: %s", out) }
+	return strconv.ParseUint(f[1], 10, 64)
+}
+
+func (cliBackend) FilesystemInfo(path string) (*FilesystemInfo, error) {
+	out, err := runBtrfs("filesystem", "show", "--raw", path)
+	if err != nil { return nil, err }
+	list := parseFilesystemList(out)
+	if len(list) == 0 { return nil, fmt.Errorf("%s: no filesystem in output", path) }
+	return &FilesystemInfo{UUID: list[0].UUID, Label: list[0].Label, Devices: list[0].Devices}, nil
+}
+
+// --- Auto backend ---
+
+type autoBackend struct {
+	native nativeBackend
+	cli    cliBackend
+}
+
+// nativeFallbacks remembers which calls already logged falling back, so a
+// filesystem that isn't btrfs or a container without CAP_SYS_ADMIN logs it
+// once rather than on every refresh.
+var nativeFallbacks = struct {
+	mu     sync.Mutex
+	logged map[string]bool
+}{logged: map[string]bool{}}
+
+func (autoBackend) Name() string { return "auto" }
+
+// fallback reports whether the CLI should be tried after the native backend
+// failed with err.
+func fallback(call string, err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) { return false }
+	switch errno {
+	case syscall.ENOTTY, syscall.EOPNOTSUPP, syscall.ENOSYS, syscall.EPERM, syscall.EACCES, syscall.EINVAL:
+	default:
+		return false
+	}
+	key := call + " " + errno.Error()
+	nativeFallbacks.mu.Lock()
+	first := !nativeFallbacks.logged[key]
+	nativeFallbacks.logged[key] = true
+	nativeFallbacks.mu.Unlock()
+	if first { logWarn("BTRFS", "Native %s failed (%v), using btrfs-progs", call, err) }
+	return true
+}
+
+func (b autoBackend) CreateSubvolume(path string) error {
+	err := b.native.CreateSubvolume(path)
+	if err != nil && fallback("subvolume create", err) { return b.cli.CreateSubvolume(path) }
+	return err
+}
+
+func (b autoBackend) DeleteSubvolume(path string) error {
+	err := b.native.DeleteSubvolume(path)
+	if err != nil && fallback("subvolume delete", err) { return b.cli.DeleteSubvolume(path) }
+	return err
+}
+
+func (b autoBackend) ListSubvolumes(path string) ([]Subvolume, error) {
+	list, err := b.native.ListSubvolumes(path)
+	if err != nil && fallback("subvolume list", err) { return b.cli.ListSubvolumes(path) }
+	return list, err
+}
+
+func (b autoBackend) SubvolumeID(path string) (uint64, error) {
+	id, err := b.native.SubvolumeID(path)
+	if err != nil && fallback("subvolume id", err) { return b.cli.SubvolumeID(path) }
+	return id, err
+}
+
+func (b autoBackend) DefaultSubvolumeID(path string) (uint64, error) {
+	id, err := b.native.DefaultSubvolumeID(path)
+	if err != nil && fallback("subvolume get-default", err) { return b.cli.DefaultSubvolumeID(path) }
+	return id, err
+}
+
+func (b autoBackend) FilesystemInfo(path string) (*FilesystemInfo, error) {
+	info, err := b.native.FilesystemInfo(path)
+	if err != nil && fallback("filesystem info", err) { return b.cli.FilesystemInfo(path) }
+	return info, err
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// --- Native btrfs backend ---
+// The ioctls behind `btrfs subvolume create/delete/list/get-default` and
+// `filesystem show`. Subvolumes are listed the way btrfs-progs does it: a
+// search of the root tree for ROOT_ITEMs (generation, flags, UUIDs) and
+// ROOT_BACKREFs (parent and name), with paths resolved by INO_LOOKUP.
+// Searches and lookups in other trees need CAP_SYS_ADMIN.
+
+const (
+	btrfsIocSubvolCreate = 0x5000940E // _IOW(0x94, 14, struct btrfs_ioctl_vol_args)
+	btrfsIocSnapDestroy  = 0x5000940F // _IOW(0x94, 15, struct btrfs_ioctl_vol_args)
+	btrfsIocTreeSearch   = 0xD0009411 // _IOWR(0x94, 17, struct btrfs_ioctl_search_args)
+	btrfsIocInoLookup    = 0xD0009412 // _IOWR(0x94, 18, struct btrfs_ioctl_ino_lookup_args)
+	btrfsIocDevInfo      = 0xD000941E // _IOWR(0x94, 30, struct btrfs_ioctl_dev_info_args)
+	btrfsIocFsInfo       = 0x8400941F // _IOR(0x94, 31, struct btrfs_ioctl_fs_info_args)
+	btrfsIocGetFslabel   = 0x81009431 // _IOR(0x94, 49, char[256])
+
+	btrfsRootTreeID       = 1
+	btrfsFSTreeID         = 5
+	btrfsRootTreeDirID    = 6   // holds the "default" dir item
+	btrfsFirstFreeID      = 256 // first subvolume ID, and the inode of every subvolume root
+	btrfsLastFreeID       = ^uint64(0) - 255
+	btrfsDirItemKey       = 84
+	btrfsRootItemKey      = 132
+	btrfsRootBackrefKey   = 144
+	btrfsRootSubvolRdonly = 1 << 0
+	btrfsFsInfoFlagGen    = 1 << 1
+
+	btrfsSearchHeaderSize = 32
+	btrfsRootItemV0Size   = 239 // root items before UUIDs and times were added
+	btrfsDirItemSize      = 30
+)
+
+type btrfsVolArgs struct {
+	Fd   int64
+	Name [4088]byte
+}
+
+type btrfsInoLookupArgs struct {
+	TreeID   uint64
+	ObjectID uint64
+	Name     [4080]byte
+}
+
+type btrfsSearchKey struct {
+	TreeID      uint64
+	MinObjectID uint64
+	MaxObjectID uint64
+	MinOffset   uint64
+	MaxOffset   uint64
+	MinTransID  uint64
+	MaxTransID  uint64
+	MinType     uint32
+	MaxType     uint32
+	NrItems     uint32
+	_           uint32
+	_           [4]uint64
+}
+
+type btrfsSearchArgs struct {
+	Key btrfsSearchKey
+	Buf [4096 - 104]byte
+}
+
+type btrfsFsInfoArgs struct {
+	MaxID          uint64
+	NumDevices     uint64
+	FSID           [16]byte
+	NodeSize       uint32
+	SectorSize     uint32
+	CloneAlignment uint32
+	CsumType       uint16
+	CsumSize       uint16
+	Flags          uint64
+	Generation     uint64
+	MetadataUUID   [16]byte
+	_              [944]byte
+}
+
+type btrfsDevInfoArgs struct {
+	DevID      uint64
+	UUID       [16]byte
+	BytesUsed  uint64
+	TotalBytes uint64
+	FSID       [16]byte
+	_          [377]uint64
+	Path       [1024]byte
+}
+
+type nativeBackend struct{}
+
+func (nativeBackend) Name() string { return "native" }
+
+func btrfsIoctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+	if errno != 0 { return errno }
+	return nil
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 { return string(b[:i]) }
+	}
+	return string(b)
+}
+
+// formatUUID spells a UUID like btrfs-progs; all zeros is no UUID.
+func formatUUID(u []byte) string {
+	if len(u) != 16 || string(u) == string(make([]byte, 16)) { return "" }
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// volIoctl runs a create or destroy ioctl on the parent of path.
+func volIoctl(req uintptr, path, what string) error {
+	dir, name := filepath.Split(filepath.Clean(path))
+	var args btrfsVolArgs
+	if name == "" || name == "." || name == ".." || len(name) >= len(args.Name) { return fmt.Errorf("%s subvolume %s: invalid name", what, path) }
+	if dir == "" { dir = "." }
+	f, err := os.Open(dir)
+	if err != nil { return err }
+	defer f.Close()
+	copy(args.Name[:], name)
+	if err := btrfsIoctl(f, req, unsafe.Pointer(&args)); err != nil { return fmt.Errorf("%s subvolume %s: %w", what, path, err) }
+	return nil
+}
+
+func (nativeBackend) CreateSubvolume(path string) error {
+	return volIoctl(btrfsIocSubvolCreate, path, "create")
+}
+
+func (nativeBackend) DeleteSubvolume(path string) error {
+	return volIoctl(btrfsIocSnapDestroy, path, "delete")
+}
+
+// treeSearch calls fn with every item between the min and max keys of key,
+// in key order. data is only valid during the call.
+func treeSearch(f *os.File, key btrfsSearchKey, fn func(objectID, offset uint64, typ uint32, data []byte)) error {
+	args := &btrfsSearchArgs{Key: key}
+	for {
+		args.Key.NrItems = ^uint32(0)
+		if err := btrfsIoctl(f, btrfsIocTreeSearch, unsafe.Pointer(args)); err != nil { return fmt.Errorf("tree search: %w", err) }
+		if args.Key.NrItems == 0 { return nil }
+
+		var objectID, offset uint64
+		var typ uint32
+		pos := 0
+		for i := uint32(0); i < args.Key.NrItems && pos+btrfsSearchHeaderSize <= len(args.Buf); i++ {
+			h := args.Buf[pos : pos+btrfsSearchHeaderSize]
+			objectID, offset, typ = binary.LittleEndian.Uint64(h[8:]), binary.LittleEndian.Uint64(h[16:]), binary.LittleEndian.Uint32(h[24:])
+			n := int(binary.LittleEndian.Uint32(h[28:]))
+			pos += btrfsSearchHeaderSize
+			if pos+n > len(args.Buf) { break }
+			fn(objectID, offset, typ, args.Buf[pos:pos+n])
+			pos += n
+		}
+
+		// Continue right after the last key returned.
+		k := &args.Key
+		k.MinObjectID, k.MinType, k.MinOffset = objectID, typ, offset
+		switch {
+		case offset < ^uint64(0):
+			k.MinOffset++
+		case typ < 255:
+			k.MinType, k.MinOffset = typ+1, 0
+		case objectID < ^uint64(0):
+			k.MinObjectID, k.MinType, k.MinOffset = objectID+1, 0, 0
+		default:
+			return nil
+		}
+		if k.MinObjectID > k.MaxObjectID { return nil }
+	}
+}
+
+// inoLookup returns the path of inode objectID in tree treeID relative to
+// the tree's root, with a trailing slash (empty for the root itself).
+func inoLookup(f *os.File, treeID, objectID uint64) (string, uint64, error) {
+	args := &btrfsInoLookupArgs{TreeID: treeID, ObjectID: objectID}
+	if err := btrfsIoctl(f, btrfsIocInoLookup, unsafe.Pointer(args)); err != nil { return "", 0, fmt.Errorf("ino lookup: %w", err) }
+	return cString(args.Name[:]), args.TreeID, nil
+}
+
+func (b nativeBackend) ListSubvolumes(path string) ([]Subvolume, error) {
+	f, err := os.Open(path)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	type root struct {
+		s        Subvolume
+		dirID    uint64
+		name     string
+		hasRef   bool
+		resolved bool
+	}
+	roots := map[uint64]*root{}
+	var order []uint64
+	get := func(id uint64) *root {
+		if roots[id] == nil {
+			roots[id] = &root{s: Subvolume{ID: id}}
+			order = append(order, id)
+		}
+		return roots[id]
+	}
+	le := binary.LittleEndian
+	err = treeSearch(f, btrfsSearchKey{
+		TreeID: btrfsRootTreeID, MinObjectID: btrfsFirstFreeID, MaxObjectID: btrfsLastFreeID,
+		MinType: btrfsRootItemKey, MaxType: btrfsRootBackrefKey, MaxOffset: ^uint64(0), MaxTransID: ^uint64(0),
+	}, func(objectID, offset uint64, typ uint32, data []byte) {
+		switch {
+		case typ == btrfsRootItemKey && len(data) >= btrfsRootItemV0Size:
+			r := get(objectID)
+			r.s.Gen = le.Uint64(data[160:])
+			r.s.ReadOnly = le.Uint64(data[208:])&btrfsRootSubvolRdonly != 0
+			if len(data) >= 311 {
+				r.s.UUID, r.s.ParentUUID, r.s.ReceivedUUID = formatUUID(data[247:263]), formatUUID(data[263:279]), formatUUID(data[279:295])
+				r.s.CGen = le.Uint64(data[303:]) // otransid
+			}
+		case typ == btrfsRootBackrefKey && len(data) >= 18:
+			r := get(objectID)
+			n := int(le.Uint16(data[16:]))
+			if 18+n > len(data) { return }
+			r.s.Parent, r.s.TopLevel, r.dirID = offset, offset, le.Uint64(data[0:])
+			r.name, r.hasRef = string(data[18:18+n]), true
+		}
+	})
+	if err != nil { return nil, fmt.Errorf("%s: %w", path, err) }
+
+	// A subvolume's path is its parent's, the directory it sits in within
+	// the parent and its name. Roots without a backref are being deleted.
+	var resolve func(id uint64, depth int) (string, error)
+	resolve = func(id uint64, depth int) (string, error) {
+		if id == btrfsFSTreeID { return "", nil }
+		r := roots[id]
+		if r == nil || !r.hasRef || depth > 256 { return "", fmt.Errorf("subvolume %d has no path", id) }
+		if r.resolved { return r.s.Path, nil }
+		parent, err := resolve(r.s.Parent, depth+1)
+		if err != nil { return "", err }
+		dir, _, err := inoLookup(f, r.s.Parent, r.dirID)
+		if err != nil { return "", err }
+		r.s.Path, r.resolved = dir+r.name, true
+		if parent != "" { r.s.Path = parent + "/" + r.s.Path }
+		return r.s.Path, nil
+	}
+
+	def, _ := b.DefaultSubvolumeID(path)
+	subvols := []Subvolume{}
+	for _, id := range order {
+		r := roots[id]
+		if !r.hasRef { continue }
+		if _, err := resolve(id, 0); err != nil {
+			var errno syscall.Errno
+			if errors.As(err, &errno) { return nil, err }
+			continue
+		}
+		r.s.Default = id == def
+		subvols = append(subvols, r.s)
+	}
+	return subvols, nil
+}
+
+// SubvolumeID looks up the tree path belongs to; only the root directory of
+// a subvolume has inode 256.
+func (nativeBackend) SubvolumeID(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil { return 0, err }
+	defer f.Close()
+	_, id, err := inoLookup(f, 0, btrfsFirstFreeID)
+	if err != nil { return 0, fmt.Errorf("%s: %w", path, err) }
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil { return 0, err }
+	if st.Ino != btrfsFirstFreeID { return 0, fmt.Errorf("%s is not a subvolume", path) }
+	return id, nil
+}
+
+// DefaultSubvolumeID reads the "default" dir item of the root tree; without
+// one the top level is the default.
+func (nativeBackend) DefaultSubvolumeID(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil { return 0, err }
+	defer f.Close()
+	def := uint64(btrfsFSTreeID)
+	err = treeSearch(f, btrfsSearchKey{
+		TreeID: btrfsRootTreeID, MinObjectID: btrfsRootTreeDirID, MaxObjectID: btrfsRootTreeDirID,
+		MinType: btrfsDirItemKey, MaxType: btrfsDirItemKey, MaxOffset: ^uint64(0), MaxTransID: ^uint64(0),
+	}, func(objectID, offset uint64, typ uint32, data []byte) {
+		if typ != btrfsDirItemKey || len(data) < btrfsDirItemSize { return }
+		n := int(binary.LittleEndian.Uint16(data[27:]))
+		if btrfsDirItemSize+n <= len(data) && string(data[btrfsDirItemSize:btrfsDirItemSize+n]) == "default" {
+			def = binary.LittleEndian.Uint64(data[0:])
+		}
+	})
+	if err != nil { return 0, fmt.Errorf("%s: %w", path, err) }
+	return def, nil
+}
+
+func (nativeBackend) FilesystemInfo(path string) (*FilesystemInfo, error) {
+	f, err := os.Open(path)
+	if err != nil { return nil, err }
+	defer f.Close()
+	fi := &btrfsFsInfoArgs{Flags: btrfsFsInfoFlagGen}
+	if err := btrfsIoctl(f, btrfsIocFsInfo, unsafe.Pointer(fi)); err != nil { return nil, fmt.Errorf("fs info %s: %w", path, err) }
+	info := &FilesystemInfo{UUID: formatUUID(fi.FSID[:]), NodeSize: fi.NodeSize, SectorSize: fi.SectorSize, Devices: []Device{}}
+	if fi.Flags&btrfsFsInfoFlagGen != 0 { info.Generation = fi.Generation }
+	var label [256]byte
+	if btrfsIoctl(f, btrfsIocGetFslabel, unsafe.Pointer(&label)) == nil { info.Label = cString(label[:]) }
+
+	// Device IDs have gaps where devices were removed.
+	for id := uint64(1); id <= fi.MaxID; id++ {
+		di := &btrfsDevInfoArgs{DevID: id}
+		if err := btrfsIoctl(f, btrfsIocDevInfo, unsafe.Pointer(di)); err != nil {
+			if errors.Is(err, syscall.ENODEV) { continue }
+			return nil, fmt.Errorf("dev info %s devid %d: %w", path, id, err)
+		}
+		d := Device{DevID: id, Path: cString(di.Path[:]), Size: di.TotalBytes, Used: di.BytesUsed}
+		if d.Path == "" { d.Path, d.Missing = "<missing disk>", true }
+		info.Devices = append(info.Devices, d)
+	}
+	return info, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Capabilities ---
+// The external tools are looked up, with their versions, at startup (and
+// with /api/capabilities?refresh=1). Features whose tool is missing or too
+// old answer 503 with what is missing instead of failing in the log with an
+// exec error, and commands of a missing tool are logged as unavailable.
+
+type ToolInfo struct {
+	Name      string `json:"name"`
+	Required  bool   `json:"required"`
+	Available bool   `json:"available"`
+	Path      string `json:"path,omitempty"`
+	Version   string `json:"version,omitempty"`
+}
+
+type Feature struct {
+	Available bool   `json:"available"`
+	Reason    string `json:"reason,omitempty"` // why not
+}
+
+// knownTools are probed in this order; versionArg is empty for tools
+// without a version option.
+var knownTools = []struct {
+	name       string
+	required   bool
+	versionArg string
+}{
+	{"btrfs", true, "--version"},
+	{"compsize", false, ""},
+	{"duperemove", false, "--version"},
+	{"fstrim", false, "--version"},
+	{"smartctl", false, "--version"},
+	{"age", false, "--version"},
+	{"gpg", false, "--version"},
+	{"journalctl", false, "--version"},
+}
+
+// features maps each feature to the tool it needs and the lowest version,
+// if that matters.
+var features = map[string]struct {
+	tool       string
+	minVersion string
+}{
+	"snapshots": {"btrfs", ""},
+	"scrub":     {"btrfs", ""},
+	"balance":   {"btrfs", ""},
+	"quotas":    {"btrfs", ""},
+	"usage":     {"btrfs", "3.18"}, // btrfs filesystem usage
+	"compsize":  {"compsize", ""},
+	"dedup":     {"duperemove", ""},
+	"trim":      {"fstrim", ""},
+	"smart":     {"smartctl", ""},
+}
+
+var capabilities = struct {
+	mu     sync.Mutex
+	tools  map[string]ToolInfo
+	probed time.Time
+}{}
+
+var versionPattern = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// probeTools looks up every known tool and logs the missing required ones.
+func probeTools() {
+	tools := map[string]ToolInfo{}
+	for _, t := range knownTools {
+		info := ToolInfo{Name: t.name, Required: t.required}
+		if path, err := exec.LookPath(t.name); err == nil {
+			info.Available, info.Path = true, path
+			if t.versionArg != "" {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				out, _ := exec.CommandContext(ctx, path, t.versionArg).CombinedOutput()
+				cancel()
+				info.Version = versionPattern.FindString(strings.SplitN(string(out), "\n", 2)[0])
+			}
+		} else if t.required {
+			logWarn("SYSTEM", "⚠️ %s is not installed; the features that need it are unavailable", t.name)
+		}
+		tools[t.name] = info
+	}
+	capabilities.mu.Lock()
+	capabilities.tools, capabilities.probed = tools, time.Now()
+	capabilities.mu.Unlock()
+}
+
+func toolInfo(name string) (ToolInfo, bool) {
+	capabilities.mu.Lock()
+	defer capabilities.mu.Unlock()
+	t, ok := capabilities.tools[name]
+	return t, ok
+}
+
+// toolMissing returns why a known tool can't be run, nil if it can or is
+// not one we probe.
+func toolMissing(name string) error {
+	if t, ok := toolInfo(name); ok && !t.Available { return fmt.Errorf("%s is not installed", name) }
+	return nil
+}
+
+// featureError returns why feature is unavailable, nil if it is available.
+func featureError(feature string) error {
+	f := features[feature]
+	if err := toolMissing(f.tool); err != nil { return err }
+	t, _ := toolInfo(f.tool)
+	if f.minVersion != "" && t.Version != "" && compareVersions(t.Version, f.minVersion) < 0 {
+		return fmt.Errorf("needs %s %s or newer, found %s", f.tool, f.minVersion, t.Version)
+	}
+	return nil
+}
+
+// requireFeature answers 503 and returns false when feature is unavailable.
+func requireFeature(w http.ResponseWriter, feature string) bool {
+	if err := featureError(feature); err != nil {
+		http.Error(w, fmt.Sprintf("Feature unavailable: %v", err), 503)
+		return false
+	}
+	return true
+}
+
+// compareVersions compares dotted version numbers like 6.6.3 and 3.18.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) { x, _ = strconv.Atoi(as[i]) }
+		if i < len(bs) { y, _ = strconv.Atoi(bs[i]) }
+		if x != y {
+			if x < y { return -1 }
+			return 1
+		}
+	}
+	return 0
+}
+
+// handleCapabilities returns the probed tools and which features are
+// available; ?refresh=1 probes again.
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("refresh") == "1" { probeTools() }
+	list := []ToolInfo{}
+	for _, t := range knownTools {
+		info, _ := toolInfo(t.name)
+		list = append(list, info)
+	}
+	feats := map[string]Feature{}
+	for name := range features {
+		if err := featureError(name); err != nil {
+			feats[name] = Feature{Reason: err.Error()}
+		} else {
+			feats[name] = Feature{Available: true}
+		}
+	}
+	capabilities.mu.Lock()
+	probed := capabilities.probed
+	capabilities.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"tools": list, "features": feats, "probed": probed.Format(time.RFC3339)})
+}
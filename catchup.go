@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// --- Missed-Run Catch-Up ---
+// The scheduler only fires while the server is running, so a job due while
+// it was down or the machine was suspended would wait for its next slot.
+// Every scheduled run is recorded in last_runs; with catch_up enabled, each
+// job whose next run after that was due more than grace_minutes ago runs
+// once on startup, or when the wall clock jumps ahead like it does after a
+// resume, and the history shows it as a CATCH-UP. Several missed runs fold
+// into one. Windows and blackouts apply as for any other run.
+
+type CatchUpConfig struct {
+	Enabled      bool `json:"enabled"`
+	GraceMinutes int  `json:"grace_minutes,omitempty"` // default 15
+}
+
+const (
+	defaultCatchUpGrace = 15 * time.Minute
+	// catchUpSlack absorbs the difference between the time a run is recorded
+	// and the time cron scheduled it.
+	catchUpSlack = 30 * time.Second
+	// resumeJump is how far the wall clock must get ahead of the watcher's
+	// ticks to count as a resume.
+	resumeJump = 2 * time.Minute
+)
+
+func (c CatchUpConfig) grace() time.Duration {
+	if c.GraceMinutes <= 0 { return defaultCatchUpGrace }
+	return time.Duration(c.GraceMinutes) * time.Minute
+}
+
+func (c CatchUpConfig) validate() error {
+	if c.GraceMinutes < 0 { return fmt.Errorf("catch_up: grace_minutes must not be negative") }
+	return nil
+}
+
+// recordLastRun notes that the scheduled job name ran at t. Caller must not
+// hold state.mu.
+func recordLastRun(name string, t time.Time) {
+	state.mu.Lock()
+	if state.LastRuns == nil { state.LastRuns = make(map[string]string) }
+	state.LastRuns[name] = t.UTC().Format(time.RFC3339)
+	state.mu.Unlock()
+	saveState()
+}
+
+// alreadyCaughtUp reports whether a fire of name is redundant because a
+// catch-up run since covers it: the run after the last one isn't due yet.
+// Cron fires late after a resume, as its timers don't count the suspended
+// time.
+func alreadyCaughtUp(name string, job scheduledJob, now time.Time) bool {
+	state.mu.Lock()
+	enabled := state.Config.CatchUp.Enabled
+	last, err := time.Parse(time.RFC3339, state.LastRuns[name])
+	state.mu.Unlock()
+	if !enabled || err != nil { return false }
+	sched, err := parseSchedule(job.Schedule)
+	if err != nil { return false }
+	return sched.Next(last).After(now.Add(catchUpSlack))
+}
+
+// catchUpMissedRuns runs each enabled scheduled job whose expected run was
+// missed by more than the grace period. Jobs without a recorded run start
+// counting from now.
+func catchUpMissedRuns(reason string) {
+	now := time.Now()
+	state.mu.Lock()
+	cfg := state.Config
+	if state.LastRuns == nil { state.LastRuns = make(map[string]string) }
+	jobs := scheduledJobs(cfg)
+	known := map[string]bool{}
+	var missed []scheduledJob
+	var due []time.Time
+	for _, job := range jobs {
+		known[job.Name] = true
+		if !job.Schedule.Enabled { continue }
+		sched, err := parseSchedule(job.Schedule)
+		if err != nil { continue }
+		last, err := time.Parse(time.RFC3339, state.LastRuns[job.Name])
+		if err != nil {
+			state.LastRuns[job.Name] = now.UTC().Format(time.RFC3339)
+			continue
+		}
+		if next := sched.Next(last); cfg.CatchUp.Enabled && next.Before(now.Add(-cfg.CatchUp.grace())) {
+			missed, due = append(missed, job), append(due, next)
+		}
+	}
+	for name := range state.LastRuns {
+		if !known[name] { delete(state.LastRuns, name) }
+	}
+	state.mu.Unlock()
+	saveState()
+
+	for i, job := range missed {
+		printDockerLog("SCHEDULER", "%s missed its run due %s (%s), catching up", job.Name, due[i].Format(time.RFC3339), reason)
+		logHistoryJob(job.Name, "CATCH-UP", "⏰", job.Name, "Success", fmt.Sprintf("Missed the run due %s (%s): running it now.", localTime(due[i]).Format(displayLayout), reason))
+		runWindowed(job.Name, "catch-up", job.Run)
+	}
+}
+
+// runResumeWatcher catches up when the wall clock gets well ahead of the
+// monotonic one, i.e. after a suspend (or a large clock correction).
+func runResumeWatcher() {
+	prev := time.Now()
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		jump := now.Round(0).Sub(prev.Round(0)) - now.Sub(prev)
+		prev = now
+		if jump < resumeJump || shuttingDown() { continue }
+		printDockerLog("SCHEDULER", "Wall clock jumped %s ahead, checking for missed runs", jump.Round(time.Second))
+		catchUpMissedRuns("resumed from suspend")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// --- Btrfs Check ---
+// `btrfs check --readonly` looks at the metadata (and with
+// --check-data-csum at every data checksum) without changing anything, for
+// a deeper opinion than a scrub gives. It is meant for unmounted devices: on
+// a mounted filesystem it needs --force and can report errors that are only
+// changes in flight. It reads the whole device and can take hours, so like
+// the device operations it goes through the plan / token / typed device
+// confirmation.
+
+type CheckRequest struct {
+	Device   string `json:"device"`    // block device of the filesystem, e.g. /dev/sdb
+	DataCsum bool   `json:"data_csum"` // also verify data checksums (--check-data-csum)
+	Token    string `json:"token"`
+	Confirm  string `json:"confirm"` // must repeat the device
+}
+
+type CheckResult struct {
+	Clean          bool     `json:"clean"` // "no error found"
+	BytesUsed      uint64   `json:"bytes_used,omitempty"`
+	ErrorCount     int      `json:"error_count"`      // ERROR: lines
+	Errors         []string `json:"errors,omitempty"` // the first maxCheckErrors of them
+	CsumMismatches int      `json:"csum_mismatches,omitempty"` // data blocks failing --check-data-csum
+}
+
+const maxCheckErrors = 50
+
+var (
+	checkFoundPattern = regexp.MustCompile(`^found (\d+) bytes used, (no error found|error\(s\) found)`)
+	checkCsumPattern  = regexp.MustCompile(`^mirror \d+ bytenr \d+ csum `)
+)
+
+// parseCheck reads the output of `btrfs check`, which ends in
+//
+//	found 1114112 bytes used, no error found
+//
+// or "error(s) found", after ERROR: lines for what it ran into.
+func parseCheck(out string) *CheckResult {
+	r := &CheckResult{}
+	summary := false
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "ERROR:"):
+			r.ErrorCount++
+			if len(r.Errors) < maxCheckErrors { r.Errors = append(r.Errors, strings.TrimSpace(strings.TrimPrefix(line, "ERROR:"))) }
+		case checkCsumPattern.MatchString(line):
+			r.CsumMismatches++
+		}
+		if m := checkFoundPattern.FindStringSubmatch(line); m != nil {
+			summary = true
+			r.BytesUsed, _ = strconv.ParseUint(m[1], 10, 64)
+			r.Clean = m[2] == "no error found"
+		}
+	}
+	if !summary && r.ErrorCount == 0 { return nil }
+	if r.ErrorCount > 0 || r.CsumMismatches > 0 { r.Clean = false }
+	return r
+}
+
+var checkDataCsum = struct {
+	once      sync.Once
+	supported bool
+}{}
+
+// dataCsumSupported reports whether the installed btrfs-progs know
+// --check-data-csum.
+func dataCsumSupported() bool {
+	checkDataCsum.once.Do(func() {
+		out, _ := exec.Command("btrfs", "check", "--help").CombinedOutput()
+		checkDataCsum.supported = strings.Contains(string(out), "--check-data-csum")
+	})
+	return checkDataCsum.supported
+}
+
+// deviceMount returns a mount point of the filesystem device belongs to, or
+// "" when it isn't mounted.
+func deviceMount(device string) string {
+	list, err := discoverFilesystems()
+	if err != nil { return "" }
+	real, _ := filepath.EvalSymlinks(device)
+	for _, fs := range list {
+		for _, d := range fs.Devices {
+			dr, _ := filepath.EvalSymlinks(d.Path)
+			if len(fs.Mounts) > 0 && (d.Path == device || (real != "" && dr == real)) { return fs.Mounts[0].Path }
+		}
+	}
+	return ""
+}
+
+func checkArgs(device, mount string, dataCsum bool) []string {
+	args := []string{"check", "--readonly"}
+	if mount != "" { args = append(args, "--force") }
+	if dataCsum { args = append(args, "--check-data-csum") }
+	return append(args, device)
+}
+
+// --- Handlers ---
+
+func handleCheck(w http.ResponseWriter, r *http.Request) {
+	var req CheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), 400)
+		return
+	}
+	if !filepath.IsAbs(req.Device) {
+		http.Error(w, "device must be an absolute path, e.g. /dev/sdb", 400)
+		return
+	}
+	device := filepath.Clean(req.Device)
+	if fi, err := os.Stat(device); err != nil || fi.Mode()&os.ModeDevice == 0 {
+		http.Error(w, device+" is not a block device", 400)
+		return
+	}
+	if req.DataCsum && !dataCsumSupported() {
+		http.Error(w, "the installed btrfs-progs don't support --check-data-csum", 400)
+		return
+	}
+
+	mount := deviceMount(device)
+	args := checkArgs(device, mount, req.DataCsum)
+	warnings := []string{"reads all metadata of the filesystem, which can take a long time on large ones; nothing is written"}
+	if req.DataCsum { warnings = append(warnings, "--check-data-csum also reads every data block, like a scrub without repairs") }
+	if mount != "" { warnings = append(warnings, fmt.Sprintf("the filesystem is mounted at %s: with --force, changes made while it runs can show up as errors; unmount it for a reliable result", mount)) }
+	action := "check"
+	if req.DataCsum { action = "check-data-csum" }
+	if !confirmDeviceOp(w, DeviceRequest{Token: req.Token, Confirm: req.Confirm}, action, device, []string{formatCommand("btrfs", args...)}, warnings) { return }
+
+	visualPath := device
+	if req.DataCsum { visualPath += " [data csum]" }
+	if mount != "" { visualPath += " (mounted)" }
+	id := runCommandAsync("BTRFS CHECK", "🩻", visualPath, "btrfs", args...)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
+}
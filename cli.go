@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// --- Command Line ---
+// `btrfs-webui <command> <action>` runs one operation and exits, for
+// scripts and timers. It asks the running server through the API at --url
+// ($BTRFS_WEBUI_URL, default the address the server listens on), with
+// --key ($BTRFS_WEBUI_KEY) once access control is on. With --standalone it
+// does the work itself against the same state directory and config, for
+// when the server isn't running; it refuses to change anything while the
+// server answers, as both would write the state.
+//
+//	btrfs-webui snapshot run [--job ID]
+//	btrfs-webui retention apply [--job ID] [--dry-run] [--break-chains]
+//	btrfs-webui history list [--limit N] [--type T] [--status S] [--json]
+
+type cliCommand struct {
+	Usage string
+	Run   func(c *cliClient, args []string) error
+}
+
+var cliCommands = map[string]map[string]cliCommand{
+	"snapshot": {
+		"run": {"[--job ID] [--wait=false]: take a snapshot of a job, or of all jobs", cliSnapshotRun},
+	},
+	"retention": {
+		"apply": {"[--job ID] [--dry-run] [--break-chains]: delete the snapshots retention no longer keeps", cliRetentionApply},
+	},
+	"history": {
+		"list": {"[--limit N] [--type T] [--status S] [--since T] [--json]: the activity log, newest first", cliHistoryList},
+	},
+}
+
+// cliTimeout bounds waiting for the server to finish what it was asked.
+const cliTimeout = 6 * time.Hour
+
+type cliClient struct {
+	flags      *flag.FlagSet
+	url        string
+	key        string
+	standalone bool
+	stateDir   string
+	config     string
+	wait       bool
+	http       *http.Client
+}
+
+// isCLI reports whether the arguments name a command rather than server
+// flags.
+func isCLI(args []string) bool { return len(args) > 0 && cliCommands[args[0]] != nil }
+
+// runCLI runs the command in args and returns the exit status.
+func runCLI(args []string) int {
+	actions := cliCommands[args[0]]
+	if len(args) < 2 || actions[args[1]].Run == nil {
+		cliUsage(os.Stderr)
+		return 2
+	}
+	cmd := actions[args[1]]
+	c := &cliClient{flags: flag.NewFlagSet(args[0]+" "+args[1], flag.ContinueOnError)}
+	c.flags.StringVar(&c.url, "url", os.Getenv("BTRFS_WEBUI_URL"), "URL of the running server, or unix:/path/to.sock ($BTRFS_WEBUI_URL)")
+	c.flags.StringVar(&c.key, "key", os.Getenv("BTRFS_WEBUI_KEY"), "access key, when access control is on ($BTRFS_WEBUI_KEY)")
+	c.flags.BoolVar(&c.standalone, "standalone", false, "run in this process instead of asking the server")
+	c.flags.StringVar(&c.stateDir, "state-dir", "", "with --standalone: the server's state directory")
+	c.flags.StringVar(&c.config, "config", "", "with --standalone: the server's --config file")
+	c.flags.Usage = func() { fmt.Fprintf(os.Stderr, "usage: btrfs-webui %s %s %s\n", args[0], args[1], cmd.Usage); c.flags.PrintDefaults() }
+	if err := cmd.Run(c, args[2:]); err != nil {
+		if err != flag.ErrHelp { fmt.Fprintf(os.Stderr, "btrfs-webui: %v\n", err) }
+		return 1
+	}
+	return 0
+}
+
+func cliUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: btrfs-webui [server flags]\n       btrfs-webui <command> <action> [flags]\n\ncommands:")
+	var names []string
+	for name := range cliCommands { names = append(names, name) }
+	sort.Strings(names)
+	for _, name := range names {
+		for action, cmd := range cliCommands[name] { fmt.Fprintf(w, "  %s %s %s\n", name, action, cmd.Usage) }
+	}
+	fmt.Fprintln(w, "\nRun an action with -h for its flags.")
+}
+
+func (c *cliClient) parse(args []string) error {
+	if err := c.flags.Parse(args); err != nil { return err }
+	if c.flags.NArg() > 0 { return fmt.Errorf("unexpected argument %q", c.flags.Arg(0)) }
+	base := c.url
+	if base == "" { base = listenAddress("") }
+	c.http = &http.Client{Timeout: time.Minute}
+	if path, ok := strings.CutPrefix(base, "unix:"); ok {
+		c.http.Transport = &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		}}
+		base = "http://localhost"
+	} else if !strings.Contains(base, "://") {
+		host, port, _ := net.SplitHostPort(base)
+		if host == "" || host == "0.0.0.0" || host == "::" { host = "127.0.0.1" }
+		base = "http://" + net.JoinHostPort(host, port)
+	}
+	c.url = strings.TrimRight(base, "/")
+	return nil
+}
+
+// call sends a request to /api/v1 and decodes the JSON answer into out.
+func (c *cliClient) call(method, path string, q url.Values, out interface{}) error {
+	u := c.url + "/api/v1" + path
+	if len(q) > 0 { u += "?" + q.Encode() }
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil { return err }
+	if c.key != "" { req.Header.Set("Authorization", "Bearer "+c.key) }
+	res, err := c.http.Do(req)
+	if err != nil { return fmt.Errorf("cannot reach the server at %s (%v); run with --standalone to work without it", c.url, err) }
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != 200 { return fmt.Errorf("%s %s: %s: %s", method, path, res.Status, strings.TrimSpace(string(body))) }
+	if out == nil { return nil }
+	return json.Unmarshal(body, out)
+}
+
+// serverUp reports whether anything answers at the server URL.
+func (c *cliClient) serverUp() bool {
+	res, err := c.http.Get(c.url + "/api/v1/openapi.json")
+	if err != nil { return false }
+	res.Body.Close()
+	return true
+}
+
+// openLocal loads the state for --standalone. Commands that change
+// something must call closeLocal to write it back.
+func (c *cliClient) openLocal(write bool) error {
+	if write && c.serverUp() { return fmt.Errorf("the server at %s is running; leave out --standalone so it does the work", c.url) }
+	configFile = c.config
+	dir := c.stateDir
+	if dir == "" { dir = os.Getenv("STATE_DIR") }
+	if dir == "" { dir = defaultStateDir() }
+	// Keep stdout for the command's own output.
+	logOutput = os.Stderr
+	if err := setStateDir(dir); err != nil { return err }
+	loadState()
+	return nil
+}
+
+func closeLocal() {
+	stopPersistence()
+	store.Close()
+}
+
+// waitForEntries polls the server's log for n entries of type since start.
+func (c *cliClient) waitForEntries(typ string, since time.Time, n int) ([]LogEntry, error) {
+	// The log filters by the second.
+	q := url.Values{"type": {typ}, "since": {since.Add(-time.Second).UTC().Format(time.RFC3339)}}
+	for deadline := time.Now().Add(cliTimeout); time.Now().Before(deadline); time.Sleep(time.Second) {
+		var entries []LogEntry
+		if err := c.call("GET", "/history", q, &entries); err != nil { return nil, err }
+		var done []LogEntry
+		for _, e := range entries {
+			if !entryTime(e).Before(since) && !strings.HasSuffix(e.Status, "...") { done = append(done, e) }
+		}
+		if len(done) >= n { return done, nil }
+	}
+	return nil, fmt.Errorf("gave up waiting for %s after %s", typ, cliTimeout)
+}
+
+// localEntries returns the finished entries of typ logged since start, oldest
+// first.
+func localEntries(typ string, since time.Time) []LogEntry {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	var list []LogEntry
+	for i := len(state.History) - 1; i >= 0; i-- {
+		if e := state.History[i]; e.Type == typ && !entryTime(e).Before(since) { list = append(list, e) }
+	}
+	return list
+}
+
+// printEntries writes a table of entries and fails if one of them failed.
+func printEntries(entries []LogEntry) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	failed := 0
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", entryTime(e).Local().Format("2006-01-02 15:04:05"), e.Status, e.Type, e.Path)
+		if e.Status == "Failed" { failed++ }
+	}
+	tw.Flush()
+	if failed > 0 { return fmt.Errorf("%d of %d failed", failed, len(entries)) }
+	return nil
+}
+
+// cliJobs returns the jobs selected by id (all of them when empty) from the
+// loaded config.
+func cliJobs(id string) ([]SnapshotJob, error) {
+	if id != "" {
+		job, err := findSnapshotJob(id)
+		if err != nil { return nil, err }
+		return []SnapshotJob{job}, nil
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return append([]SnapshotJob(nil), state.Config.SnapshotJobs...), nil
+}
+
+// --- Commands ---
+
+func cliSnapshotRun(c *cliClient, args []string) error {
+	job := c.flags.String("job", "", "snapshot job ID (default: all jobs)")
+	c.flags.BoolVar(&c.wait, "wait", true, "wait for the snapshots and fail if one failed")
+	if err := c.parse(args); err != nil { return err }
+	start := time.Now()
+
+	if c.standalone {
+		if err := c.openLocal(true); err != nil { return err }
+		defer closeLocal()
+		jobs, err := cliJobs(*job)
+		if err != nil { return err }
+		for _, j := range jobs {
+			run := newJobRun("snapshot:"+j.ID, "manual")
+			performSnapshot(j, run)
+			run.finish()
+		}
+		return printEntries(localEntries("SNAPSHOT", start))
+	}
+
+	var jobs []SnapshotJob
+	if *job != "" {
+		var j SnapshotJob
+		if err := c.call("GET", "/snapshot-jobs/"+url.PathEscape(*job), nil, &j); err != nil { return err }
+		jobs = []SnapshotJob{j}
+	} else if err := c.call("GET", "/snapshot-jobs", nil, &jobs); err != nil {
+		return err
+	}
+	q := url.Values{}
+	if *job != "" { q.Set("job", *job) }
+	if err := c.call("POST", "/snapshots", q, nil); err != nil { return err }
+	n := 0
+	for _, j := range jobs {
+		// Jobs without a source or destination do nothing.
+		if j.Source != "" && j.Dest != "" { n++ }
+	}
+	if !c.wait || n == 0 {
+		fmt.Printf("Started %d snapshot(s)\n", n)
+		return nil
+	}
+	entries, err := c.waitForEntries("SNAPSHOT", start, n)
+	if err != nil { return err }
+	return printEntries(entries)
+}
+
+func cliRetentionApply(c *cliClient, args []string) error {
+	job := c.flags.String("job", "", "snapshot job ID (default: all jobs)")
+	dryRun := c.flags.Bool("dry-run", false, "only list what would be deleted")
+	breakChains := c.flags.Bool("break-chains", false, "also delete snapshots the next incremental send needs as its parent")
+	c.flags.BoolVar(&c.wait, "wait", true, "wait for the deletions and fail if one failed")
+	if err := c.parse(args); err != nil { return err }
+	start := time.Now()
+
+	var plan []PlannedDelete
+	var warnings []string
+	var token string
+	if c.standalone {
+		if err := c.openLocal(!*dryRun); err != nil { return err }
+		if !*dryRun { defer closeLocal() }
+		jobs, err := cliJobs(*job)
+		if err != nil { return err }
+		byJob := map[string][]PlannedDelete{}
+		for _, j := range jobs {
+			p, err := planRetention(j, start)
+			if err != nil { return fmt.Errorf("job %s: %v", j.ID, err) }
+			p, _, warn := holdSendParents(p, *breakChains)
+			warnings = append(warnings, warn...)
+			plan = append(plan, p...)
+			byJob[j.ID] = p
+		}
+		annotateSizes(plan)
+		printPlan(plan, warnings)
+		if *dryRun || len(plan) == 0 { return nil }
+		for _, j := range jobs {
+			if len(byJob[j.ID]) == 0 { continue }
+			applyRetentionPlan(j, byJob[j.ID], nil)
+			refreshBootMenu(j)
+		}
+		return printEntries(localEntries("RETENTION", start))
+	}
+
+	q := url.Values{"dry_run": {"true"}}
+	if *job != "" { q.Set("job", *job) }
+	if *breakChains { q.Set("break_chains", "true") }
+	var res struct {
+		Token    string          `json:"token"`
+		Deletes  []PlannedDelete `json:"deletes"`
+		Warnings []string        `json:"warnings"`
+	}
+	if err := c.call("POST", "/snapshots/retention", q, &res); err != nil { return err }
+	plan, token = res.Deletes, res.Token
+	printPlan(plan, res.Warnings)
+	if *dryRun || len(plan) == 0 { return nil }
+	q.Del("dry_run")
+	q.Set("token", token)
+	if err := c.call("POST", "/snapshots/retention", q, nil); err != nil { return err }
+	if !c.wait { return nil }
+	jobs := map[string]bool{}
+	for _, p := range plan { jobs[p.Job] = true }
+	entries, err := c.waitForEntries("RETENTION", start, len(jobs))
+	if err != nil { return err }
+	return printEntries(entries)
+}
+
+func printPlan(plan []PlannedDelete, warnings []string) {
+	for _, w := range warnings { fmt.Println("⚠️ " + w) }
+	if len(plan) == 0 {
+		fmt.Println("Nothing to delete")
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, p := range plan {
+		size := ""
+		if p.ExclusiveBytes != nil { size = formatBytes(*p.ExclusiveBytes) }
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", p.Job, p.Name, size)
+	}
+	tw.Flush()
+	sum := summarizePlan(plan)
+	if sum.FreesBytes != nil {
+		fmt.Printf("%d snapshot(s), freeing %s\n", sum.Snapshots, formatBytes(*sum.FreesBytes))
+	} else {
+		fmt.Printf("%d snapshot(s)\n", sum.Snapshots)
+	}
+}
+
+func cliHistoryList(c *cliClient, args []string) error {
+	limit := c.flags.Int("limit", 20, "entries to show, 0 for all")
+	typ := c.flags.String("type", "", "only these types, comma-separated")
+	status := c.flags.String("status", "", "only these statuses, comma-separated, e.g. failed,warning")
+	since := c.flags.String("since", "", "only entries since, RFC 3339 or YYYY-MM-DD")
+	asJSON := c.flags.Bool("json", false, "print the entries as JSON")
+	if err := c.parse(args); err != nil { return err }
+
+	q := url.Values{}
+	if *typ != "" { q.Set("type", *typ) }
+	if *status != "" { q.Set("status", *status) }
+	if *since != "" { q.Set("since", *since) }
+	var entries []LogEntry
+	if c.standalone {
+		// Reading is safe next to the server.
+		if err := c.openLocal(false); err != nil { return err }
+		f, err := parseHistoryFilter(q)
+		if err != nil { return err }
+		entries = filterHistory(f)
+		if *limit > 0 && len(entries) > *limit { entries = entries[:*limit] }
+	} else {
+		if *limit > 0 { q.Set("limit", strconv.Itoa(*limit)) }
+		if err := c.call("GET", "/history", q, &entries); err != nil { return err }
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", entryTime(e).Local().Format("2006-01-02 15:04:05"), e.Status, e.Type, e.Duration, e.Path)
+	}
+	return tw.Flush()
+}
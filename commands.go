@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// --- Command Timeouts & Kill ---
+// Commands run in their own process group with a timeout per operation
+// type, so a hung compsize or a command stuck on an unresponsive mount ends
+// up in the log instead of staying "Running..." forever. They can also be
+// killed from the UI. Either way the group gets SIGTERM, then SIGKILL after
+// killGrace, and the log entry records why.
+
+// CommandTimeout limits how long commands of one operation type (the log
+// entry type, e.g. COMPSIZE or SCRUB START) may run. Operation "*" applies
+// to all others; 0 minutes means no limit.
+type CommandTimeout struct {
+	Operation string `json:"operation"`
+	Minutes   int    `json:"minutes"`
+}
+
+// defaultCommandTimeouts cover the quick reports. Scrubs, balances and the
+// like can legitimately run for days and have no limit unless configured.
+var defaultCommandTimeouts = map[string]int{
+	"USAGE":         10,
+	"SUBVOL LIST":   10,
+	"SCRUB CHECK":   5,
+	"BALANCE CHECK": 5,
+	"COMPSIZE":      240,
+	"BOOT MENU":     5,
+	"SNAPSHOT HOOK": 10,
+}
+
+const killGrace = 10 * time.Second
+
+// commandTermination is the cancel cause of a command ended by a timeout or
+// a kill request.
+type commandTermination struct {
+	Kind    string // timeout or killed
+	Status  string
+	Message string
+}
+
+func (t commandTermination) Error() string { return t.Message }
+
+func validateCommandTimeouts(timeouts []CommandTimeout) error {
+	seen := map[string]bool{}
+	for _, t := range timeouts {
+		if t.Operation == "" || seen[t.Operation] { return fmt.Errorf("command timeouts need unique, non-empty operations") }
+		seen[t.Operation] = true
+		if t.Minutes < 0 { return fmt.Errorf("command timeout for %s must not be negative", t.Operation) }
+	}
+	return nil
+}
+
+func commandTimeout(opType string) time.Duration {
+	state.mu.Lock()
+	timeouts := state.Config.CommandTimeouts
+	state.mu.Unlock()
+	minutes, fallback := defaultCommandTimeouts[opType], -1
+	for _, t := range timeouts {
+		if t.Operation == opType { return time.Duration(t.Minutes) * time.Minute }
+		if t.Operation == "*" { fallback = t.Minutes }
+	}
+	if minutes == 0 && fallback > 0 { minutes = fallback }
+	return time.Duration(minutes) * time.Minute
+}
+
+// newManagedCommand returns a command bound to ctx that, once ctx is done,
+// terminates its whole process group. exited must be closed when the
+// command has returned.
+func newManagedCommand(ctx context.Context, exited <-chan struct{}, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		syscall.Kill(-pgid, syscall.SIGTERM)
+		go func() {
+			select {
+			case <-exited:
+			case <-time.After(killGrace):
+				syscall.Kill(-pgid, syscall.SIGKILL)
+			}
+		}()
+		return nil
+	}
+	// Children that keep the output pipe open must not block Wait forever.
+	cmd.WaitDelay = killGrace + 5*time.Second
+	return cmd
+}
+
+// commandContext applies the timeout of opType; cancel ends the command
+// early with a commandTermination as the cause.
+func commandContext(opType string) (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	if d := commandTimeout(opType); d > 0 {
+		var stop context.CancelFunc
+		ctx, stop = context.WithTimeoutCause(ctx, d, commandTermination{Kind: "timeout", Status: "Failed", Message: fmt.Sprintf("⏱️ Timed out after %s: terminated.", d)})
+		return ctx, func(cause error) {
+			cancel(cause)
+			stop()
+		}
+	}
+	return ctx, cancel
+}
+
+// runWithTimeout runs a command that has no log entry of its own under the
+// timeout of opType and returns its combined output.
+func runWithTimeout(opType, name string, args ...string) (string, error) {
+	ctx, cancel := commandContext(opType)
+	defer cancel(nil)
+	exited := make(chan struct{})
+	defer close(exited)
+	cmd := newManagedCommand(ctx, exited, name, args...)
+	_, release := prioritize(cmd, opType)
+	defer release()
+	out, err := cmd.CombinedOutput()
+	if t, ok := terminationOf(ctx); ok { return string(out), t }
+	return string(out), err
+}
+
+// terminationOf returns why ctx ended a command, if it did.
+func terminationOf(ctx context.Context) (commandTermination, bool) {
+	t, ok := context.Cause(ctx).(commandTermination)
+	return t, ok
+}
+
+// handleKillCommand terminates the running command of a log entry.
+func handleKillCommand(w http.ResponseWriter, r *http.Request) {
+	// Entry IDs are nanosecond timestamps, more digits than a JavaScript
+	// number holds, so the UI sends a rounded one; match it the same way.
+	n, err := strconv.ParseFloat(r.PathValue("id"), 64)
+	if err != nil {
+		http.Error(w, "Invalid id", 400)
+		return
+	}
+	msg := "🛑 Killed on request."
+	if u := requestUser(r); u.Name != "" { msg = fmt.Sprintf("🛑 Killed on request by %s.", u.Name) }
+	cause := commandTermination{Kind: "killed", Status: "Warning", Message: msg}
+
+	var id int64
+	var c runningCommand
+	runningCommands.mu.Lock()
+	for i, rc := range runningCommands.cmds {
+		if float64(i) == n { id, c = i, rc }
+	}
+	runningCommands.mu.Unlock()
+	if c.cancel == nil {
+		http.Error(w, "No running command with that id", 404)
+		return
+	}
+	printDockerLog("SYSTEM", "Killing %s %v (log entry %d)", c.Name, c.Args, id)
+	c.cancel(cause)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "killing", "id": id})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// --- Compression ---
+
+// defragCompressions maps the compress parameter of the defrag action to the
+// btrfs option that recompresses while defragmenting.
+var defragCompressions = map[string]string{"zstd": "-czstd", "zlib": "-czlib", "lzo": "-clzo"}
+
+// compressionValues are accepted by `btrfs property set ... compression`;
+// "none" disables compression and "" falls back to the mount option.
+var compressionValues = map[string]bool{"zstd": true, "zlib": true, "lzo": true, "none": true, "": true}
+
+// targetPathFromRequest returns ?path= (which must be absolute) or the target
+// drive.
+func targetPathFromRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	path := fsPathFromRequest(r)
+	if path == "" {
+		http.Error(w, "Target drive not set", 400)
+		return "", false
+	}
+	if !filepath.IsAbs(path) {
+		http.Error(w, "absolute path required", 400)
+		return "", false
+	}
+	return filepath.Clean(path), true
+}
+
+// DefragRequest is the body of the defrag action. Clients without a body
+// pass the same fields as query parameters.
+type DefragRequest struct {
+	Path         string `json:"path"`          // default: the target drive
+	Recursive    *bool  `json:"recursive"`     // default true
+	TargetExtent string `json:"target_extent"` // -t, e.g. 32M
+	Compress     string `json:"compress"`      // zstd, zlib, lzo
+	// AllowSnapshots permits paths inside a snapshot destination, which
+	// unshares their extents with every other snapshot.
+	AllowSnapshots bool `json:"allow_snapshots"`
+	// Token confirms a recursive defrag, see handleActionDefrag.
+	Token string `json:"token"`
+}
+
+// DefragImpact is shown before a recursive defrag is confirmed.
+type DefragImpact struct {
+	Path      string `json:"path"`
+	Recursive bool   `json:"recursive"`
+	// UpToBytes is the most defragmenting may rewrite: the size of a file,
+	// or the space used on the filesystem of a directory.
+	UpToBytes uint64 `json:"up_to_bytes"`
+	// Snapshots are the snapshots of jobs whose source overlaps the path;
+	// defragmenting unshares their extents, which can take up to as much
+	// space again.
+	Snapshots int `json:"snapshots"`
+}
+
+var extentSizePattern = regexp.MustCompile(`^[0-9]+[KMG]?$`)
+
+func (d DefragRequest) recursive() bool { return d.Recursive == nil || *d.Recursive }
+
+// target identifies the request for confirmation tokens.
+func (d DefragRequest) target() string {
+	return fmt.Sprintf("%s|%t|%s|%s|%t", d.Path, d.recursive(), d.Compress, d.TargetExtent, d.AllowSnapshots)
+}
+
+func (d DefragRequest) validate() error {
+	if !filepath.IsAbs(d.Path) { return fmt.Errorf("absolute path required") }
+	if _, ok := defragCompressions[d.Compress]; d.Compress != "" && !ok { return fmt.Errorf("compress must be zstd, zlib or lzo") }
+	if d.TargetExtent != "" && !extentSizePattern.MatchString(d.TargetExtent) {
+		return fmt.Errorf("target_extent must be a size like 256K, 32M or 1G")
+	}
+	return nil
+}
+
+// snapshotDestination returns the job whose snapshot destination contains
+// path, if any.
+func snapshotDestination(path string) (SnapshotJob, bool) {
+	state.mu.Lock()
+	jobs := append([]SnapshotJob(nil), state.Config.SnapshotJobs...)
+	if state.Config.StateBackup.Enabled { jobs = append(jobs, stateBackupJob(state.Config.StateBackup)) }
+	state.mu.Unlock()
+	for _, j := range jobs {
+		if j.Dest != "" && (filepath.Clean(j.Dest) == path || pathBelow(j.Dest, path)) { return j, true }
+	}
+	return SnapshotJob{}, false
+}
+
+func defragImpact(d DefragRequest) DefragImpact {
+	impact := DefragImpact{Path: d.Path, Recursive: d.recursive()}
+	if fi, err := os.Stat(d.Path); err == nil && !fi.IsDir() {
+		impact.UpToBytes = uint64(fi.Size())
+	} else {
+		var st syscall.Statfs_t
+		if syscall.Statfs(d.Path, &st) == nil { impact.UpToBytes = (st.Blocks - st.Bfree) * uint64(st.Bsize) }
+	}
+	state.mu.Lock()
+	jobs := append([]SnapshotJob(nil), state.Config.SnapshotJobs...)
+	state.mu.Unlock()
+	for _, j := range jobs {
+		src := filepath.Clean(j.Source)
+		if j.Source == "" || (src != d.Path && !pathBelow(src, d.Path) && !pathBelow(d.Path, src)) { continue }
+		if snaps, err := listManagedSnapshots(j); err == nil { impact.Snapshots += len(snaps) }
+	}
+	return impact
+}
+
+func defragArgs(d DefragRequest) []string {
+	args := []string{"filesystem", "defragment"}
+	if d.recursive() { args = append(args, "-r") }
+	if c := defragCompressions[d.Compress]; c != "" { args = append(args, c) }
+	if d.TargetExtent != "" { args = append(args, "-t", d.TargetExtent) }
+	return append(args, d.Path)
+}
+
+// getCompression parses `btrfs property get <path> compression`, which prints
+// "compression=zstd" or nothing when the property is unset.
+func getCompression(path string) (string, error) {
+	out, err := exec.Command("btrfs", "property", "get", path, "compression").CombinedOutput()
+	if err != nil { return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out))) }
+	v, _ := strings.CutPrefix(strings.TrimSpace(string(out)), "compression=")
+	return v, nil
+}
+
+// --- Handlers ---
+
+func handleGetCompression(w http.ResponseWriter, r *http.Request) {
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	value, err := getCompression(path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"path": path, "compression": value})
+}
+
+func handleSetCompression(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path        string `json:"path"`
+		Compression string `json:"compression"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), 400)
+		return
+	}
+	req.Compression = strings.ToLower(strings.TrimSpace(req.Compression))
+	if !filepath.IsAbs(req.Path) || !compressionValues[req.Compression] {
+		http.Error(w, "absolute path and compression (zstd, zlib, lzo, none or empty to reset) required", 400)
+		return
+	}
+	path := filepath.Clean(req.Path)
+
+	out, err := exec.Command("btrfs", "property", "set", path, "compression", req.Compression).CombinedOutput()
+	shown := req.Compression
+	if shown == "" { shown = "(reset)" }
+	visualPath := fmt.Sprintf("%s ➡️ %s", path, shown)
+	if err != nil {
+		logHistory("COMPRESSION", "🗜️", visualPath, "Failed", string(out)+"\nError: "+err.Error())
+		http.Error(w, strings.TrimSpace(string(out)), 500)
+		return
+	}
+	logHistory("COMPRESSION", "🗜️", visualPath, "Success", string(out))
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "path": path, "compression": req.Compression})
+}
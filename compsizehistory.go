@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Compression History ---
+// Every compsize run, on compsize_sched or started by hand, records its
+// totals per compression type in the metrics store as
+// compsize_<type>_disk_bytes and compsize_<type>_uncompressed_bytes (type
+// "total" for the sum), so the ratio can be followed over time, e.g. after
+// switching a subvolume to zstd.
+
+type CompressionUsage struct {
+	DiskUsage    uint64  `json:"disk_usage"`
+	Uncompressed uint64  `json:"uncompressed"`
+	Ratio        float64 `json:"ratio"` // disk usage / uncompressed
+}
+
+type CompressionPoint struct {
+	Time  time.Time                   `json:"time"`
+	Types map[string]CompressionUsage `json:"types"` // total, none, zstd, zlib, lzo, prealloc
+}
+
+type CompressionHistory struct {
+	Path   string             `json:"path"`
+	Range  string             `json:"range"`
+	Points []CompressionPoint `json:"points"`
+}
+
+func compsizePaths(cfg Config) []string {
+	var paths []string
+	for _, p := range cfg.CompsizePaths { paths = append(paths, filepath.Clean(p)) }
+	if len(paths) == 0 && cfg.TargetDrive != "" { paths = []string{filepath.Clean(cfg.TargetDrive)} }
+	return paths
+}
+
+// runCompsize runs compsize on path as a log entry; done is closed once the
+// result is recorded.
+func runCompsize(opType, path string) (int64, <-chan struct{}) {
+	id, finished := startCommand(opType, "📊", path, "compsize", path)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-finished
+		var result *CompsizeResult
+		at := time.Unix(0, id)
+		state.mu.Lock()
+		for _, e := range state.History {
+			if e.ID == id && e.Status == "Success" && e.Result != nil { result = e.Result.Compsize }
+		}
+		state.mu.Unlock()
+		if result != nil { recordCompsize(path, at, result) }
+	}()
+	return id, done
+}
+
+func recordCompsize(path string, at time.Time, r *CompsizeResult) {
+	samples := []MetricSample{
+		{Name: "compsize_total_disk_bytes", Target: path, Time: at, Value: float64(r.DiskUsage)},
+		{Name: "compsize_total_uncompressed_bytes", Target: path, Time: at, Value: float64(r.Uncompressed)},
+	}
+	for _, t := range r.Types {
+		samples = append(samples,
+			MetricSample{Name: "compsize_" + t.Type + "_disk_bytes", Target: path, Time: at, Value: float64(t.DiskUsage)},
+			MetricSample{Name: "compsize_" + t.Type + "_uncompressed_bytes", Target: path, Time: at, Value: float64(t.Uncompressed)})
+	}
+	recordMetrics(samples...)
+}
+
+// runScheduledCompsize analyses the compsize paths one after the other.
+func runScheduledCompsize(run *JobRun) {
+	state.mu.Lock()
+	cfg := state.Config
+	state.mu.Unlock()
+	for _, p := range compsizePaths(cfg) {
+		if shuttingDown() { return }
+		id, done := runCompsize("AUTO COMPSIZE", p)
+		run.tag(id)
+		<-done
+	}
+}
+
+func previewCompsize(cfg Config) ([]PlannedOp, []string) {
+	paths := compsizePaths(cfg)
+	if len(paths) == 0 { return nil, []string{"target drive not set: job will do nothing"} }
+	var warnings []string
+	if _, err := exec.LookPath("compsize"); err != nil { warnings = append(warnings, "compsize is not installed") }
+	var ops []PlannedOp
+	for _, p := range paths {
+		if _, err := os.Stat(p); err != nil { warnings = append(warnings, "compsize path not accessible: "+err.Error()) }
+		ops = append(ops, PlannedOp{Description: "Record the compression of " + p, Command: formatCommand("compsize", p)})
+	}
+	return ops, warnings
+}
+
+// compressionHistory groups the compsize samples of path since by run,
+// oldest first.
+func compressionHistory(path string, since time.Time) ([]CompressionPoint, error) {
+	samples, err := store.QueryMetrics("", path, since)
+	if err != nil { return nil, err }
+	runs := map[int64]*CompressionPoint{}
+	var order []int64
+	for _, s := range samples {
+		rest, ok := strings.CutPrefix(s.Name, "compsize_")
+		if !ok { continue }
+		typ, field := "", ""
+		if t, ok := strings.CutSuffix(rest, "_disk_bytes"); ok {
+			typ, field = t, "disk"
+		} else if t, ok := strings.CutSuffix(rest, "_uncompressed_bytes"); ok {
+			typ, field = t, "uncompressed"
+		} else {
+			continue
+		}
+		key := s.Time.UnixNano()
+		p := runs[key]
+		if p == nil {
+			p = &CompressionPoint{Time: s.Time.UTC(), Types: map[string]CompressionUsage{}}
+			runs[key] = p
+			order = append(order, key)
+		}
+		u := p.Types[typ]
+		if field == "disk" {
+			u.DiskUsage = uint64(s.Value)
+		} else {
+			u.Uncompressed = uint64(s.Value)
+		}
+		if u.Uncompressed > 0 { u.Ratio = float64(u.DiskUsage) / float64(u.Uncompressed) }
+		p.Types[typ] = u
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+	points := []CompressionPoint{}
+	for _, key := range order { points = append(points, *runs[key]) }
+	return points, nil
+}
+
+// handleCompressionHistory returns the compsize runs of ?path= (default:
+// the first compsize path) over ?range= (default 30d).
+func handleCompressionHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	path := filepath.Clean(q.Get("path"))
+	if q.Get("path") == "" {
+		state.mu.Lock()
+		paths := compsizePaths(state.Config)
+		state.mu.Unlock()
+		if len(paths) == 0 { http.Error(w, "Target drive not set", 400); return }
+		path = paths[0]
+	}
+	rangeStr := q.Get("range")
+	if rangeStr == "" { rangeStr = "30d" }
+	span, err := parseSpan(rangeStr)
+	if err != nil {
+		http.Error(w, "range: "+err.Error(), 400)
+		return
+	}
+	if span > metricsRetention { span = metricsRetention }
+	points, err := compressionHistory(path, time.Now().Add(-span))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("compression history: %v", err), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(CompressionHistory{Path: path, Range: rangeStr, Points: points})
+}
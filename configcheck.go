@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// --- Config Validation ---
+// validateConfig collects every problem with a config instead of stopping at
+// the first, each tied to the JSON path of the setting, so the UI can mark
+// the fields and a script gets all of them in one answer. POST /api/config
+// also checks the paths it changes against the filesystem.
+
+// FieldError is one problem; Field is a JSON path like
+// "snapshot_jobs[0].schedule", empty for the request as a whole.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type ConfigErrors []FieldError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		msgs[i] = f.Message
+		if f.Field != "" { msgs[i] = f.Field + ": " + f.Message }
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// add records err for field unless it is nil or field (or a setting it is
+// part of) already has a problem.
+func (e *ConfigErrors) add(field string, err error) {
+	if err == nil { return }
+	for _, f := range *e {
+		if f.Field != "" && (field == f.Field || strings.HasPrefix(field, f.Field+".")) { return }
+	}
+	*e = append(*e, FieldError{Field: field, Message: err.Error()})
+}
+
+// err returns e as an error, nil when there are no problems.
+func (e ConfigErrors) err() error {
+	if len(e) == 0 { return nil }
+	return e
+}
+
+// scheduleField returns the JSON path of the schedule of a scheduledJob.
+func scheduleField(cfg Config, name string) string {
+	kind, id, _ := strings.Cut(name, ":")
+	for i, j := range cfg.SnapshotJobs {
+		if j.ID != id { continue }
+		switch kind {
+		case "snapshot": return fmt.Sprintf("snapshot_jobs[%d].schedule", i)
+		case "archive", "verify", "streams": return fmt.Sprintf("snapshot_jobs[%d].%s.schedule", i, kind)
+		}
+	}
+	if name == "report" { return "report.schedule" }
+	return name + "_sched"
+}
+
+// checkConfigPaths checks the paths that differ between old and cfg against
+// the filesystem. Unchanged ones are left alone so a drive that is
+// unmounted for the moment doesn't block editing other settings.
+func checkConfigPaths(old, cfg Config) ConfigErrors {
+	var errs ConfigErrors
+	if cfg.TargetDrive != "" && cfg.TargetDrive != old.TargetDrive {
+		errs.add("target_drive", checkBtrfsPath(cfg.TargetDrive))
+	}
+	oldTargets := map[string]bool{}
+	for _, t := range old.ScrubPlan.Targets { oldTargets[t] = true }
+	for i, t := range cfg.ScrubPlan.Targets {
+		if !oldTargets[t] { errs.add(fmt.Sprintf("scrub_plan.targets[%d]", i), checkBtrfsPath(t)) }
+	}
+
+	oldJobs := map[string]SnapshotJob{}
+	for _, j := range old.SnapshotJobs { oldJobs[j.ID] = j }
+	for i, j := range cfg.SnapshotJobs {
+		prev, existed := oldJobs[j.ID]
+		if j.Source != "" && (!existed || j.Source != prev.Source) {
+			errs.add(fmt.Sprintf("snapshot_jobs[%d].source", i), checkSubvolumePath(j.Source))
+		}
+		if j.Dest != "" && (!existed || j.Dest != prev.Dest) {
+			errs.add(fmt.Sprintf("snapshot_jobs[%d].dest", i), checkBtrfsPath(j.Dest))
+		}
+	}
+	return errs
+}
+
+// checkBtrfsPath reports why path is not a directory on a btrfs filesystem.
+func checkBtrfsPath(path string) error {
+	if !filepath.IsAbs(path) { return fmt.Errorf("%s is not an absolute path", path) }
+	info, err := os.Stat(path)
+	if err != nil { return fmt.Errorf("%s does not exist", path) }
+	if !info.IsDir() { return fmt.Errorf("%s is not a directory", path) }
+	m, ok := mountOf(path)
+	if !ok { return fmt.Errorf("cannot tell which filesystem %s is on", path) }
+	if m.FSType != "btrfs" { return fmt.Errorf("%s is on a %s filesystem (%s), not btrfs", path, m.FSType, m.Path) }
+	return nil
+}
+
+// checkSubvolumePath is checkBtrfsPath that also wants a subvolume.
+func checkSubvolumePath(path string) error {
+	if err := checkBtrfsPath(path); err != nil { return err }
+	if _, err := btrfsFS.SubvolumeID(path); err != nil { return fmt.Errorf("%s is not a btrfs subvolume", path) }
+	return nil
+}
+
+// decodeConfigError turns a JSON decoding error into the field it is about.
+func decodeConfigError(err error) ConfigErrors {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return ConfigErrors{{Field: typeErr.Field, Message: fmt.Sprintf("must be %s, not %s", typeErr.Type, typeErr.Value)}}
+	}
+	return ConfigErrors{{Message: "Invalid JSON: " + err.Error()}}
+}
+
+// writeConfigErrors answers 400 with the problems in err, one per field.
+func writeConfigErrors(w http.ResponseWriter, err error) {
+	var errs ConfigErrors
+	if !errors.As(err, &errs) { errs = ConfigErrors{{Message: err.Error()}} }
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(400)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": errs.Error(), "errors": errs})
+}
+
+// pathWithin reports whether path is dir or below it; both must be clean.
+func pathWithin(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- Config Export / Import ---
+// The whole configuration as a versioned document, in JSON or YAML, to move
+// settings between machines or keep them in git. An import is validated as
+// a whole and applied in one step, or not at all.
+
+const configDocumentVersion = 1
+
+type ConfigDocument struct {
+	Version    int    `json:"version"`
+	AppVersion string `json:"app_version"`
+	Exported   string `json:"exported"`
+	// Redacted documents have webhook URLs and tokens, the SMTP password and
+	// access key hashes blanked; importing one keeps the current values.
+	Redacted bool   `json:"redacted,omitempty"`
+	Config   Config `json:"config"`
+}
+
+func redactConfig(cfg Config) Config {
+	hooks := append([]WebhookConfig(nil), cfg.Notifications.Webhooks...)
+	for i := range hooks { hooks[i].URL, hooks[i].Token = "", "" }
+	cfg.Notifications.Webhooks = hooks
+	cfg.Notifications.Email.Password = ""
+	users := append([]AccessUser(nil), cfg.Access.Users...)
+	for i := range users { users[i].KeyHash = "" }
+	cfg.Access.Users = users
+	agents := append([]AgentConfig(nil), cfg.Agents...)
+	for i := range agents { agents[i].Key = "" }
+	cfg.Agents = agents
+	cfg.SnapshotJobs = redactJobs(cfg.SnapshotJobs)
+	return cfg
+}
+
+// redactJobs blanks the stream remotes of jobs, as inline rclone remotes
+// (":s3,access_key_id=...,secret_access_key=...:bucket") carry credentials.
+func redactJobs(jobs []SnapshotJob) []SnapshotJob {
+	out := append([]SnapshotJob(nil), jobs...)
+	for i := range out { out[i].Streams.Remote = "" }
+	return out
+}
+
+// restoreSecrets fills the blanks of a redacted import from current,
+// matching webhooks and users by name and jobs by ID.
+func restoreSecrets(cfg *Config, current Config) {
+	byName := map[string]WebhookConfig{}
+	for _, h := range current.Notifications.Webhooks { byName[h.Name] = h }
+	for i, h := range cfg.Notifications.Webhooks {
+		old, ok := byName[h.Name]
+		if !ok { continue }
+		if h.URL == "" { cfg.Notifications.Webhooks[i].URL = old.URL }
+		if h.Token == "" { cfg.Notifications.Webhooks[i].Token = old.Token }
+	}
+	if cfg.Notifications.Email.Password == "" { cfg.Notifications.Email.Password = current.Notifications.Email.Password }
+	keys := map[string]string{}
+	for _, u := range current.Access.Users { keys[u.Name] = u.KeyHash }
+	for i, u := range cfg.Access.Users {
+		if u.KeyHash == "" { cfg.Access.Users[i].KeyHash = keys[u.Name] }
+	}
+	agentKeys := map[string]string{}
+	for _, a := range current.Agents { agentKeys[a.Name] = a.Key }
+	for i, a := range cfg.Agents {
+		if a.Key == "" { cfg.Agents[i].Key = agentKeys[a.Name] }
+	}
+	remotes := map[string]string{}
+	for _, j := range current.SnapshotJobs { remotes[j.ID] = j.Streams.Remote }
+	for i, j := range cfg.SnapshotJobs {
+		if j.Streams.Remote == "" { cfg.SnapshotJobs[i].Streams.Remote = remotes[j.ID] }
+	}
+}
+
+// parseConfigDocument reads a JSON or YAML document. Unknown keys are
+// rejected so a typo doesn't silently drop a setting.
+func parseConfigDocument(data []byte) (ConfigDocument, error) {
+	var doc ConfigDocument
+	plain, err := decodeYAMLDocument(data)
+	if err != nil { return doc, err }
+	raw, err := json.Marshal(plain)
+	if err != nil { return doc, err }
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&doc); err != nil { return doc, err }
+	if doc.Version < 1 || doc.Version > configDocumentVersion {
+		return doc, fmt.Errorf("unsupported document version %d (this version reads 1 to %d)", doc.Version, configDocumentVersion)
+	}
+	return doc, nil
+}
+
+func validateImportedConfig(cfg *Config) error {
+	for i := range cfg.SnapshotJobs { applySnapshotJobDefaults(&cfg.SnapshotJobs[i]) }
+	return validateConfig(*cfg)
+}
+
+// --- Handlers ---
+
+// handleExportConfig returns the config document; ?format=yaml for YAML,
+// ?redact=true to leave out notification secrets.
+func handleExportConfig(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	cfg := state.Config
+	state.mu.Unlock()
+
+	doc := ConfigDocument{Version: configDocumentVersion, AppVersion: version, Exported: time.Now().Format(time.RFC3339), Config: cfg}
+	if r.URL.Query().Get("redact") == "true" {
+		doc.Redacted = true
+		doc.Config = redactConfig(cfg)
+	}
+
+	// Encode through a generic value so the YAML keys match the JSON ones.
+	raw, _ := json.Marshal(doc)
+	var plain map[string]interface{}
+	json.Unmarshal(raw, &plain)
+	name := "btrfs-webui-config-" + time.Now().Format("2006-01-02")
+	if r.URL.Query().Get("format") == "yaml" {
+		data, err := encodeYAML(plain)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".yaml"))
+		w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".json"))
+	data, _ := json.MarshalIndent(plain, "", "  ")
+	w.Write(data)
+}
+
+// handleImportConfig validates a document and replaces the whole config
+// with it; ?dry_run=true only reports what would change.
+func handleImportConfig(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	doc, err := parseConfigDocument(data)
+	if err != nil {
+		http.Error(w, "Invalid config document: "+err.Error(), 400)
+		return
+	}
+	cfg := doc.Config
+	state.mu.Lock()
+	current := state.Config
+	state.mu.Unlock()
+	if doc.Redacted { restoreSecrets(&cfg, current) }
+	if err := validateImportedConfig(&cfg); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	changed := diffConfig(current, cfg)
+	if changed == nil { changed = []string{} }
+	if r.URL.Query().Get("dry_run") == "true" {
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "valid", "dry_run": true, "changed": changed})
+		return
+	}
+	applyConfig(cfg, "config import")
+	summary := "nothing changed"
+	if len(changed) > 0 { summary = "changed " + strings.Join(changed, ", ") }
+	logHistory("CONFIG IMPORT", "📥", "Configuration", "Success", fmt.Sprintf("Imported config exported %s by %s: %s", doc.Exported, doc.AppVersion, summary))
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "imported", "changed": changed})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// --- Confirmation Tokens ---
+// Destructive endpoints use a two-step flow: the first call returns a plan
+// and a short-lived token bound to (action, target); only a second call
+// presenting that token executes.
+
+type confirmToken struct {
+	Action  string
+	Target  string
+	Expires time.Time
+}
+
+var confirmTokens = struct {
+	mu     sync.Mutex
+	tokens map[string]confirmToken
+}{tokens: make(map[string]confirmToken)}
+
+const confirmTokenTTL = 2 * time.Minute
+
+func issueConfirmToken(action, target string) (string, time.Time) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	expires := time.Now().Add(confirmTokenTTL)
+
+	confirmTokens.mu.Lock()
+	defer confirmTokens.mu.Unlock()
+	for t, c := range confirmTokens.tokens {
+		if time.Now().After(c.Expires) { delete(confirmTokens.tokens, t) }
+	}
+	confirmTokens.tokens[token] = confirmToken{Action: action, Target: target, Expires: expires}
+	return token, expires
+}
+
+// consumeConfirmToken reports whether token was issued for action/target and
+// is still valid. Tokens are single-use.
+func consumeConfirmToken(token, action, target string) bool {
+	confirmTokens.mu.Lock()
+	defer confirmTokens.mu.Unlock()
+	c, ok := confirmTokens.tokens[token]
+	if !ok { return false }
+	delete(confirmTokens.tokens, token)
+	return c.Action == action && c.Target == target && time.Now().Before(c.Expires)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Profile Conversion ---
+// Converting the data or metadata profile (e.g. single to raid1 after adding
+// a device) is a balance with convert filters. Before it starts, a pre-check
+// makes sure the filesystem has enough devices for the profile and, placing
+// the used space chunk by chunk the way the allocator would, enough room
+// for it. The conversion is kept in state.json, so its progress can be read
+// from the chunk profiles and it can be resumed: a paused balance with
+// `balance resume`, a cancelled or crashed one by starting it again with the
+// soft filter, which skips chunks already converted.
+
+type raidProfile struct {
+	MinDevices int
+	Stripes    int // devices per chunk, 0 for all with room left
+	Copies     int // copies of each block
+	Parity     int // devices worth of parity per chunk
+}
+
+var raidProfiles = map[string]raidProfile{
+	"single":  {1, 1, 1, 0},
+	"dup":     {1, 1, 2, 0},
+	"raid0":   {2, 0, 1, 0},
+	"raid1":   {2, 2, 2, 0},
+	"raid1c3": {3, 3, 3, 0},
+	"raid1c4": {4, 4, 4, 0},
+	"raid10":  {2, 0, 2, 0},
+	"raid5":   {2, 0, 1, 1},
+	"raid6":   {3, 0, 1, 2},
+}
+
+// redundancy counts the copies and parity of a block; the kernel wants
+// --force to lower it for metadata.
+func (p raidProfile) redundancy() int { return p.Copies + p.Parity }
+
+type ConvertRequest struct {
+	Data     string `json:"data"`     // target data profile, e.g. raid1; empty leaves data alone
+	Metadata string `json:"metadata"` // target metadata (and system) profile
+	Force    bool   `json:"force"`    // allow reducing metadata redundancy (-f)
+	Token    string `json:"token"`
+	Confirm  string `json:"confirm"` // must repeat the path
+}
+
+type ConvertPlan struct {
+	Path      string            `json:"path"`
+	Devices   int               `json:"devices"`
+	Current   map[string]string `json:"current"` // Data/Metadata/System: profile, comma-separated when mixed
+	Data      string            `json:"data,omitempty"`
+	Metadata  string            `json:"metadata,omitempty"`
+	Needed    uint64            `json:"needed"`    // raw bytes the used space takes in the new profiles
+	Available uint64            `json:"available"` // raw size of all devices
+	Fits      bool              `json:"fits"`
+	Errors    []string          `json:"errors"`
+	Warnings  []string          `json:"warnings"`
+	Command   string            `json:"command"`
+}
+
+type ProfileConversion struct {
+	Path     string `json:"path"`
+	Data     string `json:"data,omitempty"`
+	Metadata string `json:"metadata,omitempty"`
+	Force    bool   `json:"force,omitempty"`
+	Started  string `json:"started"`  // RFC 3339
+	EntryID  int64  `json:"entry_id"` // log entry of the last start or resume
+}
+
+type ConvertProgress struct {
+	Target    string  `json:"target"`
+	Converted uint64  `json:"converted"` // used bytes already in the target profile
+	Total     uint64  `json:"total"`
+	Percent   float64 `json:"percent"`
+}
+
+// chunkProfile names a chunk profile the way convert filters do: "single",
+// "raid1", ...
+func chunkProfile(c ChunkUsage) string { return strings.ToLower(c.Profile) }
+
+// currentProfiles returns the profiles in use per chunk type, ignoring
+// empty leftovers of a previous profile unless nothing else is there.
+func currentProfiles(usage *FilesystemUsage) map[string]string {
+	in := map[string][]string{}
+	for _, c := range usage.Chunks {
+		if c.Used == 0 && len(in[c.Type]) > 0 { continue }
+		in[c.Type] = append(in[c.Type], chunkProfile(c))
+	}
+	cur := map[string]string{}
+	for typ, list := range in {
+		sort.Strings(list)
+		cur[typ] = strings.Join(list, ",")
+	}
+	return cur
+}
+
+// typeUsed sums the used bytes of a chunk type over all its profiles and
+// returns the profile holding most of them.
+func typeUsed(usage *FilesystemUsage, typ string) (uint64, string) {
+	var total, most uint64
+	profile := ""
+	for _, c := range usage.Chunks {
+		if c.Type != typ { continue }
+		total += c.Used
+		if profile == "" || c.Used > most { most, profile = c.Used, chunkProfile(c) }
+	}
+	return total, profile
+}
+
+// placeChunks allocates need usable bytes in profile p on devices with the
+// given free space, chunk by chunk on the devices with the most room like
+// the allocator, and returns the raw bytes taken or false when they don't
+// fit.
+func placeChunks(free []uint64, p raidProfile, need, unit uint64) (uint64, bool) {
+	var raw uint64
+	for need > 0 {
+		sort.Slice(free, func(i, j int) bool { return free[i] > free[j] })
+		// dup keeps both copies on one device.
+		perDevice := unit
+		if p.Stripes == 1 { perDevice = unit * uint64(p.Copies) }
+		n := 0
+		for _, f := range free {
+			if f >= perDevice { n++ }
+		}
+		if n < p.MinDevices { return raw, false }
+		stripes := p.Stripes
+		if stripes == 0 { stripes = n - n%p.Copies }
+		for i := 0; i < stripes; i++ { free[i] -= perDevice }
+		raw += uint64(stripes) * perDevice
+		usable := uint64(stripes-p.Parity) * perDevice / uint64(p.Copies)
+		if usable >= need { break }
+		need -= usable
+	}
+	return raw, true
+}
+
+func convertArgs(path string, c ProfileConversion, soft bool) []string {
+	args := []string{"balance", "start"}
+	filter := func(flag, profile string) string {
+		if soft { return flag + "convert=" + profile + ",soft" }
+		return flag + "convert=" + profile
+	}
+	if c.Data != "" { args = append(args, filter("-d", c.Data)) }
+	// btrfs-progs apply -m to the system chunks as well.
+	if c.Metadata != "" { args = append(args, filter("-m", c.Metadata)) }
+	if c.Force { args = append(args, "-f") }
+	return append(args, path)
+}
+
+// planConversion runs the pre-check for converting the filesystem at path.
+func planConversion(path string, req ConvertRequest) (*ConvertPlan, error) {
+	devices, err := listDevices(path)
+	if err != nil { return nil, err }
+	usage, err := getFilesystemUsage(path)
+	if err != nil { return nil, err }
+	plan := &ConvertPlan{Path: path, Current: currentProfiles(usage), Data: req.Data, Metadata: req.Metadata, Errors: []string{}, Warnings: []string{}}
+
+	var free []uint64
+	smallest := uint64(0)
+	for _, d := range devices {
+		if d.Missing {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("devid %d is missing: replace or remove it before converting", d.DevID))
+			continue
+		}
+		plan.Devices++
+		plan.Available += d.Size
+		free = append(free, d.Size)
+		if smallest == 0 || d.Size < smallest { smallest = d.Size }
+	}
+	if req.Data == "" && req.Metadata == "" { plan.Errors = append(plan.Errors, "choose a data or metadata profile") }
+	for _, t := range []struct{ what, name string }{{"data", req.Data}, {"metadata", req.Metadata}} {
+		what, name := t.what, t.name
+		if name == "" { continue }
+		p, ok := raidProfiles[name]
+		if !ok {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("unknown %s profile %q", what, name))
+			continue
+		}
+		if plan.Devices < p.MinDevices { plan.Errors = append(plan.Errors, fmt.Sprintf("%s needs at least %d devices, the filesystem has %d", name, p.MinDevices, plan.Devices)) }
+		if name == "raid10" && plan.Devices < 4 { plan.Warnings = append(plan.Warnings, "older kernels need at least 4 devices for raid10") }
+		if name == "dup" && plan.Devices > 1 { plan.Warnings = append(plan.Warnings, what+" dup keeps both copies on the same device: losing a device still loses data") }
+		if p.Parity > 0 {
+			plan.Warnings = append(plan.Warnings, "raid5/6 has a write hole: a crash during a write can damage stripes, and scrubs are slow")
+			if what == "metadata" { plan.Warnings = append(plan.Warnings, "metadata on raid5/6 is not recommended; use raid1 (or raid1c3 with raid6 data)") }
+		}
+	}
+	if len(plan.Errors) > 0 { return plan, nil }
+
+	_, curMeta := typeUsed(usage, "Metadata")
+	if req.Metadata != "" && curMeta != "" {
+		if cur, ok := raidProfiles[curMeta]; ok && raidProfiles[req.Metadata].redundancy() < cur.redundancy() {
+			if !req.Force { plan.Errors = append(plan.Errors, fmt.Sprintf("metadata %s is less redundant than %s: set force to go ahead", req.Metadata, curMeta)) }
+			plan.Warnings = append(plan.Warnings, "reduces metadata redundancy")
+		}
+	}
+
+	// Place the used space as it will be once converted, types not converted
+	// in their current profile, in units small enough for small devices.
+	unit := uint64(1 << 30)
+	for unit > 1<<20 && unit*16 > smallest { unit /= 2 }
+	for _, t := range []struct{ typ, target string; extra uint64 }{{"Data", req.Data, 0}, {"Metadata", req.Metadata, usage.GlobalReserve}} {
+		used, profile := typeUsed(usage, t.typ)
+		if t.target != "" { profile = t.target }
+		p, ok := raidProfiles[profile]
+		if !ok || used+t.extra == 0 { continue }
+		raw, fits := placeChunks(free, p, used+t.extra, unit)
+		plan.Needed += raw
+		if !fits {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("%s in %s does not fit: %s used, %s devices", strings.ToLower(t.typ), profile, formatBytes(used), formatBytes(plan.Available)))
+		}
+	}
+	plan.Fits = len(plan.Errors) == 0
+	if plan.Fits && usage.DeviceUnallocated < uint64(plan.Devices)*unit {
+		plan.Warnings = append(plan.Warnings, "little unallocated space: the balance needs room for new chunks before it frees the old ones; run a light balance first")
+	}
+	plan.Command = formatCommand("btrfs", convertArgs(path, ProfileConversion{Data: req.Data, Metadata: req.Metadata, Force: req.Force}, false)...)
+	return plan, nil
+}
+
+// conversionProgress reads how much of the used space is already in the
+// target profiles.
+func conversionProgress(c *ProfileConversion) (map[string]ConvertProgress, error) {
+	usage, err := getFilesystemUsage(c.Path)
+	if err != nil { return nil, err }
+	progress := map[string]ConvertProgress{}
+	for _, t := range []struct{ typ, target string }{{"Data", c.Data}, {"Metadata", c.Metadata}} {
+		if t.target == "" { continue }
+		p := ConvertProgress{Target: t.target}
+		for _, ch := range usage.Chunks {
+			if ch.Type != t.typ { continue }
+			p.Total += ch.Used
+			if chunkProfile(ch) == t.target { p.Converted += ch.Used }
+		}
+		p.Percent = 100
+		if p.Total > 0 { p.Percent = float64(p.Converted) * 100 / float64(p.Total) }
+		progress[strings.ToLower(t.typ)] = p
+	}
+	return progress, nil
+}
+
+func conversionComplete(progress map[string]ConvertProgress) bool {
+	for _, p := range progress {
+		if p.Percent < 100 { return false }
+	}
+	return true
+}
+
+// balanceBusy reports a balance running or paused on path.
+func balanceBusy(path string) string {
+	if balanceCommandRunning() { return "running" }
+	out, _ := exec.Command("btrfs", "balance", "status", path).CombinedOutput()
+	if s := kernelBalanceState(string(out)); s != "idle" { return s }
+	return ""
+}
+
+// --- Handlers ---
+
+// handleConvertCheck returns the pre-check for ?data= and ?metadata=.
+func handleConvertCheck(w http.ResponseWriter, r *http.Request) {
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	q := r.URL.Query()
+	plan, err := planConversion(path, ConvertRequest{Data: strings.ToLower(q.Get("data")), Metadata: strings.ToLower(q.Get("metadata")), Force: q.Get("force") == "true"})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(plan)
+}
+
+// handleConvertStart starts the conversion once the pre-check passes, after
+// the token confirmation repeating the path.
+func handleConvertStart(w http.ResponseWriter, r *http.Request) {
+	var req ConvertRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), 400)
+		return
+	}
+	req.Data, req.Metadata = strings.ToLower(req.Data), strings.ToLower(req.Metadata)
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	if refuseLocked(w, path) { return }
+	if s := balanceBusy(path); s != "" { http.Error(w, "A balance is "+s+" on "+path, 409); return }
+	if op := deviceOpRunning(path); op != "" { http.Error(w, "A "+op+" is running on "+path, 409); return }
+	plan, err := planConversion(path, req)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if !plan.Fits {
+		http.Error(w, strings.Join(plan.Errors, "; "), 400)
+		return
+	}
+	warnings := append([]string{"rewrites every chunk of the converted types, which takes hours on large filesystems and can be paused"}, plan.Warnings...)
+	action := "convert:" + req.Data + ":" + req.Metadata
+	if !confirmDeviceOp(w, DeviceRequest{Token: req.Token, Confirm: req.Confirm}, action, path, []string{plan.Command}, warnings) { return }
+
+	c := &ProfileConversion{Path: path, Data: req.Data, Metadata: req.Metadata, Force: req.Force, Started: time.Now().UTC().Format(time.RFC3339)}
+	c.EntryID = runCommandAsync("PROFILE CONVERT", "🔀", convertVisualPath(c), "btrfs", convertArgs(path, *c, false)...)
+	state.mu.Lock()
+	state.Convert = c
+	saveState()
+	state.mu.Unlock()
+	wakeBalancePoller()
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": c.EntryID})
+}
+
+func convertVisualPath(c *ProfileConversion) string {
+	var to []string
+	if c.Data != "" { to = append(to, "data "+c.Data) }
+	if c.Metadata != "" { to = append(to, "metadata "+c.Metadata) }
+	return fmt.Sprintf("%s ➡️ %s", c.Path, strings.Join(to, ", "))
+}
+
+// handleConvertStatus returns the last conversion, how far it got and the
+// balance state.
+func handleConvertStatus(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	c := state.Convert
+	state.mu.Unlock()
+	if c == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"conversion": nil})
+		return
+	}
+	progress, err := conversionProgress(c)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	balance := balanceBusy(c.Path)
+	status := "done"
+	if !conversionComplete(progress) {
+		status = "interrupted"
+		if balance != "" { status = balance }
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"conversion": c, "status": status, "progress": progress})
+}
+
+// handleConvertResume continues an unfinished conversion: a paused balance
+// is resumed, otherwise the balance starts over with the soft filter.
+func handleConvertResume(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	c := state.Convert
+	state.mu.Unlock()
+	if c == nil { http.Error(w, "No conversion to resume", 404); return }
+	if refuseLocked(w, c.Path) { return }
+	progress, err := conversionProgress(c)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if conversionComplete(progress) { http.Error(w, "The conversion is complete", 400); return }
+	var id int64
+	switch balanceBusy(c.Path) {
+	case "running":
+		http.Error(w, "A balance is already running on "+c.Path, 409)
+		return
+	case "paused":
+		id = runCommandAsync("CONVERT RESUME", "🔀", convertVisualPath(c), "btrfs", "balance", "resume", c.Path)
+	default:
+		id = runCommandAsync("CONVERT RESUME", "🔀", convertVisualPath(c)+" [soft]", "btrfs", convertArgs(c.Path, *c, true)...)
+	}
+	state.mu.Lock()
+	c.EntryID = id
+	saveState()
+	state.mu.Unlock()
+	wakeBalancePoller()
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// --- Corrupt File Identification ---
+// A scrub that finds errors only reports counts; the kernel log has the
+// logical addresses, which inspect.go resolves to files. Files with errors
+// the scrub couldn't repair get the newest snapshot (taken or received by a
+// job) holding an intact copy, which the UI restores with one click through
+// the regular snapshot restore.
+
+type CorruptFile struct {
+	Path    string         `json:"path"`
+	Logical []uint64       `json:"logical"`
+	Fixed   bool           `json:"fixed"` // every error was repaired from another copy
+	Restore *RestoreSource `json:"restore,omitempty"`
+	Note    string         `json:"note,omitempty"`
+}
+
+// RestoreSource is a snapshot copy of a corrupt file: restore Source from
+// Snapshot of Job (POST /api/snapshots/{snapshot}/restore?job=).
+type RestoreSource struct {
+	Job      string `json:"job"`
+	Snapshot string `json:"snapshot"`
+	Source   string `json:"source"`
+}
+
+// identifyCorruptFiles groups the kernel-reported errors of the filesystem
+// at path by file. Blocks no file references (metadata) are left out, the
+// error counts already cover them.
+func identifyCorruptFiles(path string) ([]CorruptFile, error) {
+	errs, err := kernelScrubErrors(path)
+	if err != nil { return nil, err }
+	return groupCorruptFiles(errs), nil
+}
+
+func groupCorruptFiles(errs []KernelScrubError) []CorruptFile {
+	// Snapshot copies that share a corrupt block are just as corrupt.
+	corrupt := map[string]bool{}
+	byPath := map[string]*CorruptFile{}
+	var files []*CorruptFile
+	for _, e := range errs {
+		for _, p := range e.Paths {
+			p = filepath.Clean(p)
+			corrupt[p] = true
+			f, ok := byPath[p]
+			if !ok {
+				f = &CorruptFile{Path: p, Fixed: true}
+				byPath[p] = f
+				files = append(files, f)
+			}
+			f.Logical = append(f.Logical, e.Logical)
+			f.Fixed = f.Fixed && e.Fixed
+		}
+	}
+
+	state.mu.Lock()
+	jobs := append([]SnapshotJob(nil), state.Config.SnapshotJobs...)
+	state.mu.Unlock()
+
+	result := []CorruptFile{}
+	for _, f := range files {
+		if !f.Fixed { f.Restore, f.Note = findCleanCopy(jobs, f.Path, corrupt) }
+		result = append(result, *f)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result
+}
+
+// findCleanCopy looks for the newest snapshot, of any job whose source holds
+// file, with a copy of it that references none of the corrupt blocks.
+func findCleanCopy(jobs []SnapshotJob, file string, corrupt map[string]bool) (*RestoreSource, string) {
+	for _, job := range jobs {
+		if job.Dest != "" && pathBelow(job.Dest, file) {
+			if job.Writable { return nil, "in a snapshot" }
+			return nil, "in a read-only snapshot"
+		}
+	}
+	covered := false
+	for _, job := range jobs {
+		if job.Source == "" || job.Dest == "" || !pathBelow(job.Source, file) { continue }
+		rel, _ := filepath.Rel(filepath.Clean(job.Source), file)
+		covered = true
+		snaps, err := listManagedSnapshots(job)
+		if err != nil { continue }
+		for _, s := range snaps {
+			copyPath := filepath.Join(job.Dest, s.Name, rel)
+			if corrupt[copyPath] { continue }
+			if info, err := os.Lstat(copyPath); err != nil || !info.Mode().IsRegular() { continue }
+			return &RestoreSource{Job: job.ID, Snapshot: s.Name, Source: rel}, ""
+		}
+	}
+	if !covered { return nil, "not below the source of any snapshot job" }
+	return nil, "no snapshot holds an intact copy"
+}
+
+func pathBelow(dir, p string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), p)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// attachCorruptFiles adds the affected files to a scrub result with errors.
+// It runs commands, so it must not be called with state.mu held.
+func attachCorruptFiles(result *OperationResult, path string) {
+	if result == nil || result.Scrub == nil || result.Scrub.Errors == 0 { return }
+	files, err := identifyCorruptFiles(path)
+	if err != nil {
+		logWarn("SCRUB", "Cannot identify the corrupt files on %s: %v", path, err)
+		return
+	}
+	result.Scrub.CorruptFiles = files
+}
+
+// corruptFilesSummary lists the affected files for notifications.
+func corruptFilesSummary(files []CorruptFile) string {
+	if len(files) == 0 { return "" }
+	var b strings.Builder
+	b.WriteString("Affected files:\n")
+	for i, f := range files {
+		if i == 20 {
+			fmt.Fprintf(&b, "... and %d more\n", len(files)-i)
+			break
+		}
+		switch {
+		case f.Fixed:
+			fmt.Fprintf(&b, "- %s (repaired)\n", f.Path)
+		case f.Restore != nil:
+			fmt.Fprintf(&b, "- %s (intact copy in %s)\n", f.Path, f.Restore.Snapshot)
+		default:
+			fmt.Fprintf(&b, "- %s (%s)\n", f.Path, f.Note)
+		}
+	}
+	return b.String()
+}
+
+// --- Scrub Error Report ---
+
+// ScrubErrorReport is what a recovery needs after a scrub with errors: the
+// error counts per device, the damaged files and the corrupt blocks that no
+// file could be found for.
+type ScrubErrorReport struct {
+	Path          string             `json:"path"`
+	Devices       []DeviceScrub      `json:"devices"`
+	Uncorrectable uint64             `json:"uncorrectable"`
+	Damaged       int                `json:"damaged"` // files with errors the scrub couldn't repair
+	Files         []CorruptFile      `json:"files"`
+	Unresolved    []KernelScrubError `json:"unresolved"` // metadata, or not resolvable
+}
+
+type DeviceScrub struct {
+	Device string       `json:"device"`
+	Scrub  *ScrubResult `json:"scrub"`
+	// A scrub device by device (scrub_plan.mode devices) also tracks its
+	// run of each device, see scrub.go.
+	DevID uint64 `json:"devid,omitempty"`
+	State string `json:"state,omitempty"` // pending, running, finished, failed or skipped
+	Error string `json:"error,omitempty"`
+}
+
+// parseScrubDevices splits `btrfs scrub status -d` into its per-device
+// sections, each starting with "scrub device /dev/sdb (id 1) ...".
+func parseScrubDevices(out string) []DeviceScrub {
+	devices := []DeviceScrub{}
+	var name string
+	var section []string
+	flush := func() {
+		if name == "" { return }
+		if r := parseScrub(strings.Join(section, "\n")); r != nil { devices = append(devices, DeviceScrub{Device: name, Scrub: r}) }
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if rest, ok := strings.CutPrefix(strings.TrimSpace(line), "scrub device "); ok {
+			flush()
+			name, _, _ = strings.Cut(rest, " ")
+			section = nil
+			continue
+		}
+		section = append(section, line)
+	}
+	flush()
+	return devices
+}
+
+func scrubErrorReport(path string) (*ScrubErrorReport, error) {
+	out, err := exec.Command("btrfs", "scrub", "status", "-d", path).CombinedOutput()
+	if err != nil { return nil, fmt.Errorf("btrfs scrub status: %v: %s", err, strings.TrimSpace(string(out))) }
+	errs, err := kernelScrubErrors(path)
+	if err != nil { return nil, err }
+
+	report := &ScrubErrorReport{Path: path, Devices: parseScrubDevices(string(out)), Files: groupCorruptFiles(errs), Unresolved: []KernelScrubError{}}
+	for _, d := range report.Devices { report.Uncorrectable += d.Scrub.Uncorrectable }
+	for _, f := range report.Files {
+		if !f.Fixed { report.Damaged++ }
+	}
+	for _, e := range errs {
+		if len(e.Paths) == 0 { report.Unresolved = append(report.Unresolved, e) }
+	}
+	return report, nil
+}
+
+func handleScrubErrors(w http.ResponseWriter, r *http.Request) {
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	report, err := scrubErrorReport(path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
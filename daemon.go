@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --- Daemon Mode ---
+// Run outside the container as a systemd service: --config points at a
+// YAML (or JSON) file holding the configuration, while history, the runbook
+// and other mutable state stay in the state directory. The listening socket
+// may be handed over by systemd socket activation.
+
+// configFile is set by --config. Empty keeps the configuration inside
+// state.json, as in the container.
+var configFile string
+
+// configListen is the `listen:` address from the config file, which sits
+// next to the Config fields but is not part of what the UI edits.
+var configListen string
+
+// writtenConfig is what was last read from or written to configFile, so
+// flushState only touches the file when the config actually changed.
+// Guarded by persist.write once the server runs.
+var writtenConfig []byte
+
+// configFileMode keeps the config file and state.json, with the notification
+// secrets, agent keys and access key hashes, readable by the service's user
+// only.
+const configFileMode = 0600
+
+// sdListenFdsStart is the first file descriptor passed by systemd.
+const sdListenFdsStart = 3
+
+func configIsJSON() bool { return strings.EqualFold(filepath.Ext(configFile), ".json") }
+
+// loadConfigFile replaces state.Config with the config file. A missing file
+// is created from the config loaded so far, which moves an existing
+// state.json config over on the first start with --config.
+func loadConfigFile() error {
+	data, err := os.ReadFile(configFile)
+	if os.IsNotExist(err) {
+		printDockerLog("SYSTEM", "Creating %s from the current config", configFile)
+		if err := os.MkdirAll(filepath.Dir(configFile), 0755); err != nil { return err }
+		return writeConfigFile()
+	}
+	if err != nil { return err }
+	if info, err := os.Stat(configFile); err == nil && info.Mode().Perm()&^configFileMode != 0 {
+		printDockerLog("SYSTEM", "Making %s readable by its owner only, as it holds secrets", configFile)
+		if err := os.Chmod(configFile, configFileMode); err != nil { logWarn("SYSTEM", "Cannot change the mode of %s: %v", configFile, err) }
+	}
+
+	doc, err := decodeYAMLDocument(data)
+	if err != nil { return fmt.Errorf("%s: %v", configFile, err) }
+	if s, ok := doc["listen"].(string); ok { configListen = s }
+	delete(doc, "listen")
+	raw, err := json.Marshal(doc)
+	if err != nil { return fmt.Errorf("%s: %v", configFile, err) }
+	var cfg Config
+	if err := json.Unmarshal(raw, &cfg); err != nil { return fmt.Errorf("%s: %v", configFile, err) }
+	// Hand-written jobs may leave out the ID; like new jobs they get one from
+	// their name, which is written back so it stays.
+	assigned := false
+	state.mu.Lock()
+	state.Config.SnapshotJobs = cfg.SnapshotJobs
+	for i, j := range cfg.SnapshotJobs {
+		if j.ID == "" { cfg.SnapshotJobs[i].ID, assigned = newSnapshotJobID(j.Name), true }
+	}
+	state.mu.Unlock()
+	if err := validateImportedConfig(&cfg); err != nil { return fmt.Errorf("%s: %v", configFile, err) }
+	state.Config = cfg
+	if assigned {
+		printDockerLog("SYSTEM", "Adding the IDs of new snapshot jobs to %s", configFile)
+		return writeConfigFile()
+	}
+	writtenConfig, _ = encodeConfigFile()
+	return nil
+}
+
+// decodeYAMLDocument reads a YAML (or JSON) mapping into plain values. They
+// are round-tripped through JSON by the callers so documents use the same
+// keys as the API and state.json.
+func decodeYAMLDocument(data []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil { return nil, err }
+	if doc == nil { doc = map[string]interface{}{} }
+	return doc, nil
+}
+
+func encodeConfigFile() ([]byte, error) {
+	raw, err := json.Marshal(state.Config)
+	if err != nil { return nil, err }
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil { return nil, err }
+	if configListen != "" { doc["listen"] = configListen }
+	if configIsJSON() { return json.MarshalIndent(doc, "", "  ") }
+	return encodeYAML(doc)
+}
+
+func encodeYAML(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil { return nil, err }
+	return buf.Bytes(), nil
+}
+
+// writeConfigFile creates the config file at startup, before anything else
+// runs; later changes are written by flushState.
+func writeConfigFile() error {
+	data, err := encodeConfigFile()
+	if err != nil { return err }
+	if err := writeFileAtomic(configFile, data, configFileMode); err != nil { return err }
+	writtenConfig = data
+	return nil
+}
+
+// listenAddress picks the bind address: --listen, then LISTEN_ADDR, then
+// the config file, then :PORT.
+func listenAddress(flagAddr string) string {
+	if flagAddr != "" { return flagAddr }
+	if addr := os.Getenv("LISTEN_ADDR"); addr != "" { return addr }
+	if configListen != "" { return configListen }
+	port := os.Getenv("PORT")
+	if port == "" { port = "8080" }
+	return ":" + port
+}
+
+// systemdListener returns the first socket passed by socket activation, or
+// nil when the process was not started that way.
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) { return nil, nil }
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	// Don't pass the sockets on to btrfs and other children.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if n < 1 { return nil, nil }
+	if n > 1 { printDockerLog("SYSTEM", "%d sockets passed by systemd, using the first", n) }
+	for fd := sdListenFdsStart; fd < sdListenFdsStart+n; fd++ { syscall.CloseOnExec(fd) }
+
+	f := os.NewFile(sdListenFdsStart, "systemd-socket")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+func listen(flagAddr string) (net.Listener, error) {
+	l, err := systemdListener()
+	if err != nil { return nil, fmt.Errorf("socket activation: %v", err) }
+	if l != nil { return l, nil }
+	addr := listenAddress(flagAddr)
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		os.Remove(path)
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Deduplication ---
+// Out-of-band deduplication with duperemove, on demand or on the dedup
+// schedule, over the configured paths (default: the target drive). bees
+// deduplicates continuously on its own; with the bees tool selected a run
+// only records the counters from its status file, so the activity log
+// tracks its progress the same way.
+
+type DedupConfig struct {
+	Tool     string   `json:"tool"`               // duperemove (default) or bees
+	Paths    []string `json:"paths"`              // duperemove: empty = target drive
+	HashFile string   `json:"hashfile,omitempty"` // duperemove --hashfile, keeps hashes between runs
+	// BeesStatusDir holds the <uuid>.status files beesd writes (BEESSTATUS).
+	BeesStatusDir string `json:"bees_status_dir,omitempty"` // default /run/bees
+}
+
+const defaultBeesStatusDir = "/run/bees"
+
+type DedupResult struct {
+	Tool             string `json:"tool"`
+	BytesDeduped     uint64 `json:"bytes_deduped"`
+	ExtentsFound     uint64 `json:"extents_found"`     // duplicate extents found
+	ExtentsProcessed uint64 `json:"extents_processed"` // deduped (bees: dedup_hit)
+	Files            uint64 `json:"files,omitempty"`   // files hashed
+
+	// Counters are the TOTAL section of the bees status.
+	Counters map[string]uint64 `json:"counters,omitempty"`
+}
+
+func (c DedupConfig) validate() error {
+	if c.Tool != "" && c.Tool != "duperemove" && c.Tool != "bees" { return fmt.Errorf("dedup tool must be duperemove or bees") }
+	for _, p := range c.Paths {
+		if !filepath.IsAbs(p) { return fmt.Errorf("dedup path %q must be an absolute path", p) }
+	}
+	if c.HashFile != "" && !filepath.IsAbs(c.HashFile) { return fmt.Errorf("dedup hashfile must be an absolute path") }
+	return nil
+}
+
+func dedupPaths(cfg Config) []string {
+	if len(cfg.Dedup.Paths) > 0 { return cfg.Dedup.Paths }
+	if cfg.TargetDrive == "" { return nil }
+	return []string{cfg.TargetDrive}
+}
+
+func duperemoveArgs(cfg DedupConfig, paths []string) []string {
+	args := []string{"-dhr"}
+	if cfg.HashFile != "" { args = append(args, "--hashfile="+cfg.HashFile) }
+	return append(args, paths...)
+}
+
+// dedupRunning reports whether this app already runs duperemove.
+func dedupRunning() bool {
+	runningCommands.mu.Lock()
+	defer runningCommands.mu.Unlock()
+	for _, c := range runningCommands.cmds {
+		if c.Name == "duperemove" { return true }
+	}
+	return false
+}
+
+// startDedup runs the configured tool and returns the log entry ID, or 0
+// if nothing was started.
+func startDedup(opType string) (int64, error) {
+	state.mu.Lock()
+	cfg := state.Config
+	state.mu.Unlock()
+	if cfg.Dedup.Tool == "bees" { return recordBeesStatus(cfg.Dedup), nil }
+	if err := featureError("dedup"); err != nil { return 0, fmt.Errorf("Feature unavailable: %v", err) }
+
+	paths := dedupPaths(cfg)
+	if len(paths) == 0 { return 0, fmt.Errorf("Target drive not set") }
+	if dedupRunning() { return 0, fmt.Errorf("duperemove is already running") }
+	return runCommandAsync(opType, "🧬", strings.Join(paths, ", "), "duperemove", duperemoveArgs(cfg.Dedup, paths)...), nil
+}
+
+func runScheduledDedup(run *JobRun) {
+	id, err := startDedup("AUTO DEDUP")
+	if err != nil {
+		printDockerLog("DEDUP", "Scheduled dedup skipped: %v", err)
+		return
+	}
+	run.tag(id)
+}
+
+func previewDedup(cfg Config) ([]PlannedOp, []string) {
+	if cfg.Dedup.Tool == "bees" {
+		return []PlannedOp{{Description: "Record bees status", Command: "cat " + beesStatusDir(cfg.Dedup) + "/*.status"}}, nil
+	}
+	paths := dedupPaths(cfg)
+	if len(paths) == 0 { return nil, []string{"target drive not set: job will do nothing"} }
+	var warnings []string
+	if _, err := exec.LookPath("duperemove"); err != nil { warnings = append(warnings, "duperemove is not installed") }
+	for _, p := range paths {
+		if _, err := os.Stat(p); err != nil { warnings = append(warnings, "dedup path not accessible: "+err.Error()) }
+	}
+	return []PlannedOp{{Description: "Deduplicate " + strings.Join(paths, ", "), Command: formatCommand("duperemove", duperemoveArgs(cfg.Dedup, paths)...)}}, warnings
+}
+
+var (
+	dupeFilesRe   = regexp.MustCompile(`(?m)^\[\d+/(\d+)\]`)
+	dupeFoundRe   = regexp.MustCompile(`(?i)found (\d+) (?:identical extents|instances of\s+extents)`)
+	dupeExtentsRe = regexp.MustCompile(`(?m)Dedupe (\d+) extents`)
+	dupeBytesRe   = regexp.MustCompile(`(?:net change in shared extents of|Kernel processed data \(excludes target files\)):\s*(\S+)`)
+)
+
+// parseDuperemove reads the summary lines of `duperemove -d`:
+//
+//	[3/5] (60.00%) csum: /mnt/data/b
+//	Found 4 identical extents.
+//	[0x55d6] Dedupe 1 extents (id: 7a1c2b3d) with target: (0.0, 128.0K), "/mnt/data/a"
+//	Comparison of extent info shows a net change in shared extents of: 256.0K
+func parseDuperemove(out string) *DedupResult {
+	r := &DedupResult{Tool: "duperemove"}
+	matched := false
+	for _, m := range dupeFilesRe.FindAllStringSubmatch(out, -1) {
+		if n, _ := strconv.ParseUint(m[1], 10, 64); n > r.Files { r.Files = n }
+		matched = true
+	}
+	// The hash comparison reports the candidates, the read and compare of
+	// newer versions then the ones that remain; the last count is the one.
+	for _, m := range dupeFoundRe.FindAllStringSubmatch(out, -1) {
+		r.ExtentsFound, _ = strconv.ParseUint(m[1], 10, 64)
+		matched = true
+	}
+	for _, m := range dupeExtentsRe.FindAllStringSubmatch(out, -1) {
+		n, _ := strconv.ParseUint(m[1], 10, 64)
+		r.ExtentsProcessed += n
+		matched = true
+	}
+	for _, m := range dupeBytesRe.FindAllStringSubmatch(out, -1) {
+		if n, ok := parseHumanSize(m[1]); ok { r.BytesDeduped += n }
+		matched = true
+	}
+	if !matched { return nil }
+	return r
+}
+
+func beesStatusDir(cfg DedupConfig) string {
+	if cfg.BeesStatusDir == "" { return defaultBeesStatusDir }
+	return cfg.BeesStatusDir
+}
+
+// BeesStatus is one filesystem's status file, rewritten by bees every few
+// seconds while it runs.
+type BeesStatus struct {
+	File    string       `json:"file"`
+	Updated time.Time    `json:"updated"`
+	Result  *DedupResult `json:"result"`
+	Text    string       `json:"text"`
+}
+
+// parseBeesStatus reads the counters of the TOTAL section:
+//
+//	TOTAL:
+//		addr_block=18320 ... dedup_bytes=228818944 dedup_hit=2270 ...
+//	RATES:
+func parseBeesStatus(text string) *DedupResult {
+	r := &DedupResult{Tool: "bees", Counters: map[string]uint64{}}
+	inTotal := false
+	for _, line := range strings.Split(text, "\n") {
+		if line != "" && line[0] != ' ' && line[0] != '\t' {
+			inTotal = strings.HasPrefix(line, "TOTAL:")
+			continue
+		}
+		if !inTotal { continue }
+		for _, f := range strings.Fields(line) {
+			k, v, ok := strings.Cut(f, "=")
+			if n, err := strconv.ParseUint(v, 10, 64); ok && err == nil { r.Counters[k] = n }
+		}
+	}
+	if len(r.Counters) == 0 { return nil }
+	r.BytesDeduped, r.ExtentsProcessed = r.Counters["dedup_bytes"], r.Counters["dedup_hit"]
+	return r
+}
+
+func readBeesStatus(cfg DedupConfig) ([]BeesStatus, error) {
+	dir := beesStatusDir(cfg)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.status"))
+	if len(files) == 0 { return nil, fmt.Errorf("no bees status in %s; is beesd running?", dir) }
+	sort.Strings(files)
+	var list []BeesStatus
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil { return nil, err }
+		info, _ := os.Stat(f)
+		s := BeesStatus{File: f, Text: string(data), Result: parseBeesStatus(string(data))}
+		if info != nil { s.Updated = info.ModTime() }
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// recordBeesStatus logs the bees counters, summed over all filesystems,
+// and returns the log entry ID.
+func recordBeesStatus(cfg DedupConfig) int64 {
+	dir := beesStatusDir(cfg)
+	id := startHistory("DEDUP STATUS", "🐝", dir, "Reading bees status")
+	list, err := readBeesStatus(cfg)
+	total := &DedupResult{Tool: "bees"}
+	var out []string
+	for _, s := range list {
+		out = append(out, fmt.Sprintf("--- %s (updated %s) ---\n%s", s.File, localTime(s.Updated).Format(displayLayout), strings.TrimRight(s.Text, "\n")))
+		if s.Result == nil { continue }
+		total.BytesDeduped += s.Result.BytesDeduped
+		total.ExtentsProcessed += s.Result.ExtentsProcessed
+	}
+	updateHistory(id, func(e *LogEntry) {
+		e.Duration = "0s"
+		if err != nil {
+			e.Status, e.Output = "Failed", err.Error()
+			return
+		}
+		e.Status, e.Output, e.Result = "Success", strings.Join(out, "\n"), &OperationResult{Dedup: total}
+	})
+	return id
+}
+
+// handleActionDedup runs a dedup pass (?action=start) or records the bees
+// status (?action=status).
+func handleActionDedup(w http.ResponseWriter, r *http.Request) {
+	var id int64
+	if r.URL.Query().Get("action") == "status" {
+		state.mu.Lock()
+		cfg := state.Config.Dedup
+		state.mu.Unlock()
+		id = recordBeesStatus(cfg)
+	} else {
+		state.mu.Lock()
+		cfg := state.Config
+		state.mu.Unlock()
+		if cfg.Dedup.Tool != "bees" && !requireFeature(w, "dedup") { return }
+		if refuseLocked(w, dedupPaths(cfg)...) { return }
+		var err error
+		if id, err = startDedup("DEDUP"); err != nil {
+			http.Error(w, err.Error(), 409)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
+}
+
+func handleBeesStatus(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	cfg := state.Config.Dedup
+	state.mu.Unlock()
+	list, err := readBeesStatus(cfg)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Device Management ---
+// Adding, removing and replacing devices moves data for hours and can't be
+// undone halfway, so every one of them goes through a two-step confirmation:
+// the first call returns a plan and a token, the second must present the
+// token and repeat the device being changed in "confirm".
+
+type Device struct {
+	DevID   uint64            `json:"devid"`
+	Path    string            `json:"path"`
+	Size    uint64            `json:"size"`
+	Used    uint64            `json:"used"`
+	Missing bool              `json:"missing"`
+	Errors  map[string]uint64 `json:"errors,omitempty"` // from `btrfs device stats`, e.g. write_io_errs
+}
+
+type ReplaceResult struct {
+	State       string  `json:"state"` // running, finished, canceled, suspended, never
+	Progress    float64 `json:"progress"`
+	WriteErrors uint64  `json:"write_errors"`
+	ReadErrors  uint64  `json:"read_errors"` // uncorrectable read errors
+}
+
+type DeviceRequest struct {
+	Device   string `json:"device"`   // add/remove: device path, devid or "missing"; resize: devid or path
+	Size     string `json:"size"`     // resize: max, e.g. 500g, or a change like +10g, see filesystem.go
+	Source   string `json:"source"`   // replace: devid or path of the device to replace
+	Target   string `json:"target"`   // replace: path of the new device
+	Force    bool   `json:"force"`    // overwrite an existing filesystem on the new device
+	Strategy string `json:"strategy"` // runbook: "replace" or "add-remove", chosen by size if empty
+	Token    string `json:"token"`
+	Confirm  string `json:"confirm"` // must repeat the device being removed or replaced
+}
+
+const replacePollInterval = 10 * time.Second
+
+// parseFilesystemShow reads `btrfs filesystem show --raw`:
+//
+//	devid    1 size 10737418240 used 2172649472 path /dev/sdb
+//	devid    2 size 0 used 0 path <missing disk> MISSING
+func parseFilesystemShow(out string) []Device {
+	devices := []Device{}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 || f[0] != "devid" { continue }
+		d := Device{}
+		d.DevID, _ = strconv.ParseUint(f[1], 10, 64)
+		for i := 2; i+1 < len(f); i++ {
+			switch f[i] {
+			case "size": d.Size, _ = strconv.ParseUint(f[i+1], 10, 64)
+			case "used": d.Used, _ = strconv.ParseUint(f[i+1], 10, 64)
+			case "path": d.Path = strings.TrimSpace(strings.TrimSuffix(strings.Join(f[i+1:], " "), "MISSING"))
+			}
+		}
+		d.Missing = strings.HasSuffix(strings.TrimSpace(line), "MISSING") || d.Path == "<missing disk>"
+		devices = append(devices, d)
+	}
+	return devices
+}
+
+// parseDeviceStats reads lines like "[/dev/sdb].write_io_errs    0".
+func parseDeviceStats(out string) map[string]map[string]uint64 {
+	stats := map[string]map[string]uint64{}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 || !strings.HasPrefix(f[0], "[") { continue }
+		dev, counter, ok := strings.Cut(strings.TrimPrefix(f[0], "["), "].")
+		if !ok { continue }
+		n, _ := strconv.ParseUint(f[1], 10, 64)
+		if stats[dev] == nil { stats[dev] = map[string]uint64{} }
+		stats[dev][counter] = n
+	}
+	return stats
+}
+
+func listDevices(path string) ([]Device, error) {
+	info, err := btrfsFS.FilesystemInfo(path)
+	if err != nil { return nil, err }
+	devices := info.Devices
+	// device stats exits non-zero when any counter is set, so only the
+	// output is looked at.
+	out, _ := exec.Command("btrfs", "device", "stats", path).CombinedOutput()
+	stats := parseDeviceStats(string(out))
+	for i := range devices { devices[i].Errors = stats[devices[i].Path] }
+	return devices, nil
+}
+
+// parseReplaceStatus reads `btrfs replace status -1`:
+//
+//	Started on 12.Oct 10:00:00, 10.0% done, 0 write errs, 0 uncorr. read errs
+//	Started on 12.Oct 10:00:00, finished on 12.Oct 14:00:00, 0 write errs, 0 uncorr. read errs
+//	Started on 12.Oct 10:00:00, canceled on 12.Oct 11:00:00 at 25.0%, 0 write errs, 0 uncorr. read errs
+//	Never started
+func parseReplaceStatus(out string) *ReplaceResult {
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "Never started" { return &ReplaceResult{State: "never"} }
+		if !strings.HasPrefix(line, "Started on") { continue }
+		r := &ReplaceResult{State: "running"}
+		for _, part := range strings.Split(line, ",") {
+			f := strings.Fields(part)
+			switch {
+			case len(f) == 2 && f[1] == "done":
+				r.Progress, _ = strconv.ParseFloat(strings.TrimSuffix(f[0], "%"), 64)
+			case len(f) > 0 && (f[0] == "finished" || f[0] == "canceled" || f[0] == "suspended"):
+				r.State = f[0]
+				if f[0] == "finished" { r.Progress = 100 }
+				if _, at, ok := strings.Cut(part, " at "); ok { r.Progress, _ = strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(at), "%"), 64) }
+			case strings.HasSuffix(part, "write errs") && len(f) > 0:
+				r.WriteErrors, _ = strconv.ParseUint(f[0], 10, 64)
+			case strings.HasSuffix(part, "read errs") && len(f) > 0:
+				r.ReadErrors, _ = strconv.ParseUint(f[0], 10, 64)
+			}
+		}
+		return r
+	}
+	return nil
+}
+
+func replaceStatus(path string) (*ReplaceResult, string, error) {
+	out, err := exec.Command("btrfs", "replace", "status", "-1", path).CombinedOutput()
+	if err != nil { return nil, string(out), fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out))) }
+	return parseReplaceStatus(string(out)), string(out), nil
+}
+
+// deviceOpRunning reports a device add/remove or replace that is still in
+// progress; btrfs runs only one of them at a time anyway.
+func deviceOpRunning(path string) string {
+	runningCommands.mu.Lock()
+	for _, c := range runningCommands.cmds {
+		if c.Name == "btrfs" && len(c.Args) > 1 && c.Args[0] == "device" && (c.Args[1] == "add" || c.Args[1] == "remove") {
+			runningCommands.mu.Unlock()
+			return "device " + c.Args[1]
+		}
+	}
+	runningCommands.mu.Unlock()
+	if runbookActive() { return "replace runbook" }
+	if r, _, err := replaceStatus(path); err == nil && r != nil && r.State == "running" { return "replace" }
+	return ""
+}
+
+// checkNewDevice makes sure a device to be added is a block device that is
+// not already part of the filesystem.
+func checkNewDevice(dev string, devices []Device) error {
+	if !strings.HasPrefix(dev, "/dev/") { return fmt.Errorf("device must be a path under /dev/") }
+	info, err := os.Stat(dev)
+	if err != nil { return err }
+	if info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 { return fmt.Errorf("%s is not a block device", dev) }
+	resolved, _ := filepath.EvalSymlinks(dev)
+	for _, d := range devices {
+		if d.Path == dev || d.Path == resolved { return fmt.Errorf("%s is already part of the filesystem (devid %d)", dev, d.DevID) }
+	}
+	return nil
+}
+
+// findDevice resolves a devid, device path or "missing" to a member device.
+func findDevice(ref string, devices []Device) (Device, error) {
+	for _, d := range devices {
+		if ref == strconv.FormatUint(d.DevID, 10) || ref == d.Path || (ref == "missing" && d.Missing) { return d, nil }
+	}
+	return Device{}, fmt.Errorf("%s is not a device of this filesystem", ref)
+}
+
+// --- Handlers ---
+
+func handleListDevices(w http.ResponseWriter, r *http.Request) {
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	devices, err := listDevices(path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	replace, _, _ := replaceStatus(path)
+	json.NewEncoder(w).Encode(map[string]interface{}{"path": path, "devices": devices, "replace": replace})
+}
+
+// deviceRequest decodes the request, lists the current devices and refuses
+// while another device operation is running.
+func deviceRequest(w http.ResponseWriter, r *http.Request) (string, DeviceRequest, []Device, bool) {
+	var req DeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), 400)
+		return "", req, nil, false
+	}
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return "", req, nil, false }
+	if refuseLocked(w, path) { return "", req, nil, false }
+	devices, err := listDevices(path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return "", req, nil, false
+	}
+	if op := deviceOpRunning(path); op != "" {
+		http.Error(w, "A "+op+" is already running on "+path, 409)
+		return "", req, nil, false
+	}
+	return path, req, devices, true
+}
+
+// confirmDeviceOp implements the confirmation step. It returns true once the
+// caller may go ahead; otherwise the plan or an error has been written.
+func confirmDeviceOp(w http.ResponseWriter, req DeviceRequest, action, device string, commands []string, warnings []string) bool {
+	target := action + ":" + device
+	if req.Token == "" {
+		token, expires := issueConfirmToken(action, target)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "confirm",
+			"token":    token,
+			"expires":  expires.Format(time.RFC3339),
+			"commands": commands,
+			"warnings": warnings,
+			"confirm":  device,
+		})
+		return false
+	}
+	if req.Confirm != device {
+		http.Error(w, "confirm must repeat the device: "+device, 400)
+		return false
+	}
+	if !consumeConfirmToken(req.Token, action, target) {
+		http.Error(w, "Invalid or expired confirmation token", 403)
+		return false
+	}
+	return true
+}
+
+func handleDeviceAdd(w http.ResponseWriter, r *http.Request) {
+	path, req, devices, ok := deviceRequest(w, r)
+	if !ok { return }
+	if err := checkNewDevice(req.Device, devices); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	args := []string{"device", "add"}
+	if req.Force { args = append(args, "-f") }
+	args = append(args, req.Device, path)
+	warnings := []string{fmt.Sprintf("everything on %s will be overwritten", req.Device),
+		"existing data stays where it is until a balance spreads it over the new device"}
+	if !confirmDeviceOp(w, req, "device-add", req.Device, []string{formatCommand("btrfs", args...)}, warnings) { return }
+
+	id := runCommandAsync("DEVICE ADD", "💽", fmt.Sprintf("%s ➡️ %s", req.Device, path), "btrfs", args...)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
+}
+
+func handleDeviceRemove(w http.ResponseWriter, r *http.Request) {
+	path, req, devices, ok := deviceRequest(w, r)
+	if !ok { return }
+	dev, err := findDevice(req.Device, devices)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if len(devices) < 2 {
+		http.Error(w, "cannot remove the only device of the filesystem", 400)
+		return
+	}
+	ref := strconv.FormatUint(dev.DevID, 10)
+	if dev.Missing { ref = "missing" }
+	args := []string{"device", "remove", ref, path}
+	warnings := []string{fmt.Sprintf("%s of data is moved off devid %d (%s) first; this can take hours and fails if the other devices lack the space or the RAID profile needs more devices", formatBytes(dev.Used), dev.DevID, dev.Path)}
+	if !confirmDeviceOp(w, req, "device-remove", req.Device, []string{formatCommand("btrfs", args...)}, warnings) { return }
+
+	id := runCommandAsync("DEVICE REMOVE", "💽", fmt.Sprintf("%s (devid %d) ⬅️ %s", dev.Path, dev.DevID, path), "btrfs", args...)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
+}
+
+func handleReplaceStart(w http.ResponseWriter, r *http.Request) {
+	path, req, devices, ok := deviceRequest(w, r)
+	if !ok { return }
+	src, err := findDevice(req.Source, devices)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := checkNewDevice(req.Target, devices); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	// A missing device can only be referred to by its devid; -r reads from
+	// the other mirrors where possible, which is what you want for a failing
+	// disk.
+	args := []string{"replace", "start", "-r"}
+	if req.Force { args = append(args, "-f") }
+	args = append(args, strconv.FormatUint(src.DevID, 10), req.Target, path)
+	warnings := []string{fmt.Sprintf("everything on %s will be overwritten", req.Target),
+		fmt.Sprintf("devid %d (%s) is dropped from the filesystem once the copy finishes", src.DevID, src.Path)}
+	if !confirmDeviceOp(w, req, "replace", req.Source, []string{formatCommand("btrfs", args...)}, warnings) { return }
+
+	visualPath := fmt.Sprintf("%s (devid %d) ➡️ %s", src.Path, src.DevID, req.Target)
+	out, err := exec.Command("btrfs", args...).CombinedOutput()
+	if err != nil {
+		logHistory("REPLACE", "🔁", visualPath, "Failed", string(out)+"\nError: "+err.Error())
+		http.Error(w, strings.TrimSpace(string(out)), 500)
+		return
+	}
+	id := trackReplace(path, visualPath, "Started: "+formatCommand("btrfs", args...))
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
+}
+
+// trackReplace follows a replace running in the kernel, keeping its history
+// entry's progress current until it finished or was canceled.
+func trackReplace(path, visualPath, intro string) int64 {
+	start := time.Now()
+	id := startHistory("REPLACE", "🔁", visualPath, intro)
+	go func() {
+		for {
+			time.Sleep(replacePollInterval)
+			status, out, err := replaceStatus(path)
+			done := err != nil || status == nil || status.State != "running"
+			updateHistory(id, func(e *LogEntry) {
+				e.Output = intro + "\n\n" + out
+				e.Duration = time.Since(start).Round(time.Second).String()
+				if status != nil { e.Result = &OperationResult{Replace: status} }
+				if !done { return }
+				switch {
+				case err != nil || status == nil: e.Status = "Failed"
+				case status.State == "finished" && status.WriteErrors+status.ReadErrors == 0: e.Status = "Success"
+				case status.State == "finished": e.Status = "Warning"
+				default: e.Status = "Failed"
+				}
+			})
+			if done {
+				printDockerLog("REPLACE", "Replace on %s ended: %s", path, strings.TrimSpace(out))
+				return
+			}
+		}
+	}()
+	return id
+}
+
+func handleReplaceStatus(w http.ResponseWriter, r *http.Request) {
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	status, out, err := replaceStatus(path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"path": path, "replace": status, "output": out})
+}
+
+func handleReplaceCancel(w http.ResponseWriter, r *http.Request) {
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	id := runCommandAsync("REPLACE CANCEL", "🛑", path, "btrfs", "replace", "cancel", path)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
+}
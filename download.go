@@ -0,0 +1,218 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// --- Snapshot Downloads ---
+// GET /api/snapshots/{name}/archive serves a file from a snapshot (with
+// range requests, so big downloads can be resumed) or a directory as a tar
+// or zip stream. Snapshots of writable jobs are read through a temporary
+// read-only bind mount so nothing done while serving can change them.
+
+type DownloadConfig struct {
+	MaxMB int `json:"max_mb,omitempty"` // largest directory archive or whole file, default 4096
+}
+
+const defaultDownloadMaxMB = 4096
+
+func (c DownloadConfig) maxBytes() int64 {
+	if c.MaxMB <= 0 { return defaultDownloadMaxMB << 20 }
+	return int64(c.MaxMB) << 20
+}
+
+// readOnlyView returns a directory showing root that can't be written to:
+// root itself for read-only snapshots, else a read-only bind mount of it
+// that release unmounts again.
+func readOnlyView(job SnapshotJob, root string) (string, func(), error) {
+	if !job.Writable { return root, func() {}, nil }
+	dir, err := os.MkdirTemp("", "btrfs-webui-view-")
+	if err != nil { return "", nil, err }
+	if out, err := exec.Command("mount", "--bind", root, dir).CombinedOutput(); err != nil {
+		os.Remove(dir)
+		return "", nil, fmt.Errorf("bind mount: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	release := func() {
+		if out, err := exec.Command("umount", dir).CombinedOutput(); err != nil {
+			logWarn("DOWNLOAD", "Cannot unmount %s: %v: %s", dir, err, strings.TrimSpace(string(out)))
+			return
+		}
+		os.Remove(dir)
+	}
+	if out, err := exec.Command("mount", "-o", "remount,bind,ro", dir).CombinedOutput(); err != nil {
+		release()
+		return "", nil, fmt.Errorf("remount read-only: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return dir, release, nil
+}
+
+// treeSize sums the sizes of the regular files below dir.
+func treeSize(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil { return err }
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil { return err }
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// handleSnapshotArchive downloads ?path= from a snapshot: a file as is, a
+// directory as ?format=tar (default) or zip.
+func handleSnapshotArchive(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	job, err := jobFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	root, err := snapshotRoot(job, name)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" { format = "tar" }
+	if format != "tar" && format != "zip" {
+		http.Error(w, "format must be tar or zip", 400)
+		return
+	}
+	if _, err := os.Stat(root); err != nil {
+		http.Error(w, "Snapshot not found", 404)
+		return
+	}
+	view, release, err := readOnlyView(job, root)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer release()
+	p, err := resolveInside(view, r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	state.mu.Lock()
+	limit := state.Config.Download.maxBytes()
+	state.mu.Unlock()
+	base := filepath.Base(p)
+	if strings.Trim(r.URL.Query().Get("path"), "/") == "" { base = name }
+
+	if info.Mode().IsRegular() {
+		// A range request reads only part of the file, so the limit is for
+		// whole downloads.
+		if info.Size() > limit && r.Header.Get("Range") == "" {
+			http.Error(w, fmt.Sprintf("%s is larger than the download limit of %d MiB; request it in ranges", base, limit>>20), 413)
+			return
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", base))
+		http.ServeContent(w, r, base, info.ModTime(), f)
+		return
+	}
+	if !info.IsDir() {
+		http.Error(w, "Only files and directories can be downloaded", 400)
+		return
+	}
+	size, err := treeSize(p)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if size > limit {
+		http.Error(w, fmt.Sprintf("%s holds %d MiB, more than the download limit of %d MiB", base, size>>20, limit>>20), 413)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", base+"."+format))
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		err = writeZip(w, p, base)
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+		err = writeTar(w, p, base)
+	}
+	// The headers are out by now; all that is left is to stop early.
+	if err != nil { logWarn("DOWNLOAD", "Archive of %s:%s cut short: %v", name, r.URL.Query().Get("path"), err) }
+}
+
+// writeTar writes the tree at dir as a tar stream with entries below base.
+// Symlinks are stored as links, not followed.
+func writeTar(out io.Writer, dir, base string) error {
+	tw := tar.NewWriter(out)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil { return err }
+		info, err := d.Info()
+		if err != nil { return err }
+		link := ""
+		if d.Type()&fs.ModeSymlink != 0 { link, _ = os.Readlink(p) }
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil { return nil } // sockets, devices: skipped
+		rel, _ := filepath.Rel(dir, p)
+		hdr.Name = filepath.ToSlash(filepath.Join(base, rel))
+		if d.IsDir() { hdr.Name += "/" }
+		if err := tw.WriteHeader(hdr); err != nil { return err }
+		if !d.Type().IsRegular() { return nil }
+		return copyFile(tw, p)
+	})
+	if err != nil { return err }
+	return tw.Close()
+}
+
+// writeZip is writeTar for zip; symlinks are left out as zip has no
+// portable way to store them.
+func writeZip(out io.Writer, dir, base string) error {
+	zw := zip.NewWriter(out)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil { return err }
+		if !d.IsDir() && !d.Type().IsRegular() { return nil }
+		info, err := d.Info()
+		if err != nil { return err }
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil { return err }
+		rel, _ := filepath.Rel(dir, p)
+		hdr.Name = filepath.ToSlash(filepath.Join(base, rel))
+		if d.IsDir() {
+			hdr.Name += "/"
+		} else {
+			hdr.Method = zip.Deflate
+		}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil || d.IsDir() { return err }
+		return copyFile(fw, p)
+	})
+	if err != nil { return err }
+	return zw.Close()
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil { return err }
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
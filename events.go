@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// --- Event Hub (pub/sub for live dashboards) ---
+
+type Event struct {
+	Name string
+	Data []byte
+}
+
+// Hub fans published events out to every subscriber. Slow subscribers drop
+// events instead of blocking publishers, so a stalled browser tab can never
+// hold up a command goroutine; Lost tells a subscriber it missed some.
+type Hub struct {
+	mu      sync.Mutex
+	clients map[chan Event]struct{}
+	last    map[string]Event
+	lost    map[chan Event]bool
+}
+
+var hub = &Hub{
+	clients: make(map[chan Event]struct{}),
+	last:    make(map[string]Event),
+	lost:    make(map[chan Event]bool),
+}
+
+func (h *Hub) Subscribe() (chan Event, func()) {
+	ch := make(chan Event, 16)
+	h.mu.Lock()
+	h.clients[ch] = struct{}{}
+	// Replay the latest value of every event so new viewers render immediately.
+	for _, ev := range h.last {
+		ch <- ev
+	}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.clients, ch)
+		delete(h.lost, ch)
+		h.mu.Unlock()
+	}
+}
+
+// Publish sends an event and keeps it for subscribers still to come.
+func (h *Hub) Publish(name string, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last[name] = Event{Name: name, Data: data}
+	h.send(Event{Name: name, Data: data})
+}
+
+// Send sends an event that only matters as it happens.
+func (h *Hub) Send(name string, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.send(Event{Name: name, Data: data})
+}
+
+func (h *Hub) send(ev Event) {
+	for ch := range h.clients {
+		select {
+		case ch <- ev:
+		default:
+			h.lost[ch] = true
+		}
+	}
+}
+
+// Lost reports whether ch dropped events since the last call.
+func (h *Hub) Lost(ch chan Event) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	lost := h.lost[ch]
+	delete(h.lost, ch)
+	return lost
+}
+
+func (h *Hub) Clients() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// --- Entry and Job Events ---
+// Besides the throttled page of the history, every new or changed log entry
+// is sent on its own as "entry", and the start and end of a scheduled job's
+// run as "job", for clients that keep their own copy of the history (see
+// ws.go). They are not replayed to new subscribers.
+
+type JobEvent struct {
+	Job    string    `json:"job"`
+	Run    string    `json:"run"`
+	State  string    `json:"state"`            // running, finished
+	Status string    `json:"status,omitempty"` // worst of the run's entries, once finished
+	Stats  *JobStats `json:"stats,omitempty"`  // of the job, once finished
+}
+
+// publishEntry sends e as it is now. Callers usually hold state.mu.
+func publishEntry(e LogEntry) {
+	if data, err := json.Marshal(e); err == nil { hub.Send("entry", data) }
+}
+
+func publishJob(ev JobEvent) {
+	if data, err := json.Marshal(ev); err == nil { hub.Send("job", data) }
+}
+
+// --- Throttled History Broadcast ---
+
+// historyDirty is signalled (non-blocking) whenever state.History changes.
+// Callers usually hold state.mu, so this must never block.
+var historyDirty = make(chan struct{}, 1)
+
+func notifyHistoryChanged() {
+	select {
+	case historyDirty <- struct{}{}:
+	default:
+	}
+}
+
+// runHistoryBroadcaster serializes the newest page of the history at most
+// once per interval, no matter how many clients are connected or how many
+// changes happened.
+func runHistoryBroadcaster(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	pending := true
+	for {
+		select {
+		case <-historyDirty:
+			pending = true
+		case <-ticker.C:
+			if !pending {
+				continue
+			}
+			pending = false
+			hub.Publish("history", newestHistoryJSON())
+		}
+	}
+}
+
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch, unsubscribe := hub.Subscribe()
+	defer unsubscribe()
+
+	keepalive := time.NewTicker(25 * time.Second)
+	defer keepalive.Stop()
+
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case ev := <-ch:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Name, ev.Data)
+			flusher.Flush()
+		}
+	}
+}
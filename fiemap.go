@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// --- FIEMAP ---
+// Minimal FS_IOC_FIEMAP wrapper used to find which physical extents a file
+// occupies, so shared (reflinked / snapshotted) data can be detected.
+
+const (
+	fsIocFiemap        = 0xC020660B // _IOWR('f', 11, struct fiemap)
+	fiemapFlagSync     = 0x1
+	fiemapExtentLast   = 0x1
+	fiemapExtentInline = 0x200
+	fiemapBatch        = 256
+)
+
+type fiemapHeader struct {
+	Start         uint64
+	Length        uint64
+	Flags         uint32
+	MappedExtents uint32
+	ExtentCount   uint32
+	Reserved      uint32
+}
+
+type fiemapExtent struct {
+	Logical    uint64
+	Physical   uint64
+	Length     uint64
+	Reserved64 [2]uint64
+	Flags      uint32
+	Reserved   [3]uint32
+}
+
+type physRange struct {
+	Start, End uint64
+}
+
+// fileExtents returns the physical byte ranges backing path. Inline extents
+// live in metadata and have no physical address, so they are skipped.
+func fileExtents(path string) ([]physRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, unsafe.Sizeof(fiemapHeader{})+fiemapBatch*unsafe.Sizeof(fiemapExtent{}))
+	hdr := (*fiemapHeader)(unsafe.Pointer(&buf[0]))
+	extents := unsafe.Slice((*fiemapExtent)(unsafe.Pointer(&buf[unsafe.Sizeof(fiemapHeader{})])), fiemapBatch)
+
+	var ranges []physRange
+	var start uint64
+	for {
+		*hdr = fiemapHeader{Start: start, Length: ^uint64(0), Flags: fiemapFlagSync, ExtentCount: fiemapBatch}
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(&buf[0])))
+		if errno != 0 {
+			return nil, errno
+		}
+		n := int(hdr.MappedExtents)
+		if n == 0 {
+			return ranges, nil
+		}
+		for _, e := range extents[:n] {
+			if e.Flags&fiemapExtentInline == 0 && e.Length > 0 {
+				ranges = append(ranges, physRange{e.Physical, e.Physical + e.Length})
+			}
+			if e.Flags&fiemapExtentLast != 0 {
+				return ranges, nil
+			}
+		}
+		last := extents[n-1]
+		start = last.Logical + last.Length
+	}
+}
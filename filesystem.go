@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// --- Filesystem Label, UUIDs and Resize ---
+// GET /api/filesystem shows the label and UUID of the target drive and the
+// UUIDs of the subvolume it is a path in; the label can be changed while
+// mounted. Resizing (`btrfs filesystem resize`) grows a device's share of
+// the filesystem into a partition or volume that was enlarged ("max" or
+// "+10g"), or shrinks it, moving data off the end first, before the
+// partition is made smaller. It works per device and goes through the same
+// two-step confirmation as the device operations in devices.go, repeating
+// the devid.
+
+const maxLabelLength = 255 // bytes, BTRFS_LABEL_SIZE without the NUL
+
+var resizeSizeRe = regexp.MustCompile(`(?i)^(max|[+-]?[0-9]+[kmgtpe]?)$`)
+
+type FilesystemDetails struct {
+	Path      string   `json:"path"`
+	Label     string   `json:"label"`
+	UUID      string   `json:"uuid"` // of the filesystem, as in /dev/disk/by-uuid
+	Devices   []Device `json:"devices"`
+	Subvolume struct {
+		ID           string `json:"id,omitempty"`
+		Name         string `json:"name,omitempty"`
+		UUID         string `json:"uuid,omitempty"`
+		ParentUUID   string `json:"parent_uuid,omitempty"`
+		ReceivedUUID string `json:"received_uuid,omitempty"`
+	} `json:"subvolume"`
+}
+
+// resizeTarget works out the new size of dev for a resize argument and
+// whether it shrinks the device.
+func resizeTarget(size string, dev Device) (uint64, bool, error) {
+	size = strings.ToLower(size)
+	if !resizeSizeRe.MatchString(size) { return 0, false, fmt.Errorf("size must be max, a size like 500g, or a change like +10g or -5g") }
+	if size == "max" { return 0, false, nil }
+	num := strings.TrimLeft(size, "+-")
+	shift := 0
+	if i := strings.IndexAny(num, "kmgtpe"); i >= 0 {
+		shift = 10 * (strings.IndexByte("kmgtpe", num[i]) + 1)
+		num = num[:i]
+	}
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil || (shift > 0 && n > (1<<64-1)>>shift) { return 0, false, fmt.Errorf("size %s is out of range", size) }
+	n <<= shift
+	switch size[0] {
+	case '+': return dev.Size + n, false, nil
+	case '-':
+		if n >= dev.Size { return 0, false, fmt.Errorf("cannot shrink devid %d (%s) by more than its size", dev.DevID, formatBytes(dev.Size)) }
+		return dev.Size - n, true, nil
+	}
+	return n, n < dev.Size, nil
+}
+
+// --- Handlers ---
+
+func handleFilesystem(w http.ResponseWriter, r *http.Request) {
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	info, err := btrfsFS.FilesystemInfo(path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	d := FilesystemDetails{Path: path, Label: info.Label, UUID: info.UUID, Devices: info.Devices}
+	if sub, err := showSubvolume(path); err == nil {
+		d.Subvolume.ID, d.Subvolume.Name, d.Subvolume.UUID = sub["Subvolume ID"], sub["Name"], sub["UUID"]
+		if v := sub["Parent UUID"]; v != "-" { d.Subvolume.ParentUUID = v }
+		if v := sub["Received UUID"]; v != "-" { d.Subvolume.ReceivedUUID = v }
+	}
+	json.NewEncoder(w).Encode(d)
+}
+
+// handleSetLabel sets the label of the filesystem to {"label"}; an empty
+// label clears it.
+func handleSetLabel(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Label string `json:"label"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), 400)
+		return
+	}
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	if len(req.Label) > maxLabelLength || !utf8.ValidString(req.Label) || strings.ContainsAny(req.Label, "\n\r\x00") {
+		http.Error(w, fmt.Sprintf("label must be valid UTF-8 on one line of at most %d bytes", maxLabelLength), 400)
+		return
+	}
+	info, err := btrfsFS.FilesystemInfo(path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out, err := exec.Command("btrfs", "filesystem", "label", path, req.Label).CombinedOutput()
+	if err != nil {
+		logHistory("LABEL", "🏷️", path, "Failed", string(out)+"\nError: "+err.Error())
+		http.Error(w, strings.TrimSpace(string(out)), 500)
+		return
+	}
+	logHistory("LABEL", "🏷️", path, "Success", fmt.Sprintf("Label %q ➡️ %q (filesystem %s)", info.Label, req.Label, info.UUID))
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "label": req.Label, "previous": info.Label})
+}
+
+// handleResize resizes devid {"device"} (the only device by default) to
+// {"size"}, after confirmation.
+func handleResize(w http.ResponseWriter, r *http.Request) {
+	path, req, devices, ok := deviceRequest(w, r)
+	if !ok { return }
+	if req.Device == "" && len(devices) == 1 { req.Device = strconv.FormatUint(devices[0].DevID, 10) }
+	if req.Device == "" {
+		http.Error(w, "device (the devid to resize) is required on a filesystem with several devices", 400)
+		return
+	}
+	dev, err := findDevice(req.Device, devices)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if dev.Missing {
+		http.Error(w, "cannot resize a missing device", 400)
+		return
+	}
+	newSize, shrink, err := resizeTarget(req.Size, dev)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	ref := strconv.FormatUint(dev.DevID, 10)
+	args := []string{"filesystem", "resize", ref + ":" + strings.ToLower(req.Size), path}
+	var warnings []string
+	switch {
+	case newSize == 0:
+		warnings = append(warnings, fmt.Sprintf("devid %d (%s) grows to the whole size of its partition or volume; enlarge that first", dev.DevID, dev.Path))
+	case shrink:
+		warnings = append(warnings, fmt.Sprintf("devid %d (%s) shrinks from %s to %s; data past the new end is moved first, which fails if the rest of the device can't hold it", dev.DevID, dev.Path, formatBytes(dev.Size), formatBytes(newSize)),
+			"shrink the partition or volume only afterwards, and not below the new size")
+		if newSize < dev.Used { warnings = append(warnings, fmt.Sprintf("the new size is below the %s allocated on the device", formatBytes(dev.Used))) }
+	default:
+		warnings = append(warnings, fmt.Sprintf("devid %d (%s) grows from %s to %s; the partition or volume must already be that large", dev.DevID, dev.Path, formatBytes(dev.Size), formatBytes(newSize)))
+	}
+	if !confirmDeviceOp(w, req, "resize", ref, []string{formatCommand("btrfs", args...)}, warnings) { return }
+
+	id := runCommandAsync("RESIZE", "📏", fmt.Sprintf("%s (devid %d) ➡️ %s", dev.Path, dev.DevID, req.Size), "btrfs", args...)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
+}
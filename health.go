@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Health Watchdog ---
+// Periodically checks the target drive for conditions that end in ENOSPC or
+// an unusable filesystem. Every change of a check's status is recorded in
+// the history and, with the health event enabled, notified.
+
+type HealthConfig struct {
+	IntervalMinutes    int `json:"interval_minutes"`    // default 5
+	UnallocatedPercent int `json:"unallocated_percent"` // warn below, default 10
+	MetadataPercent    int `json:"metadata_percent"`    // warn above, default 90
+}
+
+type HealthCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"` // ok, warning, critical
+	Message string `json:"message"`
+}
+
+type HealthReport struct {
+	Path    string        `json:"path"`
+	Status  string        `json:"status"`
+	Checked string        `json:"checked"`
+	Checks  []HealthCheck `json:"checks"`
+	Error   string        `json:"error,omitempty"`
+}
+
+var healthStatusRank = map[string]int{"ok": 0, "warning": 1, "critical": 2}
+
+var health = struct {
+	mu     sync.Mutex
+	report *HealthReport
+	last   map[string]string // check name → status at the previous run
+}{last: make(map[string]string)}
+
+// metadataReserve is how much unallocated space a metadata-heavy filesystem
+// needs to be able to allocate another metadata chunk.
+const metadataReserve = 1 << 30
+
+func (c HealthConfig) withDefaults() HealthConfig {
+	if c.IntervalMinutes <= 0 { c.IntervalMinutes = 5 }
+	if c.UnallocatedPercent <= 0 { c.UnallocatedPercent = 10 }
+	if c.MetadataPercent <= 0 { c.MetadataPercent = 90 }
+	return c
+}
+
+// mountOf returns the mount that path lives on.
+func mountOf(path string) (Mount, bool) {
+	mounts, err := readMounts()
+	if err != nil { return Mount{}, false }
+	path = filepath.Clean(path)
+	var best Mount
+	found := false
+	for _, m := range mounts {
+		if m.Path == path || m.Path == "/" || strings.HasPrefix(path, m.Path+"/") {
+			if !found || len(m.Path) > len(best.Path) { best, found = m, true }
+		}
+	}
+	return best, found
+}
+
+func checkHealth(path string, cfg HealthConfig) *HealthReport {
+	report := &HealthReport{Path: path, Status: "ok", Checked: time.Now().Format(time.RFC3339), Checks: []HealthCheck{}}
+	add := func(name, status, format string, args ...interface{}) {
+		report.Checks = append(report.Checks, HealthCheck{Name: name, Status: status, Message: fmt.Sprintf(format, args...)})
+		if healthStatusRank[status] > healthStatusRank[report.Status] { report.Status = status }
+	}
+
+	if m, ok := mountOf(path); ok {
+		readOnly := false
+		for _, opt := range strings.Split(m.Options, ",") {
+			if opt == "ro" { readOnly = true }
+		}
+		if readOnly {
+			add("read_only", "critical", "%s is mounted read-only (btrfs remounts read-only after fatal errors; check dmesg)", m.Path)
+		} else {
+			add("read_only", "ok", "%s is mounted read-write", m.Path)
+		}
+	}
+
+	usage, err := getFilesystemUsage(path)
+	if err != nil || usage.Total == 0 {
+		report.Error = "cannot read filesystem usage"
+		if err != nil { report.Error = err.Error() }
+		add("usage", "warning", "%s", report.Error)
+		return report
+	}
+
+	unallocPct := float64(usage.DeviceUnallocated) * 100 / float64(usage.Total)
+	if unallocPct < float64(cfg.UnallocatedPercent) {
+		add("unallocated", "warning", "%.1f%% unallocated (%s), below %d%%; a balance can return unused chunks", unallocPct, formatBytes(usage.DeviceUnallocated), cfg.UnallocatedPercent)
+	} else {
+		add("unallocated", "ok", "%.1f%% unallocated (%s)", unallocPct, formatBytes(usage.DeviceUnallocated))
+	}
+
+	var meta ChunkUsage
+	for _, c := range usage.Chunks {
+		if c.Type == "Metadata" { meta = c }
+	}
+	if meta.Size > 0 {
+		metaPct := float64(meta.Used) * 100 / float64(meta.Size)
+		switch {
+		case usage.GlobalReserveUsed > 0:
+			add("metadata", "critical", "global reserve in use (%s): metadata is exhausted", formatBytes(usage.GlobalReserveUsed))
+		case metaPct > float64(cfg.MetadataPercent) && usage.DeviceUnallocated < metadataReserve:
+			add("metadata", "critical", "metadata %.1f%% full and only %s unallocated for new metadata chunks", metaPct, formatBytes(usage.DeviceUnallocated))
+		case metaPct > float64(cfg.MetadataPercent):
+			add("metadata", "warning", "metadata %.1f%% full (%s of %s)", metaPct, formatBytes(meta.Used), formatBytes(meta.Size))
+		default:
+			add("metadata", "ok", "metadata %.1f%% full", metaPct)
+		}
+	}
+	return report
+}
+
+// runHealthCheck checks the target drive, caches the report and records
+// every check whose status changed since the previous run.
+func runHealthCheck() *HealthReport {
+	state.mu.Lock()
+	path := state.Config.TargetDrive
+	cfg := state.Config.Health.withDefaults()
+	state.mu.Unlock()
+	if path == "" { return &HealthReport{Status: "ok", Checks: []HealthCheck{}, Error: "Target drive not set"} }
+
+	report := checkHealth(path, cfg)
+
+	health.mu.Lock()
+	health.report = report
+	var changed []HealthCheck
+	for _, c := range report.Checks {
+		prev, seen := health.last[c.Name]
+		health.last[c.Name] = c.Status
+		// The first run only reports problems, not that everything is fine.
+		if prev == c.Status || (!seen && c.Status == "ok") { continue }
+		changed = append(changed, c)
+	}
+	health.mu.Unlock()
+
+	for _, c := range changed {
+		status, title := "Warning", "Health "+c.Status+": "+c.Name
+		if c.Status == "ok" { status, title = "Success", "Health recovered: "+c.Name }
+		printDockerLog("HEALTH", "%s: %s", title, c.Message)
+		logHistory("HEALTH", "🩺", path+" ➡️ "+c.Name, status, c.Message)
+		go notify(newNotification(EventHealth, title, fmt.Sprintf("%s: %s", path, c.Message)))
+	}
+	return report
+}
+
+func runHealthWatchdog() {
+	for {
+		runHealthCheck()
+		evaluateRules()
+		state.mu.Lock()
+		interval := time.Duration(state.Config.Health.withDefaults().IntervalMinutes) * time.Minute
+		state.mu.Unlock()
+		time.Sleep(interval)
+	}
+}
+
+// handleHealth returns the latest report; ?refresh=1 checks right away.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	health.mu.Lock()
+	report := health.report
+	health.mu.Unlock()
+	if report == nil || r.URL.Query().Get("refresh") == "1" { report = runHealthCheck() }
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Activity Log Queries ---
+// The history keeps the newest history_limit entries (default 100).
+// /api/history filters and pages through them on the server, and the event
+// stream only carries the newest page, so a large history costs nothing
+// until someone looks further back.
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 100000
+	historyPageSize     = 100 // entries in the event stream
+)
+
+func historyLimit(cfg Config) int {
+	if cfg.HistoryLimit <= 0 { return defaultHistoryLimit }
+	return cfg.HistoryLimit
+}
+
+// trimHistory drops the oldest entries beyond the limit. The caller holds
+// state.mu.
+func trimHistory() {
+	if n := historyLimit(state.Config); len(state.History) > n { state.History = state.History[:n] }
+}
+
+// entryTime is when the entry was started; IDs are its UnixNano.
+func entryTime(e LogEntry) time.Time { return time.Unix(0, e.ID) }
+
+type HistoryFilter struct {
+	Types    map[string]bool // upper case
+	Statuses map[string]bool // normalized by statusKey
+	Path     string          // substring
+	Job      string          // scheduled job, see jobruns.go
+	Since    time.Time
+	Until    time.Time
+}
+
+// statusKey lets ?status=running match "Running...".
+func statusKey(s string) string { return strings.ToLower(strings.TrimSuffix(s, "...")) }
+
+// parseHistoryTime reads RFC 3339 or a local date; a date as the upper
+// bound includes that whole day.
+func parseHistoryTime(s string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil { return t, nil }
+	t, err := time.ParseInLocation("2006-01-02", s, appLocation())
+	if err != nil { return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or YYYY-MM-DD", s) }
+	if endOfDay { t = t.AddDate(0, 0, 1) }
+	return t, nil
+}
+
+// listParam collects comma-separated and repeated values of key.
+func listParam(q url.Values, key string, norm func(string) string) map[string]bool {
+	var set map[string]bool
+	for _, v := range q[key] {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item == "" { continue }
+			if set == nil { set = map[string]bool{} }
+			set[norm(item)] = true
+		}
+	}
+	return set
+}
+
+func parseHistoryFilter(q url.Values) (HistoryFilter, error) {
+	f := HistoryFilter{Types: listParam(q, "type", strings.ToUpper), Statuses: listParam(q, "status", statusKey), Path: q.Get("path"), Job: q.Get("job")}
+	var err error
+	if s := q.Get("since"); s != "" {
+		if f.Since, err = parseHistoryTime(s, false); err != nil { return f, err }
+	}
+	if s := q.Get("until"); s != "" {
+		if f.Until, err = parseHistoryTime(s, true); err != nil { return f, err }
+	}
+	return f, nil
+}
+
+func (f HistoryFilter) match(e LogEntry) bool {
+	if f.Types != nil && !f.Types[strings.ToUpper(e.Type)] { return false }
+	if f.Statuses != nil && !f.Statuses[statusKey(e.Status)] { return false }
+	if f.Path != "" && !strings.Contains(e.Path, f.Path) { return false }
+	if f.Job != "" && e.JobID != f.Job { return false }
+	t := entryTime(e)
+	if !f.Since.IsZero() && t.Before(f.Since) { return false }
+	if !f.Until.IsZero() && !t.Before(f.Until) { return false }
+	return true
+}
+
+// filterHistory returns the matching entries, newest first.
+func filterHistory(f HistoryFilter) []LogEntry {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	list := []LogEntry{}
+	for _, e := range state.History {
+		if f.match(e) { list = append(list, e) }
+	}
+	return list
+}
+
+// handleHistory returns the activity log, newest first, filtered by ?type=,
+// ?status=, ?path=, ?job=, ?since= and ?until=. ?limit= pages through it from
+// ?offset=, or from the entry after ?before=<id> (X-Next-Cursor). Without
+// a limit everything that matches is returned. X-Total-Count is the number
+// of matching entries.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f, err := parseHistoryFilter(q)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	limit, offset := 0, 0
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 { http.Error(w, "limit must be a positive number", 400); return }
+	}
+	if s := q.Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 { http.Error(w, "offset must not be negative", 400); return }
+	}
+
+	list := filterHistory(f)
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(list)))
+	if s := q.Get("before"); s != "" {
+		before, err := strconv.ParseInt(s, 10, 64)
+		if err != nil { http.Error(w, "before must be an entry ID", 400); return }
+		i := 0
+		for i < len(list) && list[i].ID >= before { i++ }
+		offset += i
+	}
+	if offset > len(list) { offset = len(list) }
+	page := list[offset:]
+	if limit > 0 && limit < len(page) {
+		page = page[:limit]
+		w.Header().Set("X-Next-Cursor", strconv.FormatInt(page[len(page)-1].ID, 10))
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// handleHistoryExport downloads the filtered activity log as ?format=json
+// (the entries as in /api/history) or csv.
+func handleHistoryExport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f, err := parseHistoryFilter(q)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	format := q.Get("format")
+	if format == "" { format = "csv" }
+	if format != "csv" && format != "json" {
+		http.Error(w, "format must be csv or json", 400)
+		return
+	}
+	list := filterHistory(f)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"btrfs-history-%s.%s\"", time.Now().Format("2006-01-02"), format))
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "time", "type", "path", "status", "duration", "termination", "output"})
+	for _, e := range list {
+		cw.Write([]string{strconv.FormatInt(e.ID, 10), entryTime(e).UTC().Format(time.RFC3339), e.Type, e.Path, e.Status, e.Duration, e.Termination, e.Output})
+	}
+	cw.Flush()
+}
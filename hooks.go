@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- Snapshot Hooks ---
+// Shell commands a job runs around its snapshots, e.g. to flush and lock a
+// database or fsfreeze a filesystem before and release it after. A failing
+// pre hook skips the snapshot (and the post hook); a failing post hook turns
+// a successful snapshot into a warning. Hooks run under the SNAPSHOT HOOK
+// command timeout and their output goes into the snapshot's log entry.
+
+type SnapshotHooks struct {
+	Pre  string `json:"pre,omitempty"`
+	Post string `json:"post,omitempty"`
+}
+
+// HookRun is the outcome of one hook, kept in the snapshot's log entry.
+type HookRun struct {
+	Phase    string `json:"phase"` // pre or post
+	Command  string `json:"command"`
+	ExitCode int    `json:"exit_code"`
+	Duration string `json:"duration"`
+	Output   string `json:"output"`
+	Error    string `json:"error,omitempty"`
+}
+
+const maxHookOutput = 64 << 10
+
+// runSnapshotHook runs the hook of phase for a snapshot at snapPath, with
+// the snapshot's status so far (post only) in the environment.
+func runSnapshotHook(job SnapshotJob, phase, command, snapPath, status string) HookRun {
+	run := HookRun{Phase: phase, Command: command}
+	start := time.Now()
+	ctx, cancel := commandContext("SNAPSHOT HOOK")
+	defer cancel(nil)
+	exited := make(chan struct{})
+	defer close(exited)
+
+	cmd := newManagedCommand(ctx, exited, "sh", "-c", command)
+	_, release := prioritize(cmd, "SNAPSHOT HOOK")
+	defer release()
+	cmd.Env = append(os.Environ(),
+		"BTRFS_JOB="+job.ID,
+		"BTRFS_SOURCE="+job.Source,
+		"BTRFS_SNAPSHOT="+snapPath,
+		"BTRFS_HOOK="+phase,
+		"BTRFS_STATUS="+status)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := cmd.Run()
+	run.Duration = time.Since(start).Round(time.Millisecond).String()
+	run.Output = out.String()
+	if len(run.Output) > maxHookOutput { run.Output = run.Output[:maxHookOutput] + "\n... (truncated)" }
+	if cmd.ProcessState != nil { run.ExitCode = cmd.ProcessState.ExitCode() }
+	if t, ok := terminationOf(ctx); ok {
+		run.Error = t.Message
+	} else if err != nil {
+		run.Error = err.Error()
+	}
+	if run.Error != "" { logWarn("SNAPSHOT", "%s hook of job %s failed: %s", phase, job.ID, run.Error) }
+	return run
+}
+
+// hookSummary appends the hooks' output to a snapshot's log details.
+func hookSummary(details string, runs []HookRun) string {
+	var b strings.Builder
+	b.WriteString(details)
+	for _, run := range runs {
+		result := "ok"
+		if run.Error != "" { result = run.Error }
+		fmt.Fprintf(&b, "\n--- %s hook (%s, %s) ---\n%s", run.Phase, run.Duration, result, strings.TrimRight(run.Output, "\n"))
+	}
+	return b.String()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+// --- Operations in Progress ---
+// btrfs runs one scrub and one balance at a time per filesystem. Rather than
+// starting another and finding "Operation in progress" in its output, scrub
+// start, balance start and balance resume first ask `btrfs scrub status` /
+// `btrfs balance status`. If one is running (or, for a start, a balance is
+// paused), the request is answered with 409 and the running operation: its
+// progress, and the log entry that follows it if this app started it or
+// re-attached to it, so the UI can show that job instead. Scheduled runs
+// skip with a line in the container log.
+
+type RunningOperation struct {
+	Operation string         `json:"operation"` // scrub, balance
+	Path      string         `json:"path"`
+	State     string         `json:"state"`        // running, or paused for a balance
+	ID        int64          `json:"id,omitempty"` // the log entry following it, if any
+	Scrub     *ScrubResult   `json:"scrub,omitempty"`
+	Balance   *BalanceResult `json:"balance,omitempty"`
+	Output    string         `json:"output"` // of the status command
+}
+
+func (op *RunningOperation) message() string {
+	return fmt.Sprintf("A %s is already %s on %s", op.Operation, op.State, op.Path)
+}
+
+// Log entry types of commands that scrub or balance a filesystem.
+var (
+	scrubEntryTypes   = []string{"SCRUB START", "AUTO SCRUB", "UNCLEAN SCRUB", "SCRUB RESUME"}
+	balanceEntryTypes = []string{"BALANCE START", "AUTO BALANCE", "BALANCE RESUME", "RULE BALANCE", "PROFILE CONVERT", "CONVERT RESUME"}
+)
+
+// runningEntry returns the newest "Running..." entry of one of types on
+// path, 0 if there is none.
+func runningEntry(path string, types []string) int64 {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for _, e := range state.History {
+		if e.Status != "Running..." || !strings.HasPrefix(e.Path, path) { continue }
+		for _, t := range types {
+			if e.Type == t { return e.ID }
+		}
+	}
+	return 0
+}
+
+// scrubInProgress returns the scrub running on path, nil if there is none.
+func scrubInProgress(path string) *RunningOperation {
+	out, _ := exec.Command("btrfs", "scrub", "status", path).CombinedOutput()
+	// A scrub this app just started may not show up in the kernel yet.
+	if kernelScrubState(string(out)) != "running" && !scrubRunning(path) { return nil }
+	return &RunningOperation{Operation: "scrub", Path: path, State: "running", ID: runningEntry(path, scrubEntryTypes), Scrub: parseScrub(string(out)), Output: string(out)}
+}
+
+// balanceInProgress returns the balance running on path, or with
+// withPaused a paused one too; nil if there is none.
+func balanceInProgress(path string, withPaused bool) *RunningOperation {
+	s := pollBalance(path)
+	st := kernelBalanceState(s.Output)
+	if balanceCommandRunning() { st = "running" }
+	if st == "idle" || (st == "paused" && !withPaused) { return nil }
+	return &RunningOperation{Operation: "balance", Path: path, State: st, ID: runningEntry(path, balanceEntryTypes), Balance: s.Balance, Output: s.Output}
+}
+
+// writeInProgress answers a request to start an operation that is already
+// running with 409 and op.
+func writeInProgress(w http.ResponseWriter, op *RunningOperation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(409)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "in_progress", "error": op.message(), "running": op})
+}
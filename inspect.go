@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// --- Inspect (read-only) ---
+// Wrappers around `btrfs inspect-internal` to map the numbers btrfs reports
+// (logical addresses, inode and root IDs) back to files and subvolumes,
+// e.g. the logical addresses of blocks a scrub found corrupt, which only the
+// kernel log names.
+
+type LogicalRef struct {
+	Inode  uint64 `json:"inode"`
+	Offset uint64 `json:"offset"`
+	Root   uint64 `json:"root"`
+}
+
+type LogicalResolution struct {
+	Logical uint64       `json:"logical"`
+	Paths   []string     `json:"paths"`
+	Refs    []LogicalRef `json:"refs"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// KernelScrubError is a corrupt block reported in the kernel log, with the
+// files referencing it.
+type KernelScrubError struct {
+	Device  string   `json:"device"`
+	Logical uint64   `json:"logical"`
+	Kind    string   `json:"kind"` // e.g. checksum, checksum/header, unable to fixup (regular)
+	Fixed   bool     `json:"fixed"`
+	Message string   `json:"message"`
+	Paths   []string `json:"paths"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// maxResolvedErrors bounds the logical-resolve calls per request.
+const maxResolvedErrors = 50
+
+func inspectCommand(args ...string) (string, error) {
+	out, err := exec.Command("btrfs", append([]string{"inspect-internal"}, args...)...).CombinedOutput()
+	if err != nil { return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out))) }
+	return string(out), nil
+}
+
+func nonEmptyLines(out string) []string {
+	lines := []string{}
+	for _, l := range strings.Split(out, "\n") {
+		if l = strings.TrimSpace(l); l != "" { lines = append(lines, l) }
+	}
+	return lines
+}
+
+// parseLogicalRefs reads `logical-resolve -P`: "inode 257 offset 0 root 5".
+func parseLogicalRefs(out string) []LogicalRef {
+	refs := []LogicalRef{}
+	for _, line := range nonEmptyLines(out) {
+		f := strings.Fields(line)
+		if len(f) != 6 || f[0] != "inode" || f[2] != "offset" || f[4] != "root" { continue }
+		var ref LogicalRef
+		ref.Inode, _ = strconv.ParseUint(f[1], 10, 64)
+		ref.Offset, _ = strconv.ParseUint(f[3], 10, 64)
+		ref.Root, _ = strconv.ParseUint(f[5], 10, 64)
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// resolveLogical lists the files (as seen below path) and the raw
+// inode/root references of a logical address.
+func resolveLogical(path string, logical uint64) *LogicalResolution {
+	res := &LogicalResolution{Logical: logical, Paths: []string{}, Refs: []LogicalRef{}}
+	addr := strconv.FormatUint(logical, 10)
+	out, err := inspectCommand("logical-resolve", "-P", addr, path)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Refs = parseLogicalRefs(out)
+	// Files in subvolumes that aren't reachable below path have no path.
+	if out, err := inspectCommand("logical-resolve", addr, path); err == nil { res.Paths = nonEmptyLines(out) }
+	return res
+}
+
+// parseKernelScrubErrors picks the scrub messages with a logical address
+// from the kernel log, one entry per device and address:
+//
+//	BTRFS warning (device sdb): checksum error at logical 298844160 on dev /dev/sdb, physical 298844160, root 5, inode 257, offset 0, length 4096, links 1 (path: file)
+//	BTRFS error (device sdb): unable to fixup (regular) error at logical 298844160 on dev /dev/sdb
+//	BTRFS info (device sdb): fixed up error at logical 298844160 on dev /dev/sdb
+func parseKernelScrubErrors(log string) []KernelScrubError {
+	errs := []KernelScrubError{}
+	index := map[string]int{}
+	for _, line := range strings.Split(log, "\n") {
+		_, msg, ok := strings.Cut(line, "BTRFS ")
+		if !ok { continue }
+		_, rest, ok := strings.Cut(msg, "(device ")
+		if !ok { continue }
+		device, text, ok := strings.Cut(rest, "): ")
+		if !ok { continue }
+		kind, after, ok := strings.Cut(text, " error at logical ")
+		if !ok { continue }
+		f := strings.Fields(after)
+		if len(f) == 0 { continue }
+		logical, err := strconv.ParseUint(strings.TrimSuffix(f[0], ","), 10, 64)
+		if err != nil { continue }
+
+		key := device + "/" + f[0]
+		i, seen := index[key]
+		if !seen {
+			i = len(errs)
+			index[key] = i
+			errs = append(errs, KernelScrubError{Device: device, Logical: logical, Paths: []string{}})
+		}
+		e := &errs[i]
+		if kind == "fixed up" {
+			e.Fixed = true
+			continue
+		}
+		// The first detailed message describes the error best.
+		if e.Kind == "" || (!strings.Contains(e.Message, "(path: ") && strings.Contains(text, "(path: ")) {
+			e.Kind, e.Message = kind, "BTRFS "+msg
+		}
+	}
+	return errs
+}
+
+// filesystemDeviceNames returns the kernel names (sdb, dm-0) of the
+// filesystem's devices as used in "(device ...)".
+func filesystemDeviceNames(path string) (map[string]bool, error) {
+	devices, err := listDevices(path)
+	if err != nil { return nil, err }
+	names := map[string]bool{}
+	for _, d := range devices {
+		if d.Missing { continue }
+		names[filepath.Base(d.Path)] = true
+		if real, err := filepath.EvalSymlinks(d.Path); err == nil { names[filepath.Base(real)] = true }
+	}
+	return names, nil
+}
+
+// kernelScrubErrors resolves the corrupt blocks the kernel log reports for
+// the filesystem at path to files.
+func kernelScrubErrors(path string) ([]KernelScrubError, error) {
+	out, err := exec.Command("dmesg").CombinedOutput()
+	if err != nil { return nil, fmt.Errorf("cannot read the kernel log: %v: %s", err, strings.TrimSpace(string(out))) }
+	names, err := filesystemDeviceNames(path)
+	if err != nil { return nil, err }
+
+	var errs []KernelScrubError
+	for _, e := range parseKernelScrubErrors(string(out)) {
+		if names[e.Device] { errs = append(errs, e) }
+	}
+	if errs == nil { errs = []KernelScrubError{} }
+	for i := range errs {
+		if i >= maxResolvedErrors {
+			errs[i].Error = fmt.Sprintf("not resolved, only the first %d addresses are", maxResolvedErrors)
+			continue
+		}
+		res := resolveLogical(path, errs[i].Logical)
+		errs[i].Paths, errs[i].Error = res.Paths, res.Error
+	}
+	return errs, nil
+}
+
+// --- Handlers ---
+
+func uintParam(w http.ResponseWriter, r *http.Request, name string) (uint64, bool) {
+	n, err := strconv.ParseUint(r.URL.Query().Get(name), 10, 64)
+	if err != nil {
+		http.Error(w, name+" must be a non-negative number", 400)
+		return 0, false
+	}
+	return n, true
+}
+
+func handleInspectRootID(w http.ResponseWriter, r *http.Request) {
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	out, err := inspectCommand("rootid", path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	id, _ := strconv.ParseUint(strings.TrimSpace(out), 10, 64)
+	json.NewEncoder(w).Encode(map[string]interface{}{"path": path, "root_id": id})
+}
+
+func handleInspectSubvolID(w http.ResponseWriter, r *http.Request) {
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	id, ok := uintParam(w, r, "id")
+	if !ok { return }
+	out, err := inspectCommand("subvolid-resolve", strconv.FormatUint(id, 10), path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "subvolume": strings.TrimSpace(out)})
+}
+
+func handleInspectInode(w http.ResponseWriter, r *http.Request) {
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	inode, ok := uintParam(w, r, "inode")
+	if !ok { return }
+	out, err := inspectCommand("inode-resolve", strconv.FormatUint(inode, 10), path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"inode": inode, "paths": nonEmptyLines(out)})
+}
+
+func handleInspectLogical(w http.ResponseWriter, r *http.Request) {
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	logical, ok := uintParam(w, r, "logical")
+	if !ok { return }
+	json.NewEncoder(w).Encode(resolveLogical(path, logical))
+}
+
+func handleInspectScrubErrors(w http.ResponseWriter, r *http.Request) {
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	errs, err := kernelScrubErrors(path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"path": path, "errors": errs})
+}
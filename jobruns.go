@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --- Job Runs ---
+// Every run of a scheduled job (see scheduledJobs), whether fired by the
+// schedule, caught up after downtime or started by hand where the UI offers
+// that, tags the log entries it writes with the job, a run ID and the
+// trigger (see onchange.go for "change"). Once the runner returned and none of its entries is still
+// running, the run counts towards the job's stats in state.json: runs,
+// failures, the last run, the last success and the current failure streak.
+// A run is as bad as its worst entry; a run that logged nothing (e.g. a
+// scrub with no target due) isn't counted.
+
+type JobRun struct {
+	Job     string // scheduled job name, e.g. snapshot:home or scrub
+	ID      string
+	Trigger string // schedule, catch-up, change, retry or manual
+	Attempt int    // 1, or the attempt of a retry, see retry.go
+	Started time.Time
+}
+
+type JobStats struct {
+	Runs          int    `json:"runs"`
+	Failures      int    `json:"failures"`
+	LastRun       string `json:"last_run,omitempty"` // RFC 3339 start
+	LastStatus    string `json:"last_status,omitempty"`
+	LastSuccess   string `json:"last_success,omitempty"`
+	FailureStreak int    `json:"failure_streak"` // failed runs in a row, up to the last one
+}
+
+type JobRunSummary struct {
+	ID      string     `json:"id"`
+	Trigger string     `json:"trigger"`
+	Attempt int        `json:"attempt,omitempty"` // of a retry
+	Started time.Time  `json:"started"`
+	Status  string     `json:"status"` // worst of its entries, Running... while one runs
+	Entries []LogEntry `json:"entries"`
+}
+
+type JobInfo struct {
+	Name    string        `json:"name"`
+	Enabled bool          `json:"enabled"`
+	Next    string        `json:"next,omitempty"`  // RFC 3339, while scheduled
+	Retry   *pendingRetry `json:"retry,omitempty"` // the next attempt after a failed run
+	Stats   JobStats      `json:"stats"`
+}
+
+// finishedRuns holds runs whose runner returned while entries were still
+// running. Guarded by state.mu.
+var finishedRuns = map[string]*JobRun{}
+
+func newJobRun(job, trigger string) *JobRun {
+	now := time.Now()
+	return &JobRun{Job: job, ID: strconv.FormatInt(now.UnixNano(), 10), Trigger: trigger, Attempt: 1, Started: now}
+}
+
+// tag attributes the log entry id to the run. A nil run leaves it alone.
+func (r *JobRun) tag(id int64) {
+	if r == nil || id == 0 { return }
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for i := range state.History {
+		if e := &state.History[i]; e.ID == id {
+			e.JobID, e.RunID, e.Trigger = r.Job, r.ID, r.Trigger
+			if r.Attempt > 1 { e.Attempt = r.Attempt }
+			publishEntry(*e)
+			publishJob(JobEvent{Job: r.Job, Run: r.ID, State: "running"})
+			break
+		}
+	}
+	notifyHistoryChanged()
+	saveState()
+}
+
+// finish is called once the runner returned; the run is recorded now or
+// when its last running entry finishes.
+func (r *JobRun) finish() {
+	if r == nil { return }
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	finishedRuns[r.ID] = r
+	recordJobRun(r.ID)
+}
+
+// recordJobRun adds the run to its job's stats if it is finished and none of
+// its entries still runs. Caller holds state.mu.
+func recordJobRun(id string) {
+	r := finishedRuns[id]
+	if r == nil { return }
+	status, n := "", 0
+	for _, e := range state.History {
+		if e.RunID != id { continue }
+		if statusKey(e.Status) == "running" { return }
+		n++
+		status = worseStatus(status, e.Status)
+	}
+	delete(finishedRuns, id)
+	if n == 0 { return }
+
+	if state.JobStats == nil { state.JobStats = make(map[string]JobStats) }
+	s := state.JobStats[r.Job]
+	started := r.Started.UTC().Format(time.RFC3339)
+	s.Runs++
+	s.LastRun, s.LastStatus = started, status
+	if status == "Failed" {
+		s.Failures++
+		s.FailureStreak++
+	} else {
+		s.FailureStreak = 0
+		s.LastSuccess = started
+	}
+	state.JobStats[r.Job] = s
+	publishJob(JobEvent{Job: r.Job, Run: r.ID, State: "finished", Status: status, Stats: &s})
+	saveState()
+	retryAfter(r, status)
+}
+
+var statusRank = map[string]int{"": 0, "Success": 1, "Warning": 2, "Interrupted": 2, "Failed": 3}
+
+func worseStatus(a, b string) string {
+	rb, ok := statusRank[b]
+	if !ok { rb = 2 }
+	if rb > statusRank[a] { return b }
+	return a
+}
+
+// jobRunsOf groups the logged entries of job by run, newest first. Caller
+// holds state.mu.
+func jobRunsOf(job string) []JobRunSummary {
+	runs := []JobRunSummary{}
+	index := map[string]int{}
+	for _, e := range state.History {
+		if e.JobID != job || e.RunID == "" { continue }
+		i, ok := index[e.RunID]
+		if !ok {
+			n, _ := strconv.ParseInt(e.RunID, 10, 64)
+			runs = append(runs, JobRunSummary{ID: e.RunID, Trigger: e.Trigger, Attempt: e.Attempt, Started: time.Unix(0, n).UTC()})
+			i = len(runs) - 1
+			index[e.RunID] = i
+		}
+		r := &runs[i]
+		// History is newest first; keep the entries of a run in order.
+		r.Entries = append([]LogEntry{e}, r.Entries...)
+		if statusKey(e.Status) == "running" || r.Status == "Running..." {
+			r.Status = "Running..."
+		} else {
+			r.Status = worseStatus(r.Status, e.Status)
+		}
+	}
+	return runs
+}
+
+// --- Handlers ---
+
+// handleListJobs returns every scheduled job with its stats.
+func handleListJobs(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	list := []JobInfo{}
+	for _, job := range scheduledJobs(state.Config) {
+		info := JobInfo{Name: job.Name, Enabled: job.Schedule.Enabled, Retry: retryPending(job.Name), Stats: state.JobStats[job.Name]}
+		if id, ok := state.cronIDs[job.Name]; ok {
+			if next := state.cron.Entry(id).Next; !next.IsZero() { info.Next = next.UTC().Format(time.RFC3339) }
+		}
+		list = append(list, info)
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleJobRuns returns the stats of job {id} and its runs still in the
+// log, newest first; ?limit= caps the runs.
+func handleJobRuns(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("id")
+	limit := 0
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 { http.Error(w, "limit must be a positive number", 400); return }
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	known := false
+	for _, job := range scheduledJobs(state.Config) {
+		if job.Name == name { known = true }
+	}
+	stats, recorded := state.JobStats[name]
+	if !known && !recorded {
+		http.Error(w, "No job "+name, 404)
+		return
+	}
+	runs := jobRunsOf(name)
+	if limit > 0 && len(runs) > limit { runs = runs[:limit] }
+	json.NewEncoder(w).Encode(map[string]interface{}{"job": name, "stats": stats, "runs": runs})
+}
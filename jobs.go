@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// --- Snapshot Jobs ---
+
+// SnapshotJob is one source ➡️ destination pair with its own cadence,
+// retention and naming. Snapshots are named Prefix + NameTemplate (see
+// snapname.go).
+type SnapshotJob struct {
+	ID           string          `json:"id"`
+	Name         string          `json:"name"`
+	Source       string          `json:"source"`
+	Dest         string          `json:"dest"`
+	Prefix       string          `json:"prefix"`
+	NameTemplate string          `json:"name_template,omitempty"` // empty: defaultNameTemplate
+	Adopt        []AdoptPattern  `json:"adopt,omitempty"`         // other tools' snapshots, see adopt.go
+	Writable     bool            `json:"writable,omitempty"`      // snapshots without -r; they can't be sent or diffed
+	Nested       bool            `json:"nested,omitempty"`        // also snapshot the subvolumes below the source, see nested.go
+	Boot         BootConfig      `json:"boot"`
+	Hooks        SnapshotHooks   `json:"hooks"`
+	Schedule     ScheduleConfig  `json:"schedule"`
+	Retention    RetentionConfig `json:"retention"`
+	Receive      ReceiveConfig   `json:"receive"`
+	Archive      ArchiveConfig   `json:"archive"` // see archive.go
+	Verify       VerifyConfig    `json:"verify"`  // see verify.go
+	OnChange     OnChangeConfig  `json:"on_change"` // see onchange.go
+	Streams      StreamConfig    `json:"streams"`   // see streams.go
+}
+
+func (j SnapshotJob) snapshotName(t time.Time) string {
+	n, err := j.naming()
+	if err != nil { n, _ = compileNameTemplate(defaultNameTemplate, j.ID, "") }
+	return j.Prefix + n.format(t)
+}
+
+// parseSnapshotTime reports whether name was produced (or adopted) by this
+// job and, if so, when it was taken.
+func (j SnapshotJob) parseSnapshotTime(name string) (time.Time, bool) {
+	if t, ok := j.parseOwnSnapshotTime(name); ok { return t, true }
+	return j.adoptedSnapshotTime(name)
+}
+
+func (j SnapshotJob) parseOwnSnapshotTime(name string) (time.Time, bool) {
+	rest, ok := strings.CutPrefix(name, j.Prefix)
+	if !ok { return time.Time{}, false }
+	n, err := j.naming()
+	if err != nil { return time.Time{}, false }
+	return n.parse(rest)
+}
+
+func applySnapshotJobDefaults(j *SnapshotJob) {
+	if j.Schedule.Type == "" { j.Schedule.Type = "every_x" }
+	if j.Schedule.Unit == "" { j.Schedule.Unit = "minutes" }
+	if j.Retention.Mode == "" {
+		j.Retention.Mode = "count"
+		j.Retention.Value = 5
+	}
+	if j.Retention.Unit == "" { j.Retention.Unit = "days" }
+	if j.Name == "" { j.Name = j.Source }
+}
+
+// findSnapshotJob looks up a job by ID. An empty ID selects the first job so
+// single-job installs can keep omitting it. The built-in state backup job is
+// only reachable by its ID.
+func findSnapshotJob(id string) (SnapshotJob, error) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if id == stateJobID && state.Config.StateBackup.Enabled {
+		return stateBackupJob(state.Config.StateBackup), nil
+	}
+	for _, j := range state.Config.SnapshotJobs {
+		if id == "" || j.ID == id { return j, nil }
+	}
+	if id == "" {
+		return SnapshotJob{}, fmt.Errorf("no snapshot jobs configured")
+	}
+	return SnapshotJob{}, fmt.Errorf("snapshot job %q not found", id)
+}
+
+func jobFromRequest(r *http.Request) (SnapshotJob, error) {
+	return findSnapshotJob(r.URL.Query().Get("job"))
+}
+
+var slugPattern = regexp.MustCompile(`[^a-z0-9]+`)
+
+// newSnapshotJobID derives a stable, URL-safe ID from the job name. Caller
+// must hold state.mu.
+func newSnapshotJobID(name string) string {
+	base := strings.Trim(slugPattern.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if base == "" { base = "job" }
+	id := base
+	for n := 2; ; n++ {
+		taken := id == stateJobID
+		for _, j := range state.Config.SnapshotJobs {
+			if j.ID == id { taken = true; break }
+		}
+		if !taken { return id }
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+}
+
+// cloneSnapshotJob returns a deep copy of j, sharing no slices or maps with it.
+func cloneSnapshotJob(j SnapshotJob) SnapshotJob {
+	var c SnapshotJob
+	data, _ := json.Marshal(j)
+	json.Unmarshal(data, &c)
+	return c
+}
+
+func validateSnapshotJob(j SnapshotJob) error {
+	// Receive-only jobs get their snapshots from `btrfs send` elsewhere.
+	if j.Dest == "" || (j.Source == "" && !j.Receive.Enabled) {
+		return fmt.Errorf("source and dest are required")
+	}
+	if j.Source == "" && j.Schedule.Enabled {
+		return fmt.Errorf("a source is required for scheduled snapshots")
+	}
+	if j.Source != "" && pathWithin(filepath.Clean(j.Dest), filepath.Clean(j.Source)) {
+		return fmt.Errorf("dest must not be inside the source")
+	}
+	if err := j.Retention.validate(); err != nil { return fmt.Errorf("retention: %v", err) }
+	if strings.ContainsAny(j.Prefix, "/") {
+		return fmt.Errorf("prefix must not contain '/'")
+	}
+	n, err := j.naming()
+	if err != nil { return fmt.Errorf("invalid name template %q: %v", j.NameTemplate, err) }
+	if err := n.validate(); err != nil { return err }
+	for i, p := range j.Adopt {
+		if err := p.validate(); err != nil { return fmt.Errorf("adopt pattern %d: %v", i+1, err) }
+	}
+	if j.Boot.Enabled && j.Source == "" {
+		return fmt.Errorf("a source is required for the boot menu")
+	}
+	if j.Writable && j.Receive.Enabled {
+		return fmt.Errorf("received snapshots are always read-only, a receiving job can't be writable")
+	}
+	if j.Nested && j.Source == "" {
+		return fmt.Errorf("nested snapshots need a source")
+	}
+	if err := validateWindows(j.Schedule.Windows); err != nil {
+		return fmt.Errorf("schedule: %v", err)
+	}
+	if err := validateArchive(j); err != nil { return err }
+	if err := validateVerify(j.Verify); err != nil { return err }
+	if err := validateOnChange(j); err != nil { return err }
+	if err := validateStreams(j); err != nil { return err }
+	if j.Schedule.Enabled {
+		if _, err := parseSchedule(j.Schedule); err != nil {
+			return fmt.Errorf("invalid schedule %q: %v", scheduleSpec(j.Schedule), err)
+		}
+	}
+	return nil
+}
+
+// validateSharedDests refuses jobs sharing a destination unless their
+// prefixes tell their snapshots apart: retention, purge, adoption and the
+// trash pick a job's snapshots by prefix.
+func validateSharedDests(jobs []SnapshotJob) error {
+	for i, a := range jobs {
+		for _, b := range jobs[i+1:] {
+			if a.Dest == "" || filepath.Clean(a.Dest) != filepath.Clean(b.Dest) { continue }
+			if a.Prefix == "" || b.Prefix == "" || strings.HasPrefix(a.Prefix, b.Prefix) || strings.HasPrefix(b.Prefix, a.Prefix) {
+				return fmt.Errorf("jobs %q and %q share the destination %s and need prefixes that don't start with one another", a.Name, b.Name, a.Dest)
+			}
+		}
+	}
+	return nil
+}
+
+// jobsWith returns the configured jobs with job in place of the one with its
+// ID, or added when it is new.
+func jobsWith(job SnapshotJob) []SnapshotJob {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	jobs := append([]SnapshotJob(nil), state.Config.SnapshotJobs...)
+	for i := range jobs {
+		if job.ID != "" && jobs[i].ID == job.ID {
+			jobs[i] = job
+			return jobs
+		}
+	}
+	return append(jobs, job)
+}
+
+// --- CRUD Handlers ---
+
+func handleListSnapshotJobs(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	jobs := state.Config.SnapshotJobs
+	if jobs == nil { jobs = []SnapshotJob{} }
+	// Only admins see stream remotes, which may carry credentials.
+	if requestUser(r).Role != roleAdmin { jobs = redactJobs(jobs) }
+	json.NewEncoder(w).Encode(jobs)
+}
+
+func handleGetSnapshotJob(w http.ResponseWriter, r *http.Request) {
+	job, err := findSnapshotJob(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	if requestUser(r).Role != roleAdmin { job = redactJobs([]SnapshotJob{job})[0] }
+	json.NewEncoder(w).Encode(job)
+}
+
+func handleCreateSnapshotJob(w http.ResponseWriter, r *http.Request) {
+	var job SnapshotJob
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), 400)
+		return
+	}
+	applySnapshotJobDefaults(&job)
+	if err := validateSnapshotJob(job); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	job.ID = ""
+	if err := validateSharedDests(jobsWith(job)); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	backupStateBeforeChange("snapshot job create")
+	state.mu.Lock()
+	job.ID = newSnapshotJobID(job.Name)
+	state.Config.SnapshotJobs = append(state.Config.SnapshotJobs, job)
+	saveState()
+	state.mu.Unlock()
+
+	printDockerLog("SYSTEM", "Snapshot job %s created (%s ➡️ %s)", job.ID, job.Source, job.Dest)
+	go refreshSchedules()
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(job)
+}
+
+func handleUpdateSnapshotJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == stateJobID {
+		http.Error(w, "The state backup job is configured in settings", 400)
+		return
+	}
+	current, err := findSnapshotJob(id)
+	if err != nil || id == "" {
+		http.Error(w, "Snapshot job not found", 404)
+		return
+	}
+
+	// Decode on top of a copy of the existing job so partial updates work
+	// without writing into the slices of the live config.
+	job := cloneSnapshotJob(current)
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), 400)
+		return
+	}
+	job.ID = id
+	applySnapshotJobDefaults(&job)
+	if err := validateSnapshotJob(job); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := validateSharedDests(jobsWith(job)); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	backupStateBeforeChange("snapshot job update")
+	state.mu.Lock()
+	for i := range state.Config.SnapshotJobs {
+		if state.Config.SnapshotJobs[i].ID == id { state.Config.SnapshotJobs[i] = job }
+	}
+	saveState()
+	state.mu.Unlock()
+
+	printDockerLog("SYSTEM", "Snapshot job %s updated", id)
+	go refreshSchedules()
+	json.NewEncoder(w).Encode(job)
+}
+
+func handleDeleteSnapshotJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := findSnapshotJob(id); err != nil || id == "" || id == stateJobID {
+		http.Error(w, "Snapshot job not found", 404)
+		return
+	}
+	backupStateBeforeChange("snapshot job delete")
+	state.mu.Lock()
+	var jobs []SnapshotJob
+	found := false
+	for _, j := range state.Config.SnapshotJobs {
+		if j.ID == id { found = true; continue }
+		jobs = append(jobs, j)
+	}
+	state.Config.SnapshotJobs = jobs
+	if found { saveState() }
+	state.mu.Unlock()
+
+	if !found {
+		http.Error(w, "Snapshot job not found", 404)
+		return
+	}
+	// Existing snapshots are left on disk; only the job definition goes away.
+	printDockerLog("SYSTEM", "Snapshot job %s deleted", id)
+	go refreshSchedules()
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "deleted"})
+}
+
+// --- Migration ---
+
+// migrateLegacySnapshotConfig turns the pre-jobs single snapshot_source /
+// snapshot_dest configuration into a "default" job.
+func migrateLegacySnapshotConfig(data []byte) {
+	var legacy struct {
+		Config struct {
+			SnapshotSource string          `json:"snapshot_source"`
+			SnapshotDest   string          `json:"snapshot_dest"`
+			SnapshotSched  ScheduleConfig  `json:"snapshot_sched"`
+			Retention      RetentionConfig `json:"retention"`
+		} `json:"config"`
+	}
+	if json.Unmarshal(data, &legacy) != nil { return }
+	c := legacy.Config
+	if len(state.Config.SnapshotJobs) > 0 || (c.SnapshotSource == "" && c.SnapshotDest == "") { return }
+
+	job := SnapshotJob{
+		ID:        "default",
+		Name:      "Default",
+		Source:    c.SnapshotSource,
+		Dest:      c.SnapshotDest,
+		Schedule:  c.SnapshotSched,
+		Retention: c.Retention,
+	}
+	applySnapshotJobDefaults(&job)
+	state.Config.SnapshotJobs = []SnapshotJob{job}
+	printDockerLog("SYSTEM", "Migrated legacy snapshot config to job 'default'")
+}
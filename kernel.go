@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// --- Kernel Events ---
+// What goes wrong in the filesystem itself, checksum errors, a forced
+// read-only remount, ENOSPC in a transaction, only the kernel log tells, and
+// often while no job is running. The kernel log is followed (/dev/kmsg, or
+// `journalctl -k -f` where that isn't readable, e.g. in a container with the
+// host's journal mounted) and its BTRFS messages kept in a feed of the
+// newest kernelEventLimit, GET /api/kernel-events. Severe ones go into the
+// history as KERNEL entries and a health notification, at most one per
+// device and kind every kernelEventQuiet, as a scrub of a bad disk logs
+// thousands of checksum errors; the next entry counts the ones left out.
+// Messages from before the watcher started are in the feed, but not logged
+// again.
+
+type KernelEventsConfig struct {
+	Source string `json:"source,omitempty"` // auto (default), kmsg, journalctl or off
+}
+
+type KernelEvent struct {
+	Seq     int64  `json:"seq"` // increasing within this process, for ?since=
+	Time    string `json:"time"`
+	Level   string `json:"level"`            // emerg ... debug, as the kernel logged it
+	Device  string `json:"device,omitempty"` // e.g. sdb, dm-0
+	Kind    string `json:"kind"`             // csum, io, read_only, enospc, transaction or other
+	Severe  bool   `json:"severe"`
+	Message string `json:"message"`
+	Backlog bool   `json:"backlog,omitempty"` // logged before the watcher started
+}
+
+const (
+	kernelEventLimit = 500
+	kernelEventQuiet = 10 * time.Minute
+	kernelRetryDelay = time.Minute
+)
+
+var kernelLevels = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// kernelKinds classifies messages by the first pattern found, lowercased.
+var kernelKinds = []struct{ kind, pattern string }{
+	{"read_only", "forced readonly"},
+	{"read_only", "remounting read-only"},
+	{"enospc", "enospc"},
+	{"enospc", "errno=-28"},
+	{"enospc", "no space left"},
+	{"transaction", "transaction aborted"},
+	{"csum", "csum failed"},
+	{"csum", "checksum error"},
+	{"csum", "checksum verify failed"},
+	{"csum", "bad tree block"},
+	{"csum", "corrupt "},
+	{"io", "i/o error"},
+	{"io", "io failure"},
+	{"io", "errs: wr"},
+	{"io", "unable to fixup"},
+}
+
+var kernelEvents = struct {
+	mu         sync.Mutex
+	events     []KernelEvent
+	seq        int64
+	source     string // in use, "" while none is
+	err        string // why none is
+	configured string // the source setting the watcher runs with
+	cancel     context.CancelFunc
+	last       map[string]time.Time // device/kind → last logged
+	skipped    map[string]int       // device/kind → left out since
+}{last: map[string]time.Time{}, skipped: map[string]int{}}
+
+func (c KernelEventsConfig) validate() error {
+	switch c.Source {
+	case "", "auto", "kmsg", "journalctl", "off": return nil
+	}
+	return fmt.Errorf("kernel_events source must be auto, kmsg, journalctl or off")
+}
+
+// parseKernelMessage reads a BTRFS message, "BTRFS error (device sdb): ..."
+// or "BTRFS: error (device sdb state EA) in ...", into an event; ok is false
+// for other messages. level is the syslog level the record came with, -1 if
+// unknown.
+func parseKernelMessage(msg string, level int) (KernelEvent, bool) {
+	i := strings.Index(msg, "BTRFS")
+	if i < 0 { return KernelEvent{}, false }
+	msg = strings.TrimSpace(msg[i:])
+	e := KernelEvent{Message: msg, Kind: "other"}
+	if _, rest, ok := strings.Cut(msg, "(device "); ok {
+		if f := strings.FieldsFunc(rest, func(r rune) bool { return r == ' ' || r == ')' }); len(f) > 0 { e.Device = f[0] }
+	}
+	head := strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(msg, "BTRFS"), ":"))
+	for _, l := range []struct{ word, level string }{{"critical", "crit"}, {"error", "err"}, {"warning", "warning"}, {"notice", "notice"}, {"info", "info"}, {"debug", "debug"}, {"emerg", "emerg"}, {"alert", "alert"}} {
+		if strings.HasPrefix(strings.TrimSpace(head), l.word) { e.Level = l.level; break }
+	}
+	if e.Level == "" && level >= 0 && level < len(kernelLevels) { e.Level = kernelLevels[level] }
+	if e.Level == "" { e.Level = "info" }
+	lower := strings.ToLower(msg)
+	for _, k := range kernelKinds {
+		if strings.Contains(lower, k.pattern) { e.Kind = k.kind; break }
+	}
+	e.Severe = e.Kind != "other" || e.errorLevel()
+	// Scrub and device statistics report fixed errors at info level.
+	if e.Kind == "csum" && strings.Contains(lower, "fixed up") { e.Severe = false }
+	return e, true
+}
+
+func (e KernelEvent) errorLevel() bool {
+	return e.Level == "err" || e.Level == "crit" || e.Level == "alert" || e.Level == "emerg"
+}
+
+// addKernelEvent puts e in the feed and, if it is severe and new, into the
+// history.
+func addKernelEvent(e KernelEvent) {
+	kernelEvents.mu.Lock()
+	kernelEvents.seq++
+	e.Seq = kernelEvents.seq
+	kernelEvents.events = append(kernelEvents.events, e)
+	if n := len(kernelEvents.events) - kernelEventLimit; n > 0 { kernelEvents.events = kernelEvents.events[n:] }
+	report, skipped := false, 0
+	key := e.Device + "/" + e.Kind
+	if e.Severe && !e.Backlog {
+		if t, ok := kernelEvents.last[key]; ok && time.Since(t) < kernelEventQuiet {
+			kernelEvents.skipped[key]++
+		} else {
+			report, skipped = true, kernelEvents.skipped[key]
+			kernelEvents.last[key], kernelEvents.skipped[key] = time.Now(), 0
+		}
+	}
+	kernelEvents.mu.Unlock()
+
+	if data, err := json.Marshal(e); err == nil { hub.Publish("kernel", data) }
+	if !report { return }
+	status := "Warning"
+	if e.errorLevel() || e.Kind == "read_only" { status = "Failed" }
+	output := e.Message
+	if skipped > 0 { output += fmt.Sprintf("\n\n%d more %s messages for %s in the last %v, see /api/kernel-events.", skipped, e.Kind, e.Device, kernelEventQuiet) }
+	device := e.Device
+	if device == "" { device = "btrfs" }
+	printDockerLog("KERNEL", "%s", e.Message)
+	logHistory("KERNEL", "🐧", device+" ➡️ "+e.Kind, status, output)
+	go notify(newNotification(EventHealth, "Kernel: btrfs "+strings.ReplaceAll(e.Kind, "_", " ")+" on "+device, e.Message))
+}
+
+// --- Sources ---
+
+// bootTime is when the kernel's clock started, to date /dev/kmsg records.
+func bootTime() time.Time {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil { return time.Now() }
+	f := strings.Fields(string(data))
+	if len(f) == 0 { return time.Now() }
+	up, _ := strconv.ParseFloat(f[0], 64)
+	return time.Now().Add(-time.Duration(up * float64(time.Second)))
+}
+
+// parseKmsgRecord reads "prio,seq,usec,flags;message"; continuation lines
+// (" KEY=value") after the message are dropped.
+func parseKmsgRecord(rec string, boot time.Time) (KernelEvent, bool) {
+	head, msg, ok := strings.Cut(rec, ";")
+	if !ok { return KernelEvent{}, false }
+	msg, _, _ = strings.Cut(msg, "\n")
+	f := strings.Split(head, ",")
+	if len(f) < 3 { return KernelEvent{}, false }
+	prio, _ := strconv.Atoi(f[0])
+	e, ok := parseKernelMessage(msg, prio&7)
+	if !ok { return e, false }
+	usec, _ := strconv.ParseInt(f[2], 10, 64)
+	e.Time = boot.Add(time.Duration(usec) * time.Microsecond).UTC().Format(time.RFC3339)
+	return e, true
+}
+
+// watchKmsg follows /dev/kmsg until ctx is done. The records already in
+// the buffer are read first without blocking, as the backlog.
+func watchKmsg(ctx context.Context, started func()) error {
+	fd, err := syscall.Open("/dev/kmsg", syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil { return fmt.Errorf("/dev/kmsg: %v", err) }
+	boot := bootTime()
+	buf := make([]byte, 8192)
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EAGAIN { break }
+		if err == syscall.EPIPE || err == syscall.EINTR { continue } // records overwritten before they were read
+		if err != nil {
+			syscall.Close(fd)
+			return fmt.Errorf("/dev/kmsg: %v", err)
+		}
+		if e, ok := parseKmsgRecord(string(buf[:n]), boot); ok {
+			e.Backlog = true
+			addKernelEvent(e)
+		}
+	}
+	started()
+	// Through the runtime poller, so closing the file ends a pending read.
+	f := os.NewFile(uintptr(fd), "/dev/kmsg")
+	stop := context.AfterFunc(ctx, func() { f.Close() })
+	defer stop()
+	defer f.Close()
+	for {
+		n, err := f.Read(buf)
+		if ctx.Err() != nil { return nil }
+		if errors.Is(err, syscall.EPIPE) { continue }
+		if err != nil { return fmt.Errorf("/dev/kmsg: %v", err) }
+		if e, ok := parseKmsgRecord(string(buf[:n]), boot); ok { addKernelEvent(e) }
+	}
+}
+
+// watchJournal follows `journalctl -k`; the last 200 kernel messages of
+// this boot are the backlog.
+func watchJournal(ctx context.Context, started func()) error {
+	if _, err := exec.LookPath("journalctl"); err != nil { return err }
+	since := time.Now()
+	cmd := exec.CommandContext(ctx, "journalctl", "-k", "-f", "-n", "200", "-o", "short-unix", "--no-pager", "--no-hostname")
+	out, err := cmd.StdoutPipe()
+	if err != nil { return err }
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil { return err }
+	started()
+	sc := bufio.NewScanner(out)
+	for sc.Scan() {
+		// "1697300000.123456 kernel: BTRFS error (device sdb): ..."
+		stamp, msg, ok := strings.Cut(sc.Text(), " ")
+		if !ok { continue }
+		e, ok := parseKernelMessage(msg, -1)
+		if !ok { continue }
+		t := time.Now()
+		if secs, err := strconv.ParseFloat(stamp, 64); err == nil { t = time.Unix(0, int64(secs*float64(time.Second))) }
+		e.Time, e.Backlog = t.UTC().Format(time.RFC3339), t.Before(since)
+		addKernelEvent(e)
+	}
+	err = cmd.Wait()
+	if ctx.Err() != nil { return nil }
+	if err == nil { return fmt.Errorf("journalctl exited") }
+	return fmt.Errorf("journalctl: %v: %s", err, strings.TrimSpace(stderr.String()))
+}
+
+func kernelEventSource() string {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if s := state.Config.KernelEvents.Source; s != "" { return s }
+	return "auto"
+}
+
+func setKernelWatcher(source, err string) {
+	kernelEvents.mu.Lock()
+	defer kernelEvents.mu.Unlock()
+	kernelEvents.source, kernelEvents.err = source, err
+}
+
+// runKernelWatcher follows the configured source, trying again after
+// kernelRetryDelay when it fails and switching when the config changes.
+func runKernelWatcher() {
+	for {
+		configured := kernelEventSource()
+		ctx, cancel := context.WithCancel(context.Background())
+		kernelEvents.mu.Lock()
+		kernelEvents.cancel, kernelEvents.configured = cancel, configured
+		kernelEvents.mu.Unlock()
+		if configured == "off" {
+			setKernelWatcher("", "kernel_events source is off")
+			<-ctx.Done()
+			continue
+		}
+		var errs []string
+		for _, source := range []string{"kmsg", "journalctl"} {
+			if configured != "auto" && configured != source { continue }
+			watch := watchKmsg
+			if source == "journalctl" { watch = watchJournal }
+			// The source's backlog fills the feed again.
+			kernelEvents.mu.Lock()
+			kernelEvents.events = nil
+			kernelEvents.mu.Unlock()
+			running := false
+			err := watch(ctx, func() {
+				running = true
+				setKernelWatcher(source, "")
+				printDockerLog("KERNEL", "Following btrfs kernel messages from %s", source)
+			})
+			if ctx.Err() != nil { break }
+			errs = append(errs, err.Error())
+			// A source that worked for a while is tried again, not the next one.
+			if running { break }
+		}
+		if ctx.Err() != nil {
+			cancel()
+			continue
+		}
+		setKernelWatcher("", strings.Join(errs, "; "))
+		logWarn("KERNEL", "Cannot follow the kernel log, trying again in %v: %s", kernelRetryDelay, strings.Join(errs, "; "))
+		select {
+		case <-ctx.Done():
+		case <-time.After(kernelRetryDelay):
+		}
+		cancel()
+	}
+}
+
+// restartKernelWatcher switches to the configured source if it changed.
+func restartKernelWatcher() {
+	configured := kernelEventSource()
+	kernelEvents.mu.Lock()
+	defer kernelEvents.mu.Unlock()
+	if kernelEvents.cancel == nil || configured == kernelEvents.configured { return }
+	kernelEvents.cancel()
+}
+
+// --- Handlers ---
+
+// handleKernelEvents returns the feed, newest last; ?since= the seq of the
+// last event already seen, ?severe=1 only severe ones, ?device= one
+// device's.
+func handleKernelEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var since int64
+	if s := q.Get("since"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, "since must be a number", 400)
+			return
+		}
+		since = n
+	}
+	severe, device := q.Get("severe") == "1", q.Get("device")
+	kernelEvents.mu.Lock()
+	events := []KernelEvent{}
+	for _, e := range kernelEvents.events {
+		if e.Seq <= since || (severe && !e.Severe) || (device != "" && e.Device != device) { continue }
+		events = append(events, e)
+	}
+	source, errText := kernelEvents.source, kernelEvents.err
+	kernelEvents.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"source": source, "error": errText, "events": events})
+}
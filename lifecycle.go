@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// --- Graceful Shutdown & Resumption ---
+// On SIGTERM running scrubs are cancelled and balances paused through btrfs
+// itself, so the kernel keeps enough state to continue them. Their history
+// entries are marked "Interrupted". On the next start the app asks btrfs what
+// is still running or resumable and picks those operations up again.
+
+const interruptedStatus = "Interrupted"
+
+type runningCommand struct {
+	Name   string
+	Args   []string
+	cancel context.CancelCauseFunc // see commands.go; nil for runbook steps
+}
+
+var runningCommands = struct {
+	mu       sync.Mutex
+	cmds     map[int64]runningCommand
+	stopping bool
+}{cmds: make(map[int64]runningCommand)}
+
+func trackCommand(id int64, name string, args []string, cancel context.CancelCauseFunc) {
+	runningCommands.mu.Lock()
+	defer runningCommands.mu.Unlock()
+	runningCommands.cmds[id] = runningCommand{Name: name, Args: args, cancel: cancel}
+}
+
+func untrackCommand(id int64) {
+	runningCommands.mu.Lock()
+	defer runningCommands.mu.Unlock()
+	delete(runningCommands.cmds, id)
+}
+
+// shuttingDown reports whether a command that just ended was stopped by the
+// shutdown rather than failing on its own.
+func shuttingDown() bool {
+	runningCommands.mu.Lock()
+	defer runningCommands.mu.Unlock()
+	return runningCommands.stopping
+}
+
+// suspendArgs returns the btrfs command that stops a foreground scrub or
+// balance (started or resumed) in a way that can be resumed later, or nil
+// for anything else.
+func suspendArgs(c runningCommand) []string {
+	if c.Name != "btrfs" || len(c.Args) < 3 || (c.Args[1] != "start" && c.Args[1] != "resume") { return nil }
+	path := c.Args[len(c.Args)-1]
+	switch c.Args[0] {
+	case "scrub": return []string{"scrub", "cancel", path}
+	case "balance": return []string{"balance", "pause", path}
+	}
+	return nil
+}
+
+// markInterrupted flags every entry still "Running..." and persists the
+// history. The caller must not hold state.mu.
+func markInterrupted(reason string) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	n := 0
+	for i := range state.History {
+		if state.History[i].Status != "Running..." { continue }
+		state.History[i].Status = interruptedStatus
+		state.History[i].Output += "\n\n⚠️ " + reason
+		publishEntry(state.History[i])
+		n++
+	}
+	if n == 0 { return }
+	printDockerLog("SYSTEM", "Marked %d running operation(s) as interrupted", n)
+	notifyHistoryChanged()
+	saveState()
+}
+
+// handleShutdownSignals blocks until SIGTERM/SIGINT, shuts down and then
+// closes done.
+func handleShutdownSignals(srv *http.Server, done chan struct{}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	printDockerLog("SYSTEM", "Received %v, shutting down", <-sig)
+
+	<-state.cron.Stop().Done()
+
+	runningCommands.mu.Lock()
+	runningCommands.stopping = true
+	cmds := make([]runningCommand, 0, len(runningCommands.cmds))
+	for _, c := range runningCommands.cmds { cmds = append(cmds, c) }
+	runningCommands.mu.Unlock()
+
+	for _, c := range cmds {
+		args := suspendArgs(c)
+		if args == nil { continue }
+		out, err := exec.Command("btrfs", args...).CombinedOutput()
+		if err != nil {
+			logWarn("SYSTEM", "btrfs %s failed: %v %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		} else {
+			printDockerLog("SYSTEM", "btrfs %s", strings.Join(args, " "))
+		}
+	}
+	// Give suspended commands a moment to exit and record their own output.
+	for deadline := time.Now().Add(15 * time.Second); time.Now().Before(deadline); time.Sleep(200 * time.Millisecond) {
+		runningCommands.mu.Lock()
+		n := len(runningCommands.cmds)
+		runningCommands.mu.Unlock()
+		if n == 0 { break }
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+
+	markInterrupted("Interrupted: the web UI was stopped while this was running.")
+	recordCleanShutdown()
+	stopPersistence()
+	state.mu.Lock()
+	store.Close()
+	state.mu.Unlock()
+	close(done)
+}
+
+// --- Startup Reconciliation ---
+
+// reconcileOperations runs once at startup. Entries left "Running..." by a
+// crash are marked interrupted; scrubs, balances and replaces still running in
+// the kernel get a tracking entry, and ones this app interrupted are resumed.
+func reconcileOperations() {
+	markInterrupted("Interrupted: the web UI exited while this was running.")
+
+	state.mu.Lock()
+	path := state.Config.TargetDrive
+	state.mu.Unlock()
+	if path == "" { return }
+
+	out, _ := exec.Command("btrfs", "scrub", "status", path).CombinedOutput()
+	switch kernelScrubState(string(out)) {
+	case "running":
+		attachToKernelOp("SCRUB START", "🧹", path, "scrub", []string{"scrub", "status", path})
+	case "interrupted":
+		if lastOpInterrupted("SCRUB START", "AUTO SCRUB", "UNCLEAN SCRUB", "SCRUB RESUME", "SCRUB STOP") {
+			runCommandAsync("SCRUB RESUME", "🧹", path, "btrfs", "scrub", "resume", "-B", path)
+		}
+	}
+
+	// A replace started by the runbook is followed by the runbook itself.
+	if status, _, err := replaceStatus(path); err == nil && status != nil && status.State == "running" && !runbookActive() {
+		printDockerLog("REPLACE", "Re-attaching to replace still running on %s", path)
+		trackReplace(path, path, "Re-attached after restart: this replace was already running in the kernel.")
+	}
+
+	// balance status exits non-zero while a balance exists, so only the
+	// output is looked at.
+	out, _ = exec.Command("btrfs", "balance", "status", path).CombinedOutput()
+	switch kernelBalanceState(string(out)) {
+	case "running":
+		attachToKernelOp("BALANCE START", "⚖️", path, "balance", []string{"balance", "status", path})
+	case "paused":
+		if lastOpInterrupted("BALANCE START", "AUTO BALANCE", "BALANCE RESUME", "BALANCE STOP", "BALANCE PAUSE", "RULE BALANCE", "PROFILE CONVERT", "CONVERT RESUME") {
+			runCommandAsync("BALANCE RESUME", "⚖️", path, "btrfs", "balance", "resume", path)
+		}
+	}
+}
+
+// kernelScrubState reads `btrfs scrub status`: "Status: running" on current
+// btrfs-progs, "... running for ..." / "... was aborted after ..." on older
+// ones.
+func kernelScrubState(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.ToLower(strings.TrimSpace(line))
+		if v, ok := strings.CutPrefix(line, "status:"); ok {
+			switch strings.TrimSpace(v) {
+			case "running": return "running"
+			case "interrupted", "aborted": return "interrupted"
+			}
+			return "idle"
+		}
+		if strings.HasPrefix(line, "scrub started") || strings.HasPrefix(line, "scrub resumed") {
+			if strings.Contains(line, "running for") { return "running" }
+			if strings.Contains(line, "aborted") || strings.Contains(line, "interrupted") { return "interrupted" }
+		}
+	}
+	return "idle"
+}
+
+// kernelBalanceState reads "Balance on '/x' is running" / "is paused" /
+// "No balance found on '/x'".
+func kernelBalanceState(out string) string {
+	first, _, _ := strings.Cut(strings.TrimSpace(out), "\n")
+	if strings.Contains(first, " is running") { return "running" }
+	if strings.Contains(first, " is paused") { return "paused" }
+	return "idle"
+}
+
+// lastOpInterrupted reports whether the newest history entry of any of the
+// given types was interrupted by a shutdown or crash.
+func lastOpInterrupted(types ...string) bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for _, e := range state.History {
+		for _, t := range types {
+			if e.Type == t { return e.Status == interruptedStatus }
+		}
+	}
+	return false
+}
+
+// attachToKernelOp tracks an operation that outlived the previous process by
+// polling its status command until it is no longer running.
+func attachToKernelOp(opType, emoji, path, kind string, statusArgs []string) {
+	printDockerLog(opType, "Re-attaching to %s still running on %s", kind, path)
+	start := time.Now()
+	id := startHistory(opType, emoji, path, "Re-attached after restart: this "+kind+" was already running in the kernel.")
+	go func() {
+		for {
+			time.Sleep(30 * time.Second)
+			out, _ := exec.Command("btrfs", statusArgs...).CombinedOutput()
+			output := string(out)
+			running := kernelBalanceState(output) == "running"
+			if kind == "scrub" { running = kernelScrubState(output) == "running" }
+			result := parseCommandResult("btrfs", statusArgs, output)
+			if kind == "scrub" && !running { attachCorruptFiles(result, path) }
+			updateHistory(id, func(e *LogEntry) {
+				e.Output = "Re-attached after restart.\n\n" + output
+				e.Result = result
+				e.Duration = time.Since(start).Round(time.Second).String() + " (since restart)"
+				if running { return }
+				e.Status = "Success"
+				if kind == "scrub" && ((e.Result != nil && e.Result.Scrub != nil && e.Result.Scrub.Errors > 0) || kernelScrubState(output) == "interrupted") { e.Status = "Failed" }
+				if kind == "balance" && kernelBalanceState(output) == "paused" { e.Status = "Warning" }
+			})
+			if !running { return }
+		}
+	}()
+}
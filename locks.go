@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- Maintenance Locks ---
+// While someone repairs a filesystem from a shell, a maintenance lock on it
+// keeps the app's hands off: scheduled jobs that touch it are skipped (and
+// logged), rules don't start balances on it, and snapshot deletion,
+// retention, purge, rollback, subvolume deletion, balance, profile
+// conversion, defrag, dedup, device changes, resize and qgroup cleanup on it
+// are refused with 423 until the lock is released. Locks are kept in the
+// state by filesystem UUID, so they cover every mount of the filesystem and
+// survive restarts.
+
+type MaintenanceLock struct {
+	UUID   string `json:"uuid"`
+	Path   string `json:"path"` // the path it was locked by
+	Label  string `json:"label,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	User   string `json:"user,omitempty"`
+	Since  string `json:"since"` // RFC 3339
+}
+
+// filesystemUUID returns the UUID of the btrfs filesystem holding path.
+func filesystemUUID(path string) (string, error) {
+	info, err := btrfsFS.FilesystemInfo(path)
+	if err != nil { return "", err }
+	return info.UUID, nil
+}
+
+// lockedFor returns the lock on the filesystem of any of paths, or nil.
+// Paths that can't be resolved are not considered locked.
+func lockedFor(paths ...string) *MaintenanceLock {
+	state.mu.Lock()
+	// The handlers below change the map while paths are resolved.
+	locks := maps.Clone(state.Locks)
+	state.mu.Unlock()
+	if len(locks) == 0 { return nil }
+	for _, p := range paths {
+		if p == "" { continue }
+		uuid, err := filesystemUUID(p)
+		if err != nil { continue }
+		if l, ok := locks[uuid]; ok { return &l }
+	}
+	return nil
+}
+
+func (l *MaintenanceLock) message() string {
+	msg := fmt.Sprintf("the filesystem of %s is under a maintenance lock since %s", l.Path, localTime(parseRFC3339(l.Since)).Format(displayLayout))
+	if l.Reason != "" { msg += " (" + l.Reason + ")" }
+	return msg
+}
+
+func parseRFC3339(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339, s)
+	return t
+}
+
+// refuseLocked answers 423 and returns true when any of paths is locked.
+func refuseLocked(w http.ResponseWriter, paths ...string) bool {
+	l := lockedFor(paths...)
+	if l == nil { return false }
+	http.Error(w, "Locked: "+l.message()+"; release the lock first", 423)
+	return true
+}
+
+// scheduledJobPaths returns the paths the scheduled job name works on.
+func scheduledJobPaths(cfg Config, name string) []string {
+	kind, id, _ := strings.Cut(name, ":")
+	for _, j := range cfg.SnapshotJobs {
+		if j.ID != id { continue }
+		switch kind {
+		case "snapshot": return []string{j.Source, j.Dest}
+		case "archive": return []string{j.Dest, j.Archive.Dest}
+		case "streams", "verify": return []string{j.Dest}
+		}
+	}
+	switch name {
+	case "scrub": return scrubTargets(cfg)
+	case "balance", "trim": return []string{cfg.TargetDrive}
+	case "compsize": return compsizePaths(cfg)
+	case "dedup": return dedupPaths(cfg)
+	}
+	return nil
+}
+
+// skipLocked logs and returns true when the scheduled job name would touch
+// a locked filesystem.
+func skipLocked(cfg Config, name string) bool {
+	l := lockedFor(scheduledJobPaths(cfg, name)...)
+	if l == nil { return false }
+	logHistoryJob(name, "LOCKED", "🔒", name, "Warning", fmt.Sprintf("Scheduled run skipped: %s.", l.message()))
+	return true
+}
+
+// --- Handlers ---
+
+func handleListLocks(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	locks := []MaintenanceLock{}
+	for _, l := range state.Locks { locks = append(locks, l) }
+	state.mu.Unlock()
+	json.NewEncoder(w).Encode(locks)
+}
+
+// handleCreateLock locks the filesystem holding {"path"}, with an optional
+// {"reason"}.
+func handleCreateLock(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path   string `json:"path"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), 400)
+		return
+	}
+	if req.Path == "" {
+		state.mu.Lock()
+		req.Path = state.Config.TargetDrive
+		state.mu.Unlock()
+	}
+	if req.Path == "" {
+		http.Error(w, "Path required", 400)
+		return
+	}
+	info, err := btrfsFS.FilesystemInfo(req.Path)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s is not on a btrfs filesystem: %v", req.Path, err), 400)
+		return
+	}
+	lock := MaintenanceLock{UUID: info.UUID, Path: req.Path, Label: info.Label, Reason: strings.TrimSpace(req.Reason), User: requestUser(r).Name, Since: time.Now().UTC().Format(time.RFC3339)}
+	state.mu.Lock()
+	if state.Locks == nil { state.Locks = map[string]MaintenanceLock{} }
+	_, exists := state.Locks[lock.UUID]
+	if !exists { state.Locks[lock.UUID] = lock }
+	saveState()
+	state.mu.Unlock()
+	if exists {
+		http.Error(w, "The filesystem is already locked", 409)
+		return
+	}
+	logHistory("LOCK", "🔒", req.Path, "Success", "Maintenance lock set: scheduled jobs are skipped and destructive actions refused"+reasonSuffix(lock.Reason))
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(lock)
+}
+
+func handleReleaseLock(w http.ResponseWriter, r *http.Request) {
+	uuid := r.PathValue("uuid")
+	state.mu.Lock()
+	lock, ok := state.Locks[uuid]
+	delete(state.Locks, uuid)
+	saveState()
+	state.mu.Unlock()
+	if !ok {
+		http.Error(w, "The filesystem is not locked", 404)
+		return
+	}
+	logHistory("UNLOCK", "🔓", lock.Path, "Success", "Maintenance lock released")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "released"})
+}
+
+func reasonSuffix(reason string) string {
+	if reason == "" { return "" }
+	return " (" + reason + ")"
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Log Output Files ---
+// A full balance or a recursive defrag can print megabytes, and the history
+// is rewritten on every state save. Once an entry finishes, output beyond
+// log_output.max_entry_kb (default 64) goes to a file of its own in logs/
+// under the state directory, and the entry keeps the start and the end of
+// it. GET /api/history/{id}/output returns the whole output. Log files are
+// gzipped after compress_after_days (7) and deleted after retention_days
+// (90), oldest first as well once they take more than max_total_mb (500).
+
+type LogOutputConfig struct {
+	MaxEntryKB        int `json:"max_entry_kb,omitempty"`        // output kept in the history per entry, default 64
+	CompressAfterDays int `json:"compress_after_days,omitempty"` // default 7
+	RetentionDays     int `json:"retention_days,omitempty"`      // default 90
+	MaxTotalMB        int `json:"max_total_mb,omitempty"`        // default 500
+}
+
+const (
+	logDirName              = "logs"
+	defaultLogEntryKB       = 64
+	defaultLogCompressDays  = 7
+	defaultLogRetentionDays = 90
+	defaultLogTotalMB       = 500
+	logMaintenanceInterval  = time.Hour
+)
+
+func (c LogOutputConfig) maxEntry() int {
+	if c.MaxEntryKB <= 0 { return defaultLogEntryKB << 10 }
+	return c.MaxEntryKB << 10
+}
+
+func (c LogOutputConfig) compressAfter() time.Duration {
+	if c.CompressAfterDays <= 0 { return defaultLogCompressDays * 24 * time.Hour }
+	return time.Duration(c.CompressAfterDays) * 24 * time.Hour
+}
+
+func (c LogOutputConfig) retention() time.Duration {
+	if c.RetentionDays <= 0 { return defaultLogRetentionDays * 24 * time.Hour }
+	return time.Duration(c.RetentionDays) * 24 * time.Hour
+}
+
+func (c LogOutputConfig) maxTotal() int64 {
+	if c.MaxTotalMB <= 0 { return defaultLogTotalMB << 20 }
+	return int64(c.MaxTotalMB) << 20
+}
+
+func (c LogOutputConfig) validate() error {
+	if c.MaxEntryKB < 0 || c.CompressAfterDays < 0 || c.RetentionDays < 0 || c.MaxTotalMB < 0 { return fmt.Errorf("log_output: values must not be negative") }
+	if c.MaxEntryKB > 0 && c.MaxEntryKB < 4 { return fmt.Errorf("log_output: max_entry_kb must be at least 4") }
+	return nil
+}
+
+func logDir() string { return filepath.Join(stateDir, logDirName) }
+
+// trimOutput keeps the first quarter and the last three quarters of
+// limit, as the end usually holds the summary and the error.
+func trimOutput(out string, limit int) string {
+	head, tail := limit/4, limit-limit/4
+	cut := out[:head]
+	if i := strings.LastIndexByte(cut, '\n'); i > 0 { cut = cut[:i+1] }
+	end := out[len(out)-tail:]
+	if i := strings.IndexByte(end, '\n'); i >= 0 && i < len(end)-1 { end = end[i+1:] }
+	return fmt.Sprintf("%s\n... %s of output left out, see the full output ...\n\n%s", cut, formatBytes(uint64(len(out)-len(cut)-len(end))), end)
+}
+
+// spillOutput moves the output of a finished entry that is over the limit
+// to its log file. It runs once per entry, as it finishes. Caller holds
+// state.mu.
+func spillOutput(e *LogEntry) {
+	if e.OutputFile != "" || strings.HasSuffix(e.Status, "...") { return }
+	limit := state.Config.LogOutput.maxEntry()
+	if len(e.Output) <= limit { return }
+	name := strconv.FormatInt(e.ID, 10) + ".log"
+	err := os.MkdirAll(logDir(), 0755)
+	if err == nil { err = writeFileAtomic(filepath.Join(logDir(), name), []byte(e.Output), 0644) }
+	if err != nil {
+		logError("STORAGE", "Failed to write the output of log entry %d: %v", e.ID, err)
+		return
+	}
+	e.OutputFile, e.OutputBytes = name, len(e.Output)
+	e.Output = trimOutput(e.Output, limit)
+}
+
+// readOutputFile returns the contents of a log file, which may have been
+// gzipped since.
+func readOutputFile(name string) ([]byte, error) {
+	path := filepath.Join(logDir(), filepath.Base(name))
+	if data, err := os.ReadFile(path); !os.IsNotExist(err) { return data, err }
+	f, err := os.Open(path + ".gz")
+	if err != nil { return nil, err }
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil { return nil, err }
+	return io.ReadAll(zr)
+}
+
+func gzipFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil { return err }
+	var b strings.Builder
+	zw := gzip.NewWriter(&b)
+	zw.Write(data)
+	if err := zw.Close(); err != nil { return err }
+	if err := writeFileAtomic(path+".gz", []byte(b.String()), 0644); err != nil { return err }
+	return os.Remove(path)
+}
+
+// maintainLogFiles spills entries written before the limit existed (or was
+// lowered), then compresses and expires the log files.
+func maintainLogFiles() {
+	state.mu.Lock()
+	cfg := state.Config.LogOutput
+	spilled := 0
+	for i := range state.History {
+		if state.History[i].OutputFile != "" { continue }
+		spillOutput(&state.History[i])
+		if state.History[i].OutputFile != "" { spilled++ }
+	}
+	if spilled > 0 { saveState() }
+	state.mu.Unlock()
+	if spilled > 0 { printDockerLog("STORAGE", "Moved the output of %d log entries to %s", spilled, logDir()) }
+
+	entries, err := os.ReadDir(logDir())
+	if err != nil {
+		if !os.IsNotExist(err) { logWarn("STORAGE", "Failed to read %s: %v", logDir(), err) }
+		return
+	}
+	type logFile struct {
+		path string
+		mod  time.Time
+		size int64
+	}
+	var files []logFile
+	now := time.Now()
+	for _, d := range entries {
+		if d.IsDir() || !(strings.HasSuffix(d.Name(), ".log") || strings.HasSuffix(d.Name(), ".log.gz")) { continue }
+		fi, err := d.Info()
+		if err != nil { continue }
+		f := logFile{filepath.Join(logDir(), d.Name()), fi.ModTime(), fi.Size()}
+		if now.Sub(f.mod) > cfg.retention() {
+			if err := os.Remove(f.path); err != nil { logWarn("STORAGE", "Failed to delete %s: %v", f.path, err) }
+			continue
+		}
+		if strings.HasSuffix(f.path, ".log") && now.Sub(f.mod) > cfg.compressAfter() {
+			if err := gzipFile(f.path); err != nil {
+				logWarn("STORAGE", "Failed to compress %s: %v", f.path, err)
+			} else if fi, err := os.Stat(f.path + ".gz"); err == nil {
+				f.path, f.size = f.path+".gz", fi.Size()
+				os.Chtimes(f.path, f.mod, f.mod)
+			}
+		}
+		files = append(files, f)
+	}
+
+	var total int64
+	for _, f := range files { total += f.size }
+	sort.Slice(files, func(i, j int) bool { return files[i].mod.Before(files[j].mod) })
+	for _, f := range files {
+		if total <= cfg.maxTotal() { break }
+		if err := os.Remove(f.path); err != nil { continue }
+		total -= f.size
+	}
+}
+
+func runLogFileMaintenance() {
+	for ; ; time.Sleep(logMaintenanceInterval) {
+		if shuttingDown() { return }
+		maintainLogFiles()
+	}
+}
+
+// handleHistoryOutput returns the whole output of a log entry as text;
+// ?download=true saves it as a file. IDs are matched like in
+// handleKillCommand, as the UI rounds them.
+func handleHistoryOutput(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.ParseFloat(r.PathValue("id"), 64)
+	if err != nil {
+		http.Error(w, "Invalid id", 400)
+		return
+	}
+	var entry *LogEntry
+	state.mu.Lock()
+	for _, e := range state.History {
+		if float64(e.ID) == n { entry = &e; break }
+	}
+	state.mu.Unlock()
+	if entry == nil {
+		http.Error(w, "No log entry with that id", 404)
+		return
+	}
+	output := []byte(entry.Output)
+	if entry.OutputFile != "" {
+		if output, err = readOutputFile(entry.OutputFile); os.IsNotExist(err) {
+			http.Error(w, "The full output was deleted by the log file retention", 410)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Reading the output: %v", err), 500)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.URL.Query().Get("download") == "true" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"btrfs-%s-%d.log\"", strings.ToLower(strings.ReplaceAll(entry.Type, " ", "-")), entry.ID))
+	}
+	w.Write(output)
+}
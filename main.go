@@ -3,14 +3,17 @@ package main
 import (
 	"embed"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"html/template"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -28,6 +31,11 @@ type ScheduleConfig struct {
 	Type    string `json:"type"`
 	Value   string `json:"value"`
 	Unit    string `json:"unit"`
+
+	Windows []TimeWindow `json:"windows,omitempty"` // see windows.go; empty: any time
+	Retry   RetryPolicy  `json:"retry"`             // of failed runs, see retry.go
+
+	Timezone string `json:"timezone,omitempty"` // cron only; default: the installation's, see timezone.go
 }
 
 type RetentionConfig struct {
@@ -35,16 +43,50 @@ type RetentionConfig struct {
 	Mode    string `json:"mode"`
 	Value   int    `json:"value"`
 	Unit    string `json:"unit"`
+
+	Tags []TagRetention `json:"tags,omitempty"` // for tagged snapshots, see snapmeta.go
 }
 
 type Config struct {
-	TargetDrive    string          `json:"target_drive"`
-	SnapshotSource string          `json:"snapshot_source"`
-	SnapshotDest   string          `json:"snapshot_dest"`
-	SnapshotSched  ScheduleConfig  `json:"snapshot_sched"`
-	ScrubSched     ScheduleConfig  `json:"scrub_sched"`
-	BalanceSched   ScheduleConfig  `json:"balance_sched"`
-	Retention      RetentionConfig `json:"retention"`
+	TargetDrive   string             `json:"target_drive"`
+	SnapshotJobs  []SnapshotJob      `json:"snapshot_jobs"`
+	ScrubSched    ScheduleConfig     `json:"scrub_sched"`
+	ScrubPlan     ScrubPlanConfig    `json:"scrub_plan"`
+	BalanceSched  ScheduleConfig     `json:"balance_sched"`
+	BalancePreset string             `json:"balance_preset"`
+	StateBackup   StateBackupConfig  `json:"state_backup"`
+	Notifications NotificationConfig `json:"notifications"`
+	Storage       StorageConfig      `json:"storage"`
+	UpdateCheck   UpdateCheckConfig  `json:"update_check"`
+	Health        HealthConfig       `json:"health"`
+	Access        AccessConfig       `json:"access"`
+
+	CommandTimeouts    []CommandTimeout `json:"command_timeouts"`
+	UsageSampleMinutes int              `json:"usage_sample_minutes"` // default 5
+	Blackouts          []Blackout       `json:"blackouts"`            // no scheduled jobs run during these
+	DedupSched         ScheduleConfig   `json:"dedup_sched"`
+	Dedup              DedupConfig      `json:"dedup"`
+	HistoryLimit       int              `json:"history_limit,omitempty"` // log entries kept, default 100
+
+	CommandPriorities []CommandPriority   `json:"command_priorities"` // see priority.go
+	UncleanScrub      UncleanScrubConfig  `json:"unclean_scrub"`      // see unclean.go
+	SnapshotSizes     SnapshotSizesConfig `json:"snapshot_sizes"`     // see snapsizes.go
+	BtrfsBackend      string              `json:"btrfs_backend"`      // auto (default), native or cli; see btrfsbackend.go
+	CompsizeSched     ScheduleConfig      `json:"compsize_sched"`
+	CompsizePaths     []string            `json:"compsize_paths"` // empty: the target drive
+	TrimSched         ScheduleConfig      `json:"trim_sched"`     // see trim.go
+	CatchUp           CatchUpConfig       `json:"catch_up"`       // see catchup.go
+	Report            ReportConfig        `json:"report"`         // see report.go
+	LogOutput         LogOutputConfig     `json:"log_output"`     // see logfiles.go
+	Logging           LoggingConfig       `json:"logging"`        // see applog.go
+	PublicStatus      PublicStatusConfig  `json:"public_status"`  // see publicstatus.go
+	Rules             []RemediationRule   `json:"rules"`          // see rules.go
+	Timezone          string              `json:"timezone,omitempty"` // IANA name, default: the server's; see timezone.go
+	Locale            string              `json:"locale,omitempty"`   // for showing times, default: the browser's
+	KernelEvents      KernelEventsConfig  `json:"kernel_events"`      // see kernel.go
+	Download          DownloadConfig      `json:"download"`           // see download.go
+	Agents            []AgentConfig       `json:"agents"`             // other boxes managed from here, see agents.go
+	Trash             TrashConfig         `json:"trash"`              // see trash.go
 }
 
 type LogEntry struct {
@@ -56,89 +98,193 @@ type LogEntry struct {
 	Status    string `json:"status"`
 	Output    string `json:"output"`
 	Duration  string `json:"duration"`
+
+	// OutputFile names the file in logs/ with the whole output when Output
+	// was cut down to log_output.max_entry_kb; OutputBytes is its size.
+	OutputFile  string `json:"output_file,omitempty"`
+	OutputBytes int    `json:"output_bytes,omitempty"`
+
+	// JobID, RunID and Trigger tie the entry to a run of a scheduled job,
+	// see jobruns.go.
+	JobID   string `json:"job_id,omitempty"`
+	RunID   string `json:"run_id,omitempty"`
+	Trigger string `json:"trigger,omitempty"`
+	Attempt int    `json:"attempt,omitempty"` // of a retry, see retry.go
+
+	// Termination is "timeout" or "killed" for commands ended early.
+	Termination string `json:"termination,omitempty"`
+	// Limits describes the priority and cgroup limits applied, see priority.go.
+	Limits string `json:"limits,omitempty"`
+
+	// Result holds figures parsed from Output for operations that have a
+	// parser (see results.go).
+	Result *OperationResult `json:"result,omitempty"`
 }
 
 type AppState struct {
-	Config  Config     `json:"config"`
-	History []LogEntry `json:"history"`
+	Config  Config          `json:"config"`
+	History []LogEntry      `json:"history"`
+	Runbook *ReplaceRunbook `json:"runbook,omitempty"`
+
+	RetentionReports []RetentionReport `json:"retention_reports,omitempty"`
+	// ScrubRotation records when the schedule last scrubbed each target.
+	ScrubRotation map[string]string `json:"scrub_rotation,omitempty"`
+	Shutdown      *ShutdownState    `json:"shutdown,omitempty"` // see unclean.go
+	// LastRuns records when each scheduled job last ran, see catchup.go.
+	LastRuns map[string]string `json:"last_runs,omitempty"`
+	// JobStats sums up the runs of each scheduled job, see jobruns.go.
+	JobStats map[string]JobStats `json:"job_stats,omitempty"`
+	// Convert is the last profile conversion, see convert.go.
+	Convert *ProfileConversion `json:"convert,omitempty"`
+	// RuleFirings and BalanceHold are the state of the rules, see rules.go.
+	RuleFirings map[string][]string `json:"rule_firings,omitempty"`
+	BalanceHold *BalanceHold        `json:"balance_hold,omitempty"`
+	// Pins are the pinned snapshots by path, see pins.go.
+	Pins map[string]SnapshotPin `json:"pins,omitempty"`
+	// SendParents are the parents of the next incremental sends by chain,
+	// see sendparents.go.
+	SendParents map[string]string `json:"send_parents,omitempty"`
+	// SnapshotMeta are the descriptions and tags of snapshots by path, see
+	// snapmeta.go.
+	SnapshotMeta map[string]SnapshotMeta `json:"snapshot_meta,omitempty"`
+	// Locks are the maintenance locks by filesystem UUID, see locks.go.
+	Locks map[string]MaintenanceLock `json:"locks,omitempty"`
 	mu      sync.Mutex
 	cron    *cron.Cron
 	cronIDs map[string]cron.EntryID
+	// cronSpecs remembers the spec each job was registered with so unchanged
+	// jobs can be left alone (and keep their phase) on config updates.
+	cronSpecs map[string]string
+	// qgroups caches the last `qgroup show` per filesystem path.
+	qgroups map[string]*QgroupReport
 }
 
 var state = AppState{
-	cron:    cron.New(),
-	cronIDs: make(map[string]cron.EntryID),
-	Config: Config{
-		SnapshotSched: ScheduleConfig{Unit: "minutes"},
-		Retention:     RetentionConfig{Unit: "days", Mode: "count", Value: 5},
-	},
+	cron:      cron.New(),
+	cronIDs:   make(map[string]cron.EntryID),
+	cronSpecs: make(map[string]string),
 }
 
-const timeLayout = "02-01-2006-15-04-MST"
-
 func main() {
+	if isCLI(os.Args[1:]) { os.Exit(runCLI(os.Args[1:])) }
+	flag.StringVar(&configFile, "config", "", "read the configuration from this YAML or JSON file instead of state.json")
+	stateDirFlag := flag.String("state-dir", "", "directory for state.json, history and keys (default $STATE_DIR, else /var/lib/btrfs-webui or $XDG_DATA_HOME/btrfs-webui)")
+	listenFlag := flag.String("listen", "", "address to listen on, e.g. 127.0.0.1:8080 or unix:/run/btrfs-webui.sock (default :$PORT)")
+	tlsEnabled := flag.Bool("tls", envEnabled("TLS"), "serve HTTPS; without --tls-cert a self-signed certificate is generated ($TLS)")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate (chain) to serve HTTPS with ($TLS_CERT)")
+	tlsKey := flag.String("tls-key", "", "PEM private key of --tls-cert ($TLS_KEY)")
+	acmeDomains := flag.String("acme-domain", "", "get certificates for these comma-separated host names from Let's Encrypt ($ACME_DOMAINS)")
+	acmeEmail := flag.String("acme-email", "", "contact address for the Let's Encrypt account ($ACME_EMAIL)")
+	acmeHTTP := flag.String("acme-http", "", "also answer HTTP-01 challenges and redirect to HTTPS on this address, e.g. :80 ($ACME_HTTP)")
+	templatesFlag := flag.String("templates", "", "directory with templates that replace the built-in index.html, layout.html and pages ($TEMPLATE_DIR)")
+	flag.Parse()
+	if flag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", flag.Arg(0))
+		cliUsage(os.Stderr)
+		os.Exit(2)
+	}
+	tlsOpts := TLSOptions{
+		Enabled:     *tlsEnabled,
+		Cert:        tlsFlag(*tlsCert, "TLS_CERT"),
+		Key:         tlsFlag(*tlsKey, "TLS_KEY"),
+		ACMEDomains: splitDomains(tlsFlag(*acmeDomains, "ACME_DOMAINS")),
+		ACMEEmail:   tlsFlag(*acmeEmail, "ACME_EMAIL"),
+		ACMEHTTP:    tlsFlag(*acmeHTTP, "ACME_HTTP"),
+	}
+
+	dir := tlsFlag(*stateDirFlag, "STATE_DIR")
+	if dir == "" { dir = defaultStateDir() }
+	if err := setStateDir(dir); err != nil { log.Fatal(err) }
 	loadState()
+	probes.stateLoaded.Store(true)
+	probeTools()
+	ensureStateSubvolume()
+	reconcileOperations()
+	checkUncleanShutdown()
+	resumeRunbook()
 	state.cron.Start()
+	probes.schedulerStarted.Store(true)
 	refreshSchedules()
-
-	// Handlers
-	http.HandleFunc("/", handleIndex)
-	http.HandleFunc("/api/config", handleConfig)
-	http.HandleFunc("/api/history", handleHistory)
-	http.HandleFunc("/api/logs/clear", handleClearLogs)
-	
-	// Snapshot Management
-	http.HandleFunc("/api/snapshots/list", handleListSnapshots)
-	http.HandleFunc("/api/snapshots/delete", handleDeleteSnapshot)
-
-	// Actions
-	http.HandleFunc("/api/action/snapshot", handleActionSnapshot)
-	http.HandleFunc("/api/action/scrub", handleActionScrub)
-	http.HandleFunc("/api/action/balance", handleActionBalance)
-	http.HandleFunc("/api/action/defrag", handleActionDefrag)
-	http.HandleFunc("/api/action/compsize", handleActionCompsize)
-	http.HandleFunc("/api/action/purge_all", handlePurgeAllSnapshots)
-
-	port := os.Getenv("PORT")
-	if port == "" { port = "8080" }
-
-	fmt.Printf("🚀 BTRFS Manager started on :%s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	catchUpMissedRuns("the server was not running")
+	go runResumeWatcher()
+	go runHistoryBroadcaster(time.Second)
+	go runSpaceMonitor()
+	go runQgroupRefresher(10 * time.Minute)
+	go runSnapshotSizeRefresher()
+	go runUpdateChecker(24 * time.Hour)
+	go runHealthWatchdog()
+	go runKernelWatcher()
+	go runBalancePoller()
+	go runLogFileMaintenance()
+	go runTrashReaper()
+
+	if err := loadTemplates(tlsFlag(*templatesFlag, "TEMPLATE_DIR")); err != nil { log.Fatal(err) }
+	registerRoutes(http.DefaultServeMux)
+
+	tlsCfg, certInfo, err := tlsConfig(tlsOpts)
+	if err != nil { log.Fatal(err) }
+	ln, err := listen(*listenFlag)
+	if err != nil { log.Fatal(err) }
+
+	srv := &http.Server{TLSConfig: tlsCfg}
+	done := make(chan struct{})
+	go handleShutdownSignals(srv, done)
+
+	if tlsCfg == nil {
+		printDockerLog("SYSTEM", "🚀 BTRFS Manager started on %s", ln.Addr())
+		err = srv.Serve(ln)
+	} else {
+		printDockerLog("SYSTEM", "🚀 BTRFS Manager started on %s (HTTPS, %s)", ln.Addr(), certInfo)
+		err = srv.ServeTLS(ln, "", "")
+	}
+	if err != http.ErrServerClosed { log.Fatal(err) }
+	<-done
 }
 
 // --- Helper: Command Runner & Logger ---
 
-func printDockerLog(opType, msg string, args ...interface{}) {
-	timestamp := time.Now().Format(time.RFC3339)
-	formattedMsg := fmt.Sprintf(msg, args...)
-	fmt.Printf("[%s] [%s] %s\n", timestamp, opType, formattedMsg)
-}
+// logOutput receives the server log; the command line sends it to stderr.
+var logOutput io.Writer = os.Stdout
 
 func runCommandAsync(opType, emoji, path, cmdName string, args ...string) int64 {
-	state.mu.Lock()
+	id, _ := startCommand(opType, emoji, path, cmdName, args...)
+	return id
+}
+
+// startCommand is runCommandAsync that also returns a channel which is
+// closed once the command has ended and its outcome is recorded.
+func startCommand(opType, emoji, path, cmdName string, args ...string) (int64, <-chan struct{}) {
 	startTime := time.Now()
-	entryID := time.Now().UnixNano()
-	
 	cmdStr := fmt.Sprintf("%s %s", cmdName, strings.Join(args, " "))
-
-	entry := LogEntry{
-		ID:        entryID,
-		Type:      opType,
-		Emoji:     emoji,
-		Path:      path,
-		Timestamp: startTime.Format("02-01-2006 15:04 MST"),
-		Status:    "Running...",
-		Output:    fmt.Sprintf("Command: %s", cmdStr),
-	}
-	state.History = append([]LogEntry{entry}, state.History...)
-	state.mu.Unlock()
+	entryID := startHistory(opType, emoji, path, fmt.Sprintf("Command: %s", cmdStr))
+	ctx, cancel := commandContext(opType)
+	trackCommand(entryID, cmdName, args, cancel)
+	done := make(chan struct{})
 
 	go func() {
+		defer close(done)
+		defer untrackCommand(entryID)
+		defer cancel(nil)
+		if err := toolMissing(cmdName); err != nil {
+			logWarn(opType, "UNAVAILABLE: %v", err)
+			updateHistory(entryID, func(e *LogEntry) {
+				e.Status = "Failed"
+				e.Output += fmt.Sprintf("\n\nFeature unavailable: %v", err)
+			})
+			return
+		}
 		printDockerLog(opType, "STARTING: %s", cmdStr)
 
-		cmd := exec.Command(cmdName, args...)
+		exited := make(chan struct{})
+		cmd := newManagedCommand(ctx, exited, cmdName, args...)
+		limits, release := prioritize(cmd, opType)
+		if limits != "" {
+			printDockerLog(opType, "LIMITS: %s", limits)
+			updateHistory(entryID, func(e *LogEntry) { e.Limits = limits })
+		}
 		output, err := cmd.CombinedOutput()
+		release()
+		close(exited)
 		duration := time.Since(startTime).Round(time.Millisecond)
 		outputStr := string(output)
 
@@ -147,88 +293,173 @@ func runCommandAsync(opType, emoji, path, cmdName string, args ...string) int64
 			printDockerLog(opType, "OUTPUT:\n%s", outputStr)
 		}
 		if err != nil {
-			printDockerLog(opType, "ERROR: %v", err)
+			logError(opType, "ERROR: %v", err)
 		}
-		fmt.Println("---------------------------------------------------------------")
-
-		state.mu.Lock()
-		defer state.mu.Unlock()
-		
-		for i, e := range state.History {
-			if e.ID == entryID {
-				state.History[i].Duration = duration.String()
-				state.History[i].Output = outputStr
-				
-				if err != nil {
-					if strings.Contains(outputStr, "Operation in progress") || strings.Contains(outputStr, "inprogress") {
-						state.History[i].Status = "Warning" 
-						state.History[i].Output += "\n\n⚠️ NOTE: A scrub/balance is already running in the background."
-					} else {
-						state.History[i].Status = "Failed"
-						state.History[i].Output += fmt.Sprintf("\nError: %v", err)
-					}
+		logSeparator()
+
+		result := parseCommandResult(cmdName, args, outputStr)
+		if result != nil { appLog.Debug("parsed result", "op", opType, "command", cmdStr, "result", result) }
+		if cmdName == "btrfs" && len(args) > 0 && args[0] == "scrub" && !shuttingDown() { attachCorruptFiles(result, args[len(args)-1]) }
+
+		updateHistory(entryID, func(e *LogEntry) {
+			e.Duration = duration.String()
+			e.Output = outputStr
+			e.Result = result
+
+			if t, ok := terminationOf(ctx); ok && err != nil {
+				e.Status = t.Status
+				e.Termination = t.Kind
+				e.Output += "\n\n" + t.Message
+			} else if err != nil && shuttingDown() {
+				e.Status = interruptedStatus
+				e.Output += "\n\n⚠️ Interrupted: the web UI was stopped while this was running."
+			} else if err != nil {
+				// Starts check for a running scrub or balance first (see
+				// inprogress.go); this catches one started meanwhile.
+				if strings.Contains(outputStr, "Operation in progress") || strings.Contains(outputStr, "inprogress") {
+					e.Status = "Warning"
+					e.Output += "\n\n⚠️ NOTE: A scrub/balance is already running in the background."
 				} else {
-					state.History[i].Status = "Success"
+					e.Status = "Failed"
+					e.Output += fmt.Sprintf("\nError: %v", err)
 				}
-				break
+			} else {
+				e.Status = "Success"
 			}
-		}
-		if len(state.History) > 100 { state.History = state.History[:100] }
-		saveState()
+		})
 	}()
 
-	return entryID
+	return entryID, done
+}
+
+// startHistory records a "Running..." entry and returns its ID so the caller
+// can fill in the outcome later with updateHistory.
+func startHistory(opType, emoji, path, output string) int64 {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	entry := LogEntry{
+		ID:        time.Now().UnixNano(),
+		Type:      opType,
+		Emoji:     emoji,
+		Path:      path,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Status:    "Running...",
+		Output:    output,
+	}
+	state.History = append([]LogEntry{entry}, state.History...)
+	notifyHistoryChanged()
+	publishEntry(entry)
+	return entry.ID
+}
+
+func updateHistory(id int64, fn func(e *LogEntry)) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for i := range state.History {
+		if state.History[i].ID == id {
+			fn(&state.History[i])
+			spillOutput(&state.History[i])
+			notifyHistoryEntry(state.History[i])
+			publishEntry(state.History[i])
+			if e := state.History[i]; e.RunID != "" && statusKey(e.Status) != "running" { recordJobRun(e.RunID) }
+			break
+		}
+	}
+	trimHistory()
+	notifyHistoryChanged()
+	saveState()
 }
 
 // --- Snapshot List & Delete Handlers ---
 
 type SnapshotItem struct {
-	Name string `json:"name"`
-	Date string `json:"date"`
+	Name     string `json:"name"`
+	Date     string `json:"date"`
+	Job      string `json:"job"`
+	Bootable bool   `json:"bootable,omitempty"` // listed in the job's boot menu
+	Archived bool   `json:"archived,omitempty"` // a copy is on the job's archive tier
+	Adopted  bool   `json:"adopted,omitempty"`  // made by another tool, see adopt.go
+	Pinned   bool   `json:"pinned,omitempty"`   // exempt from retention and purge, see pins.go
+	PinNote  string `json:"pin_note,omitempty"`
+	// Description and Tags were given when it was taken, see snapmeta.go.
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// SendParentOf names the chains whose next send needs it, see sendparents.go.
+	SendParentOf []string `json:"send_parent_of,omitempty"`
+	// With snapshot_sizes, from the last qgroup refresh of the destination.
+	Referenced   *uint64 `json:"referenced_bytes,omitempty"`
+	Exclusive    *uint64 `json:"exclusive_bytes,omitempty"` // freed by deleting the snapshot
+	SizesUpdated string  `json:"sizes_updated,omitempty"`
 }
 
 func handleListSnapshots(w http.ResponseWriter, r *http.Request) {
-	state.mu.Lock()
-	dest := state.Config.SnapshotDest
-	state.mu.Unlock()
-
-	if dest == "" {
+	job, err := jobFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if job.Dest == "" {
 		http.Error(w, "Destination not configured", 400)
 		return
 	}
-
-	entries, err := os.ReadDir(dest)
+	list, err := listSnapshotItems(job)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	json.NewEncoder(w).Encode(list)
+}
 
-	var list []SnapshotItem
+// listSnapshotItems lists the snapshots of job, newest first, as shown in
+// the UI and on the /snapshots page.
+func listSnapshotItems(job SnapshotJob) ([]SnapshotItem, error) {
+	dest := job.Dest
+	entries, err := os.ReadDir(dest)
+	if err != nil { return nil, err }
+
+	times := loadSnapshotTimes(dest)
+	list := []SnapshotItem{}
+	taken := map[string]time.Time{}
 	for _, e := range entries {
-		if e.IsDir() {
+		// Jobs sharing a destination are told apart by their prefix.
+		if e.IsDir() && (strings.HasPrefix(e.Name(), job.Prefix) || job.adopted(e.Name())) && e.Name() != quarantineDirName && e.Name() != trashDirName {
 			// Try to parse date, otherwise just use mod time or generic
 			displayDate := "Unknown"
-			t, err := time.Parse(timeLayout, e.Name())
-			if err == nil {
-				displayDate = t.Format("Jan 02, 2006 15:04 MST")
-			} else {
+			t, ok := job.snapshotTime(e.Name(), times)
+			if !ok {
 				info, _ := e.Info()
-				displayDate = info.ModTime().Format("Jan 02, 2006 15:04 MST")
+				t = info.ModTime()
 			}
+			displayDate = localTime(t).Format("Jan 02, 2006 15:04 MST")
+			taken[e.Name()] = t
 
+			pin, pinned := snapshotPin(job, e.Name())
+			meta := snapshotMeta(job, e.Name())
 			list = append(list, SnapshotItem{
-				Name: e.Name(),
-				Date: displayDate,
+				Name:         e.Name(),
+				Date:         displayDate,
+				Job:          job.ID,
+				Bootable:     snapshotBootable(job, e.Name()),
+				Archived:     inArchive(job, e.Name()),
+				Adopted:      job.adopted(e.Name()),
+				Pinned:       pinned,
+				PinNote:      pin.Note,
+				Description:  meta.Description,
+				Tags:         meta.Tags,
+				SendParentOf: sendParentOf(snapshotPath(dest, e.Name())),
 			})
 		}
 	}
 
-	// Sort by Name (which is Date format) descending
+	// Newest first; adopted snapshots are named differently, so the names
+	// alone don't sort.
 	sort.Slice(list, func(i, j int) bool {
+		ti, tj := taken[list[i].Name], taken[list[j].Name]
+		if !ti.Equal(tj) { return ti.After(tj) }
 		return list[i].Name > list[j].Name
 	})
-
-	json.NewEncoder(w).Encode(list)
+	annotateSnapshotSizes(dest, list)
+	return list, nil
 }
 
 func handleDeleteSnapshot(w http.ResponseWriter, r *http.Request) {
@@ -238,32 +469,107 @@ func handleDeleteSnapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	state.mu.Lock()
-	dest := state.Config.SnapshotDest
-	state.mu.Unlock()
+	job, err := jobFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
 
 	// Security: Clean path to prevent .. traversal
-	fullPath := filepath.Join(dest, name)
-	if filepath.Dir(fullPath) != filepath.Clean(dest) {
+	fullPath, err := snapshotRoot(job, name)
+	if err != nil {
 		http.Error(w, "Invalid path", 403)
 		return
 	}
+	if _, pinned := snapshotPin(job, name); pinned {
+		http.Error(w, "Snapshot is pinned; unpin it first", 409)
+		return
+	}
+	if refuseLocked(w, job.Dest) { return }
+	if chains := sendParentOf(fullPath); len(chains) > 0 && r.URL.Query().Get("break_chains") != "true" {
+		http.Error(w, "Snapshot is the parent of "+describeChains(chains)+"; set break_chains to delete it anyway", 409)
+		return
+	}
+	// ?permanent=true skips the trash.
+	if trashConfig().Enabled && r.URL.Query().Get("permanent") != "true" {
+		trashed, err := moveToTrash(job, name)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if job.Boot.Enabled { go refreshBootMenu(job) }
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "trashed", "trashed": trashed})
+		return
+	}
 
-	runCommandAsync("DELETE SNAP", "🗑️", fullPath, "btrfs", "subvolume", "delete", fullPath)
+	_, done := startBtrfsOp("DELETE SNAP", "🗑️", fullPath, fmt.Sprintf("Delete subvolume '%s'", fullPath), func() (*OperationResult, error) {
+		err := deleteSnapshotTree(fullPath)
+		if err == nil { forgetSnapshotMeta(fullPath) }
+		return nil, err
+	})
+	if job.Boot.Enabled {
+		go func() {
+			<-done
+			refreshBootMenu(job)
+		}()
+	}
 	json.NewEncoder(w).Encode(map[string]interface{}{"status": "triggered"})
 }
 
 
 // --- Action Handlers ---
 
+// handleActionSnapshot snapshots the job given by ?job=, or every job.
 func handleActionSnapshot(w http.ResponseWriter, r *http.Request) {
-	go performSnapshot()
+	if !requireFeature(w, "snapshots") { return }
+	jobs, err := jobsFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var meta SnapshotMeta
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), 400)
+			return
+		}
+	}
+	if err := meta.normalize(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	for _, job := range jobs {
+		if refuseLocked(w, job.Source, job.Dest) { return }
+	}
+	for _, job := range jobs {
+		go func() {
+			run := newJobRun("snapshot:"+job.ID, "manual")
+			performSnapshotWith(job, run, meta)
+			run.finish()
+		}()
+	}
 	json.NewEncoder(w).Encode(map[string]interface{}{"status": "triggered", "message": "Snapshot initiated"})
 }
 
+// jobsFromRequest returns the job selected with ?job=, or all jobs when the
+// parameter is absent.
+func jobsFromRequest(r *http.Request) ([]SnapshotJob, error) {
+	if id := r.URL.Query().Get("job"); id != "" {
+		job, err := findSnapshotJob(id)
+		if err != nil { return nil, err }
+		return []SnapshotJob{job}, nil
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return append([]SnapshotJob(nil), state.Config.SnapshotJobs...), nil
+}
+
 func handleActionScrub(w http.ResponseWriter, r *http.Request) {
+	if !requireFeature(w, "scrub") { return }
 	action := r.URL.Query().Get("action")
-	path := state.Config.TargetDrive
+	state.mu.Lock()
+	path, defaultMode := state.Config.TargetDrive, state.Config.ScrubPlan.Mode
+	state.mu.Unlock()
 	if path == "" { http.Error(w, "Target drive not set", 400); return }
 
 	var id int64
@@ -272,14 +578,21 @@ func handleActionScrub(w http.ResponseWriter, r *http.Request) {
 	} else if action == "cancel" {
 		id = runCommandAsync("SCRUB STOP", "🛑", path, "btrfs", "scrub", "cancel", path)
 	} else {
-		id = runCommandAsync("SCRUB START", "🧹", path, "btrfs", "scrub", "start", "-B", path)
+		if op := scrubInProgress(path); op != nil { writeInProgress(w, op); return }
+		// ?mode= overrides the scheduled scrubs' mode.
+		mode := r.URL.Query().Get("mode")
+		if mode == "" { mode = defaultMode }
+		id, _ = startScrub("SCRUB START", path, mode)
 	}
 	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
 }
 
 func handleActionBalance(w http.ResponseWriter, r *http.Request) {
+	if !requireFeature(w, "balance") { return }
 	action := r.URL.Query().Get("action")
-	path := state.Config.TargetDrive
+	state.mu.Lock()
+	path, defaultPreset := state.Config.TargetDrive, state.Config.BalancePreset
+	state.mu.Unlock()
 	if path == "" { http.Error(w, "Target drive not set", 400); return }
 
 	var id int64
@@ -287,59 +600,144 @@ func handleActionBalance(w http.ResponseWriter, r *http.Request) {
 		id = runCommandAsync("BALANCE CHECK", "⚖️", path, "btrfs", "balance", "status", path)
 	} else if action == "cancel" {
 		id = runCommandAsync("BALANCE STOP", "🛑", path, "btrfs", "balance", "cancel", path)
+	} else if action == "pause" {
+		id = runCommandAsync("BALANCE PAUSE", "⏸️", path, "btrfs", "balance", "pause", path)
+	} else if action == "resume" {
+		if refuseLocked(w, path) { return }
+		if op := balanceInProgress(path, false); op != nil { writeInProgress(w, op); return }
+		id = runCommandAsync("BALANCE RESUME", "⚖️", path, "btrfs", "balance", "resume", path)
 	} else {
-		id = runCommandAsync("BALANCE START", "⚖️", path, "btrfs", "balance", "start", "--full-balance", path)
+		presetID := r.URL.Query().Get("preset")
+		if !validBalancePreset(presetID) { http.Error(w, "Unknown balance preset", 400); return }
+		if presetID == "" { presetID = defaultPreset }
+		preset := findBalancePreset(presetID)
+		if refuseLocked(w, path) { return }
+		if op := balanceInProgress(path, true); op != nil { writeInProgress(w, op); return }
+		id = runCommandAsync("BALANCE START", "⚖️", balanceVisualPath(path, preset), "btrfs", balanceStartArgs(preset, path)...)
 	}
+	wakeBalancePoller()
 	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
 }
 
+// handleActionDefrag defragments a path as described by a DefragRequest
+// body, or by query parameters (?path=&compress=&recursive=&target_extent=).
 func handleActionDefrag(w http.ResponseWriter, r *http.Request) {
-	path := state.Config.TargetDrive
-	if path == "" { http.Error(w, "Target drive not set", 400); return }
-	id := runCommandAsync("DEFRAG", "📦", path, "btrfs", "filesystem", "defragment", "-r", path)
+	var req DefragRequest
+	if r.Method == "POST" && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), 400)
+			return
+		}
+	} else {
+		q := r.URL.Query()
+		req.Path, req.Compress, req.TargetExtent = q.Get("path"), q.Get("compress"), q.Get("target_extent")
+		req.AllowSnapshots, req.Token = q.Get("allow_snapshots") == "true", q.Get("token")
+		if v := q.Get("recursive"); v != "" {
+			recursive := v == "true"
+			req.Recursive = &recursive
+		}
+	}
+	if req.Path == "" {
+		state.mu.Lock()
+		req.Path = state.Config.TargetDrive
+		state.mu.Unlock()
+		if req.Path == "" {
+			http.Error(w, "Target drive not set", 400)
+			return
+		}
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	req.Path = filepath.Clean(req.Path)
+	if refuseLocked(w, req.Path) { return }
+	if job, ok := snapshotDestination(req.Path); ok && !req.AllowSnapshots {
+		http.Error(w, fmt.Sprintf("%s is inside the snapshot destination of %s; defragmenting it unshares extents with the other snapshots (set allow_snapshots to do it anyway)", req.Path, job.Name), 409)
+		return
+	}
+	// A recursive defrag can rewrite the whole filesystem, so like purge it
+	// first returns its impact and a token that a second call confirms.
+	if req.recursive() || r.URL.Query().Get("dry_run") == "true" {
+		if req.Token == "" || r.URL.Query().Get("dry_run") == "true" {
+			token, expires := issueConfirmToken("defrag", req.target())
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status":  "confirm",
+				"dry_run": true,
+				"token":   token,
+				"expires": expires.Format(time.RFC3339),
+				"impact":  defragImpact(req),
+			})
+			return
+		}
+		if !consumeConfirmToken(req.Token, "defrag", req.target()) {
+			http.Error(w, "Invalid or expired confirmation token (the request changed or was already run)", 403)
+			return
+		}
+	}
+
+	visualPath := req.Path
+	var opts []string
+	if !req.recursive() { opts = append(opts, "non-recursive") }
+	if req.Compress != "" { opts = append(opts, req.Compress) }
+	if req.TargetExtent != "" { opts = append(opts, "-t "+req.TargetExtent) }
+	if len(opts) > 0 { visualPath = fmt.Sprintf("%s [%s]", req.Path, strings.Join(opts, ", ")) }
+	id := runCommandAsync("DEFRAG", "📦", visualPath, "btrfs", defragArgs(req)...)
 	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
 }
 
 func handleActionCompsize(w http.ResponseWriter, r *http.Request) {
-	path := state.Config.TargetDrive
-	if path == "" { http.Error(w, "Target drive not set", 400); return }
-	id := runCommandAsync("COMPSIZE", "📊", path, "compsize", path)
+	if !requireFeature(w, "compsize") { return }
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	id, _ := runCompsize("COMPSIZE", path)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
+}
+
+// handleActionUsage records a usage report in the history; -b keeps the
+// output parseable.
+func handleActionUsage(w http.ResponseWriter, r *http.Request) {
+	if !requireFeature(w, "usage") { return }
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	id := runCommandAsync("USAGE", "💾", path, "btrfs", "filesystem", "usage", "-b", path)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
+}
+
+func handleActionSubvolumes(w http.ResponseWriter, r *http.Request) {
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	id, _ := startBtrfsOp("SUBVOL LIST", "🗂️", path, fmt.Sprintf("List subvolumes of '%s'", path), func() (*OperationResult, error) {
+		subvols, err := btrfsFS.ListSubvolumes(path)
+		if err != nil { return nil, err }
+		return &OperationResult{Subvolumes: subvols}, nil
+	})
 	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
 }
 
 func handlePurgeAllSnapshots(w http.ResponseWriter, r *http.Request) {
-	go func() {
-		state.mu.Lock()
-		dest := state.Config.SnapshotDest
-		state.mu.Unlock()
-		if dest == "" { return }
-
-		printDockerLog("PURGE ALL", "Starting purge of %s", dest)
-
-		entries, _ := os.ReadDir(dest)
-		count := 0
-		for _, e := range entries {
-			if e.IsDir() {
-				_, err := time.Parse(timeLayout, e.Name())
-				if err == nil {
-					p := fmt.Sprintf("%s/%s", dest, e.Name())
-					printDockerLog("PURGE", "Deleting: %s", p)
-					exec.Command("btrfs", "subvolume", "delete", p).Run()
-					count++
-				}
-			}
+	handlePlannedDeletion(w, r, "purge", planPurge, func(job SnapshotJob, plan []PlannedDelete) {
+		if job.Dest == "" { return }
+		printDockerLog("PURGE ALL", "Starting purge of %s (job %s)", job.Dest, job.ID)
+		var result *PruneResult
+		var msg string
+		if trashConfig().Enabled {
+			result = trashPlanned("PURGE", plan)
+			msg = fmt.Sprintf("Moved %d snapshots to the trash", len(result.Deleted))
+		} else {
+			result = deletePlanned("PURGE", plan)
+			msg = fmt.Sprintf("Deleted %d snapshots", len(result.Deleted))
 		}
-		
-		msg := fmt.Sprintf("Deleted %d snapshots", count)
 		printDockerLog("PURGE ALL", "Finished: %s", msg)
-		runCommandAsync("PURGE ALL", "🔥", dest, "echo", msg)
-	}()
-	json.NewEncoder(w).Encode(map[string]interface{}{"status": "triggered"})
+		logHistoryResult("PURGE ALL", "🔥", job.Dest, prunedStatus(result), msg, &OperationResult{Prune: result})
+	})
 }
 
 func handleClearLogs(w http.ResponseWriter, r *http.Request) {
 	state.mu.Lock()
 	state.History = []LogEntry{}
+	notifyHistoryChanged()
+	hub.Send("cleared", nil)
 	state.mu.Unlock()
 	printDockerLog("SYSTEM", "Logs cleared by user")
 	saveState()
@@ -348,31 +746,48 @@ func handleClearLogs(w http.ResponseWriter, r *http.Request) {
 
 // --- Logic ---
 
-func performSnapshot() {
-	state.mu.Lock()
-	src := state.Config.SnapshotSource
-	dest := state.Config.SnapshotDest
-	state.mu.Unlock()
+func performSnapshot(job SnapshotJob, run *JobRun) { performSnapshotWith(job, run, SnapshotMeta{}) }
+
+// performSnapshotWith takes a snapshot described by meta.
+func performSnapshotWith(job SnapshotJob, run *JobRun, meta SnapshotMeta) {
+	src := job.Source
+	dest := job.Dest
 
 	if src == "" || dest == "" { return }
 	os.MkdirAll(dest, 0755)
 
 	now := time.Now()
-	name := now.Format(timeLayout)
-	fullDest := fmt.Sprintf("%s/%s", strings.TrimRight(dest, "/"), name)
+	name := job.snapshotName(now)
+	fullDest := snapshotPath(dest, name)
 	visualPath := fmt.Sprintf("%s ➡️ %s", src, name)
 
+	var hooks []HookRun
+	if job.Hooks.Pre != "" {
+		hook := runSnapshotHook(job, "pre", job.Hooks.Pre, fullDest, "")
+		hooks = append(hooks, hook)
+		if hook.Error != "" {
+			run.tag(logHistoryResult("SNAPSHOT", "📸", visualPath, "Failed", hookSummary("Pre-snapshot hook failed, snapshot skipped.", hooks), &OperationResult{Hooks: hooks}))
+			return
+		}
+	}
+
 	printDockerLog("SNAPSHOT", "Creating snapshot %s -> %s", src, fullDest)
 
-	cmd := exec.Command("btrfs", "subvolume", "snapshot", "-r", src, fullDest)
-	output, err := cmd.CombinedOutput()
-	outputStr := string(output)
+	var outputStr string
+	var err error
+	if job.Nested {
+		outputStr, err = snapshotNested(src, fullDest, !job.Writable)
+	} else {
+		var output []byte
+		output, err = exec.Command("btrfs", snapshotArgs(src, fullDest, !job.Writable)...).CombinedOutput()
+		outputStr = string(output)
+	}
 
 	if len(outputStr) > 0 {
 		printDockerLog("SNAPSHOT", "Output:\n%s", outputStr)
 	}
 	if err != nil {
-		printDockerLog("SNAPSHOT", "Error: %v", err)
+		logError("SNAPSHOT", "Error: %v", err)
 	}
 
 	status := "Success"
@@ -381,34 +796,67 @@ func performSnapshot() {
 		status = "Failed"
 		details = fmt.Sprintf("%s : %s", err.Error(), outputStr)
 	}
-	
-	logHistory("SNAPSHOT", "📸", visualPath, status, details)
 
-	if status == "Success" {
-		enforceRetention(dest)
+	var result *OperationResult
+	if job.Hooks.Post != "" {
+		hook := runSnapshotHook(job, "post", job.Hooks.Post, fullDest, status)
+		hooks = append(hooks, hook)
+		if hook.Error != "" && status == "Success" { status = "Warning" }
 	}
-}
-
-func enforceRetention(destPath string) {
-	state.mu.Lock()
-	cfg := state.Config.Retention
-	state.mu.Unlock()
+	if hooks != nil {
+		details = hookSummary(details, hooks)
+		result = &OperationResult{Hooks: hooks}
+	}
+	run.tag(logHistoryResult("SNAPSHOT", "📸", visualPath, status, details, result))
 
-	if !cfg.Enabled { return }
+	if err == nil {
+		recordSnapshotTime(dest, name, now)
+		recordSnapshotMeta(fullDest, meta)
+		enforceRetention(job, run)
+		refreshBootMenu(job)
+	}
+}
 
-	entries, err := os.ReadDir(destPath)
+// enforceRetention applies the job's retention, as part of run if not nil.
+func enforceRetention(job SnapshotJob, run *JobRun) {
+	if l := lockedFor(job.Dest); l != nil {
+		appLog.Debug(fmt.Sprintf("Not applying the retention of %s: %s", job.ID, l.message()), "op", "RETENTION")
+		return
+	}
+	plan, err := planRetention(job, time.Now())
 	if err != nil { return }
+	plan, _, warnings := holdSendParents(plan, false)
+	for _, w := range warnings { printDockerLog("RETENTION", "Job %s: %s", job.ID, w) }
+	applyRetentionPlan(job, plan, run)
+}
 
-	type SnapInfo struct {
-		Name string
-		Time time.Time
+func applyRetentionPlan(job SnapshotJob, plan []PlannedDelete, run *JobRun) {
+	if len(plan) > 0 {
+		printDockerLog("RETENTION", "Cleaning up %d old snapshots", len(plan))
+		report := pruneWithReport(job, plan)
+		recordRetentionReport(report)
+		status := "Success"
+		if len(report.Failed) > 0 { status = "Warning" }
+		run.tag(logHistoryResult("RETENTION", "🗑️", job.Dest, status, report.summary(), &OperationResult{Retention: report}))
 	}
-	var snaps []SnapInfo
+}
+
+type SnapInfo struct {
+	Name string
+	Time time.Time
+}
+
+// listManagedSnapshots returns the job's snapshots (names matching its
+// prefix and name template), newest first. Anything else is left alone.
+func listManagedSnapshots(job SnapshotJob) ([]SnapInfo, error) {
+	entries, err := os.ReadDir(job.Dest)
+	if err != nil { return nil, err }
 
+	times := loadSnapshotTimes(job.Dest)
+	var snaps []SnapInfo
 	for _, e := range entries {
 		if !e.IsDir() { continue }
-		t, err := time.Parse(timeLayout, e.Name())
-		if err == nil {
+		if t, ok := job.snapshotTime(e.Name(), times); ok {
 			snaps = append(snaps, SnapInfo{Name: e.Name(), Time: t})
 		}
 	}
@@ -416,18 +864,20 @@ func enforceRetention(destPath string) {
 	sort.Slice(snaps, func(i, j int) bool {
 		return snaps[i].Time.After(snaps[j].Time)
 	})
+	return snaps, nil
+}
 
-	var toDelete []string
+// selectRetentionDeletes applies the retention policy to snaps (newest first)
+// as of now and returns the ones that should be removed.
+func selectRetentionDeletes(snaps []SnapInfo, cfg RetentionConfig, now time.Time) []SnapInfo {
+	var toDelete []SnapInfo
 
 	if cfg.Mode == "count" {
 		if len(snaps) > cfg.Value {
-			for _, s := range snaps[cfg.Value:] {
-				toDelete = append(toDelete, s.Name)
-			}
+			toDelete = append(toDelete, snaps[cfg.Value:]...)
 		}
 	} else if cfg.Mode == "time" {
 		var cutoff time.Time
-		now := time.Now()
 		switch cfg.Unit {
 		case "days": cutoff = now.AddDate(0, 0, -cfg.Value)
 		case "weeks": cutoff = now.AddDate(0, 0, -cfg.Value*7)
@@ -438,26 +888,18 @@ func enforceRetention(destPath string) {
 
 		for _, s := range snaps {
 			if s.Time.Before(cutoff) {
-				toDelete = append(toDelete, s.Name)
+				toDelete = append(toDelete, s)
 			}
 		}
 	}
+	return toDelete
+}
 
-	if len(toDelete) > 0 {
-		printDockerLog("RETENTION", "Cleaning up %d old snapshots", len(toDelete))
-		count := 0
-		for _, name := range toDelete {
-			p := fmt.Sprintf("%s/%s", destPath, name)
-			if err := exec.Command("btrfs", "subvolume", "delete", p).Run(); err == nil {
-				printDockerLog("RETENTION", "Deleted: %s", name)
-				count++
-			}
-		}
-		logHistory("RETENTION", "🗑️", destPath, "Success", fmt.Sprintf("Cleaned up %d old snapshots", count))
-	}
+func logHistory(opType, emoji, path, status, output string) int64 {
+	return logHistoryResult(opType, emoji, path, status, output, nil)
 }
 
-func logHistory(opType, emoji, path, status, output string) {
+func logHistoryResult(opType, emoji, path, status, output string, result *OperationResult) int64 {
 	state.mu.Lock()
 	defer state.mu.Unlock()
 	entry := LogEntry{
@@ -465,91 +907,390 @@ func logHistory(opType, emoji, path, status, output string) {
 		Type:      opType,
 		Emoji:     emoji,
 		Path:      path,
-		Timestamp: time.Now().Format("02-01-2006 15:04 MST"),
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
 		Status:    status,
 		Output:    output,
 		Duration:  "0s",
+		Result:    result,
 	}
+	spillOutput(&entry)
 	state.History = append([]LogEntry{entry}, state.History...)
-	if len(state.History) > 100 { state.History = state.History[:100] }
+	trimHistory()
+	notifyHistoryChanged()
+	notifyHistoryEntry(entry)
+	publishEntry(entry)
+	saveState()
+	return entry.ID
+}
+
+// logHistoryJob logs an entry about the scheduled job name outside of a run,
+// e.g. that it was deferred.
+func logHistoryJob(name, opType, emoji, path, status, output string) {
+	id := logHistory(opType, emoji, path, status, output)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for i := range state.History {
+		if state.History[i].ID == id {
+			state.History[i].JobID = name
+			publishEntry(state.History[i])
+			break
+		}
+	}
 	saveState()
 }
 
 // --- Scheduler Logic ---
 
+// refreshSchedules reconciles the cron registry with the current config:
+// only jobs whose spec changed (or were enabled/disabled) are re-registered,
+// so untouched jobs keep their next-run time.
 func refreshSchedules() {
 	state.mu.Lock()
 	defer state.mu.Unlock()
-	for _, id := range state.cronIDs { state.cron.Remove(id) }
-	state.cronIDs = make(map[string]cron.EntryID)
-
-	addJob := func(name string, cfg ScheduleConfig, job func()) {
-		if !cfg.Enabled { return }
-		spec := cfg.Value
-		if cfg.Type == "every_x" {
-			unit := "m"
-			if cfg.Unit == "hours" { unit = "h" }
-			if cfg.Unit == "days" { unit = "d" }
-			spec = fmt.Sprintf("@every %s%s", cfg.Value, unit)
-		}
-		id, err := state.cron.AddFunc(spec, job)
+
+	wanted := make(map[string]scheduledJob)
+	for _, job := range scheduledJobs(state.Config) {
+		if job.Schedule.Enabled { wanted[job.Name] = job }
+	}
+
+	for name, id := range state.cronIDs {
+		job, ok := wanted[name]
+		if ok && scheduleSpec(job.Schedule) == state.cronSpecs[name] { continue }
+		state.cron.Remove(id)
+		delete(state.cronIDs, name)
+		delete(state.cronSpecs, name)
+		printDockerLog("SCHEDULER", "Unregistered %s job", name)
+	}
+
+	for _, job := range scheduledJobs(state.Config) {
+		if _, ok := wanted[job.Name]; !ok { continue }
+		if _, ok := state.cronIDs[job.Name]; ok { continue }
+		spec := scheduleSpec(job.Schedule)
+		name, run := job.Name, job.Run
+		id, err := state.cron.AddFunc(spec, func() { runWindowed(name, "schedule", run) })
 		if err == nil {
-			printDockerLog("SCHEDULER", "Registered %s job: %s", name, spec)
-			state.cronIDs[name] = id
+			printDockerLog("SCHEDULER", "Registered %s job: %s", job.Name, spec)
+			state.cronIDs[job.Name] = id
+			state.cronSpecs[job.Name] = spec
 		} else {
-			printDockerLog("SCHEDULER", "Error registering %s: %v", name, err)
+			logError("SCHEDULER", "Error registering %s: %v", job.Name, err)
 		}
 	}
+	refreshChangeWatchers(state.Config)
+}
 
-	addJob("snapshot", state.Config.SnapshotSched, func() { go performSnapshot() })
-	addJob("scrub", state.Config.ScrubSched, func() {
-		p := state.Config.TargetDrive
-		if p != "" { runCommandAsync("AUTO SCRUB", "🧹", p, "btrfs", "scrub", "start", "-B", p) }
-	})
-	addJob("balance", state.Config.BalanceSched, func() {
-		p := state.Config.TargetDrive
-		if p != "" { runCommandAsync("AUTO BALANCE", "⚖️", p, "btrfs", "balance", "start", "--full-balance", p) }
-	})
+type scheduledJob struct {
+	Name     string
+	Schedule ScheduleConfig
+	// Run does the work and returns once it is done or handed off to a
+	// command whose entry it tagged with the run.
+	Run func(run *JobRun)
+	// Preview describes what Run would do if it fired at the given time.
+	Preview func(at time.Time) ([]PlannedOp, []string)
 }
 
-// --- HTTP Boilerplate ---
+// scheduledJobs lists every job the scheduler knows about, enabled or not.
+func scheduledJobs(cfg Config) []scheduledJob {
+	var jobs []scheduledJob
+	for _, sj := range cfg.SnapshotJobs {
+		id := sj.ID
+		jobs = append(jobs, scheduledJob{
+			Name:     "snapshot:" + id,
+			Schedule: sj.Schedule,
+			// Look the job up at fire time so edits apply without re-registering.
+			Run: func(run *JobRun) {
+				if job, err := findSnapshotJob(id); err == nil { performSnapshot(job, run) }
+			},
+			Preview: func(at time.Time) ([]PlannedOp, []string) { return previewSnapshot(sj, at) },
+		})
+		if sj.Archive.Enabled {
+			jobs = append(jobs, scheduledJob{
+				Name:     "archive:" + id,
+				Schedule: sj.Archive.Schedule,
+				Run: func(run *JobRun) {
+					if job, err := findSnapshotJob(id); err == nil && job.Archive.Enabled { runArchive(job, run) }
+				},
+				Preview: func(time.Time) ([]PlannedOp, []string) { return previewArchive(sj) },
+			})
+		}
+		if sj.Streams.Enabled {
+			jobs = append(jobs, scheduledJob{
+				Name:     "streams:" + id,
+				Schedule: sj.Streams.Schedule,
+				Run: func(run *JobRun) {
+					if job, err := findSnapshotJob(id); err == nil && job.Streams.Enabled { runStreams(job, run) }
+				},
+				Preview: func(time.Time) ([]PlannedOp, []string) { return previewStreams(sj) },
+			})
+		}
+		jobs = append(jobs, scheduledJob{
+			Name:     "verify:" + id,
+			Schedule: sj.Verify.Schedule,
+			Run: func(run *JobRun) {
+				job, err := findSnapshotJob(id)
+				if err != nil { return }
+				name, err := pickVerifySnapshot(job)
+				if err != nil {
+					printDockerLog("VERIFY", "Skipping scheduled verify: %v", err)
+					return
+				}
+				runVerify(job, name, run)
+			},
+			Preview: func(time.Time) ([]PlannedOp, []string) { return previewVerify(sj) },
+		})
+	}
+	return append(jobs,
+		scheduledJob{"scrub", cfg.ScrubSched, runScheduledScrubs, func(time.Time) ([]PlannedOp, []string) {
+			return previewScheduledScrubs(cfg)
+		}},
+		scheduledJob{"balance", cfg.BalanceSched, func(run *JobRun) {
+			state.mu.Lock()
+			p := state.Config.TargetDrive
+			preset := findBalancePreset(state.Config.BalancePreset)
+			state.mu.Unlock()
+			if hold := balanceHeld(); hold != nil && p != "" {
+				logHistoryJob("balance", "HELD", "✋", p, "Warning", fmt.Sprintf("Scheduled balance skipped: held by rule %s since %s (%s). Release the hold with DELETE /api/rules/hold.", hold.Rule, hold.Since, hold.Reason))
+				return
+			}
+			if p == "" { return }
+			if op := balanceInProgress(p, true); op != nil {
+				printDockerLog("AUTO BALANCE", "Skipping scheduled balance: %s", op.message())
+				return
+			}
+			run.tag(runCommandAsync("AUTO BALANCE", "⚖️", balanceVisualPath(p, preset), "btrfs", balanceStartArgs(preset, p)...))
+		}, func(time.Time) ([]PlannedOp, []string) {
+			preset := findBalancePreset(cfg.BalancePreset)
+			return previewTargetCommand(cfg.TargetDrive, preset.Name+" balance of target drive", func(p string) []string { return balanceStartArgs(preset, p) })
+		}},
+		scheduledJob{"dedup", cfg.DedupSched, runScheduledDedup, func(time.Time) ([]PlannedOp, []string) {
+			return previewDedup(cfg)
+		}},
+		scheduledJob{"compsize", cfg.CompsizeSched, runScheduledCompsize, func(time.Time) ([]PlannedOp, []string) {
+			return previewCompsize(cfg)
+		}},
+		scheduledJob{"trim", cfg.TrimSched, runScheduledTrim, func(time.Time) ([]PlannedOp, []string) {
+			return previewTrim(cfg)
+		}},
+		scheduledJob{"report", cfg.Report.Schedule, sendScheduledReport, func(time.Time) ([]PlannedOp, []string) {
+			return previewReport(cfg)
+		}},
+	)
+}
+
+// scheduleSpec converts a ScheduleConfig into a robfig/cron spec.
+func scheduleSpec(cfg ScheduleConfig) string {
+	spec := cfg.Value
+	if cfg.Type == "every_x" {
+		unit := "m"
+		if cfg.Unit == "hours" { unit = "h" }
+		if cfg.Unit == "days" {
+			// Durations have no days unit.
+			if n, err := strconv.Atoi(cfg.Value); err == nil { return fmt.Sprintf("@every %dh", n*24) }
+			unit = "d"
+		}
+		return fmt.Sprintf("@every %s%s", cfg.Value, unit)
+	}
+	if tz := scheduleTimezone(cfg); tz != "" && !strings.HasPrefix(spec, "TZ=") && !strings.HasPrefix(spec, "CRON_TZ=") { spec = "CRON_TZ=" + tz + " " + spec }
+	return spec
+}
 
-func handleIndex(w http.ResponseWriter, r *http.Request) {
-	tmpl, _ := template.ParseFS(content, "static/index.html")
-	tmpl.Execute(w, nil)
+// --- Command Lines ---
+// Shared by the runners and the schedule preview so both always agree.
+
+func snapshotArgs(src, fullDest string, readOnly bool) []string {
+	if !readOnly { return []string{"subvolume", "snapshot", src, fullDest} }
+	return []string{"subvolume", "snapshot", "-r", src, fullDest}
 }
 
+func snapshotPath(dest, name string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimRight(dest, "/"), name)
+}
+
+func scrubStartArgs(path string) []string {
+	return []string{"scrub", "start", "-B", path}
+}
+
+func balanceStartArgs(preset BalancePreset, path string) []string {
+	args := append([]string{"balance", "start"}, preset.Filters...)
+	return append(args, path)
+}
+
+// --- HTTP Boilerplate ---
+
+
 func handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" || r.Method == "PATCH" {
+		state.mu.Lock()
+		// Decode on top of a copy of the current config so omitted fields keep
+		// their values without the request writing into the live slices.
+		newConfig := cloneConfig(state.Config)
+		state.mu.Unlock()
+		if err := json.NewDecoder(r.Body).Decode(&newConfig); err != nil {
+			writeConfigErrors(w, decodeConfigError(err))
+			return
+		}
+		state.mu.Lock()
+		current := state.Config
+		state.mu.Unlock()
+		errs, _ := validateConfig(newConfig).(ConfigErrors)
+		for _, f := range checkConfigPaths(current, newConfig) { errs.add(f.Field, errors.New(f.Message)) }
+		if len(errs) > 0 {
+			writeConfigErrors(w, errs)
+			return
+		}
+		applyConfig(newConfig, "config change")
+	}
 	state.mu.Lock()
-	defer state.mu.Unlock()
-	if r.Method == "POST" {
-		var newConfig Config
-		if err := json.NewDecoder(r.Body).Decode(&newConfig); err == nil {
-			state.Config = newConfig
-			saveState()
-			go refreshSchedules()
+	cfg := state.Config
+	state.mu.Unlock()
+	// Only admins see notification secrets and access key hashes.
+	if requestUser(r).Role != roleAdmin { cfg = redactConfig(cfg) }
+	// display is read-only: how the UI should show times.
+	json.NewEncoder(w).Encode(struct {
+		Config
+		Display DisplaySettings `json:"display"`
+	}{cfg, displaySettings(cfg)})
+}
+
+// cloneConfig returns a deep copy of cfg, sharing no slices or maps with it.
+func cloneConfig(cfg Config) Config {
+	var c Config
+	data, _ := json.Marshal(cfg)
+	json.Unmarshal(data, &c)
+	return c
+}
+
+// validateConfig checks every setting and returns all problems found as
+// ConfigErrors, see configcheck.go.
+func validateConfig(cfg Config) error {
+	var errs ConfigErrors
+	// Jobs go first: a broken job is reported once, not again per schedule.
+	// IDs name their cron entries and select them in ?job=.
+	ids := map[string]bool{}
+	for i, j := range cfg.SnapshotJobs {
+		field := fmt.Sprintf("snapshot_jobs[%d]", i)
+		if j.ID == "" || j.ID == stateJobID {
+			errs.add(field+".id", fmt.Errorf("invalid id %q", j.ID))
+		} else if ids[j.ID] {
+			errs.add(field+".id", fmt.Errorf("duplicate id %q", j.ID))
 		}
+		ids[j.ID] = true
+		errs.add(field, validateSnapshotJob(j))
 	}
-	json.NewEncoder(w).Encode(state.Config)
+	errs.add("snapshot_jobs", validateSharedDests(cfg.SnapshotJobs))
+	if !validBalancePreset(cfg.BalancePreset) { errs.add("balance_preset", fmt.Errorf("unknown balance preset %q", cfg.BalancePreset)) }
+	errs.add("access", cfg.Access.validate())
+	errs.add("command_timeouts", validateCommandTimeouts(cfg.CommandTimeouts))
+	errs.add("command_priorities", validateCommandPriorities(cfg.CommandPriorities))
+	if cfg.UsageSampleMinutes < 0 { errs.add("usage_sample_minutes", fmt.Errorf("must not be negative")) }
+	if cfg.HistoryLimit < 0 || cfg.HistoryLimit > maxHistoryLimit { errs.add("history_limit", fmt.Errorf("must be between 0 and %d", maxHistoryLimit)) }
+	if cfg.StateBackup.Keep < 0 { errs.add("state_backup.keep", fmt.Errorf("must not be negative")) }
+	errs.add("dedup", cfg.Dedup.validate())
+	errs.add("unclean_scrub", cfg.UncleanScrub.validate())
+	errs.add("catch_up", cfg.CatchUp.validate())
+	errs.add("report", cfg.Report.validate())
+	errs.add("log_output", cfg.LogOutput.validate())
+	errs.add("logging", cfg.Logging.validate())
+	errs.add("rules", validateRules(cfg.Rules))
+	errs.add("timezone", validateTimezones(cfg))
+	errs.add("kernel_events", cfg.KernelEvents.validate())
+	errs.add("agents", validateAgents(cfg.Agents))
+	errs.add("trash", cfg.Trash.validate())
+	if cfg.SnapshotSizes.RefreshMinutes < 0 { errs.add("snapshot_sizes.refresh_minutes", fmt.Errorf("must not be negative")) }
+	if _, err := openBackend(cfg.BtrfsBackend); err != nil { errs.add("btrfs_backend", err) }
+	errs = append(errs, validateSchedules(cfg)...)
+	return errs.err()
 }
 
-func handleHistory(w http.ResponseWriter, r *http.Request) {
+// applyConfig replaces the whole config in one step, after backing up the
+// state, and returns the top-level fields that changed.
+func applyConfig(newConfig Config, reason string) []string {
 	state.mu.Lock()
-	defer state.mu.Unlock()
-	json.NewEncoder(w).Encode(state.History)
+	changed := diffConfig(state.Config, newConfig)
+	state.mu.Unlock()
+	if len(changed) == 0 { return nil }
+
+	backupStateBeforeChange(reason)
+	printDockerLog("SYSTEM", "Config changed: %s", strings.Join(changed, ", "))
+	state.mu.Lock()
+	if newConfig.Storage != state.Config.Storage {
+		if err := switchStore(newConfig.Storage); err != nil {
+			logWarn("STORAGE", "Cannot switch storage driver: %v", err)
+			newConfig.Storage = state.Config.Storage
+		}
+	}
+	if newConfig.BtrfsBackend != state.Config.BtrfsBackend {
+		if b, err := openBackend(newConfig.BtrfsBackend); err == nil { btrfsFS = b }
+	}
+	state.Config = newConfig
+	setAppTimezone(newConfig)
+	configureLogging(newConfig.Logging)
+	saveState()
+	state.mu.Unlock()
+	go ensureStateSubvolume()
+	go refreshSchedules()
+	go restartKernelWatcher()
+	return changed
 }
 
-func saveState() {
-	data, _ := json.MarshalIndent(state, "", "  ")
-	os.WriteFile("/data/state.json", data, 0644)
+// diffConfig returns the JSON names of the top-level config fields that differ.
+func diffConfig(old, new Config) []string {
+	var a, b map[string]json.RawMessage
+	oldData, _ := json.Marshal(old)
+	newData, _ := json.Marshal(new)
+	json.Unmarshal(oldData, &a)
+	json.Unmarshal(newData, &b)
+
+	var changed []string
+	for k, v := range b {
+		if string(a[k]) != string(v) { changed = append(changed, k) }
+	}
+	sort.Strings(changed)
+	return changed
 }
 
 func loadState() {
-	data, err := os.ReadFile("/data/state.json")
+	locateStateFile()
+	data, err := os.ReadFile(stateFile)
+	var loaded AppState
 	if err == nil {
-		var loaded AppState
-		json.Unmarshal(data, &loaded)
+		if err := json.Unmarshal(data, &loaded); err != nil { logError("SYSTEM", "Cannot read %s, starting without its content: %v", stateFile, err) }
 		state.Config = loaded.Config
-		state.History = loaded.History
+		state.Runbook = loaded.Runbook
+		state.RetentionReports = loaded.RetentionReports
+		state.ScrubRotation = loaded.ScrubRotation
+		state.Shutdown = loaded.Shutdown
+		state.LastRuns = loaded.LastRuns
+		state.JobStats = loaded.JobStats
+		state.Convert = loaded.Convert
+		state.RuleFirings, state.BalanceHold = loaded.RuleFirings, loaded.BalanceHold
+		state.Pins = loaded.Pins
+		state.SendParents = loaded.SendParents
+		state.SnapshotMeta = loaded.SnapshotMeta
+		state.Locks = loaded.Locks
+		migrateLegacySnapshotConfig(data)
+	}
+	if configFile != "" {
+		if err := loadConfigFile(); err != nil { log.Fatal(err) }
+	}
+	setAppTimezone(state.Config)
+	configureLogging(state.Config.Logging)
+
+	if s, err := openStore(state.Config.Storage); err != nil {
+		logWarn("STORAGE", "Cannot open %s store, falling back to json: %v", storageDriverName(state.Config.Storage), err)
+	} else {
+		store = s
+	}
+	if b, err := openBackend(state.Config.BtrfsBackend); err != nil {
+		logWarn("BTRFS", "%v, using auto", err)
+	} else {
+		btrfsFS = b
 	}
+	history, err := store.LoadHistory()
+	if err != nil { logError("STORAGE", "Failed to load history: %v", err) }
+	// Older versions kept the history inside state.json; it moves to the
+	// store on the next save.
+	if len(history) == 0 { history = loaded.History }
+	migrateTimestamps(history)
+	state.History = history
 }
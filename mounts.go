@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// --- Mount Table ---
+
+type Mount struct {
+	Device  string `json:"device"`
+	Path    string `json:"path"`
+	FSType  string `json:"fstype"`
+	Options string `json:"options"`
+}
+
+func readMounts() ([]Mount, error) {
+	data, err := os.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	var mounts []Mount
+	for _, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 4 {
+			continue
+		}
+		mounts = append(mounts, Mount{
+			Device:  unescapeMountField(f[0]),
+			Path:    unescapeMountField(f[1]),
+			FSType:  f[2],
+			Options: f[3],
+		})
+	}
+	return mounts, nil
+}
+
+// unescapeMountField decodes the octal escapes (\040 for space etc.) used in
+// /proc/self/mounts.
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isMountPoint(path string) bool {
+	mounts, err := readMounts()
+	if err != nil {
+		return false
+	}
+	clean := filepath.Clean(path)
+	for _, m := range mounts {
+		if m.Path == clean {
+			return true
+		}
+	}
+	return false
+}
+
+// --- Filesystem Discovery ---
+// Mounted btrfs filesystems, so the target drive can be picked from a list.
+
+type DiscoveredFilesystem struct {
+	UUID    string            `json:"uuid"`
+	Label   string            `json:"label"`
+	Devices []Device          `json:"devices"`
+	Mounts  []FilesystemMount `json:"mounts"`
+}
+
+type FilesystemMount struct {
+	Path      string `json:"path"`
+	Device    string `json:"device"`
+	Subvolume string `json:"subvolume"` // from the subvol= option
+	Options   string `json:"options"`
+}
+
+// parseFilesystemList reads `btrfs filesystem show --raw` for all
+// filesystems:
+//
+//	Label: 'data'  uuid: 7a3c...
+//		Total devices 2 FS bytes used 1114112
+//		devid    1 size 10737418240 used 2172649472 path /dev/sdb
+func parseFilesystemList(out string) []DiscoveredFilesystem {
+	var list []DiscoveredFilesystem
+	var block []string
+	flush := func() {
+		if len(list) > 0 {
+			list[len(list)-1].Devices = parseFilesystemShow(strings.Join(block, "\n"))
+		}
+		block = nil
+	}
+	for _, line := range strings.Split(out, "\n") {
+		rest, ok := strings.CutPrefix(strings.TrimSpace(line), "Label: ")
+		if !ok {
+			block = append(block, line)
+			continue
+		}
+		flush()
+		label, uuid, _ := strings.Cut(rest, "uuid: ")
+		label = strings.TrimSpace(label)
+		if label == "none" {
+			label = ""
+		}
+		list = append(list, DiscoveredFilesystem{UUID: strings.TrimSpace(uuid), Label: strings.Trim(label, "'"), Mounts: []FilesystemMount{}})
+	}
+	flush()
+	return list
+}
+
+func mountOption(options, name string) string {
+	for _, o := range strings.Split(options, ",") {
+		if v, ok := strings.CutPrefix(o, name+"="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// discoverFilesystems lists the mounted btrfs filesystems with their
+// mounts. Mounts whose device `btrfs filesystem show` doesn't list (e.g.
+// without access to /dev) get an entry of their own without UUID.
+func discoverFilesystems() ([]DiscoveredFilesystem, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return nil, err
+	}
+	var list []DiscoveredFilesystem
+	if out, err := exec.Command("btrfs", "filesystem", "show", "--raw").CombinedOutput(); err == nil {
+		list = parseFilesystemList(string(out))
+	} else {
+		logWarn("DISCOVER", "btrfs filesystem show: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	byDevice := map[string]int{}
+	for i, fs := range list {
+		for _, d := range fs.Devices {
+			byDevice[d.Path] = i
+			if real, err := filepath.EvalSymlinks(d.Path); err == nil {
+				byDevice[real] = i
+			}
+		}
+	}
+	for _, m := range mounts {
+		if m.FSType != "btrfs" {
+			continue
+		}
+		fm := FilesystemMount{Path: m.Path, Device: m.Device, Subvolume: mountOption(m.Options, "subvol"), Options: m.Options}
+		i, ok := byDevice[m.Device]
+		if !ok {
+			if real, err := filepath.EvalSymlinks(m.Device); err == nil {
+				i, ok = byDevice[real]
+			}
+		}
+		if !ok {
+			i = len(list)
+			byDevice[m.Device] = i
+			list = append(list, DiscoveredFilesystem{Devices: []Device{{Path: m.Device}}})
+		}
+		list[i].Mounts = append(list[i].Mounts, fm)
+	}
+
+	mounted := []DiscoveredFilesystem{}
+	for _, fs := range list {
+		if len(fs.Mounts) > 0 {
+			mounted = append(mounted, fs)
+		}
+	}
+	return mounted, nil
+}
+
+func handleDiscoverFilesystems(w http.ResponseWriter, r *http.Request) {
+	list, err := discoverFilesystems()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// --- Nested Subvolumes ---
+// `btrfs subvolume snapshot` doesn't descend into subvolumes below the
+// source; they show up as empty directories in the snapshot. Jobs with
+// nested set snapshot each of them into the same place inside the snapshot,
+// so the snapshot mirrors the source. The snapshots are taken one after the
+// other, so unlike a single snapshot they aren't atomic across subvolumes.
+// Read-only jobs create them writable and make them read-only once all are
+// in place, since nothing can be created inside a read-only snapshot.
+//
+// Deleting a snapshot with nested snapshots in it (retention, purge, the
+// delete button) removes the nested ones first, deepest first.
+
+// nestedSubvolumes returns the paths, relative to path, of the subvolumes
+// below the subvolume at path, parents before their children.
+func nestedSubvolumes(path string) ([]string, error) {
+	id, err := btrfsFS.SubvolumeID(path)
+	if err != nil { return nil, err }
+	list, err := btrfsFS.ListSubvolumes(path)
+	if err != nil { return nil, err }
+
+	base := ""
+	children := map[uint64][]Subvolume{}
+	for _, s := range list {
+		if s.ID == id { base = s.Path }
+		children[s.Parent] = append(children[s.Parent], s)
+	}
+	var rels []string
+	queue := []uint64{id}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		for _, s := range children[parent] {
+			rel := s.Path
+			if base != "" {
+				var ok bool
+				if rel, ok = strings.CutPrefix(s.Path, base+"/"); !ok { continue }
+			}
+			rels = append(rels, rel)
+			queue = append(queue, s.ID)
+		}
+	}
+	return rels, nil
+}
+
+func setSubvolumeReadOnly(path string, ro bool) error {
+	_, err := runBtrfs("property", "set", "-ts", path, "ro", fmt.Sprint(ro))
+	return err
+}
+
+// snapshotNested snapshots src and the subvolumes below it into fullDest and
+// returns the command output. A failure removes what was created.
+func snapshotNested(src, fullDest string, readOnly bool) (string, error) {
+	nested, err := nestedSubvolumes(src)
+	if err != nil { return "", fmt.Errorf("listing nested subvolumes: %v", err) }
+	// Snapshot destinations below the source, e.g. /.snapshots, stay out.
+	kept := nested[:0]
+	for _, rel := range nested {
+		if _, ok := snapshotDestination(filepath.Join(src, rel)); !ok { kept = append(kept, rel) }
+	}
+	nested = kept
+	if len(nested) == 0 {
+		out, err := exec.Command("btrfs", snapshotArgs(src, fullDest, readOnly)...).CombinedOutput()
+		return string(out), err
+	}
+
+	var output strings.Builder
+	out, err := exec.Command("btrfs", snapshotArgs(src, fullDest, false)...).CombinedOutput()
+	output.Write(out)
+	if err != nil { return output.String(), err }
+	for _, rel := range nested {
+		target := filepath.Join(fullDest, rel)
+		// The snapshot of the parent holds an empty directory in its place.
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			deleteSnapshotTree(fullDest)
+			return output.String(), fmt.Errorf("%s: %v", rel, err)
+		}
+		out, err := exec.Command("btrfs", snapshotArgs(filepath.Join(src, rel), target, false)...).CombinedOutput()
+		output.Write(out)
+		if err != nil {
+			deleteSnapshotTree(fullDest)
+			return output.String(), fmt.Errorf("%s: %v", rel, err)
+		}
+	}
+	if readOnly {
+		for i := len(nested) - 1; i >= 0; i-- {
+			if err := setSubvolumeReadOnly(filepath.Join(fullDest, nested[i]), true); err != nil {
+				deleteSnapshotTree(fullDest)
+				return output.String(), err
+			}
+		}
+		if err := setSubvolumeReadOnly(fullDest, true); err != nil {
+			deleteSnapshotTree(fullDest)
+			return output.String(), err
+		}
+	}
+	fmt.Fprintf(&output, "Snapshotted %d nested subvolume(s): %s\n", len(nested), strings.Join(nested, ", "))
+	return output.String(), nil
+}
+
+// deleteSnapshotTree deletes the subvolume at path. If it holds other
+// subvolumes, they are deleted first, deepest first, after making them all
+// writable, as nothing can be removed from a read-only snapshot.
+func deleteSnapshotTree(path string) error {
+	err := btrfsFS.DeleteSubvolume(path)
+	if err == nil || !(errors.Is(err, syscall.ENOTEMPTY) || strings.Contains(strings.ToLower(err.Error()), "not empty")) { return err }
+
+	nested, lerr := nestedSubvolumes(path)
+	if lerr != nil || len(nested) == 0 { return err }
+	if err := setSubvolumeReadOnly(path, false); err != nil { return err }
+	for _, rel := range nested { setSubvolumeReadOnly(filepath.Join(path, rel), false) }
+	sort.SliceStable(nested, func(i, j int) bool { return strings.Count(nested[i], "/") > strings.Count(nested[j], "/") })
+	for _, rel := range nested {
+		if err := btrfsFS.DeleteSubvolume(filepath.Join(path, rel)); err != nil { return fmt.Errorf("%s: %v", rel, err) }
+	}
+	return btrfsFS.DeleteSubvolume(path)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Notifications ---
+
+type WebhookConfig struct {
+	Name  string `json:"name"`
+	Kind  string `json:"kind"` // generic, discord, slack, ntfy, gotify
+	URL   string `json:"url"`
+	Token string `json:"token"`
+}
+
+type EmailConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+type NotifyEvents struct {
+	JobFailure      bool `json:"job_failure"`
+	ScrubErrors     bool `json:"scrub_errors"`
+	LowSpace        bool `json:"low_space"`
+	LowSpacePercent int  `json:"low_space_percent"`
+	SnapshotSuccess bool `json:"snapshot_success"`
+	UpdateAvailable bool `json:"update_available"`
+	Health          bool `json:"health"`
+}
+
+type NotificationConfig struct {
+	Webhooks []WebhookConfig `json:"webhooks"`
+	Email    EmailConfig     `json:"email"`
+	Events   NotifyEvents    `json:"events"`
+}
+
+const (
+	EventJobFailure      = "job_failure"
+	EventScrubErrors     = "scrub_errors"
+	EventLowSpace        = "low_space"
+	EventSnapshotSuccess = "snapshot_success"
+	EventUpdateAvailable = "update_available"
+	EventHealth          = "health"
+	EventReport          = "report" // sent on report.schedule, see report.go
+	EventRule            = "rule"   // a rule's notify action, see rules.go
+	EventTest            = "test"
+)
+
+type Notification struct {
+	Event   string `json:"event"`
+	Title   string `json:"title"`
+	Message string `json:"message"`
+	Host    string `json:"host"`
+	Time    string `json:"time"`
+	// HTML, when set, is sent to email alongside the plain-text message.
+	HTML string `json:"-"`
+}
+
+type NotifyResult struct {
+	Channel string `json:"channel"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+func (e NotifyEvents) enabled(event string) bool {
+	switch event {
+	case EventJobFailure: return e.JobFailure
+	case EventScrubErrors: return e.ScrubErrors
+	case EventLowSpace: return e.LowSpace
+	case EventSnapshotSuccess: return e.SnapshotSuccess
+	case EventUpdateAvailable: return e.UpdateAvailable
+	case EventHealth: return e.Health
+	case EventTest, EventReport, EventRule: return true
+	}
+	return false
+}
+
+func newNotification(event, title, message string) Notification {
+	host, _ := os.Hostname()
+	return Notification{Event: event, Title: title, Message: message, Host: host, Time: time.Now().Format(time.RFC3339)}
+}
+
+// notify sends n to every configured channel if its event is enabled. It
+// blocks until all channels answered, so callers usually run it in a
+// goroutine.
+func notify(n Notification) []NotifyResult {
+	state.mu.Lock()
+	cfg := state.Config.Notifications
+	state.mu.Unlock()
+	if !cfg.Events.enabled(n.Event) { return nil }
+
+	var results []NotifyResult
+	for _, hook := range cfg.Webhooks {
+		if hook.URL == "" { continue }
+		name := hook.Name
+		if name == "" { name = hook.Kind + " webhook" }
+		results = append(results, notifyResult(name, sendWebhook(hook, n)))
+	}
+	if cfg.Email.Enabled {
+		results = append(results, notifyResult("email", sendEmail(cfg.Email, n)))
+	}
+	for _, r := range results {
+		if r.Error != "" { logWarn("NOTIFY", "%s: %s failed: %s", n.Event, r.Channel, r.Error) }
+	}
+	return results
+}
+
+func notifyResult(channel string, err error) NotifyResult {
+	if err != nil { return NotifyResult{Channel: channel, Status: "Failed", Error: err.Error()} }
+	return NotifyResult{Channel: channel, Status: "Success"}
+}
+
+func sendWebhook(hook WebhookConfig, n Notification) error {
+	var body []byte
+	headers := map[string]string{"Content-Type": "application/json"}
+	url := hook.URL
+
+	switch hook.Kind {
+	case "discord":
+		body, _ = json.Marshal(map[string]string{"content": fmt.Sprintf("**%s**\n%s", n.Title, n.Message)})
+	case "slack":
+		body, _ = json.Marshal(map[string]string{"text": fmt.Sprintf("*%s*\n%s", n.Title, n.Message)})
+	case "ntfy":
+		// ntfy takes the message as plain body and metadata as headers.
+		body = []byte(n.Message)
+		headers = map[string]string{"Title": n.Title, "Tags": n.Event}
+		if hook.Token != "" { headers["Authorization"] = "Bearer " + hook.Token }
+	case "gotify":
+		url = strings.TrimRight(url, "/") + "/message"
+		body, _ = json.Marshal(map[string]interface{}{"title": n.Title, "message": n.Message, "priority": notifyPriority(n.Event)})
+		headers["X-Gotify-Key"] = hook.Token
+	default:
+		body, _ = json.Marshal(n)
+		if hook.Token != "" { headers["Authorization"] = "Bearer " + hook.Token }
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil { return err }
+	for k, v := range headers { req.Header.Set(k, v) }
+	resp, err := notifyClient.Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 { return fmt.Errorf("HTTP %d", resp.StatusCode) }
+	return nil
+}
+
+func notifyPriority(event string) int {
+	switch event {
+	case EventJobFailure, EventScrubErrors, EventLowSpace: return 8
+	}
+	return 4
+}
+
+// sendEmail uses implicit TLS on port 465 and STARTTLS (when offered)
+// everywhere else.
+func sendEmail(cfg EmailConfig, n Notification) error {
+	if cfg.Host == "" || len(cfg.To) == 0 { return fmt.Errorf("SMTP host and recipients are required") }
+	port := cfg.Port
+	if port == 0 { port = 587 }
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+	from := cfg.From
+	if from == "" { from = cfg.Username }
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: [BTRFS Manager] %s\r\nDate: %s\r\n", from, strings.Join(cfg.To, ", "), n.Title, time.Now().Format(time.RFC1123Z))
+	text := fmt.Sprintf("%s\r\n\r\nHost: %s\r\nEvent: %s\r\nTime: %s\r\n", n.Message, n.Host, n.Event, n.Time)
+	if n.HTML == "" {
+		msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+		msg.WriteString(text)
+	} else {
+		boundary := fmt.Sprintf("btrfs-manager-%d", time.Now().UnixNano())
+		fmt.Fprintf(&msg, "MIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=%q\r\n\r\n", boundary)
+		fmt.Fprintf(&msg, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", boundary, text)
+		fmt.Fprintf(&msg, "--%s\r\nContent-Type: text/html; charset=utf-8\r\n\r\n%s\r\n--%s--\r\n", boundary, n.HTML, boundary)
+	}
+
+	var auth smtp.Auth
+	if cfg.Username != "" { auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host) }
+	if port != 465 {
+		return smtp.SendMail(addr, auth, from, cfg.To, []byte(msg.String()))
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, &tls.Config{ServerName: cfg.Host})
+	if err != nil { return err }
+	c, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil { return err }
+	defer c.Close()
+	if auth != nil {
+		if err := c.Auth(auth); err != nil { return err }
+	}
+	if err := c.Mail(from); err != nil { return err }
+	for _, to := range cfg.To {
+		if err := c.Rcpt(to); err != nil { return err }
+	}
+	wc, err := c.Data()
+	if err != nil { return err }
+	if _, err := wc.Write([]byte(msg.String())); err != nil { return err }
+	if err := wc.Close(); err != nil { return err }
+	return c.Quit()
+}
+
+// --- Event Sources ---
+
+// notifyHistoryEntry maps a finished history entry to notification events.
+// It is called with state.mu held, so the actual sending is asynchronous.
+func notifyHistoryEntry(e LogEntry) {
+	if e.Status == "Running..." { return }
+	go recordOperationMetrics(e)
+	output := e.Output
+	if len(output) > 1500 { output = output[len(output)-1500:] }
+
+	if e.Status == "Failed" {
+		go notify(newNotification(EventJobFailure, fmt.Sprintf("%s failed", e.Type), fmt.Sprintf("%s %s failed after %s.\n\n%s", e.Emoji, e.Path, e.Duration, output)))
+	}
+	if e.Result != nil && e.Result.Scrub != nil && e.Result.Scrub.Errors > 0 {
+		go notify(newNotification(EventScrubErrors, "Scrub found errors", fmt.Sprintf("Scrub of %s reported %d errors (%d uncorrectable).\n\n%s\n%s", e.Path, e.Result.Scrub.Errors, e.Result.Scrub.Uncorrectable, corruptFilesSummary(e.Result.Scrub.CorruptFiles), output)))
+	}
+	if e.Type == "SNAPSHOT" && e.Status == "Success" {
+		go notify(newNotification(EventSnapshotSuccess, "Snapshot created", e.Path))
+	}
+}
+
+// runSpaceMonitor samples usage of the target drive into the metrics store
+// every usage_sample_minutes and notifies once when free space falls below
+// the threshold, then again only after it recovered.
+func runSpaceMonitor() {
+	alerted := false
+	var lastPrune time.Time
+	for {
+		time.Sleep(usageSampleInterval())
+		state.mu.Lock()
+		path := state.Config.TargetDrive
+		events := state.Config.Notifications.Events
+		state.mu.Unlock()
+		if path == "" { continue }
+
+		usage, err := getFilesystemUsage(path)
+		if err != nil || usage.Total == 0 { continue }
+		now := time.Now()
+		recordMetrics(
+			MetricSample{Name: "fs_total_bytes", Target: path, Time: now, Value: float64(usage.Total)},
+			MetricSample{Name: "fs_used_bytes", Target: path, Time: now, Value: float64(usage.Used)},
+			MetricSample{Name: "fs_free_bytes", Target: path, Time: now, Value: float64(usage.Free)},
+			MetricSample{Name: "fs_unallocated_bytes", Target: path, Time: now, Value: float64(usage.DeviceUnallocated)},
+		)
+		recordDeviceStats(path, now)
+		if now.Sub(lastPrune) > 24*time.Hour {
+			lastPrune = now
+			if err := store.PruneMetrics(now.Add(-metricsRetention)); err != nil {
+				logWarn("STORAGE", "Failed to prune metrics: %v", err)
+			}
+			if err := store.PruneAudit(now.Add(-auditRetention)); err != nil {
+				logWarn("STORAGE", "Failed to prune the audit log: %v", err)
+			}
+		}
+		if !events.LowSpace { continue }
+
+		threshold := events.LowSpacePercent
+		if threshold <= 0 { threshold = 10 }
+		freePct := float64(usage.Free) * 100 / float64(usage.Total)
+
+		if freePct >= float64(threshold) {
+			alerted = false
+			continue
+		}
+		if alerted { continue }
+		alerted = true
+		printDockerLog("NOTIFY", "Low free space on %s: %.1f%%", path, freePct)
+		notify(newNotification(EventLowSpace, "Low free space",
+			fmt.Sprintf("%s has %.1f%% free (%s of %s), below the %d%% threshold.", path, freePct, formatBytes(usage.Free), formatBytes(usage.Total), threshold)))
+	}
+}
+
+func formatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit { return fmt.Sprintf("%d B", b) }
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// --- Test Endpoint ---
+
+var notifyTestMu sync.Mutex
+
+func handleTestNotification(w http.ResponseWriter, r *http.Request) {
+	if !notifyTestMu.TryLock() {
+		http.Error(w, "A test notification is already being sent", 409)
+		return
+	}
+	defer notifyTestMu.Unlock()
+
+	results := notify(newNotification(EventTest, "Test notification", "Notifications from BTRFS Manager are working."))
+	if results == nil { results = []NotifyResult{} }
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "results": results})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// --- Snapshot on Change ---
+// Besides its schedule, a snapshot job can watch its source (or another
+// directory) with inotify and take a snapshot once changes have settled:
+// after debounce_seconds (default 60) without a change, and no earlier than
+// min_interval_minutes (default 15) after its newest snapshot, scheduled or
+// not. inotify watches single directories, so every directory below the path
+// is watched, up to maxChangeWatches, the snapshot destination excepted.
+// The job's schedule windows and the blackouts apply; a change snapshot that
+// falls into one waits for the next allowed time.
+
+type OnChangeConfig struct {
+	Enabled            bool     `json:"enabled"`
+	Path               string   `json:"path,omitempty"`                 // watched directory, default the source
+	DebounceSeconds    int      `json:"debounce_seconds,omitempty"`     // quiet time before the snapshot, default 60
+	MinIntervalMinutes int      `json:"min_interval_minutes,omitempty"` // between snapshots of the job, default 15
+	Exclude            []string `json:"exclude,omitempty"`              // glob patterns of names to ignore, e.g. *.swp
+}
+
+const (
+	defaultChangeDebounce    = 60 * time.Second
+	defaultChangeMinInterval = 15 * time.Minute
+	maxChangeWatches         = 8192
+)
+
+func (c OnChangeConfig) debounce() time.Duration {
+	if c.DebounceSeconds <= 0 { return defaultChangeDebounce }
+	return time.Duration(c.DebounceSeconds) * time.Second
+}
+
+func (c OnChangeConfig) minInterval() time.Duration {
+	if c.MinIntervalMinutes <= 0 { return defaultChangeMinInterval }
+	return time.Duration(c.MinIntervalMinutes) * time.Minute
+}
+
+func validateOnChange(j SnapshotJob) error {
+	c := j.OnChange
+	if !c.Enabled { return nil }
+	if j.Source == "" { return fmt.Errorf("on_change: snapshots on change need a source") }
+	if c.Path != "" && !filepath.IsAbs(c.Path) { return fmt.Errorf("on_change: path must be absolute") }
+	if c.DebounceSeconds < 0 || c.MinIntervalMinutes < 0 { return fmt.Errorf("on_change: values must not be negative") }
+	for _, p := range c.Exclude {
+		if _, err := filepath.Match(p, ""); err != nil { return fmt.Errorf("on_change: invalid exclude pattern %q", p) }
+	}
+	return nil
+}
+
+type changeWatcher struct {
+	spec string
+	stop chan struct{}
+}
+
+var changeWatchers = struct {
+	mu    sync.Mutex
+	byJob map[string]*changeWatcher
+}{byJob: map[string]*changeWatcher{}}
+
+// refreshChangeWatchers starts, restarts and stops the watchers to match the
+// snapshot jobs in cfg, leaving unchanged ones alone like refreshSchedules.
+func refreshChangeWatchers(cfg Config) {
+	changeWatchers.mu.Lock()
+	defer changeWatchers.mu.Unlock()
+	wanted := map[string]SnapshotJob{}
+	for _, j := range cfg.SnapshotJobs {
+		if j.OnChange.Enabled && j.Source != "" { wanted[j.ID] = j }
+	}
+	for id, w := range changeWatchers.byJob {
+		if j, ok := wanted[id]; ok && changeWatchSpec(j) == w.spec { continue }
+		close(w.stop)
+		delete(changeWatchers.byJob, id)
+	}
+	for id, j := range wanted {
+		if _, ok := changeWatchers.byJob[id]; ok { continue }
+		w := &changeWatcher{spec: changeWatchSpec(j), stop: make(chan struct{})}
+		changeWatchers.byJob[id] = w
+		go watchForChanges(j, w.stop)
+	}
+}
+
+func changeWatchSpec(j SnapshotJob) string {
+	return fmt.Sprintf("%s|%s|%v|%v|%s", changeWatchRoot(j), j.Dest, j.OnChange.debounce(), j.OnChange.minInterval(), strings.Join(j.OnChange.Exclude, ","))
+}
+
+func changeWatchRoot(j SnapshotJob) string {
+	if j.OnChange.Path != "" { return filepath.Clean(j.OnChange.Path) }
+	return filepath.Clean(j.Source)
+}
+
+func changeExcluded(c OnChangeConfig, name string) bool {
+	base := filepath.Base(name)
+	for _, p := range c.Exclude {
+		if ok, _ := filepath.Match(p, base); ok { return true }
+	}
+	return false
+}
+
+// watchTree adds dir and the directories below it to w, skipping the
+// snapshot destination, and returns the number of watches added.
+func watchTree(w *fsnotify.Watcher, dir, dest string, c OnChangeConfig, watched int) int {
+	added := 0
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() { return nil }
+		if path == dest || (path != dir && changeExcluded(c, path)) { return filepath.SkipDir }
+		if watched+added >= maxChangeWatches { return filepath.SkipAll }
+		if err := w.Add(path); err != nil {
+			logWarn("WATCH", "Cannot watch %s: %v", path, err)
+			return filepath.SkipDir
+		}
+		added++
+		return nil
+	})
+	return added
+}
+
+// lastSnapshotTime returns when the newest snapshot of the job was taken.
+func lastSnapshotTime(j SnapshotJob) time.Time {
+	var last time.Time
+	entries, err := os.ReadDir(j.Dest)
+	if err != nil { return last }
+	times := loadSnapshotTimes(j.Dest)
+	for _, e := range entries {
+		if t, ok := j.snapshotTime(e.Name(), times); ok && t.After(last) { last = t }
+	}
+	return last
+}
+
+func watchForChanges(job SnapshotJob, stop chan struct{}) {
+	root, dest, c := changeWatchRoot(job), filepath.Clean(job.Dest), job.OnChange
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		logWarn("WATCH", "Cannot watch %s for job %s: %v", root, job.ID, err)
+		return
+	}
+	defer w.Close()
+	watched := watchTree(w, root, dest, c, 0)
+	if watched >= maxChangeWatches { logWarn("WATCH", "%s has more than %d directories; changes below the first %d are missed", root, maxChangeWatches, maxChangeWatches) }
+	printDockerLog("WATCH", "Watching %s (%d directories) for job %s: snapshot %v after the last change, at most every %v", root, watched, job.ID, c.debounce(), c.minInterval())
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	pending := 0
+	for {
+		select {
+		case <-stop:
+			timer.Stop()
+			printDockerLog("WATCH", "Stopped watching %s for job %s", root, job.ID)
+			return
+		case err, ok := <-w.Errors:
+			if !ok { return }
+			logWarn("WATCH", "Watching %s: %v", root, err)
+		case ev, ok := <-w.Events:
+			if !ok { return }
+			if ev.Op == fsnotify.Chmod || ev.Name == dest || strings.HasPrefix(ev.Name, dest+"/") || changeExcluded(c, ev.Name) { continue }
+			if ev.Op&fsnotify.Create != 0 {
+				if fi, err := os.Lstat(ev.Name); err == nil && fi.IsDir() { watched += watchTree(w, ev.Name, dest, c, watched) }
+			}
+			pending++
+			timer.Reset(c.debounce())
+		case <-timer.C:
+			latest, err := findSnapshotJob(job.ID)
+			if err != nil { return }
+			now := time.Now()
+			if wait := c.minInterval() - now.Sub(lastSnapshotTime(latest)); wait > 0 {
+				timer.Reset(wait)
+				continue
+			}
+			state.mu.Lock()
+			blackouts := state.Config.Blackouts
+			state.mu.Unlock()
+			if reason := blockedBy(latest.Schedule.Windows, blackouts, now); reason != "" {
+				if at, ok := nextAllowed(latest.Schedule.Windows, blackouts, now); ok {
+					printDockerLog("WATCH", "%d changes in %s, snapshot deferred to %s (%s)", pending, root, at.Format(time.RFC3339), reason)
+					timer.Reset(time.Until(at))
+				} else {
+					printDockerLog("WATCH", "%d changes in %s, but no allowed time for a snapshot (%s)", pending, root, reason)
+				}
+				continue
+			}
+			if l := lockedFor(latest.Source, latest.Dest); l != nil {
+				printDockerLog("WATCH", "%d changes in %s, but no snapshot: %s", pending, root, l.message())
+				timer.Reset(c.minInterval())
+				continue
+			}
+			printDockerLog("WATCH", "%d changes in %s settled, taking a snapshot", pending, root)
+			pending = 0
+			run := newJobRun("snapshot:"+job.ID, "change")
+			performSnapshot(latest, run)
+			run.finish()
+		}
+	}
+}
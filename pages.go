@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// --- Server-Rendered Pages ---
+// Next to the single-page UI at /, /snapshots, /devices and /history are
+// rendered on the server, for text browsers, browsers without JavaScript
+// and links from elsewhere. The templates are parsed once at startup, each
+// page together with layout.html. A file of the same name in the template
+// directory (--templates or $TEMPLATE_DIR) replaces the embedded one, so
+// the pages, and index.html, can be restyled without a rebuild; one that
+// doesn't parse stops the server at startup rather than showing an empty
+// page later.
+
+var pageNames = []string{"snapshots", "devices", "history"}
+
+const historyPageLimit = 200
+
+var pageTemplates map[string]*template.Template
+
+type PageData struct {
+	Title   string
+	Page    string
+	Nav     []string
+	Version string
+	Host    string
+	Target  string
+	User    AccessUser
+	Now     time.Time
+	Data    interface{}
+}
+
+type snapshotsPage struct {
+	Job       SnapshotJob
+	Snapshots []SnapshotItem
+	Error     string
+}
+
+type devicesPage struct {
+	Devices []Device
+	Replace *ReplaceResult
+	Error   string
+}
+
+type historyPage struct {
+	Query   url.Values
+	Entries []LogEntry
+	Total   int
+	More    bool
+	Error   string
+}
+
+var pageFuncs = template.FuncMap{
+	"bytes":  formatBytes,
+	"status": statusKey,
+	"title":  func(s string) string { return strings.ToUpper(s[:1]) + s[1:] },
+}
+
+// templateSource reads name from dir if it is there, else the embedded
+// copy at embedded.
+func templateSource(dir, name, embedded string) (string, error) {
+	if dir != "" {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil { return string(data), nil }
+		if !os.IsNotExist(err) { return "", err }
+	}
+	data, err := content.ReadFile(embedded)
+	return string(data), err
+}
+
+// loadTemplates parses index.html and the pages, with overrides from dir.
+func loadTemplates(dir string) error {
+	if dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() { return fmt.Errorf("template directory %s: not a directory", dir) }
+	}
+	parsed := map[string]*template.Template{}
+	src, err := templateSource(dir, "index.html", "static/index.html")
+	if err != nil { return err }
+	if parsed["index"], err = template.New("index.html").Funcs(pageFuncs).Parse(src); err != nil { return err }
+
+	layout, err := templateSource(dir, "layout.html", "static/templates/layout.html")
+	if err != nil { return err }
+	for _, name := range pageNames {
+		t, err := template.New("layout.html").Funcs(pageFuncs).Parse(layout)
+		if err != nil { return err }
+		src, err := templateSource(dir, name+".html", "static/templates/"+name+".html")
+		if err != nil { return err }
+		if _, err := t.New(name + ".html").Parse(src); err != nil { return err }
+		if t.Lookup("content") == nil { return fmt.Errorf("template %s.html: no \"content\" template defined", name) }
+		parsed[name] = t
+	}
+	pageTemplates = parsed
+	return nil
+}
+
+func newPageData(r *http.Request, page, title string, data interface{}) PageData {
+	host, _ := os.Hostname()
+	state.mu.Lock()
+	target := state.Config.TargetDrive
+	state.mu.Unlock()
+	return PageData{Title: title, Page: page, Nav: pageNames, Version: buildInfo().Version, Host: host, Target: target, User: requestUser(r), Now: time.Now(), Data: data}
+}
+
+// renderPage executes the page into a buffer first, so a template error
+// becomes a 500 instead of half a page.
+func renderPage(w http.ResponseWriter, name string, data PageData) {
+	t := pageTemplates[name]
+	if t == nil {
+		http.Error(w, "Templates not loaded", 500)
+		return
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		logWarn("TEMPLATE", "Rendering %s: %v", name, err)
+		http.Error(w, "Rendering the page failed: "+err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func handleIndex(w http.ResponseWriter, r *http.Request) {
+	renderPage(w, "index", newPageData(r, "", "Dashboard", nil))
+}
+
+func handleSnapshotsPage(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	jobs := append([]SnapshotJob(nil), state.Config.SnapshotJobs...)
+	state.mu.Unlock()
+	var list []snapshotsPage
+	for _, job := range jobs {
+		p := snapshotsPage{Job: job}
+		var err error
+		if job.Dest == "" {
+			p.Error = "Destination not configured"
+		} else if p.Snapshots, err = listSnapshotItems(job); err != nil {
+			p.Error = err.Error()
+		}
+		list = append(list, p)
+	}
+	renderPage(w, "snapshots", newPageData(r, "snapshots", "Snapshots", list))
+}
+
+func handleDevicesPage(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	path := state.Config.TargetDrive
+	state.mu.Unlock()
+	var p devicesPage
+	if path == "" {
+		p.Error = "Target drive not configured"
+	} else if devices, err := listDevices(path); err != nil {
+		p.Error = err.Error()
+	} else {
+		p.Devices = devices
+		p.Replace, _, _ = replaceStatus(path)
+	}
+	renderPage(w, "devices", newPageData(r, "devices", "Devices", p))
+}
+
+// handleHistoryPage shows the newest historyPageLimit entries, filtered by
+// the same parameters as /api/history.
+func handleHistoryPage(w http.ResponseWriter, r *http.Request) {
+	p := historyPage{Query: r.URL.Query()}
+	f, err := parseHistoryFilter(p.Query)
+	if err != nil {
+		p.Error = err.Error()
+	} else {
+		p.Entries = filterHistory(f)
+	}
+	p.Total = len(p.Entries)
+	if p.Total > historyPageLimit { p.Entries, p.More = p.Entries[:historyPageLimit], true }
+	renderPage(w, "history", newPageData(r, "history", "History", p))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// --- State Persistence ---
+// saveState only marks the state as changed. A flush writes it at most once
+// per persistInterval, outside state.mu: a burst of log updates from busy
+// commands coalesces into one write instead of rewriting state.json and the
+// history for every line. Files are replaced atomically (temp file, fsync,
+// rename), so a crash or power loss leaves the previous version intact.
+
+const persistInterval = time.Second
+
+var persist = struct {
+	mu      sync.Mutex // guards the fields up to write
+	timer   *time.Timer
+	last    time.Time
+	paused  int  // see pausePersistence
+	pending bool // changed while paused
+	stopped bool
+	write   sync.Mutex // one flush at a time; also guards writtenConfig
+}{}
+
+// saveState schedules a write of the config and history. Caller must hold
+// state.mu.
+func saveState() {
+	persist.mu.Lock()
+	defer persist.mu.Unlock()
+	scheduleFlush()
+}
+
+// scheduleFlush starts the timer for the next write. Caller must hold
+// persist.mu.
+func scheduleFlush() {
+	if persist.paused > 0 {
+		persist.pending = true
+		return
+	}
+	if persist.timer != nil || persist.stopped { return }
+	delay := time.Until(persist.last.Add(persistInterval))
+	if delay < 0 { delay = 0 }
+	persist.timer = time.AfterFunc(delay, func() { writeState(false) })
+}
+
+// flushState writes the current state now. Caller must not hold state.mu.
+func flushState() { writeState(true) }
+
+// pausePersistence writes what is pending and holds back scheduled writes
+// until resumePersistence, e.g. while the state subvolume is rolled back
+// underneath the state file.
+func pausePersistence() {
+	persist.mu.Lock()
+	persist.paused++
+	persist.mu.Unlock()
+	flushState()
+}
+
+func resumePersistence() {
+	persist.mu.Lock()
+	defer persist.mu.Unlock()
+	persist.paused--
+	if persist.paused == 0 && persist.pending {
+		persist.pending = false
+		scheduleFlush()
+	}
+}
+
+func writeState(force bool) {
+	persist.write.Lock()
+	defer persist.write.Unlock()
+	persist.mu.Lock()
+	if persist.timer != nil {
+		persist.timer.Stop()
+		persist.timer = nil
+	}
+	if !force && persist.paused > 0 {
+		persist.pending = true
+		persist.mu.Unlock()
+		return
+	}
+	persist.last = time.Now()
+	persist.mu.Unlock()
+
+	// Take a consistent copy under the lock, do the I/O without it.
+	state.mu.Lock()
+	saved := map[string]interface{}{}
+	var configData []byte
+	var configErr error
+	if configFile == "" {
+		saved["config"] = state.Config
+	} else {
+		configData, configErr = encodeConfigFile()
+	}
+	if state.Runbook != nil { saved["runbook"] = state.Runbook }
+	if len(state.RetentionReports) > 0 { saved["retention_reports"] = state.RetentionReports }
+	if len(state.ScrubRotation) > 0 { saved["scrub_rotation"] = state.ScrubRotation }
+	if state.Shutdown != nil { saved["shutdown"] = state.Shutdown }
+	if len(state.LastRuns) > 0 { saved["last_runs"] = state.LastRuns }
+	if len(state.JobStats) > 0 { saved["job_stats"] = state.JobStats }
+	if state.Convert != nil { saved["convert"] = state.Convert }
+	if len(state.RuleFirings) > 0 { saved["rule_firings"] = state.RuleFirings }
+	if state.BalanceHold != nil { saved["balance_hold"] = state.BalanceHold }
+	if len(state.Pins) > 0 { saved["pins"] = state.Pins }
+	if len(state.SendParents) > 0 { saved["send_parents"] = state.SendParents }
+	if len(state.SnapshotMeta) > 0 { saved["snapshot_meta"] = state.SnapshotMeta }
+	if len(state.Locks) > 0 { saved["locks"] = state.Locks }
+	data, _ := json.MarshalIndent(saved, "", "  ")
+	path := stateFile
+	history := append([]LogEntry(nil), state.History...)
+	s := store
+	state.mu.Unlock()
+
+	if configErr == nil && configData != nil && !bytes.Equal(configData, writtenConfig) {
+		configErr = writeFileAtomic(configFile, configData, configFileMode)
+		if configErr == nil { writtenConfig = configData }
+	}
+	if configErr != nil { logError("SYSTEM", "Failed to save config to %s: %v", configFile, configErr) }
+	if err := writeFileAtomic(path, data, configFileMode); err != nil {
+		logError("SYSTEM", "Failed to save state to %s: %v", path, err)
+	}
+	if err := s.SaveHistory(history); err != nil {
+		logError("STORAGE", "Failed to save history: %v", err)
+	}
+}
+
+// stopPersistence writes pending changes and stops scheduling writes, before
+// the store is closed on shutdown.
+func stopPersistence() {
+	flushState()
+	persist.mu.Lock()
+	persist.stopped = true
+	if persist.timer != nil { persist.timer.Stop() }
+	persist.mu.Unlock()
+}
+
+// writeFileAtomic replaces path with data through a synced temp file in the
+// same directory, so readers and crashes see either the old or the new file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil { return err }
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil { err = f.Sync() }
+	if cerr := f.Close(); err == nil { err = cerr }
+	if err == nil { err = os.Chmod(tmp, perm) }
+	if err == nil { err = os.Rename(tmp, path) }
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Persist the rename itself.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// --- Pinned Snapshots ---
+// A pinned snapshot (say, the one taken before a risky upgrade) is kept
+// whatever the job's retention says: retention and purge leave it out of
+// their plans, and deleting it by hand is refused until it is unpinned.
+// Pins are kept in the state by snapshot path, so jobs sharing a
+// destination don't mix them up. In count mode the kept snapshots are
+// counted without the pinned ones.
+
+type SnapshotPin struct {
+	Note  string `json:"note,omitempty"`
+	Since string `json:"since"` // RFC 3339
+}
+
+func snapshotPin(job SnapshotJob, name string) (SnapshotPin, bool) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	p, ok := state.Pins[snapshotPath(job.Dest, name)]
+	return p, ok
+}
+
+// withoutPinned returns snaps without the job's pinned snapshots.
+func withoutPinned(job SnapshotJob, snaps []SnapInfo) []SnapInfo {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if len(state.Pins) == 0 { return snaps }
+	var kept []SnapInfo
+	for _, s := range snaps {
+		if _, ok := state.Pins[snapshotPath(job.Dest, s.Name)]; !ok { kept = append(kept, s) }
+	}
+	return kept
+}
+
+// handlePinSnapshot pins ?name= of ?job=, with an optional {"note"}; DELETE
+// unpins it.
+func handlePinSnapshot(w http.ResponseWriter, r *http.Request) {
+	job, err := jobFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	path, err := snapshotRoot(job, name)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		state.mu.Lock()
+		_, ok := state.Pins[path]
+		delete(state.Pins, path)
+		saveState()
+		state.mu.Unlock()
+		if !ok {
+			http.Error(w, "Snapshot is not pinned", 404)
+			return
+		}
+		logHistory("UNPIN", "📌", path, "Success", "Unpinned: retention applies again")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "unpinned"})
+		return
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		http.Error(w, "Snapshot not found", 404)
+		return
+	}
+	var req struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), 400)
+			return
+		}
+	}
+	pin := SnapshotPin{Note: req.Note, Since: time.Now().UTC().Format(time.RFC3339)}
+	state.mu.Lock()
+	if state.Pins == nil { state.Pins = map[string]SnapshotPin{} }
+	state.Pins[path] = pin
+	saveState()
+	state.mu.Unlock()
+	msg := "Pinned: kept regardless of retention"
+	if pin.Note != "" { msg = fmt.Sprintf("%s (%s)", msg, pin.Note) }
+	logHistory("PIN", "📌", path, "Success", msg)
+	json.NewEncoder(w).Encode(pin)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// --- Schedule Preview ---
+
+type PlannedOp struct {
+	Description string `json:"description"`
+	Command     string `json:"command"`
+}
+
+type SchedulePreview struct {
+	Job      string      `json:"job"`
+	Spec     string      `json:"spec"`
+	NextRun  string      `json:"next_run,omitempty"`
+	Ops      []PlannedOp `json:"operations"`
+	Warnings []string    `json:"warnings,omitempty"`
+	Error    string      `json:"error,omitempty"`
+
+	// DeferredTo is when a next run outside the schedule's windows or in a
+	// blackout actually starts.
+	DeferredTo string `json:"deferred_to,omitempty"`
+}
+
+// handleSchedulePreview is strictly read-only: it resolves what each enabled
+// schedule would execute at its next fire time without running anything.
+func handleSchedulePreview(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	cfg := state.Config
+	// Registered jobs know their real next fire time (@every keeps its phase).
+	nextRuns := make(map[string]time.Time)
+	for name, id := range state.cronIDs {
+		nextRuns[name] = state.cron.Entry(id).Next
+	}
+	state.mu.Unlock()
+
+	now := time.Now()
+	previews := []SchedulePreview{}
+	for _, job := range scheduledJobs(cfg) {
+		if !job.Schedule.Enabled { continue }
+		previews = append(previews, previewJob(cfg, job, now, nextRuns[job.Name]))
+	}
+	json.NewEncoder(w).Encode(previews)
+}
+
+func previewJob(cfg Config, job scheduledJob, now, next time.Time) SchedulePreview {
+	p := SchedulePreview{Job: job.Name, Spec: scheduleSpec(job.Schedule)}
+
+	sched, err := cron.ParseStandard(p.Spec)
+	if err != nil {
+		p.Error = "invalid schedule: " + err.Error()
+		return p
+	}
+	if next.IsZero() {
+		next = sched.Next(now)
+	}
+	p.NextRun = next.Format(time.RFC3339)
+	if at, ok := nextAllowed(job.Schedule.Windows, cfg.Blackouts, next); !ok {
+		p.Warnings = append(p.Warnings, fmt.Sprintf("no allowed time within %d days of the next run: it will be skipped", int(maxDeferral.Hours()/24)))
+	} else if !at.Equal(next) {
+		p.DeferredTo = at.Format(time.RFC3339)
+		next = at
+	}
+
+	ops, warnings := job.Preview(next)
+	p.Ops, p.Warnings = ops, append(p.Warnings, warnings...)
+	return p
+}
+
+func previewTargetCommand(path, desc string, args func(string) []string) ([]PlannedOp, []string) {
+	if path == "" {
+		return nil, []string{"target drive not set: job will do nothing"}
+	}
+	var warnings []string
+	if _, err := os.Stat(path); err != nil {
+		warnings = append(warnings, "target drive not accessible: "+err.Error())
+	}
+	return []PlannedOp{{Description: desc, Command: formatCommand("btrfs", args(path)...)}}, warnings
+}
+
+func previewSnapshot(job SnapshotJob, at time.Time) ([]PlannedOp, []string) {
+	src, dest := job.Source, job.Dest
+	if src == "" || dest == "" {
+		return nil, []string{"snapshot source or destination not set: job will do nothing"}
+	}
+	var warnings []string
+	if _, err := os.Stat(src); err != nil {
+		warnings = append(warnings, "snapshot source not accessible: "+err.Error())
+	}
+
+	name := job.snapshotName(at)
+	fullDest := snapshotPath(dest, name)
+	kind := "read-only"
+	if job.Writable { kind = "writable" }
+	var ops []PlannedOp
+	if job.Hooks.Pre != "" { ops = append(ops, PlannedOp{Description: "Run pre-snapshot hook", Command: job.Hooks.Pre}) }
+	ops = append(ops, PlannedOp{
+		Description: "Create " + kind + " snapshot " + name,
+		Command:     formatCommand("btrfs", snapshotArgs(src, fullDest, !job.Writable)...),
+	})
+	if job.Hooks.Post != "" { ops = append(ops, PlannedOp{Description: "Run post-snapshot hook", Command: job.Hooks.Post}) }
+
+	if !job.Retention.Enabled {
+		return ops, warnings
+	}
+
+	existing, err := listManagedSnapshots(job)
+	if err != nil && !os.IsNotExist(err) {
+		warnings = append(warnings, "cannot read snapshot destination: "+err.Error())
+	}
+	// Retention runs right after the new snapshot exists, so include it.
+	snaps := append([]SnapInfo{{Name: name, Time: at}}, withoutPinned(job, existing)...)
+	for _, s := range selectJobRetentionDeletes(job, snaps, at) {
+		p := snapshotPath(dest, s.Name)
+		ops = append(ops, PlannedOp{
+			Description: "Retention: delete " + s.Name,
+			Command:     formatCommand("btrfs", "subvolume", "delete", p),
+		})
+	}
+	return ops, warnings
+}
+
+func formatCommand(name string, args ...string) string {
+	return strings.TrimSpace(name + " " + strings.Join(args, " "))
+}
+
+// --- Schedule Validation ---
+
+// parseSchedule parses cfg with the same parser the scheduler registers jobs
+// with, so anything accepted here will also be accepted by refreshSchedules.
+func parseSchedule(cfg ScheduleConfig) (cron.Schedule, error) {
+	if strings.TrimSpace(cfg.Value) == "" { return nil, fmt.Errorf("schedule value is empty") }
+	return cron.ParseStandard(scheduleSpec(cfg))
+}
+
+// validateSchedules checks every enabled schedule in cfg, since a spec that
+// fails to parse would otherwise just leave its job unregistered.
+func validateSchedules(cfg Config) ConfigErrors {
+	var errs ConfigErrors
+	errs.add("scrub_plan", cfg.ScrubPlan.validate())
+	errs.add("blackouts", validateBlackouts(cfg.Blackouts))
+	for _, job := range scheduledJobs(cfg) {
+		field := scheduleField(cfg, job.Name)
+		if err := validateWindows(job.Schedule.Windows); err != nil {
+			errs.add(field+".windows", err)
+			continue
+		}
+		if err := validateRetry(job.Schedule.Retry); err != nil {
+			errs.add(field+".retry", err)
+			continue
+		}
+		if !job.Schedule.Enabled { continue }
+		if _, err := parseSchedule(job.Schedule); err != nil {
+			errs.add(field, fmt.Errorf("invalid schedule %q: %v", scheduleSpec(job.Schedule), err))
+		}
+	}
+	return errs
+}
+
+// allowedRunTimes is nextRunTimes with fires outside the windows or in a
+// blackout moved to when they actually run, several folding into one.
+func allowedRunTimes(sched cron.Schedule, windows []TimeWindow, blackouts []Blackout, from time.Time, n int) []string {
+	if len(windows) == 0 && len(blackouts) == 0 { return nextRunTimes(sched, from, n) }
+	runs := make([]string, 0, n)
+	var last time.Time
+	for t, i := from, 0; len(runs) < n && i < 1000; i++ {
+		t = sched.Next(t)
+		if t.IsZero() { break }
+		at, ok := nextAllowed(windows, blackouts, t)
+		if !ok || !at.After(last) { continue }
+		last = at
+		runs = append(runs, at.Format(time.RFC3339))
+		if at.After(t) { t = at.Add(-time.Second) } // fires while deferred fold into this run
+	}
+	return runs
+}
+
+func nextRunTimes(sched cron.Schedule, from time.Time, n int) []string {
+	runs := make([]string, 0, n)
+	for t := from; len(runs) < n; {
+		t = sched.Next(t)
+		if t.IsZero() { break }
+		runs = append(runs, t.Format(time.RFC3339))
+	}
+	return runs
+}
+
+// handleValidateSchedule accepts a schedule as stored in the config, or a raw
+// {"spec": "..."} cron expression, and returns the next 5 run times.
+func handleValidateSchedule(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ScheduleConfig
+		Spec string `json:"spec"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), 400)
+		return
+	}
+	cfg := req.ScheduleConfig
+	if req.Spec != "" { cfg = ScheduleConfig{Type: "cron", Value: req.Spec} }
+
+	spec := scheduleSpec(cfg)
+	sched, err := parseSchedule(cfg)
+	if err == nil { err = validateWindows(cfg.Windows) }
+	if err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]interface{}{"valid": false, "spec": spec, "error": err.Error()})
+		return
+	}
+	state.mu.Lock()
+	blackouts := state.Config.Blackouts
+	state.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"valid": true, "spec": spec, "next": allowedRunTimes(sched, cfg.Windows, blackouts, time.Now(), 5)})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// --- Command Priorities ---
+// Scrubs, defrags and other long operations can be run with a lower CPU and
+// IO priority per operation type, wrapped in `ionice` and `nice`, and
+// optionally in a cgroup (v2) of their own with CPU and IO bandwidth
+// limits. The log entry records what was applied.
+
+// CommandPriority configures the commands of one operation type (the log
+// entry type, e.g. SCRUB START); operation "*" applies to all others.
+type CommandPriority struct {
+	Operation string `json:"operation"`
+	Nice      int    `json:"nice,omitempty"`     // 1..19, higher is nicer
+	IOClass   string `json:"io_class,omitempty"` // idle or best-effort
+	IOLevel   int    `json:"io_level,omitempty"` // best-effort level 0 (high) .. 7 (low)
+
+	// Cgroup limits; 0 is unlimited. IO limits apply to the target drive's
+	// devices.
+	CPUPercent int    `json:"cpu_percent,omitempty"` // of one CPU
+	ReadMBps   uint64 `json:"read_mbps,omitempty"`   // MiB/s
+	WriteMBps  uint64 `json:"write_mbps,omitempty"`  // MiB/s
+}
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+func (p CommandPriority) validate() error {
+	if p.Nice < 0 || p.Nice > 19 { return fmt.Errorf("nice for %s must be between 0 and 19", p.Operation) }
+	if p.IOClass != "" && p.IOClass != "idle" && p.IOClass != "best-effort" { return fmt.Errorf("io_class for %s must be idle or best-effort", p.Operation) }
+	if p.IOLevel < 0 || p.IOLevel > 7 { return fmt.Errorf("io_level for %s must be between 0 and 7", p.Operation) }
+	if p.CPUPercent < 0 { return fmt.Errorf("cpu_percent for %s must not be negative", p.Operation) }
+	return nil
+}
+
+func (p CommandPriority) cgroupLimited() bool { return p.CPUPercent > 0 || p.ReadMBps > 0 || p.WriteMBps > 0 }
+
+func validateCommandPriorities(priorities []CommandPriority) error {
+	seen := map[string]bool{}
+	for _, p := range priorities {
+		if p.Operation == "" || seen[p.Operation] { return fmt.Errorf("command priorities need unique, non-empty operations") }
+		seen[p.Operation] = true
+		if err := p.validate(); err != nil { return err }
+	}
+	return nil
+}
+
+// commandPriority returns the priority for opType, like commandTimeout.
+func commandPriority(opType string) (CommandPriority, bool) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	var fallback *CommandPriority
+	for i, p := range state.Config.CommandPriorities {
+		if p.Operation == opType { return p, true }
+		if p.Operation == "*" { fallback = &state.Config.CommandPriorities[i] }
+	}
+	if fallback != nil { return *fallback, true }
+	return CommandPriority{}, false
+}
+
+// prioritize applies the priority of opType to cmd before it is started and
+// describes what was applied ("" for nothing). release must be called once
+// the command has started.
+func prioritize(cmd *exec.Cmd, opType string) (string, func()) {
+	p, ok := commandPriority(opType)
+	if !ok || cmd.Err != nil { return "", func() {} }
+	var applied, wrap []string
+	if p.IOClass != "" {
+		if path, err := exec.LookPath("ionice"); err != nil {
+			applied = append(applied, "ionice not installed")
+		} else if p.IOClass == "idle" {
+			wrap = append(wrap, path, "-c3")
+			applied = append(applied, "ionice idle")
+		} else {
+			wrap = append(wrap, path, "-c2", "-n", strconv.Itoa(p.IOLevel))
+			applied = append(applied, fmt.Sprintf("ionice best-effort %d", p.IOLevel))
+		}
+	}
+	if p.Nice > 0 {
+		if path, err := exec.LookPath("nice"); err != nil {
+			applied = append(applied, "nice not installed")
+		} else {
+			wrap = append(wrap, path, "-n", strconv.Itoa(p.Nice))
+			applied = append(applied, fmt.Sprintf("nice %d", p.Nice))
+		}
+	}
+	if len(wrap) > 0 {
+		cmd.Args = append(wrap, append([]string{cmd.Path}, cmd.Args[1:]...)...)
+		cmd.Path = wrap[0]
+	}
+
+	release := func() {}
+	if p.cgroupLimited() {
+		dir, limits, err := limitCgroup(opType, p)
+		if err == nil {
+			var f *os.File
+			if f, err = os.Open(dir); err == nil {
+				cmd.SysProcAttr.UseCgroupFD, cmd.SysProcAttr.CgroupFD = true, int(f.Fd())
+				release = func() { f.Close() }
+				applied = append(applied, "cgroup "+limits)
+			}
+		}
+		if err != nil { applied = append(applied, "cgroup unavailable: "+err.Error()) }
+	}
+	return strings.Join(applied, ", "), release
+}
+
+var cgroupSetup = struct {
+	sync.Mutex
+	base string // delegated cgroup directory, once set up
+}{}
+
+// ownCgroup sets up the cgroup the limited commands go under: the app's own
+// cgroup, with the app's processes moved into a "manager" leaf so the cpu
+// and io controllers can be enabled for children.
+func ownCgroup() (string, error) {
+	cgroupSetup.Lock()
+	defer cgroupSetup.Unlock()
+	if cgroupSetup.base != "" { return cgroupSetup.base, nil }
+
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil { return "", err }
+	var rel string
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if p, ok := strings.CutPrefix(line, "0::"); ok { rel, found = p, true }
+	}
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); !found || err != nil { return "", fmt.Errorf("cgroup v2 is not mounted at %s", cgroupRoot) }
+	base := filepath.Join(cgroupRoot, rel)
+	if filepath.Base(base) == "manager" { base = filepath.Dir(base) } // set up by an earlier run
+
+	controllers, err := os.ReadFile(filepath.Join(base, "cgroup.controllers"))
+	if err != nil { return "", err }
+	for _, c := range []string{"cpu", "io"} {
+		if !strings.Contains(" "+string(controllers)+" ", " "+c+" ") { return "", fmt.Errorf("the %s controller is not available in %s", c, base) }
+	}
+
+	// Processes may only live in leaves once controllers are enabled.
+	leaf := filepath.Join(base, "manager")
+	if err := os.MkdirAll(leaf, 0755); err != nil { return "", err }
+	procs, err := os.ReadFile(filepath.Join(base, "cgroup.procs"))
+	if err != nil { return "", err }
+	for _, pid := range strings.Fields(string(procs)) {
+		os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(pid), 0644)
+	}
+	if err := os.WriteFile(filepath.Join(base, "cgroup.subtree_control"), []byte("+cpu +io"), 0644); err != nil {
+		return "", fmt.Errorf("enabling cpu and io controllers in %s: %v", base, err)
+	}
+	cgroupSetup.base = base
+	return base, nil
+}
+
+// limitCgroup creates or updates the cgroup of opType with the limits of p
+// and returns its directory and a description of the limits.
+func limitCgroup(opType string, p CommandPriority) (string, string, error) {
+	base, err := ownCgroup()
+	if err != nil { return "", "", err }
+	dir := filepath.Join(base, "op-"+strings.ToLower(strings.ReplaceAll(opType, " ", "-")))
+	if err := os.MkdirAll(dir, 0755); err != nil { return "", "", err }
+
+	var desc []string
+	cpuMax := "max 100000"
+	if p.CPUPercent > 0 {
+		cpuMax = fmt.Sprintf("%d 100000", p.CPUPercent*1000)
+		desc = append(desc, fmt.Sprintf("cpu %d%%", p.CPUPercent))
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(cpuMax), 0644); err != nil { return "", "", fmt.Errorf("cpu.max: %v", err) }
+
+	if p.ReadMBps > 0 || p.WriteMBps > 0 {
+		devs, err := targetBlockDevices()
+		if err != nil { return "", "", err }
+		rbps, wbps := "max", "max"
+		if p.ReadMBps > 0 { rbps = strconv.FormatUint(p.ReadMBps<<20, 10) }
+		if p.WriteMBps > 0 { wbps = strconv.FormatUint(p.WriteMBps<<20, 10) }
+		for _, dev := range devs {
+			if err := os.WriteFile(filepath.Join(dir, "io.max"), []byte(fmt.Sprintf("%s rbps=%s wbps=%s", dev, rbps, wbps)), 0644); err != nil { return "", "", fmt.Errorf("io.max for %s: %v", dev, err) }
+		}
+		if p.ReadMBps > 0 { desc = append(desc, fmt.Sprintf("read %d MiB/s", p.ReadMBps)) }
+		if p.WriteMBps > 0 { desc = append(desc, fmt.Sprintf("write %d MiB/s", p.WriteMBps)) }
+	}
+	return dir, strings.Join(desc, " "), nil
+}
+
+// targetBlockDevices returns the MAJ:MIN of the disks under the target
+// drive; io.max takes whole disks, not partitions.
+func targetBlockDevices() ([]string, error) {
+	state.mu.Lock()
+	path := state.Config.TargetDrive
+	state.mu.Unlock()
+	if path == "" { return nil, fmt.Errorf("target drive not set") }
+	devices, err := listDevices(path)
+	if err != nil { return nil, err }
+	seen := map[string]bool{}
+	var list []string
+	for _, d := range devices {
+		var st syscall.Stat_t
+		if d.Missing || syscall.Stat(d.Path, &st) != nil || st.Mode&syscall.S_IFMT != syscall.S_IFBLK { continue }
+		dev := fmt.Sprintf("%d:%d", (st.Rdev>>8)&0xfff|(st.Rdev>>32)&^0xfff, st.Rdev&0xff|(st.Rdev>>12)&^0xff)
+		if _, err := os.Stat("/sys/dev/block/" + dev + "/partition"); err == nil {
+			if parent, err := os.ReadFile("/sys/dev/block/" + dev + "/../dev"); err == nil { dev = strings.TrimSpace(string(parent)) }
+		}
+		if !seen[dev] { seen[dev], list = true, append(list, dev) }
+	}
+	if len(list) == 0 { return nil, fmt.Errorf("no block devices found for %s", path) }
+	return list, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// --- Probes ---
+// GET /healthz and GET /readyz answer without an access key, for container
+// health checks and Kubernetes probes. /healthz only says the process
+// serves requests. /readyz also checks that the state was loaded, the
+// scheduler runs and the target drive is mounted and answers, and that the
+// server isn't shutting down; it answers 503 until all of that holds. Like
+// /status they leave out paths, as anyone who can reach the port can ask.
+
+type ProbeCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+const probeTimeout = 5 * time.Second
+
+var probes = struct {
+	started          time.Time
+	stateLoaded      atomic.Bool
+	schedulerStarted atomic.Bool
+}{started: time.Now()}
+
+// handleHealthz answers 200 while the process serves requests.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         "ok",
+		"uptime_seconds": int64(time.Since(probes.started).Seconds()),
+	})
+}
+
+// handleReadyz answers 200 when the server can do its work, 503 with the
+// failed checks otherwise.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := []ProbeCheck{
+		{Name: "state", OK: probes.stateLoaded.Load()},
+		{Name: "scheduler", OK: probes.schedulerStarted.Load()},
+		targetDriveCheck(),
+		{Name: "shutdown", OK: !shuttingDown()},
+	}
+	if !checks[0].OK { checks[0].Detail = "the state is not loaded yet" }
+	if !checks[1].OK { checks[1].Detail = "the scheduler is not started yet" }
+	if !checks[3].OK { checks[3].Detail = "the server is shutting down" }
+	ready := true
+	for _, c := range checks { ready = ready && c.OK }
+
+	w.Header().Set("Cache-Control", "no-store")
+	status := "ready"
+	if !ready {
+		status = "not ready"
+		w.WriteHeader(503)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "checks": checks})
+}
+
+// targetDriveCheck checks that the target drive is a mounted btrfs
+// filesystem that answers within probeTimeout; without a target drive
+// there is nothing to wait for.
+func targetDriveCheck() ProbeCheck {
+	c := ProbeCheck{Name: "target_drive"}
+	state.mu.Lock()
+	path := state.Config.TargetDrive
+	state.mu.Unlock()
+	if path == "" {
+		c.OK, c.Detail = true, "not configured"
+		return c
+	}
+	// A hung mount blocks stat, so it runs aside.
+	result := make(chan error, 1)
+	go func() {
+		if _, err := os.Stat(path); err != nil {
+			result <- errors.New("not accessible")
+			return
+		}
+		// Unmounted, the path is a directory of the filesystem below.
+		if m, ok := mountOf(path); !ok || m.FSType != "btrfs" {
+			result <- errors.New("not mounted as btrfs")
+			return
+		}
+		if _, err := btrfsFS.FilesystemInfo(path); err != nil {
+			result <- errors.New("the filesystem does not answer")
+			return
+		}
+		result <- nil
+	}()
+	select {
+	case err := <-result:
+		c.OK = err == nil
+		if err != nil { c.Detail = err.Error() }
+	case <-time.After(probeTimeout):
+		c.Detail = fmt.Sprintf("no answer within %v", probeTimeout)
+	}
+	return c
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- Deletion Plans ---
+// Retention and purge first build the list of snapshots they would delete.
+// The HTTP endpoints return that list as a dry run together with a
+// confirmation token bound to exactly those snapshots.
+
+type PlannedDelete struct {
+	Job   string `json:"job"`
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Taken string `json:"taken"`
+	Age   string `json:"age"`
+	// ExclusiveBytes is what deleting the snapshot frees, known only when
+	// quotas are enabled.
+	ExclusiveBytes *uint64 `json:"exclusive_bytes,omitempty"`
+	// SendParentOf names the chains whose next send needs the snapshot as
+	// its parent, see sendparents.go.
+	SendParentOf []string `json:"send_parent_of,omitempty"`
+}
+
+func planRetention(job SnapshotJob, now time.Time) ([]PlannedDelete, error) {
+	if !job.Retention.Enabled { return nil, nil }
+	snaps, err := listManagedSnapshots(job)
+	if os.IsNotExist(err) { return nil, nil }
+	if err != nil { return nil, err }
+	deletes := selectJobRetentionDeletes(job, withoutPinned(job, snaps), now)
+	if job.Archive.Enabled { deletes = keepUnarchived(job, snaps, deletes) }
+	return plannedDeletes(job, deletes, now), nil
+}
+
+func planPurge(job SnapshotJob, now time.Time) ([]PlannedDelete, error) {
+	if job.Dest == "" { return nil, nil }
+	snaps, err := listManagedSnapshots(job)
+	if os.IsNotExist(err) { return nil, nil }
+	if err != nil { return nil, err }
+	return plannedDeletes(job, withoutPinned(job, snaps), now), nil
+}
+
+func plannedDeletes(job SnapshotJob, snaps []SnapInfo, now time.Time) []PlannedDelete {
+	plan := []PlannedDelete{}
+	for _, s := range snaps {
+		plan = append(plan, PlannedDelete{
+			Job:          job.ID,
+			Name:         s.Name,
+			Path:         snapshotPath(job.Dest, s.Name),
+			Taken:        s.Time.Format(time.RFC3339),
+			Age:          formatAge(now.Sub(s.Time)),
+			SendParentOf: sendParentOf(snapshotPath(job.Dest, s.Name)),
+		})
+	}
+	return plan
+}
+
+// annotateSizes fills ExclusiveBytes from the cached qgroup reports. It
+// costs one `subvolume show` per snapshot, so it is only used for previews
+// and retention reports.
+func annotateSizes(plan []PlannedDelete) {
+	state.mu.Lock()
+	exclusive := map[string]uint64{}
+	for _, report := range state.qgroups {
+		for _, g := range report.Qgroups { exclusive[g.ID] = g.Exclusive }
+	}
+	state.mu.Unlock()
+	if len(exclusive) == 0 { return }
+
+	for i := range plan {
+		id, err := btrfsFS.SubvolumeID(plan[i].Path)
+		if err != nil { continue }
+		if excl, ok := exclusive[fmt.Sprintf("0/%d", id)]; ok {
+			plan[i].ExclusiveBytes = &excl
+		}
+	}
+}
+
+func formatAge(d time.Duration) string {
+	if d < time.Hour { return fmt.Sprintf("%dm", int(d.Minutes())) }
+	if d < 24*time.Hour { return fmt.Sprintf("%dh %dm", int(d.Hours()), int(d.Minutes())%60) }
+	return fmt.Sprintf("%dd %dh", int(d.Hours())/24, int(d.Hours())%24)
+}
+
+// DeletionSummary is the impact of a plan as shown before confirming it.
+type DeletionSummary struct {
+	Snapshots int `json:"snapshots"`
+	// FreesBytes adds up ExclusiveBytes, set only when every planned
+	// snapshot has a size.
+	FreesBytes *uint64 `json:"frees_bytes,omitempty"`
+}
+
+func summarizePlan(plan []PlannedDelete) DeletionSummary {
+	sum := DeletionSummary{Snapshots: len(plan)}
+	var total uint64
+	for _, p := range plan {
+		if p.ExclusiveBytes == nil { return sum }
+		total += *p.ExclusiveBytes
+	}
+	if len(plan) > 0 { sum.FreesBytes = &total }
+	return sum
+}
+
+// planTarget identifies a plan for confirmation tokens.
+func planTarget(plan []PlannedDelete) string {
+	names := make([]string, len(plan))
+	for i, p := range plan { names[i] = p.Job + "/" + p.Name }
+	return strings.Join(names, ",")
+}
+
+// deletePlanned removes the snapshots of plan and reports which of them were
+// deleted.
+func deletePlanned(opType string, plan []PlannedDelete) *PruneResult {
+	result := &PruneResult{Planned: len(plan), Deleted: []string{}}
+	for _, p := range plan {
+		printDockerLog(opType, "Deleting: %s", p.Path)
+		if err := deleteSnapshotTree(p.Path); err == nil {
+			forgetSnapshotMeta(p.Path)
+			result.Deleted = append(result.Deleted, p.Name)
+		} else {
+			logError(opType, "Failed to delete %s: %v", p.Path, err)
+			result.Failed = append(result.Failed, p.Name)
+		}
+	}
+	return result
+}
+
+func prunedStatus(r *PruneResult) string {
+	if len(r.Failed) > 0 { return "Warning" }
+	return "Success"
+}
+
+// --- Handlers ---
+
+// handlePlannedDeletion implements the shared dry-run / confirm flow: without
+// a token (or with dry_run=true) it only returns the plan and a token; with
+// a valid token it deletes exactly the planned snapshots.
+func handlePlannedDeletion(w http.ResponseWriter, r *http.Request, action string, planFn func(SnapshotJob, time.Time) ([]PlannedDelete, error), run func(SnapshotJob, []PlannedDelete)) {
+	jobs, err := jobsFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var req struct {
+		Token       string `json:"token"`
+		BreakChains bool   `json:"break_chains"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	if req.Token == "" { req.Token = r.URL.Query().Get("token") }
+	if r.URL.Query().Get("break_chains") == "true" { req.BreakChains = true }
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	now := time.Now()
+	plan, held, warnings := []PlannedDelete{}, []PlannedDelete{}, []string{}
+	byJob := map[string][]PlannedDelete{}
+	for _, job := range jobs {
+		p, err := planFn(job, now)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("job %s: %v", job.ID, err), 500)
+			return
+		}
+		p, h, warn := holdSendParents(p, req.BreakChains)
+		plan = append(plan, p...)
+		held = append(held, h...)
+		warnings = append(warnings, warn...)
+		byJob[job.ID] = p
+	}
+	target := planTarget(plan)
+	var dests []string
+	for _, job := range jobs { dests = append(dests, job.Dest) }
+	lock := lockedFor(dests...)
+	if lock != nil { warnings = append(warnings, lock.message()+": the deletion is refused until it is released") }
+
+	if dryRun || req.Token == "" {
+		annotateSizes(plan)
+		token, expires := issueConfirmToken(action, target)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "confirm",
+			"dry_run":  true,
+			"token":    token,
+			"expires":  expires.Format(time.RFC3339),
+			"deletes":  plan,
+			"held":     held,
+			"warnings": warnings,
+			"summary":  summarizePlan(plan),
+		})
+		return
+	}
+	if lock != nil {
+		http.Error(w, "Locked: "+lock.message()+"; release the lock first", 423)
+		return
+	}
+	if !consumeConfirmToken(req.Token, action, target) {
+		http.Error(w, "Invalid or expired confirmation token (the snapshot list may have changed)", 403)
+		return
+	}
+
+	go func() {
+		for _, job := range jobs {
+			run(job, byJob[job.ID])
+			if len(byJob[job.ID]) > 0 { refreshBootMenu(job) }
+		}
+	}()
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "triggered", "deletes": len(plan)})
+}
+
+func handleRunRetention(w http.ResponseWriter, r *http.Request) {
+	handlePlannedDeletion(w, r, "retention", planRetention, func(job SnapshotJob, plan []PlannedDelete) { applyRetentionPlan(job, plan, nil) })
+}
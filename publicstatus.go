@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Public Status ---
+// GET /status answers without an access key, for uptime monitors and wall
+// dashboards: the overall health, the age of the newest snapshot, the last
+// scrub's result and the free space of the target drive in percent. It
+// leaves out paths, job names and command output. It is off unless
+// public_status.enabled is set, and the answer is cached for
+// publicStatusTTL so unauthenticated requests can't keep btrfs busy.
+// Monitors can go by the status code: 503 while the status is critical.
+
+type PublicStatusConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+type PublicStatus struct {
+	Status             string  `json:"status"` // ok, warning, critical
+	Checked            string  `json:"checked"`
+	LastSnapshot       string  `json:"last_snapshot,omitempty"` // RFC 3339
+	LastSnapshotAgeSec int64   `json:"last_snapshot_age_seconds,omitempty"`
+	LastScrub          string  `json:"last_scrub,omitempty"` // RFC 3339 start
+	LastScrubStatus    string  `json:"last_scrub_status,omitempty"`
+	LastScrubErrors    uint64  `json:"last_scrub_errors"`
+	FreePercent        float64 `json:"free_percent"`
+}
+
+const publicStatusTTL = 30 * time.Second
+
+var publicStatusCache = struct {
+	mu     sync.Mutex
+	status *PublicStatus
+	at     time.Time
+}{}
+
+func buildPublicStatus() *PublicStatus {
+	now := time.Now()
+	s := &PublicStatus{Status: "ok", Checked: now.UTC().Format(time.RFC3339)}
+	health.mu.Lock()
+	report := health.report
+	health.mu.Unlock()
+	if report == nil { report = runHealthCheck() }
+	s.Status = report.Status
+	if report.Error != "" { s.Status = "warning" }
+
+	state.mu.Lock()
+	path := state.Config.TargetDrive
+	jobs := append([]SnapshotJob(nil), state.Config.SnapshotJobs...)
+	for _, e := range state.History {
+		if e.Result == nil || e.Result.Scrub == nil || strings.HasSuffix(e.Status, "...") { continue }
+		s.LastScrubStatus, s.LastScrubErrors = e.Status, e.Result.Scrub.Errors
+		s.LastScrub = entryTime(e).UTC().Format(time.RFC3339)
+		// Errors a scrub could not repair from another copy mean lost data.
+		if e.Result.Scrub.Uncorrectable > 0 { s.Status = worseHealth(s.Status, "critical") }
+		break
+	}
+	state.mu.Unlock()
+
+	var last time.Time
+	for _, j := range jobs {
+		if t := lastSnapshotTime(j); t.After(last) { last = t }
+	}
+	if !last.IsZero() {
+		s.LastSnapshot = last.UTC().Format(time.RFC3339)
+		s.LastSnapshotAgeSec = int64(now.Sub(last).Seconds())
+	}
+	if s.LastScrubStatus == "Failed" { s.Status = worseHealth(s.Status, "warning") }
+	if path != "" {
+		if usage, err := getFilesystemUsage(path); err == nil && usage.Total > 0 {
+			s.FreePercent = math.Round(float64(usage.Free)*1000/float64(usage.Total)) / 10
+		}
+	}
+	return s
+}
+
+func worseHealth(a, b string) string {
+	if healthStatusRank[b] > healthStatusRank[a] { return b }
+	return a
+}
+
+var publicStatusPage = template.Must(template.New("public").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="60">
+<title>BTRFS Status: {{.Status}}</title>
+<style>body{font-family:system-ui,sans-serif;max-width:600px;margin:20px auto;padding:0 10px;color:#333}
+td{padding:6px 4px;border-bottom:1px solid #e5e7eb}.critical,.Failed{color:#dc2626}.ok,.Success{color:#16a34a}.warning,.Warning{color:#92400e}</style></head><body>
+<h1 class="{{.Status}}">🍃 {{.Status}}</h1>
+<table>
+<tr><td>📸 Last snapshot</td><td>{{if .LastSnapshot}}{{.LastSnapshot}} ({{.Age}} ago){{else}}none{{end}}</td></tr>
+<tr><td>🧹 Last scrub</td><td>{{if .LastScrubStatus}}<span class="{{.LastScrubStatus}}">{{.LastScrubStatus}}</span>{{with .LastScrub}}, {{.}}{{end}}{{if .LastScrubErrors}}, {{.LastScrubErrors}} errors{{end}}{{else}}none{{end}}</td></tr>
+<tr><td>💾 Free space</td><td>{{printf "%.1f" .FreePercent}}%</td></tr>
+</table>
+<p style="opacity:0.6">Checked {{.Checked}}</p>
+</body></html>`))
+
+// handlePublicStatus returns the public status as JSON, or as a page with
+// ?format=html or when a browser asks for HTML.
+func handlePublicStatus(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	enabled := state.Config.PublicStatus.Enabled
+	state.mu.Unlock()
+	if !enabled {
+		http.NotFound(w, r)
+		return
+	}
+
+	publicStatusCache.mu.Lock()
+	if publicStatusCache.status == nil || time.Since(publicStatusCache.at) > publicStatusTTL {
+		publicStatusCache.status, publicStatusCache.at = buildPublicStatus(), time.Now()
+	}
+	s := publicStatusCache.status
+	publicStatusCache.mu.Unlock()
+
+	code := 200
+	if s.Status == "critical" { code = 503 }
+	w.Header().Set("Cache-Control", "no-store")
+	format := r.URL.Query().Get("format")
+	if format == "html" || (format == "" && strings.Contains(r.Header.Get("Accept"), "text/html")) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(code)
+		age := (time.Duration(s.LastSnapshotAgeSec) * time.Second).Round(time.Minute).String()
+		publicStatusPage.Execute(w, struct {
+			*PublicStatus
+			Age string
+		}{s, age})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(s)
+}
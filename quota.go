@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Quota Groups ---
+
+type Qgroup struct {
+	ID            string `json:"id"`
+	Level         int    `json:"level"`
+	SubvolID      uint64 `json:"subvol_id"`
+	Referenced    uint64 `json:"referenced"`
+	Exclusive     uint64 `json:"exclusive"`
+	MaxReferenced uint64 `json:"max_referenced"` // 0 = no limit
+	MaxExclusive  uint64 `json:"max_exclusive"`
+	Path          string `json:"path"` // subvolume path relative to the filesystem root
+}
+
+type QgroupReport struct {
+	Path    string   `json:"path"`
+	Updated string   `json:"updated"`
+	Qgroups []Qgroup `json:"qgroups"`
+	Error   string   `json:"error,omitempty"`
+}
+
+var (
+	qgroupIDPattern   = regexp.MustCompile(`^(\d+)/(\d+)$`)
+	qgroupSizePattern = regexp.MustCompile(`^(none|\d+(\.\d+)?[KMGTPE]?)$`)
+)
+
+// fsPathFromRequest returns ?path= or the target drive.
+func fsPathFromRequest(r *http.Request) string {
+	if p := r.URL.Query().Get("path"); p != "" { return p }
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.Config.TargetDrive
+}
+
+// refreshQgroups runs `qgroup show` for path and caches the result.
+func refreshQgroups(path string) *QgroupReport {
+	report := &QgroupReport{Path: path, Updated: time.Now().Format(time.RFC3339), Qgroups: []Qgroup{}}
+	out, err := exec.Command("btrfs", "qgroup", "show", "-re", "--raw", path).CombinedOutput()
+	if err != nil {
+		report.Error = fmt.Sprintf("%v: %s", err, strings.TrimSpace(string(out)))
+	} else {
+		report.Qgroups = parseQgroupShow(string(out))
+		if paths, err := listSubvolumePaths(path); err == nil {
+			for i := range report.Qgroups {
+				g := &report.Qgroups[i]
+				if p, ok := paths[g.SubvolID]; ok && g.Level == 0 { g.Path = p }
+			}
+		}
+	}
+
+	state.mu.Lock()
+	if state.qgroups == nil { state.qgroups = make(map[string]*QgroupReport) }
+	state.qgroups[path] = report
+	state.mu.Unlock()
+	return report
+}
+
+// parseQgroupShow reads `btrfs qgroup show -re --raw`. Columns are qgroupid,
+// referenced, exclusive, max referenced, max exclusive and, on newer
+// btrfs-progs, a path; headers and separators are skipped.
+func parseQgroupShow(out string) []Qgroup {
+	groups := []Qgroup{}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 5 { continue }
+		m := qgroupIDPattern.FindStringSubmatch(f[0])
+		if m == nil { continue }
+		g := Qgroup{ID: f[0]}
+		g.Level, _ = strconv.Atoi(m[1])
+		g.SubvolID, _ = strconv.ParseUint(m[2], 10, 64)
+		g.Referenced, _ = strconv.ParseUint(f[1], 10, 64)
+		g.Exclusive, _ = strconv.ParseUint(f[2], 10, 64)
+		g.MaxReferenced, _ = strconv.ParseUint(f[3], 10, 64) // "none" parses as 0
+		g.MaxExclusive, _ = strconv.ParseUint(f[4], 10, 64)
+		if len(f) > 5 { g.Path = strings.Join(f[5:], " ") }
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// listSubvolumePaths maps subvolume IDs to their path.
+func listSubvolumePaths(path string) (map[uint64]string, error) {
+	subvols, err := btrfsFS.ListSubvolumes(path)
+	if err != nil { return nil, err }
+	paths := map[uint64]string{5: "<toplevel>"}
+	for _, s := range subvols { paths[s.ID] = s.Path }
+	return paths, nil
+}
+
+// runQgroupRefresher keeps the qgroup cache of the target drive warm.
+func runQgroupRefresher(interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		state.mu.Lock()
+		path := state.Config.TargetDrive
+		state.mu.Unlock()
+		if path != "" { refreshQgroups(path) }
+	}
+}
+
+// --- Handlers ---
+
+func handleQuotaEnable(w http.ResponseWriter, r *http.Request) {
+	if !requireFeature(w, "quotas") { return }
+	path := fsPathFromRequest(r)
+	if path == "" { http.Error(w, "Target drive not set", 400); return }
+	id := runCommandAsync("QUOTA ENABLE", "📏", path, "btrfs", "quota", "enable", path)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
+}
+
+func handleListQgroups(w http.ResponseWriter, r *http.Request) {
+	path := fsPathFromRequest(r)
+	if path == "" { http.Error(w, "Target drive not set", 400); return }
+
+	state.mu.Lock()
+	report := state.qgroups[path]
+	state.mu.Unlock()
+	if report == nil || r.URL.Query().Get("refresh") == "1" {
+		report = refreshQgroups(path)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// QgroupLimitRequest limits either the subvolume at Path, or the qgroup
+// Qgroup (e.g. "0/256") of the filesystem mounted at Path / the target drive.
+type QgroupLimitRequest struct {
+	Path      string `json:"path"`
+	Qgroup    string `json:"qgroup"`
+	Size      string `json:"size"` // e.g. 10G, or "none" to remove the limit
+	Exclusive bool   `json:"exclusive"`
+}
+
+func handleQgroupLimit(w http.ResponseWriter, r *http.Request) {
+	var req QgroupLimitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), 400)
+		return
+	}
+	req.Size = strings.ToUpper(strings.TrimSpace(req.Size))
+	if req.Size == "NONE" { req.Size = "none" }
+	if req.Path == "" && req.Qgroup != "" {
+		state.mu.Lock()
+		req.Path = state.Config.TargetDrive
+		state.mu.Unlock()
+	}
+	if req.Path == "" || !qgroupSizePattern.MatchString(req.Size) {
+		http.Error(w, "path and size (e.g. 10G or none) are required", 400)
+		return
+	}
+	if req.Qgroup != "" && !qgroupIDPattern.MatchString(req.Qgroup) {
+		http.Error(w, "Invalid qgroup id", 400)
+		return
+	}
+
+	args := []string{"qgroup", "limit"}
+	if req.Exclusive { args = append(args, "-e") }
+	args = append(args, req.Size)
+	target := req.Path
+	if req.Qgroup != "" {
+		args = append(args, req.Qgroup)
+		target = req.Qgroup + " @ " + req.Path
+	}
+	args = append(args, req.Path)
+	id := runCommandAsync("QGROUP LIMIT", "📏", fmt.Sprintf("%s ➡️ %s", target, req.Size), "btrfs", args...)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
+}
+
+// --- Orphan Cleanup ---
+
+// findOrphanQgroups returns level-0 qgroups whose subvolume no longer exists.
+// Deleted subvolumes leave these behind, still showing up in reports.
+func findOrphanQgroups(path string) ([]Qgroup, error) {
+	out, err := exec.Command("btrfs", "qgroup", "show", "-re", "--raw", path).CombinedOutput()
+	if err != nil { return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out))) }
+	paths, err := listSubvolumePaths(path)
+	if err != nil { return nil, err }
+
+	orphans := []Qgroup{}
+	for _, g := range parseQgroupShow(string(out)) {
+		if g.Level != 0 { continue }
+		if _, ok := paths[g.SubvolID]; ok { continue }
+		orphans = append(orphans, g)
+	}
+	return orphans, nil
+}
+
+func handleCleanupQgroups(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	path := fsPathFromRequest(r)
+	if path == "" { http.Error(w, "Target drive not set", 400); return }
+	orphans, err := findOrphanQgroups(path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	ids := make([]string, len(orphans))
+	for i, g := range orphans { ids[i] = g.ID }
+	// Binding the token to the exact list means a confirmation never removes
+	// more than what was shown in the dry run.
+	target := path + ":" + strings.Join(ids, ",")
+
+	if req.Token == "" {
+		token, expires := issueConfirmToken("qgroup-cleanup", target)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "confirm",
+			"token":   token,
+			"expires": expires.Format(time.RFC3339),
+			"orphans": orphans,
+		})
+		return
+	}
+	if refuseLocked(w, path) { return }
+	if !consumeConfirmToken(req.Token, "qgroup-cleanup", target) {
+		http.Error(w, "Invalid or expired confirmation token (the orphan list may have changed)", 403)
+		return
+	}
+	if len(orphans) == 0 {
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "removed": 0})
+		return
+	}
+
+	id := startHistory("QGROUP CLEANUP", "🧽", path, fmt.Sprintf("Removing %d orphaned qgroup(s)", len(orphans)))
+	go func() {
+		start := time.Now()
+		var log strings.Builder
+		status := "Success"
+		for _, g := range orphans {
+			out, err := exec.Command("btrfs", "qgroup", "destroy", g.ID, path).CombinedOutput()
+			if err != nil {
+				status = "Failed"
+				fmt.Fprintf(&log, "❌ %s: %v %s\n", g.ID, err, strings.TrimSpace(string(out)))
+				continue
+			}
+			fmt.Fprintf(&log, "✅ destroyed %s (%s exclusive)\n", g.ID, formatBytes(g.Exclusive))
+		}
+		printDockerLog("QGROUP CLEANUP", "Finished: %s", status)
+		duration := time.Since(start).Round(time.Millisecond)
+		updateHistory(id, func(e *LogEntry) {
+			e.Status = status
+			e.Output = log.String()
+			e.Duration = duration.String()
+		})
+		refreshQgroups(path)
+	}()
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id, "removed": len(orphans)})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Receive with Quarantine ---
+// Snapshots sent to a job (`btrfs send ... | curl -T - .../api/receive?job=x`)
+// are first received into <dest>/.quarantine/<upload>/ and verified there.
+// Only a snapshot that passes is moved into the destination, where retention
+// sees it; anything else stays in quarantine until it is inspected and
+// discarded.
+
+type ReceiveConfig struct {
+	Enabled         bool `json:"enabled"`
+	RequireManifest bool `json:"require_manifest"`
+}
+
+// ReceiveManifest is sent by the sender in the X-Snapshot-Manifest header.
+// Every field that is set must match what was received.
+type ReceiveManifest struct {
+	Name   string `json:"name"`
+	UUID   string `json:"uuid"`   // UUID of the sent subvolume, i.e. the Received UUID here
+	SHA256 string `json:"sha256"` // of the send stream
+}
+
+type QuarantinedSnapshot struct {
+	Upload   string `json:"upload"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Received string `json:"received"`
+	Reason   string `json:"reason"`
+}
+
+const (
+	quarantineDirName = ".quarantine"
+	quarantineReason  = "reason.txt"
+	// A received snapshot dated further ahead than this would outrank every
+	// local snapshot in count-based retention.
+	receiveClockSkew = 5 * time.Minute
+)
+
+func quarantineDir(job SnapshotJob) string {
+	return filepath.Join(job.Dest, quarantineDirName)
+}
+
+// receivedSubvolumes lists what `btrfs receive` created in dir.
+func receivedSubvolumes(dir string) []string {
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() { names = append(names, e.Name()) }
+	}
+	return names
+}
+
+// verifyReceived checks a received snapshot before it may join the job's
+// snapshots and returns every problem found.
+func verifyReceived(job SnapshotJob, dir, streamSum string, manifest *ReceiveManifest, now time.Time) (string, []string) {
+	names := receivedSubvolumes(dir)
+	if len(names) != 1 { return "", []string{fmt.Sprintf("expected exactly one subvolume, got %d", len(names))} }
+	name := names[0]
+
+	var problems []string
+	fields, err := showSubvolume(filepath.Join(dir, name))
+	if err != nil {
+		return name, []string{err.Error()}
+	}
+	received := fields["Received UUID"]
+	if received == "" || received == "-" { problems = append(problems, "no received UUID: not created by btrfs receive") }
+	if !strings.Contains(fields["Flags"], "readonly") { problems = append(problems, "subvolume is not read-only") }
+
+	t, ok := job.parseSnapshotTime(name)
+	if !ok {
+		problems = append(problems, fmt.Sprintf("name %q does not match the job's naming (%s%s)", name, job.Prefix, job.nameTemplate()))
+	} else if t.After(now.Add(receiveClockSkew)) {
+		problems = append(problems, fmt.Sprintf("snapshot is dated in the future (%s)", t.Format(time.RFC3339)))
+	}
+	if _, err := os.Lstat(snapshotPath(job.Dest, name)); err == nil {
+		problems = append(problems, "a snapshot named "+name+" already exists")
+	}
+
+	if manifest != nil {
+		if manifest.Name != "" && manifest.Name != name { problems = append(problems, fmt.Sprintf("manifest name %q does not match %q", manifest.Name, name)) }
+		if manifest.UUID != "" && manifest.UUID != received { problems = append(problems, fmt.Sprintf("manifest UUID %s does not match received UUID %s", manifest.UUID, received)) }
+		if manifest.SHA256 != "" && !strings.EqualFold(manifest.SHA256, streamSum) { problems = append(problems, "stream checksum does not match the manifest") }
+	}
+	return name, problems
+}
+
+func receiveJobFromRequest(w http.ResponseWriter, r *http.Request) (SnapshotJob, bool) {
+	job, err := jobFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return job, false
+	}
+	if !job.Receive.Enabled || job.Dest == "" {
+		http.Error(w, "Receiving is not enabled for this job", 403)
+		return job, false
+	}
+	return job, true
+}
+
+// --- Handlers ---
+
+func handleReceiveSnapshot(w http.ResponseWriter, r *http.Request) {
+	job, ok := receiveJobFromRequest(w, r)
+	if !ok { return }
+	if refuseLocked(w, job.Source, job.Dest) { return }
+
+	var manifest *ReceiveManifest
+	if h := r.Header.Get("X-Snapshot-Manifest"); h != "" {
+		manifest = &ReceiveManifest{}
+		if err := json.Unmarshal([]byte(h), manifest); err != nil {
+			http.Error(w, "Invalid manifest: "+err.Error(), 400)
+			return
+		}
+	}
+	if manifest == nil && job.Receive.RequireManifest {
+		http.Error(w, "This job requires an X-Snapshot-Manifest header", 400)
+		return
+	}
+
+	if err := toolMissing("btrfs"); err != nil {
+		http.Error(w, fmt.Sprintf("Feature unavailable: %v", err), 503)
+		return
+	}
+
+	upload := strconv.FormatInt(time.Now().UnixNano(), 10)
+	dir := filepath.Join(quarantineDir(job), upload)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	start := time.Now()
+	visualPath := fmt.Sprintf("remote ➡️ %s", job.Dest)
+	id := startHistory("RECEIVE", "📥", visualPath, "Receiving into quarantine: "+dir)
+	printDockerLog("RECEIVE", "Receiving into %s", dir)
+
+	// -C chroots into the quarantine, so paths in the stream can't reach
+	// out of it.
+	hash := sha256.New()
+	args := []string{"receive", "-C", dir}
+	ctx, cancel := commandContext("RECEIVE")
+	defer cancel(nil)
+	trackCommand(id, "btrfs", args, cancel)
+	exited := make(chan struct{})
+	cmd := newManagedCommand(ctx, exited, "btrfs", args...)
+	cmd.Stdin = io.TeeReader(r.Body, hash)
+	out, err := cmd.CombinedOutput()
+	close(exited)
+	untrackCommand(id)
+	streamSum := hex.EncodeToString(hash.Sum(nil))
+	termination, terminated := terminationOf(ctx)
+	terminated = terminated && err != nil
+
+	var name string
+	var problems []string
+	if err != nil {
+		if terminated { err = termination }
+		problems = []string{fmt.Sprintf("btrfs receive failed: %v", err)}
+		name = strings.Join(receivedSubvolumes(dir), ", ")
+	} else {
+		name, problems = verifyReceived(job, dir, streamSum, manifest, time.Now())
+	}
+
+	log := string(out) + "\nStream SHA-256: " + streamSum + "\n"
+	status := "Success"
+	if len(problems) == 0 {
+		err = os.Rename(filepath.Join(dir, name), snapshotPath(job.Dest, name))
+		if err != nil { problems = append(problems, "promote failed: "+err.Error()) }
+	}
+	if len(problems) == 0 {
+		os.Remove(dir)
+		log += "✅ Verified and promoted to " + snapshotPath(job.Dest, name)
+		visualPath = fmt.Sprintf("remote ➡️ %s", name)
+	} else {
+		status = "Failed"
+		reason := strings.Join(problems, "\n")
+		os.WriteFile(filepath.Join(dir, quarantineReason), []byte(reason+"\n"), 0600)
+		log += "⛔ Kept in quarantine (" + dir + "):\n" + reason
+	}
+	printDockerLog("RECEIVE", "Finished: %s", status)
+
+	duration := time.Since(start).Round(time.Millisecond)
+	updateHistory(id, func(e *LogEntry) {
+		e.Status = status
+		if terminated { e.Status, e.Termination = termination.Status, termination.Kind }
+		e.Path = visualPath
+		e.Output = log
+		e.Duration = duration.String()
+	})
+
+	if len(problems) > 0 {
+		w.WriteHeader(422)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "quarantined", "id": id, "upload": upload, "name": name, "problems": problems})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id, "name": name, "sha256": streamSum})
+	enforceRetention(job, nil)
+}
+
+func handleListQuarantine(w http.ResponseWriter, r *http.Request) {
+	job, ok := receiveJobFromRequest(w, r)
+	if !ok { return }
+	entries, _ := os.ReadDir(quarantineDir(job))
+	list := []QuarantinedSnapshot{}
+	for _, e := range entries {
+		if !e.IsDir() { continue }
+		dir := filepath.Join(quarantineDir(job), e.Name())
+		item := QuarantinedSnapshot{Upload: e.Name(), Path: dir, Name: strings.Join(receivedSubvolumes(dir), ", ")}
+		if info, err := e.Info(); err == nil { item.Received = info.ModTime().Format(time.RFC3339) }
+		if reason, err := os.ReadFile(filepath.Join(dir, quarantineReason)); err == nil {
+			item.Reason = strings.TrimSpace(string(reason))
+		}
+		list = append(list, item)
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+func handleDiscardQuarantine(w http.ResponseWriter, r *http.Request) {
+	job, ok := receiveJobFromRequest(w, r)
+	if !ok { return }
+	upload := r.PathValue("upload")
+	dir := filepath.Join(quarantineDir(job), upload)
+	if upload == "" || filepath.Dir(dir) != quarantineDir(job) {
+		http.Error(w, "Invalid upload", 400)
+		return
+	}
+	if _, err := os.Stat(dir); err != nil {
+		http.Error(w, "Upload not found", 404)
+		return
+	}
+
+	var log strings.Builder
+	status := "Success"
+	for _, name := range receivedSubvolumes(dir) {
+		if err := btrfsFS.DeleteSubvolume(filepath.Join(dir, name)); err != nil {
+			status = "Failed"
+			fmt.Fprintf(&log, "Error: %v\n", err)
+			continue
+		}
+		fmt.Fprintf(&log, "Delete subvolume '%s'\n", filepath.Join(dir, name))
+	}
+	if status == "Success" { os.RemoveAll(dir) }
+	logHistory("RECEIVE DISCARD", "🗑️", dir, status, log.String())
+	if status != "Success" {
+		http.Error(w, log.String(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok"})
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Maintenance Reports ---
+// A report summarizes a period (default the last 7 days): snapshots taken
+// and deleted, scrub results, growth of the device error counters, the
+// change in used space and the operations that failed. The counts come from
+// the metrics store, which every finished log entry adds to (op_runs,
+// op_failures, snapshots_deleted, scrub_*), so they stay complete however
+// short the history is kept; the space monitor also samples the device
+// error counters (device_<counter>). Only the list of failures comes from
+// the history itself. On report.schedule the report goes out through the
+// notification channels, as HTML to email.
+
+type ReportConfig struct {
+	Schedule ScheduleConfig `json:"schedule"`
+	Range    string         `json:"range,omitempty"` // default 7d
+}
+
+const defaultReportRange = "7d"
+
+type MaintenanceReport struct {
+	Host      string            `json:"host"`
+	Generated time.Time         `json:"generated"`
+	From      time.Time         `json:"from"`
+	To        time.Time         `json:"to"`
+	Range     string            `json:"range"`
+	Snapshots ReportSnapshots   `json:"snapshots"`
+	Scrubs    []ReportScrub     `json:"scrubs"`
+	Devices   []ReportDevice    `json:"device_errors"` // counters that are not zero
+	Space     *ReportSpace      `json:"space,omitempty"`
+	Ops       []ReportOperation `json:"operations"`
+	Failures  []ReportFailure   `json:"failures"`
+	// FailuresTruncated is set when the history doesn't reach back to the
+	// start of the period, so older failures are only counted in Ops.
+	FailuresTruncated bool `json:"failures_truncated,omitempty"`
+}
+
+type ReportSnapshots struct {
+	Taken   int `json:"taken"`
+	Failed  int `json:"failed"`
+	Deleted int `json:"deleted"`
+}
+
+type ReportScrub struct {
+	Time          time.Time `json:"time"`
+	Path          string    `json:"path"`
+	Errors        uint64    `json:"errors"`
+	Uncorrectable uint64    `json:"uncorrectable"`
+}
+
+type ReportDevice struct {
+	Device  string `json:"device"`
+	Counter string `json:"counter"` // e.g. write_io_errs
+	Total   uint64 `json:"total"`
+	Delta   uint64 `json:"delta"` // growth over the period
+}
+
+type ReportSpace struct {
+	Path  string `json:"path"`
+	Total uint64 `json:"total"`
+	Start uint64 `json:"used_start"`
+	End   uint64 `json:"used_end"`
+	// Change is End - Start, negative when space was freed.
+	Change int64 `json:"change"`
+}
+
+type ReportOperation struct {
+	Type   string `json:"type"`
+	Runs   int    `json:"runs"`
+	Failed int    `json:"failed"`
+}
+
+type ReportFailure struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Path   string    `json:"path"`
+	Output string    `json:"output"`
+}
+
+func (c ReportConfig) span() (time.Duration, string) {
+	r := c.Range
+	if r == "" { r = defaultReportRange }
+	d, err := parseSpan(r)
+	if err != nil { return 7 * 24 * time.Hour, defaultReportRange }
+	return d, r
+}
+
+func (c ReportConfig) validate() error {
+	if c.Range == "" { return nil }
+	if _, err := parseSpan(c.Range); err != nil { return fmt.Errorf("report range: %v", err) }
+	return nil
+}
+
+// --- Recording ---
+
+// opMetricsSeen keeps entries whose outcome was already recorded, as an
+// entry can be updated again after it finished.
+var opMetricsSeen = struct {
+	mu  sync.Mutex
+	ids map[int64]bool
+}{ids: map[int64]bool{}}
+
+// recordOperationMetrics adds a finished log entry to the report counters.
+func recordOperationMetrics(e LogEntry) {
+	if e.Status == "Running..." { return }
+	opMetricsSeen.mu.Lock()
+	seen := opMetricsSeen.ids[e.ID]
+	if len(opMetricsSeen.ids) > 1000 { opMetricsSeen.ids = map[int64]bool{} }
+	opMetricsSeen.ids[e.ID] = true
+	opMetricsSeen.mu.Unlock()
+	if seen { return }
+
+	now := time.Now()
+	samples := []MetricSample{{Name: "op_runs", Target: e.Type, Time: now, Value: 1}}
+	if e.Status == "Failed" { samples = append(samples, MetricSample{Name: "op_failures", Target: e.Type, Time: now, Value: 1}) }
+	deleted := 0
+	if e.Type == "DELETE SNAP" && e.Status == "Success" { deleted = 1 }
+	if r := e.Result; r != nil {
+		if r.Prune != nil { deleted += len(r.Prune.Deleted) }
+		if r.Retention != nil { deleted += len(r.Retention.Deleted) }
+		if s := r.Scrub; s != nil && s.Status != "running" {
+			samples = append(samples,
+				MetricSample{Name: "scrub_errors", Target: e.Path, Time: now, Value: float64(s.Errors)},
+				MetricSample{Name: "scrub_uncorrectable", Target: e.Path, Time: now, Value: float64(s.Uncorrectable)})
+		}
+	}
+	if deleted > 0 { samples = append(samples, MetricSample{Name: "snapshots_deleted", Target: e.Path, Time: now, Value: float64(deleted)}) }
+	recordMetrics(samples...)
+}
+
+// recordDeviceStats samples the error counters of the devices of path.
+func recordDeviceStats(path string, at time.Time) {
+	out, _ := exec.Command("btrfs", "device", "stats", path).CombinedOutput()
+	var samples []MetricSample
+	for dev, counters := range parseDeviceStats(string(out)) {
+		for name, v := range counters {
+			samples = append(samples, MetricSample{Name: "device_" + name, Target: dev, Time: at, Value: float64(v)})
+		}
+	}
+	if len(samples) > 0 { recordMetrics(samples...) }
+}
+
+// --- Building ---
+
+func buildReport(cfg Config, span time.Duration, rangeStr string, now time.Time) (*MaintenanceReport, error) {
+	from := now.Add(-span)
+	host, _ := os.Hostname()
+	rep := &MaintenanceReport{Host: host, Generated: now, From: from, To: now, Range: rangeStr,
+		Scrubs: []ReportScrub{}, Devices: []ReportDevice{}, Ops: []ReportOperation{}, Failures: []ReportFailure{}}
+
+	samples, err := store.QueryMetrics("", "", from)
+	if err != nil { return nil, err }
+	ops := map[string]*ReportOperation{}
+	scrubs := map[string]*ReportScrub{} // by path and time
+	type counter struct{ first, last float64 }
+	devices := map[[2]string]*counter{}
+	var used []MetricSample
+	var total uint64
+	for _, s := range samples {
+		if s.Time.After(now) { continue }
+		switch {
+		case s.Name == "op_runs" || s.Name == "op_failures":
+			o := ops[s.Target]
+			if o == nil {
+				o = &ReportOperation{Type: s.Target}
+				ops[s.Target] = o
+			}
+			if s.Name == "op_runs" {
+				o.Runs += int(s.Value)
+			} else {
+				o.Failed += int(s.Value)
+			}
+		case s.Name == "snapshots_deleted":
+			rep.Snapshots.Deleted += int(s.Value)
+		case s.Name == "scrub_errors" || s.Name == "scrub_uncorrectable":
+			key := s.Target + "@" + s.Time.String()
+			sc := scrubs[key]
+			if sc == nil {
+				sc = &ReportScrub{Time: s.Time.UTC(), Path: s.Target}
+				scrubs[key] = sc
+			}
+			if s.Name == "scrub_errors" {
+				sc.Errors = uint64(s.Value)
+			} else {
+				sc.Uncorrectable = uint64(s.Value)
+			}
+		case strings.HasPrefix(s.Name, "device_"):
+			key := [2]string{s.Target, strings.TrimPrefix(s.Name, "device_")}
+			if c := devices[key]; c == nil {
+				devices[key] = &counter{first: s.Value, last: s.Value}
+			} else {
+				c.last = s.Value
+			}
+		case s.Name == "fs_used_bytes" && s.Target == cfg.TargetDrive:
+			used = append(used, s)
+		case s.Name == "fs_total_bytes" && s.Target == cfg.TargetDrive:
+			total = uint64(s.Value)
+		}
+	}
+
+	if o := ops["SNAPSHOT"]; o != nil { rep.Snapshots.Taken, rep.Snapshots.Failed = o.Runs-o.Failed, o.Failed }
+	for _, o := range ops { rep.Ops = append(rep.Ops, *o) }
+	sort.Slice(rep.Ops, func(i, j int) bool { return rep.Ops[i].Type < rep.Ops[j].Type })
+	for _, sc := range scrubs { rep.Scrubs = append(rep.Scrubs, *sc) }
+	sort.Slice(rep.Scrubs, func(i, j int) bool { return rep.Scrubs[i].Time.Before(rep.Scrubs[j].Time) })
+	for key, c := range devices {
+		if c.last == 0 { continue }
+		d := ReportDevice{Device: key[0], Counter: key[1], Total: uint64(c.last)}
+		if c.last > c.first { d.Delta = uint64(c.last - c.first) }
+		rep.Devices = append(rep.Devices, d)
+	}
+	sort.Slice(rep.Devices, func(i, j int) bool {
+		if rep.Devices[i].Device != rep.Devices[j].Device { return rep.Devices[i].Device < rep.Devices[j].Device }
+		return rep.Devices[i].Counter < rep.Devices[j].Counter
+	})
+	if len(used) > 0 {
+		sortMetrics(used)
+		first, last := used[0], used[len(used)-1]
+		rep.Space = &ReportSpace{Path: cfg.TargetDrive, Total: total, Start: uint64(first.Value), End: uint64(last.Value), Change: int64(last.Value) - int64(first.Value)}
+	}
+
+	state.mu.Lock()
+	history := append([]LogEntry(nil), state.History...)
+	state.mu.Unlock()
+	rep.FailuresTruncated = len(history) == 0 || time.Unix(0, history[len(history)-1].ID).After(from)
+	for _, e := range history {
+		at := time.Unix(0, e.ID)
+		if e.Status != "Failed" || at.Before(from) || at.After(now) { continue }
+		output := e.Output
+		if len(output) > 500 { output = "..." + output[len(output)-500:] }
+		rep.Failures = append(rep.Failures, ReportFailure{Time: at.UTC(), Type: e.Type, Path: e.Path, Output: output})
+	}
+	return rep, nil
+}
+
+func (r *MaintenanceReport) failedOps() int {
+	n := 0
+	for _, o := range r.Ops { n += o.Failed }
+	return n
+}
+
+func (r *MaintenanceReport) title() string {
+	return fmt.Sprintf("Maintenance report %s – %s", localTime(r.From).Format("02 Jan"), localTime(r.To).Format("02 Jan 2006"))
+}
+
+// text is the plain-text summary sent to webhooks and as the text part of
+// the email.
+func (r *MaintenanceReport) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (%s)\n\n", r.title(), r.Host)
+	fmt.Fprintf(&b, "Snapshots: %d taken, %d failed, %d deleted\n", r.Snapshots.Taken, r.Snapshots.Failed, r.Snapshots.Deleted)
+	errs := 0
+	for _, s := range r.Scrubs {
+		if s.Errors > 0 { errs++ }
+	}
+	fmt.Fprintf(&b, "Scrubs: %d run, %d with errors\n", len(r.Scrubs), errs)
+	for _, s := range r.Scrubs {
+		if s.Errors > 0 { fmt.Fprintf(&b, "  %s %s: %d errors, %d uncorrectable\n", localTime(s.Time).Format("02 Jan 15:04"), s.Path, s.Errors, s.Uncorrectable) }
+	}
+	grown := 0
+	for _, d := range r.Devices {
+		if d.Delta > 0 {
+			grown++
+			fmt.Fprintf(&b, "Device errors: %s %s +%d (now %d)\n", d.Device, d.Counter, d.Delta, d.Total)
+		}
+	}
+	if grown == 0 { b.WriteString("Device errors: no new errors\n") }
+	if s := r.Space; s != nil {
+		sign := "+"
+		if s.Change < 0 { sign = "-" }
+		fmt.Fprintf(&b, "Space: %s used of %s on %s (%s%s)\n", formatBytes(s.End), formatBytes(s.Total), s.Path, sign, formatBytes(uint64(abs64(s.Change))))
+	}
+	fmt.Fprintf(&b, "Failed operations: %d\n", r.failedOps())
+	for _, f := range r.Failures { fmt.Fprintf(&b, "  %s %s %s\n", localTime(f.Time).Format("02 Jan 15:04"), f.Type, f.Path) }
+	return b.String()
+}
+
+func abs64(v int64) int64 {
+	if v < 0 { return -v }
+	return v
+}
+
+var reportPage = template.Must(template.New("report").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+	"when":  func(t time.Time) string { return localTime(t).Format("02 Jan 2006 15:04") },
+	"change": func(v int64) string {
+		if v < 0 { return "-" + formatBytes(uint64(-v)) }
+		return "+" + formatBytes(uint64(v))
+	},
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>body{font-family:system-ui,sans-serif;max-width:800px;margin:20px auto;padding:0 10px;color:#333}
+table{width:100%;border-collapse:collapse}td,th{text-align:left;padding:4px;border-bottom:1px solid #e5e7eb}
+.bad{color:#dc2626}.ok{color:#16a34a}pre{white-space:pre-wrap;font-size:12px;background:#f3f4f6;padding:6px}</style></head><body>
+{{with .R}}<h1>🍃 {{$.Title}}</h1>
+<p>{{.Host}} · {{when .From}} – {{when .To}}</p>
+<h2>📸 Snapshots</h2>
+<p>{{.Snapshots.Taken}} taken, <span class="{{if .Snapshots.Failed}}bad{{else}}ok{{end}}">{{.Snapshots.Failed}} failed</span>, {{.Snapshots.Deleted}} deleted</p>
+<h2>🧹 Scrubs</h2>
+{{if .Scrubs}}<table><tr><th>Time</th><th>Path</th><th>Errors</th><th>Uncorrectable</th></tr>
+{{range .Scrubs}}<tr><td>{{when .Time}}</td><td>{{.Path}}</td><td class="{{if .Errors}}bad{{else}}ok{{end}}">{{.Errors}}</td><td>{{.Uncorrectable}}</td></tr>
+{{end}}</table>{{else}}<p>No scrubs in this period.</p>{{end}}
+<h2>💽 Device Errors</h2>
+{{if .Devices}}<table><tr><th>Device</th><th>Counter</th><th>New</th><th>Total</th></tr>
+{{range .Devices}}<tr><td>{{.Device}}</td><td>{{.Counter}}</td><td class="{{if .Delta}}bad{{end}}">+{{.Delta}}</td><td>{{.Total}}</td></tr>
+{{end}}</table>{{else}}<p class="ok">No device errors.</p>{{end}}
+<h2>💾 Space</h2>
+{{with .Space}}<p>{{.Path}}: {{bytes .End}} used of {{bytes .Total}} ({{change .Change}} in this period)</p>
+{{else}}<p>No usage samples in this period.</p>{{end}}
+<h2>📜 Operations</h2>
+<table><tr><th>Type</th><th>Runs</th><th>Failed</th></tr>
+{{range .Ops}}<tr><td>{{.Type}}</td><td>{{.Runs}}</td><td class="{{if .Failed}}bad{{end}}">{{.Failed}}</td></tr>
+{{end}}</table>
+{{if .Failures}}<h2>❌ Failures</h2>
+{{range .Failures}}<p><b>{{when .Time}} {{.Type}}</b> {{.Path}}</p><pre>{{.Output}}</pre>
+{{end}}{{end}}{{if .FailuresTruncated}}<p><i>The log doesn't go back to the start of the period; earlier failures are only counted above.</i></p>{{end}}
+{{end}}</body></html>`))
+
+func (r *MaintenanceReport) html() string {
+	var b bytes.Buffer
+	reportPage.Execute(&b, struct {
+		Title string
+		R     *MaintenanceReport
+	}{r.title(), r})
+	return b.String()
+}
+
+// --- Delivery ---
+
+func sendScheduledReport(run *JobRun) {
+	state.mu.Lock()
+	cfg := state.Config
+	state.mu.Unlock()
+	span, rangeStr := cfg.Report.span()
+	rep, err := buildReport(cfg, span, rangeStr, time.Now())
+	if err != nil {
+		run.tag(logHistory("REPORT", "📰", rangeStr, "Failed", fmt.Sprintf("Building the report failed: %v", err)))
+		return
+	}
+	n := newNotification(EventReport, rep.title(), rep.text())
+	n.HTML = rep.html()
+	results := notify(n)
+	status, failed := "Success", 0
+	for _, r := range results {
+		if r.Error != "" { failed++ }
+	}
+	if len(results) == 0 || failed == len(results) { status = "Failed" } else if failed > 0 { status = "Warning" }
+	run.tag(logHistory("REPORT", "📰", rangeStr, status, fmt.Sprintf("Sent to %d of %d channels.\n\n%s", len(results)-failed, len(results), rep.text())))
+}
+
+func previewReport(cfg Config) ([]PlannedOp, []string) {
+	_, rangeStr := cfg.Report.span()
+	var warnings []string
+	n := cfg.Notifications
+	if len(n.Webhooks) == 0 && !n.Email.Enabled { warnings = append(warnings, "no notification channel configured: the report goes nowhere") }
+	return []PlannedOp{{Description: "Send the maintenance report of the last " + rangeStr}}, warnings
+}
+
+// --- Handlers ---
+
+// handleLatestReport returns the report of the last ?range= (default
+// report.range) as JSON, or as HTML with ?format=html; ?download=true makes
+// it an attachment.
+func handleLatestReport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	state.mu.Lock()
+	cfg := state.Config
+	state.mu.Unlock()
+	span, rangeStr := cfg.Report.span()
+	if q.Get("range") != "" {
+		var err error
+		if span, err = parseSpan(q.Get("range")); err != nil {
+			http.Error(w, "range: "+err.Error(), 400)
+			return
+		}
+		rangeStr = q.Get("range")
+	}
+	if span > metricsRetention { span = metricsRetention }
+	format := q.Get("format")
+	if format == "" { format = "json" }
+	if format != "json" && format != "html" {
+		http.Error(w, "format must be json or html", 400)
+		return
+	}
+	rep, err := buildReport(cfg, span, rangeStr, time.Now())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("report: %v", err), 500)
+		return
+	}
+	if q.Get("download") == "true" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"btrfs-report-%s.%s\"", rep.To.Format("2006-01-02"), format))
+	}
+	if format == "html" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(rep.html()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// --- Operation Results ---
+// Finished operations keep their raw output, and commands with a parser
+// below also get a typed Result with what was parsed out of it, so the UI,
+// notifications and API clients can render tables and progress or read e.g.
+// the scrub error count without matching on free-form text that changes
+// between btrfs-progs versions.
+
+type OperationResult struct {
+	Scrub      *ScrubResult     `json:"scrub,omitempty"`
+	Balance    *BalanceResult   `json:"balance,omitempty"`
+	Replace    *ReplaceResult   `json:"replace,omitempty"`
+	Compsize   *CompsizeResult  `json:"compsize,omitempty"`
+	Usage      *FilesystemUsage `json:"usage,omitempty"`
+	Subvolumes []Subvolume      `json:"subvolumes,omitempty"`
+	Prune      *PruneResult     `json:"prune,omitempty"`
+	Retention  *RetentionReport `json:"retention,omitempty"`
+	Hooks      []HookRun        `json:"hooks,omitempty"` // snapshot hooks, see hooks.go
+	Dedup      *DedupResult     `json:"dedup,omitempty"`
+	Archive    *ArchiveResult   `json:"archive,omitempty"`
+	Verify     *VerifyResult    `json:"verify,omitempty"`
+	Check      *CheckResult     `json:"check,omitempty"`
+	Stream     *StreamResult    `json:"stream,omitempty"`
+	Trim       *TrimResult      `json:"trim,omitempty"`
+}
+
+type ScrubResult struct {
+	Status        string            `json:"status,omitempty"` // finished, running, aborted, interrupted
+	Duration      string            `json:"duration,omitempty"`
+	BytesScrubbed uint64            `json:"bytes_scrubbed"`
+	Errors        uint64            `json:"errors"`
+	ErrorCounts   map[string]uint64 `json:"error_counts,omitempty"` // by kind, e.g. csum, read, verify
+	Corrected     uint64            `json:"corrected"`
+	Uncorrectable uint64            `json:"uncorrectable"`
+	CorruptFiles  []CorruptFile     `json:"corrupt_files,omitempty"` // see corruption.go
+	Devices       []DeviceScrub     `json:"devices,omitempty"`       // scrubbed device by device, see scrub.go
+}
+
+type BalanceResult struct {
+	State      string  `json:"state"`    // running, paused, idle, done
+	Chunks     uint64  `json:"chunks"`   // balanced so far, or relocated once done
+	Total      uint64  `json:"total"`    // estimated while running
+	Progress   float64 `json:"progress"` // percent
+	Considered uint64  `json:"considered,omitempty"`
+}
+
+type CompsizeResult struct {
+	Files        uint64              `json:"files"`
+	DiskUsage    uint64              `json:"disk_usage"`
+	Uncompressed uint64              `json:"uncompressed"`
+	Referenced   uint64              `json:"referenced"`
+	Ratio        float64             `json:"ratio"` // disk usage / uncompressed, e.g. 0.52
+	Types        []CompsizeTypeUsage `json:"types"`
+}
+
+type CompsizeTypeUsage struct {
+	Type         string  `json:"type"` // none, zstd, zlib, lzo, prealloc
+	DiskUsage    uint64  `json:"disk_usage"`
+	Uncompressed uint64  `json:"uncompressed"`
+	Referenced   uint64  `json:"referenced"`
+	Ratio        float64 `json:"ratio"`
+}
+
+type PruneResult struct {
+	Planned int      `json:"planned"`
+	Deleted []string `json:"deleted"`
+	Failed  []string `json:"failed,omitempty"`
+}
+
+// outputParsers are matched against the command (flags left out) run by
+// runCommandAsync; the first prefix that matches parses its output.
+var outputParsers = []struct {
+	prefix string
+	parse  func(output string) *OperationResult
+}{
+	{"btrfs scrub", func(out string) *OperationResult {
+		if s := parseScrub(out); s != nil { return &OperationResult{Scrub: s} }
+		return nil
+	}},
+	{"btrfs balance", func(out string) *OperationResult {
+		if b := parseBalance(out); b != nil { return &OperationResult{Balance: b} }
+		return nil
+	}},
+	{"btrfs replace", func(out string) *OperationResult {
+		if r := parseReplaceStatus(out); r != nil { return &OperationResult{Replace: r} }
+		return nil
+	}},
+	{"btrfs filesystem usage", func(out string) *OperationResult {
+		// Only byte values (-b) can be parsed.
+		if u := parseFilesystemUsage(out); u.Total > 0 { return &OperationResult{Usage: u} }
+		return nil
+	}},
+	{"btrfs subvolume list", func(out string) *OperationResult {
+		if s := parseSubvolumeList(out); len(s) > 0 { return &OperationResult{Subvolumes: s} }
+		return nil
+	}},
+	{"btrfs check", func(out string) *OperationResult {
+		if c := parseCheck(out); c != nil { return &OperationResult{Check: c} }
+		return nil
+	}},
+	{"compsize", func(out string) *OperationResult {
+		if c := parseCompsize(out); c != nil { return &OperationResult{Compsize: c} }
+		return nil
+	}},
+	{"fstrim", func(out string) *OperationResult {
+		if t := parseFstrim(out); t != nil { return &OperationResult{Trim: t} }
+		return nil
+	}},
+	{"duperemove", func(out string) *OperationResult {
+		if d := parseDuperemove(out); d != nil { return &OperationResult{Dedup: d} }
+		return nil
+	}},
+}
+
+func parseCommandResult(cmdName string, args []string, output string) *OperationResult {
+	words := []string{cmdName}
+	for _, a := range args {
+		if !strings.HasPrefix(a, "-") { words = append(words, a) }
+	}
+	cmd := strings.Join(words, " ") + " "
+	for _, p := range outputParsers {
+		if strings.HasPrefix(cmd, p.prefix+" ") { return p.parse(output) }
+	}
+	return nil
+}
+
+// parseHumanSize reads sizes as printed by btrfs-progs and compsize
+// ("120.00GiB", "1.2G", "556M", "0.00B"); units are binary.
+func parseHumanSize(s string) (uint64, bool) {
+	s = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(s), "B"), "i")
+	mult := 1.0
+	if s != "" {
+		if i := strings.IndexByte("KMGTPE", s[len(s)-1]); i >= 0 {
+			for ; i >= 0; i-- { mult *= 1024 }
+			s = s[:len(s)-1]
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 { return 0, false }
+	return uint64(f * mult), true
+}
+
+// parseScrub reads `btrfs scrub start -B` and `btrfs scrub status`, both the
+// current "Key: value" layout and the older one-line summaries:
+//
+//	Status:           finished
+//	Total to scrub:   120.00GiB
+//	Error summary:    csum=12
+//	  Corrected:      10
+//	  Uncorrectable:  2
+//
+//	total bytes scrubbed: 1.00GiB with 0 errors
+//	error details: csum=3
+//	corrected errors: 3, uncorrectable errors: 0, unverified errors: 0
+func parseScrub(out string) *ScrubResult {
+	r := &ScrubResult{ErrorCounts: map[string]uint64{}}
+	found, scrubbed := false, false
+	var total, summaryErrors uint64
+	addCounts := func(s string) {
+		for _, f := range strings.Fields(s) {
+			kind, n, ok := strings.Cut(f, "=")
+			if !ok { continue }
+			v, _ := strconv.ParseUint(n, 10, 64)
+			r.ErrorCounts[kind] += v
+			r.Errors += v
+		}
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		// "scrub started at <date> and finished after 00:00:05"
+		if lower := strings.ToLower(line); strings.HasPrefix(lower, "scrub started at") || strings.HasPrefix(lower, "scrub resumed at") {
+			found = true
+			if _, after, ok := strings.Cut(lower, "finished after "); ok {
+				r.Status, r.Duration = "finished", after
+			} else if strings.Contains(lower, "running for") {
+				r.Status = "running"
+			} else if strings.Contains(lower, "aborted") || strings.Contains(lower, "interrupted") {
+				r.Status = "aborted"
+			}
+			continue
+		}
+		key, val, ok := strings.Cut(line, ":")
+		if !ok { continue }
+		val = strings.TrimSpace(val)
+		fields := strings.Fields(val)
+		switch strings.ToLower(key) {
+		case "status":
+			r.Status, found = val, true
+		case "duration":
+			r.Duration = val
+		case "total to scrub":
+			if len(fields) > 0 { total, _ = parseHumanSize(fields[0]) }
+			found = true
+		case "bytes scrubbed":
+			if len(fields) > 0 { r.BytesScrubbed, scrubbed = parseHumanSize(fields[0]) }
+		case "error summary", "error details":
+			found = true
+			if val != "no errors found" { addCounts(val) }
+		case "corrected":
+			r.Corrected, _ = strconv.ParseUint(val, 10, 64)
+		case "uncorrectable":
+			r.Uncorrectable, _ = strconv.ParseUint(val, 10, 64)
+		case "total bytes scrubbed":
+			// "1.00GiB with 0 errors"
+			found = true
+			if len(fields) > 0 { r.BytesScrubbed, scrubbed = parseHumanSize(fields[0]) }
+			if len(fields) > 2 && fields[1] == "with" { summaryErrors, _ = strconv.ParseUint(fields[2], 10, 64) }
+		case "corrected errors":
+			// "3, uncorrectable errors: 0, unverified errors: 0"
+			n, _, _ := strings.Cut(val, ",")
+			r.Corrected, _ = strconv.ParseUint(strings.TrimSpace(n), 10, 64)
+			r.Uncorrectable = parseKeyedNumber(val, "uncorrectable errors:")
+		}
+	}
+	if !found { return nil }
+	// A finished scrub only prints what it had to scrub, which is then what
+	// it scrubbed.
+	if !scrubbed && r.Status == "finished" { r.BytesScrubbed = total }
+	// Older versions print the total next to the bytes and the breakdown
+	// only when there were errors.
+	if len(r.ErrorCounts) == 0 { r.Errors, r.ErrorCounts = summaryErrors, nil }
+	return r
+}
+
+// parseCompsize reads the table compsize prints:
+//
+//	Processed 3356 files, 1001 regular extents (1034 refs), 2189 inline.
+//	Type       Perc     Disk Usage   Uncompressed Referenced
+//	TOTAL       52%      1.2G         2.3G         2.4G
+//	zstd        38%      694M         1.7G         1.8G
+func parseCompsize(out string) *CompsizeResult {
+	var r *CompsizeResult
+	var files uint64
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "Processed" {
+			files, _ = strconv.ParseUint(fields[1], 10, 64)
+			continue
+		}
+		if len(fields) != 5 || !strings.HasSuffix(fields[1], "%") { continue }
+		perc, err := strconv.ParseFloat(strings.TrimSuffix(fields[1], "%"), 64)
+		if err != nil { continue }
+		disk, _ := parseHumanSize(fields[2])
+		uncompressed, _ := parseHumanSize(fields[3])
+		referenced, _ := parseHumanSize(fields[4])
+		if r == nil { r = &CompsizeResult{Types: []CompsizeTypeUsage{}} }
+		if fields[0] == "TOTAL" {
+			r.DiskUsage, r.Uncompressed, r.Referenced, r.Ratio = disk, uncompressed, referenced, perc/100
+			continue
+		}
+		r.Types = append(r.Types, CompsizeTypeUsage{Type: fields[0], DiskUsage: disk, Uncompressed: uncompressed, Referenced: referenced, Ratio: perc / 100})
+	}
+	if r != nil { r.Files = files }
+	return r
+}
+
+// parseBalance reads `btrfs balance status` and the summary of a finished
+// `btrfs balance start` / `resume`:
+//
+//	Balance on '/mnt' is running
+//	2 out of about 10 chunks balanced (3 considered),  80% left
+//
+//	Done, had to relocate 5 out of 10 chunks
+func parseBalance(out string) *BalanceResult {
+	var r *BalanceResult
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "No balance found"):
+			r = &BalanceResult{State: "idle"}
+		case strings.HasPrefix(line, "Balance on ") && strings.HasSuffix(line, " is running"):
+			r = &BalanceResult{State: "running"}
+		case strings.HasPrefix(line, "Balance on ") && strings.HasSuffix(line, " is paused"):
+			r = &BalanceResult{State: "paused"}
+		case strings.HasPrefix(line, "Done, had to relocate") && len(fields) >= 8:
+			r = &BalanceResult{State: "done", Progress: 100}
+			r.Chunks, _ = strconv.ParseUint(fields[4], 10, 64)
+			r.Total, _ = strconv.ParseUint(fields[7], 10, 64)
+		case r != nil && len(fields) >= 6 && fields[1] == "out" && fields[3] == "about":
+			r.Chunks, _ = strconv.ParseUint(fields[0], 10, 64)
+			r.Total, _ = strconv.ParseUint(fields[4], 10, 64)
+			r.Considered = parseKeyedNumber(line, "(")
+			if _, left, ok := strings.Cut(line, "),"); ok {
+				pct, _, _ := strings.Cut(strings.TrimSpace(left), "%")
+				if n, err := strconv.ParseFloat(pct, 64); err == nil { r.Progress = 100 - n }
+			}
+		}
+	}
+	return r
+}
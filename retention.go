@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Retention Reports ---
+// Every retention run that deletes something leaves a report of what the
+// policy kept (grouped by age), what it deleted and how much that freed, so
+// a prune can be audited after its history entry has rotated out.
+
+const retentionReportsKept = 50
+
+type RetentionBucket struct {
+	Bucket string `json:"bucket"` // day, week, month, year, older
+	Count  int    `json:"count"`
+}
+
+type RetentionReport struct {
+	ID       int64             `json:"id"`
+	Job      string            `json:"job"`
+	Path     string            `json:"path"`
+	Policy   string            `json:"policy"`
+	Started  string            `json:"started"`
+	Duration string            `json:"duration"`
+	Kept     []RetentionBucket `json:"kept"`
+	Deleted  []PlannedDelete   `json:"deleted"`
+	Failed   []string          `json:"failed,omitempty"`
+	// FreedBytes is the exclusive size of the deleted snapshots, known only
+	// when quotas are enabled and reported sizes for all of them.
+	FreedBytes *uint64 `json:"freed_bytes,omitempty"`
+}
+
+var retentionBuckets = []struct {
+	name   string
+	maxAge time.Duration
+}{
+	{"day", 24 * time.Hour},
+	{"week", 7 * 24 * time.Hour},
+	{"month", 30 * 24 * time.Hour},
+	{"year", 365 * 24 * time.Hour},
+}
+
+func (c RetentionConfig) validate() error {
+	if !c.Enabled { return nil }
+	for _, t := range c.Tags {
+		if err := t.validate(); err != nil { return fmt.Errorf("tag %s: %v", t.Tag, err) }
+	}
+	if c.Value <= 0 { return fmt.Errorf("value must be positive") }
+	switch c.Mode {
+	case "count":
+	case "time":
+		switch c.Unit {
+		case "", "days", "weeks", "months", "years":
+		default: return fmt.Errorf("unknown unit %q (days, weeks, months or years)", c.Unit)
+		}
+	default: return fmt.Errorf("unknown mode %q (count or time)", c.Mode)
+	}
+	return nil
+}
+
+func describeRetentionPolicy(cfg RetentionConfig) string {
+	if cfg.Mode == "count" { return fmt.Sprintf("keep newest %d", cfg.Value) }
+	unit := cfg.Unit
+	if unit == "" { unit = "days" }
+	return fmt.Sprintf("keep %d %s", cfg.Value, unit)
+}
+
+// keptBuckets groups snaps by age as of now; empty buckets are left out.
+func keptBuckets(snaps []SnapInfo, now time.Time) []RetentionBucket {
+	counts := map[string]int{}
+	for _, s := range snaps {
+		bucket := "older"
+		for _, b := range retentionBuckets {
+			if now.Sub(s.Time) < b.maxAge {
+				bucket = b.name
+				break
+			}
+		}
+		counts[bucket]++
+	}
+	kept := []RetentionBucket{}
+	for _, b := range retentionBuckets {
+		if n := counts[b.name]; n > 0 { kept = append(kept, RetentionBucket{Bucket: b.name, Count: n}) }
+	}
+	if n := counts["older"]; n > 0 { kept = append(kept, RetentionBucket{Bucket: "older", Count: n}) }
+	return kept
+}
+
+// pruneWithReport deletes plan and accounts for it. Sizes have to be looked
+// up before the snapshots are gone.
+func pruneWithReport(job SnapshotJob, plan []PlannedDelete) *RetentionReport {
+	start := time.Now()
+	annotateSizes(plan)
+	result := deletePlanned("RETENTION", plan)
+
+	report := &RetentionReport{
+		ID:      start.UnixNano(),
+		Job:     job.ID,
+		Path:    job.Dest,
+		Policy:  describeRetentionPolicy(job.Retention),
+		Started: start.Format(time.RFC3339),
+		Kept:    []RetentionBucket{},
+		Deleted: []PlannedDelete{},
+		Failed:  result.Failed,
+	}
+	deleted := map[string]bool{}
+	for _, name := range result.Deleted { deleted[name] = true }
+	var freed uint64
+	sized := true
+	for _, p := range plan {
+		if !deleted[p.Name] { continue }
+		report.Deleted = append(report.Deleted, p)
+		if p.ExclusiveBytes == nil {
+			sized = false
+		} else {
+			freed += *p.ExclusiveBytes
+		}
+	}
+	if sized && len(report.Deleted) > 0 { report.FreedBytes = &freed }
+
+	// Whatever is still there afterwards is what the policy kept.
+	if snaps, err := listManagedSnapshots(job); err == nil {
+		report.Kept = keptBuckets(snaps, time.Now())
+	}
+	report.Duration = time.Since(start).Round(time.Millisecond).String()
+	return report
+}
+
+func (r *RetentionReport) summary() string {
+	kept := 0
+	var buckets []string
+	for _, b := range r.Kept {
+		kept += b.Count
+		buckets = append(buckets, fmt.Sprintf("%s %d", b.Bucket, b.Count))
+	}
+	msg := fmt.Sprintf("Deleted %d old snapshots (%s), kept %d", len(r.Deleted), r.Policy, kept)
+	if len(buckets) > 0 { msg += " (" + strings.Join(buckets, ", ") + ")" }
+	if r.FreedBytes != nil { msg += ", freed " + formatBytes(*r.FreedBytes) }
+	if len(r.Failed) > 0 { msg += fmt.Sprintf("; %d could not be deleted: %s", len(r.Failed), strings.Join(r.Failed, ", ")) }
+	return msg
+}
+
+func recordRetentionReport(report *RetentionReport) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.RetentionReports = append([]RetentionReport{*report}, state.RetentionReports...)
+	if len(state.RetentionReports) > retentionReportsKept { state.RetentionReports = state.RetentionReports[:retentionReportsKept] }
+	saveState()
+}
+
+// handleRetentionReports returns the latest reports, newest first,
+// optionally for one ?job= and at most ?limit= of them.
+func handleRetentionReports(w http.ResponseWriter, r *http.Request) {
+	job := r.URL.Query().Get("job")
+	limit := retentionReportsKept
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", 400)
+			return
+		}
+		limit = n
+	}
+
+	state.mu.Lock()
+	reports := []RetentionReport{}
+	for _, rep := range state.RetentionReports {
+		if len(reports) >= limit { break }
+		if job == "" || rep.Job == job { reports = append(reports, rep) }
+	}
+	state.mu.Unlock()
+	json.NewEncoder(w).Encode(reports)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// --- Retries ---
+// A scheduled run that failed for a passing reason (the destination was
+// briefly unmounted, the device was busy) doesn't have to wait for the next
+// fire: with retry.max_attempts above 1 in a job's schedule, a failed run is
+// tried again after backoff_minutes, doubling after every further failure up
+// to max_backoff_minutes, until an attempt succeeds or max_attempts runs
+// were made. Each attempt is a run of its own with the trigger "retry" and
+// its attempt number, so it shows in the log and counts in the job's stats.
+// When a retried run recovers or gives up, a job failure notification says
+// so. Manual runs aren't retried. A retry due outside the schedule's windows
+// waits for the next one, a regular fire in the meantime replaces it, and
+// pending retries are not kept across restarts (catch-up covers those,
+// see catchup.go).
+
+type RetryPolicy struct {
+	MaxAttempts       int `json:"max_attempts,omitempty"`        // including the first run; 0 or 1: no retries
+	BackoffMinutes    int `json:"backoff_minutes,omitempty"`     // before the first retry, default 5
+	MaxBackoffMinutes int `json:"max_backoff_minutes,omitempty"` // default 240
+}
+
+type pendingRetry struct {
+	Attempt int       `json:"attempt"`
+	At      time.Time `json:"at"`
+	timer   *time.Timer
+}
+
+const (
+	maxRetryAttempts       = 10
+	defaultRetryBackoff    = 5 * time.Minute
+	defaultMaxRetryBackoff = 4 * time.Hour
+)
+
+var retries = struct {
+	mu      sync.Mutex
+	pending map[string]*pendingRetry // by scheduled job name
+}{pending: map[string]*pendingRetry{}}
+
+// backoff is the wait after the attempt-th attempt failed.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d, max := defaultRetryBackoff, defaultMaxRetryBackoff
+	if p.BackoffMinutes > 0 { d = time.Duration(p.BackoffMinutes) * time.Minute }
+	if p.MaxBackoffMinutes > 0 { max = time.Duration(p.MaxBackoffMinutes) * time.Minute }
+	if max < d { max = d }
+	for i := 1; i < attempt && d < max; i++ { d *= 2 }
+	if d > max { d = max }
+	return d
+}
+
+func validateRetry(p RetryPolicy) error {
+	if p.MaxAttempts < 0 || p.BackoffMinutes < 0 || p.MaxBackoffMinutes < 0 { return fmt.Errorf("retry: values must not be negative") }
+	if p.MaxAttempts > maxRetryAttempts { return fmt.Errorf("retry: max_attempts is at most %d", maxRetryAttempts) }
+	if p.MaxBackoffMinutes > 0 && p.BackoffMinutes > p.MaxBackoffMinutes { return fmt.Errorf("retry: backoff_minutes is above max_backoff_minutes") }
+	return nil
+}
+
+// retryAfter follows up on run r, recorded with status: another attempt,
+// the outcome notification of a retried run, or nothing. Caller holds
+// state.mu.
+func retryAfter(r *JobRun, status string) {
+	if r.Trigger == "manual" { return }
+	var policy RetryPolicy
+	for _, j := range scheduledJobs(state.Config) {
+		if j.Name == r.Job { policy = j.Schedule.Retry }
+	}
+	if status != "Failed" {
+		if r.Attempt > 1 {
+			printDockerLog("SCHEDULER", "%s recovered on attempt %d", r.Job, r.Attempt)
+			go notify(newNotification(EventJobFailure, r.Job+" recovered", fmt.Sprintf("🔁 %s succeeded on attempt %d after failing: %s.", r.Job, r.Attempt, status)))
+		}
+		return
+	}
+	if r.Attempt >= policy.MaxAttempts {
+		if r.Attempt > 1 {
+			logWarn("SCHEDULER", "%s failed on all %d attempts", r.Job, r.Attempt)
+			go notify(newNotification(EventJobFailure, r.Job+" failed after retries", fmt.Sprintf("🔁 %s failed %d times in a row; it runs again when next scheduled.", r.Job, r.Attempt)))
+		}
+		return
+	}
+	delay := policy.backoff(r.Attempt)
+	printDockerLog("SCHEDULER", "%s failed on attempt %d of %d, retrying in %v", r.Job, r.Attempt, policy.MaxAttempts, delay)
+	scheduleRetry(r.Job, r.Attempt+1, delay)
+}
+
+// scheduleRetry makes attempt of job name due in delay, replacing a retry
+// already pending.
+func scheduleRetry(name string, attempt int, delay time.Duration) {
+	retries.mu.Lock()
+	defer retries.mu.Unlock()
+	if p := retries.pending[name]; p != nil { p.timer.Stop() }
+	p := &pendingRetry{Attempt: attempt, At: time.Now().Add(delay)}
+	p.timer = time.AfterFunc(delay, func() { runRetry(name, p) })
+	retries.pending[name] = p
+}
+
+// cancelRetry drops the pending retry of name, if any, e.g. because the
+// job runs anyway.
+func cancelRetry(name string) {
+	retries.mu.Lock()
+	defer retries.mu.Unlock()
+	if p := retries.pending[name]; p != nil {
+		p.timer.Stop()
+		delete(retries.pending, name)
+		printDockerLog("SCHEDULER", "Dropped retry %d of %s: the job runs again", p.Attempt, name)
+	}
+}
+
+func retryPending(name string) *pendingRetry {
+	retries.mu.Lock()
+	defer retries.mu.Unlock()
+	return retries.pending[name]
+}
+
+func runRetry(name string, p *pendingRetry) {
+	retries.mu.Lock()
+	if retries.pending[name] != p {
+		retries.mu.Unlock()
+		return
+	}
+	delete(retries.pending, name)
+	retries.mu.Unlock()
+
+	state.mu.Lock()
+	_, registered := state.cronIDs[name]
+	var job scheduledJob
+	for _, j := range scheduledJobs(state.Config) {
+		if j.Name == name { job = j }
+	}
+	blackouts := state.Config.Blackouts
+	cfg := state.Config
+	state.mu.Unlock()
+	if !registered || job.Run == nil { return } // unscheduled since
+	if skipLocked(cfg, name) { return }
+
+	now := time.Now()
+	if reason := blockedBy(job.Schedule.Windows, blackouts, now); reason != "" {
+		at, ok := nextAllowed(job.Schedule.Windows, blackouts, now)
+		if !ok { return }
+		printDockerLog("SCHEDULER", "Retry %d of %s due %s, waiting until %s", p.Attempt, name, reason, at.Format(time.RFC3339))
+		scheduleRetry(name, p.Attempt, time.Until(at))
+		return
+	}
+	r := newJobRun(name, "retry")
+	r.Attempt = p.Attempt
+	job.Run(r)
+	r.finish()
+}
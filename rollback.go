@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Snapshot Rollback ---
+
+type rollbackStep struct {
+	Description string `json:"description"`
+	Command     string `json:"command"`
+	do          func() error
+	undo        func() error
+}
+
+// rollbackMu ensures only one rollback runs at a time.
+var rollbackMu sync.Mutex
+
+// planRollback builds the ordered steps that swap a writable clone of the
+// snapshot in place of the live subvolume. The live subvolume is renamed
+// aside rather than deleted, so every step can be undone.
+func planRollback(job SnapshotJob, name string) ([]rollbackStep, []string, error) {
+	snap, err := snapshotRoot(job, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := os.Stat(snap); err != nil {
+		return nil, nil, fmt.Errorf("snapshot not found: %v", err)
+	}
+
+	live := job.Source
+	dest := filepath.Clean(job.Dest)
+	if live == "" {
+		return nil, nil, fmt.Errorf("snapshot source not configured")
+	}
+	live = filepath.Clean(live)
+	if _, err := os.Stat(live); err != nil {
+		return nil, nil, fmt.Errorf("live subvolume not accessible: %v", err)
+	}
+	if isMountPoint(live) {
+		return nil, nil, fmt.Errorf("%s is a mount point and cannot be renamed; roll back via the default subvolume instead", live)
+	}
+
+	var warnings []string
+	ts := time.Now().Format("20060102-150405")
+	clone := filepath.Join(filepath.Dir(live), fmt.Sprintf(".%s.rollback-%s", filepath.Base(live), ts))
+	aside := fmt.Sprintf("%s.pre-rollback-%s", live, ts)
+
+	steps := []rollbackStep{
+		{
+			Description: "Create writable clone of " + name,
+			Command:     formatCommand("btrfs", "subvolume", "snapshot", snap, clone),
+			do: func() error {
+				out, err := exec.Command("btrfs", "subvolume", "snapshot", snap, clone).CombinedOutput()
+				if err != nil { return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out))) }
+				return nil
+			},
+			undo: func() error { return btrfsFS.DeleteSubvolume(clone) },
+		},
+		{
+			Description: "Move live subvolume aside",
+			Command:     formatCommand("mv", live, aside),
+			do:          func() error { return os.Rename(live, aside) },
+			undo:        func() error { return os.Rename(aside, live) },
+		},
+		{
+			Description: "Move clone into place",
+			Command:     formatCommand("mv", clone, live),
+			do:          func() error { return os.Rename(clone, live) },
+			undo:        func() error { return os.Rename(live, clone) },
+		},
+	}
+
+	// When snapshots are stored inside the live subvolume they moved aside
+	// with it; carry the destination over so snapshots stay where the config
+	// expects them. The clone only has an empty placeholder directory there.
+	if rel, err := filepath.Rel(live, dest); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+		oldDest := filepath.Join(aside, rel)
+		newDest := filepath.Join(live, rel)
+		warnings = append(warnings, "snapshot destination is inside the live subvolume and will be moved into the restored one")
+		steps = append(steps, rollbackStep{
+			Description: "Move snapshot destination into restored subvolume",
+			Command:     formatCommand("mv", oldDest, newDest),
+			do: func() error {
+				os.Remove(newDest)
+				os.MkdirAll(filepath.Dir(newDest), 0755)
+				return os.Rename(oldDest, newDest)
+			},
+			undo: func() error { return os.Rename(newDest, oldDest) },
+		})
+	}
+
+	warnings = append(warnings, fmt.Sprintf("previous live subvolume is kept at %s; delete it manually once satisfied", aside))
+	return steps, warnings, nil
+}
+
+func handleSnapshotRollback(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var req struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	job, err := jobFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	target := job.ID + "/" + name
+	steps, warnings, err := planRollback(job, name)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if req.Token == "" {
+		token, expires := issueConfirmToken("rollback", target)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "confirm",
+			"token":    token,
+			"expires":  expires.Format(time.RFC3339),
+			"steps":    steps,
+			"warnings": warnings,
+		})
+		return
+	}
+	if refuseLocked(w, job.Source, job.Dest) { return }
+	if !consumeConfirmToken(req.Token, "rollback", target) {
+		http.Error(w, "Invalid or expired confirmation token", 403)
+		return
+	}
+	if !rollbackMu.TryLock() {
+		http.Error(w, "Another rollback is in progress", 409)
+		return
+	}
+
+	// Rolling back the state subvolume restores an older config; pick it up
+	// before the history update writes the in-memory state back out.
+	var onSuccess func()
+	if job.ID == stateJobID { onSuccess = reloadConfigFromDisk }
+
+	id := startHistory("ROLLBACK", "⏪", name, "Starting rollback")
+	go func() {
+		defer rollbackMu.Unlock()
+		// Nothing may write the in-memory state into the state subvolume
+		// while it is being swapped.
+		if job.ID == stateJobID {
+			pausePersistence()
+			defer resumePersistence()
+		}
+		runRollback(id, steps, onSuccess)
+	}()
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
+}
+
+// runRollback executes steps in order. On the first failure all completed
+// steps are undone in reverse so the system ends up where it started.
+// onSuccess, if set, runs after all steps succeeded.
+func runRollback(id int64, steps []rollbackStep, onSuccess func()) {
+	start := time.Now()
+	var log strings.Builder
+	status := "Success"
+
+	for i, step := range steps {
+		printDockerLog("ROLLBACK", "[%d/%d] %s: %s", i+1, len(steps), step.Description, step.Command)
+		fmt.Fprintf(&log, "[%d/%d] %s\n    $ %s\n", i+1, len(steps), step.Description, step.Command)
+		if err := step.do(); err != nil {
+			status = "Failed"
+			fmt.Fprintf(&log, "    ❌ %v\n\nUndoing completed steps:\n", err)
+			for j := i - 1; j >= 0; j-- {
+				if uerr := steps[j].undo(); uerr != nil {
+					fmt.Fprintf(&log, "    ⚠️ undo '%s' failed: %v\n", steps[j].Description, uerr)
+				} else {
+					fmt.Fprintf(&log, "    ↩️ undid '%s'\n", steps[j].Description)
+				}
+			}
+			break
+		}
+		log.WriteString("    ✅ ok\n")
+	}
+
+	printDockerLog("ROLLBACK", "Finished: %s", status)
+	if status == "Success" && onSuccess != nil { onSuccess() }
+	duration := time.Since(start).Round(time.Millisecond)
+	updateHistory(id, func(e *LogEntry) {
+		e.Status = status
+		e.Output = log.String()
+		e.Duration = duration.String()
+	})
+}
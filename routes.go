@@ -0,0 +1,184 @@
+package main
+
+import "net/http"
+
+// --- Routes ---
+// Every endpoint with the role it requires (see access.go). The versioned
+// API in apiv1.go maps onto the same handlers.
+
+type route struct {
+	Pattern string
+	Role    string
+	Handler http.HandlerFunc
+}
+
+func routeTable() []route {
+	return []route{
+		{"/", roleViewer, handleIndex},
+		{"GET /snapshots", roleViewer, handleSnapshotsPage},
+		{"GET /devices", roleViewer, handleDevicesPage},
+		{"GET /history", roleViewer, handleHistoryPage},
+		{"GET /api/config", roleViewer, handleConfig},
+		{"POST /api/config", roleAdmin, handleConfig},
+		{"GET /api/config/export", roleAdmin, handleExportConfig},
+		{"POST /api/config/import", roleAdmin, handleImportConfig},
+		{"/api/history", roleViewer, handleHistory},
+		{"GET /api/history/export", roleViewer, handleHistoryExport},
+		{"GET /api/history/{id}/output", roleViewer, handleHistoryOutput},
+		{"/api/events", roleViewer, handleEvents},
+		{"GET /ws", roleViewer, handleWebSocket},
+		{"POST /api/logs/clear", roleAdmin, handleClearLogs},
+		{"/api/usage", roleViewer, handleUsage},
+		{"GET /api/usage/history", roleViewer, handleUsageHistory},
+		{"GET /api/compression/history", roleViewer, handleCompressionHistory},
+		{"GET /api/reports/latest", roleViewer, handleLatestReport},
+		{"GET /api/health", roleViewer, handleHealth},
+		{"GET /api/kernel-events", roleViewer, handleKernelEvents},
+		{"GET /api/rules", roleViewer, handleGetRules},
+		{"PUT /api/rules", roleAdmin, handlePutRules},
+		{"DELETE /api/rules/hold", roleAdmin, handleReleaseBalanceHold},
+		{"GET /api/version", roleViewer, handleVersion},
+		{"GET /api/capabilities", roleViewer, handleCapabilities},
+		{"GET /api/debug/logs", roleAdmin, handleDebugLogs},
+		{"GET /api/metrics", roleViewer, handleMetrics},
+		{"/api/schedules/preview", roleViewer, handleSchedulePreview},
+		{"POST /api/schedule/validate", roleViewer, handleValidateSchedule},
+		{"GET /api/advisor/space", roleViewer, handleSpaceAdvisor},
+		{"POST /api/notifications/test", roleOperator, handleTestNotification},
+		{"POST /api/jobs/{id}/kill", roleOperator, handleKillCommand},
+		{"GET /api/jobs", roleViewer, handleListJobs},
+		{"GET /api/jobs/{id}/runs", roleViewer, handleJobRuns},
+
+		// Access Control
+		{"GET /api/access/me", roleViewer, handleAccessMe},
+		{"GET /api/access/users", roleAdmin, handleListAccessUsers},
+		{"POST /api/access/users", roleAdmin, handleSaveAccessUser},
+		{"DELETE /api/access/users/{name}", roleAdmin, handleDeleteAccessUser},
+		{"GET /api/audit", roleAdmin, handleAudit},
+		{"GET /api/audit/export", roleAdmin, handleAuditExport},
+
+		// Snapshot Management
+		{"/api/snapshots/list", roleViewer, handleListSnapshots},
+		{"POST /api/snapshots/delete", roleAdmin, handleDeleteSnapshot},
+		{"POST /api/snapshots/retention", roleAdmin, handleRunRetention},
+		{"POST /api/snapshots/pin", roleOperator, handlePinSnapshot},
+		{"DELETE /api/snapshots/pin", roleOperator, handlePinSnapshot},
+		{"GET /api/snapshots/trash", roleViewer, handleListTrash},
+		{"POST /api/snapshots/trash/restore", roleAdmin, handleRestoreTrash},
+		{"DELETE /api/snapshots/trash", roleAdmin, handleEmptyTrash},
+		{"GET /api/retention/reports", roleViewer, handleRetentionReports},
+		{"GET /api/snapshots/diff", roleViewer, handleSnapshotDiff},
+		{"GET /api/snapshots/{name}/ls", roleViewer, handleSnapshotLs},
+		{"GET /api/snapshots/{name}/archive", roleViewer, handleSnapshotArchive},
+		{"POST /api/snapshots/{name}/restore", roleAdmin, handleSnapshotRestore},
+		{"POST /api/snapshots/{name}/rollback", roleAdmin, handleSnapshotRollback},
+		{"POST /api/verify", roleOperator, handleActionVerify},
+
+		// Maintenance Locks
+		{"GET /api/locks", roleViewer, handleListLocks},
+		{"POST /api/locks", roleAdmin, handleCreateLock},
+		{"DELETE /api/locks/{uuid}", roleAdmin, handleReleaseLock},
+
+		// Quotas
+		{"POST /api/quota/enable", roleAdmin, handleQuotaEnable},
+		{"GET /api/qgroups", roleViewer, handleListQgroups},
+		{"POST /api/qgroups/limit", roleAdmin, handleQgroupLimit},
+		{"POST /api/qgroups/cleanup", roleAdmin, handleCleanupQgroups},
+
+		// Subvolumes
+		{"GET /api/subvolumes", roleViewer, handleListSubvolumes},
+		{"GET /api/subvolumes/graph", roleViewer, handleSubvolumeGraph},
+		{"POST /api/subvolumes", roleAdmin, handleCreateSubvolume},
+		{"DELETE /api/subvolumes", roleAdmin, handleDeleteSubvolume},
+		{"POST /api/subvolumes/default", roleAdmin, handleSetDefaultSubvolume},
+
+		// Inspect
+		{"GET /api/inspect/rootid", roleViewer, handleInspectRootID},
+		{"GET /api/inspect/subvolid-resolve", roleViewer, handleInspectSubvolID},
+		{"GET /api/inspect/inode-resolve", roleViewer, handleInspectInode},
+		{"GET /api/inspect/logical-resolve", roleViewer, handleInspectLogical},
+		{"GET /api/inspect/scrub-errors", roleViewer, handleInspectScrubErrors},
+		{"GET /api/scrub/errors", roleViewer, handleScrubErrors},
+
+		// Devices
+		{"GET /api/filesystems/discover", roleViewer, handleDiscoverFilesystems},
+		{"GET /api/filesystem", roleViewer, handleFilesystem},
+		{"PUT /api/filesystem/label", roleAdmin, handleSetLabel},
+		{"POST /api/filesystem/resize", roleAdmin, handleResize},
+		{"GET /api/devices", roleViewer, handleListDevices},
+		{"POST /api/devices/add", roleAdmin, handleDeviceAdd},
+		{"POST /api/devices/remove", roleAdmin, handleDeviceRemove},
+		{"POST /api/check", roleAdmin, handleCheck},
+		{"GET /api/convert/check", roleViewer, handleConvertCheck},
+		{"GET /api/convert", roleViewer, handleConvertStatus},
+		{"POST /api/convert", roleAdmin, handleConvertStart},
+		{"POST /api/convert/resume", roleAdmin, handleConvertResume},
+		{"GET /api/replace/status", roleViewer, handleReplaceStatus},
+		{"POST /api/replace/start", roleAdmin, handleReplaceStart},
+		{"POST /api/replace/cancel", roleAdmin, handleReplaceCancel},
+
+		// Replace Runbook
+		{"GET /api/runbook", roleViewer, handleGetRunbook},
+		{"POST /api/runbook/replace", roleAdmin, handleStartRunbook},
+		{"POST /api/runbook/resume", roleAdmin, handleResumeRunbook},
+		{"POST /api/runbook/abort", roleAdmin, handleAbortRunbook},
+
+		// Snapshot Jobs
+		{"GET /api/snapshot-jobs", roleViewer, handleListSnapshotJobs},
+		{"POST /api/snapshot-jobs", roleAdmin, handleCreateSnapshotJob},
+		{"GET /api/snapshot-jobs/{id}", roleViewer, handleGetSnapshotJob},
+		{"PUT /api/snapshot-jobs/{id}", roleAdmin, handleUpdateSnapshotJob},
+		{"DELETE /api/snapshot-jobs/{id}", roleAdmin, handleDeleteSnapshotJob},
+		{"POST /api/snapshot-jobs/{id}/adopt/preview", roleViewer, handleAdoptPreview},
+
+		// Receive
+		{"POST /api/receive", roleOperator, handleReceiveSnapshot},
+		{"GET /api/receive/quarantine", roleViewer, handleListQuarantine},
+		{"DELETE /api/receive/quarantine/{upload}", roleAdmin, handleDiscardQuarantine},
+
+		// Archive Tier
+		{"POST /api/archive", roleOperator, handleActionArchive},
+		{"GET /api/archive/snapshots", roleViewer, handleListArchive},
+		{"POST /api/streams", roleOperator, handleActionStreams},
+		{"GET /api/streams", roleViewer, handleListStreams},
+		{"POST /api/streams/restore", roleAdmin, handleStreamRestore},
+		{"GET /api/streams/catalog", roleAdmin, handleBrowseStreams},
+
+		// Actions
+		{"POST /api/action/snapshot", roleOperator, handleActionSnapshot},
+		{"POST /api/action/scrub", roleOperator, handleActionScrub},
+		{"POST /api/action/balance", roleOperator, handleActionBalance},
+		{"GET /api/balance/presets", roleViewer, handleBalancePresets},
+		{"GET /api/status/balance", roleViewer, handleBalanceStatus},
+		{"POST /api/action/dedup", roleOperator, handleActionDedup},
+		{"GET /api/dedup/bees", roleViewer, handleBeesStatus},
+		{"POST /api/action/defrag", roleOperator, handleActionDefrag},
+		{"/api/action/compsize", roleOperator, handleActionCompsize},
+		{"POST /api/action/trim", roleOperator, handleActionTrim},
+		{"/api/action/usage", roleOperator, handleActionUsage},
+		{"/api/action/subvolumes", roleOperator, handleActionSubvolumes},
+		{"GET /api/compression", roleViewer, handleGetCompression},
+		{"POST /api/compression", roleAdmin, handleSetCompression},
+		{"POST /api/action/purge_all", roleAdmin, handlePurgeAllSnapshots},
+
+		// Temporary Access Links
+		{"POST /api/share", roleAdmin, handleCreateShare},
+		{"POST /api/share/revoke", roleAdmin, handleRevokeShares},
+		{"GET /share/file", rolePublic, handleSharedFile},
+		{"GET /share/status", rolePublic, handleSharedStatus},
+		{"GET /status", rolePublic, handlePublicStatus},
+		{"GET /healthz", rolePublic, handleHealthz},
+		{"GET /readyz", rolePublic, handleReadyz},
+
+		// Agents
+		{"GET /api/agents", roleViewer, handleListAgents},
+		{"GET /api/agents/overview", roleViewer, handleAgentsOverview},
+		{"/api/agents/{name}/{path...}", roleViewer, handleAgentProxy}, // checks the forwarded route's role
+	}
+}
+
+func registerRoutes(mux *http.ServeMux) {
+	for _, rt := range routeTable() { mux.HandleFunc(rt.Pattern, logged(audited(withRole(rt.Role, rt.Handler)))) }
+	for _, rt := range apiV1Routes() { mux.HandleFunc(rt.Method+" "+apiV1Prefix+rt.Path, logged(audited(withRole(rt.Role, rt.Handler)))) }
+	mux.HandleFunc(apiV1Prefix+"/", logged(handleAPIv1Unmatched))
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Remediation Rules ---
+// Rules turn what the health watchdog sees into actions. After each check
+// they are evaluated against the newest scrub's counts (once per scrub),
+// the growth of the device error counters since the previous check, and the
+// target drive's usage. A rule whose condition holds runs its actions:
+// notify; pause_balance, which pauses a running balance and holds the
+// scheduled one until the hold is released; and balance, a balance with the
+// rule's filters (default -dusage=20). Every firing is logged as RULE.
+//
+// Each rule has an error budget: it acts at most max_per_day times in 24
+// hours (default 3) and not within cooldown_minutes (default 60) of its last
+// firing. With the budget spent it only notifies, so a balance that doesn't
+// help isn't repeated all day.
+
+type RemediationRule struct {
+	ID              string        `json:"id"`
+	Enabled         bool          `json:"enabled"`
+	When            RuleCondition `json:"when"`
+	Actions         []string      `json:"actions"`                    // notify, pause_balance, balance
+	BalanceFilters  []string      `json:"balance_filters,omitempty"`  // for balance, default -dusage=20
+	CooldownMinutes int           `json:"cooldown_minutes,omitempty"` // default 60
+	MaxPerDay       int           `json:"max_per_day,omitempty"`      // default 3
+}
+
+type RuleCondition struct {
+	Metric string  `json:"metric"` // see ruleMetrics
+	Op     string  `json:"op"`     // >, >=, <, <=
+	Value  float64 `json:"value"`
+}
+
+// BalanceHold keeps the scheduled balance from running, set by a rule.
+type BalanceHold struct {
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+	Since  string `json:"since"` // RFC 3339
+}
+
+var ruleMetrics = map[string]string{
+	"scrub_errors":             "errors found by the newest scrub",
+	"scrub_corrected":          "errors the newest scrub corrected",
+	"scrub_uncorrectable":      "errors the newest scrub could not correct",
+	"write_io_errs_increase":   "growth of write_io_errs over all devices since the previous check",
+	"read_io_errs_increase":    "growth of read_io_errs",
+	"flush_io_errs_increase":   "growth of flush_io_errs",
+	"corruption_errs_increase": "growth of corruption_errs",
+	"generation_errs_increase": "growth of generation_errs",
+	"unallocated_percent":      "unallocated space of the target drive in percent",
+	"free_percent":             "free space of the target drive in percent",
+	"metadata_percent":         "how full the metadata chunks are in percent",
+}
+
+var ruleOps = map[string]bool{">": true, ">=": true, "<": true, "<=": true}
+
+var ruleActions = map[string]bool{"notify": true, "pause_balance": true, "balance": true}
+
+const (
+	defaultRuleCooldown  = 60 * time.Minute
+	defaultRuleMaxPerDay = 3
+)
+
+var defaultRuleBalanceFilters = []string{"-dusage=20"}
+
+// rulesEval is what evaluation compares against: the newest scrub entry
+// seen and the device counters at the previous check.
+var rulesEval = struct {
+	mu        sync.Mutex
+	lastScrub int64
+	counters  map[string]uint64
+}{}
+
+func (r RemediationRule) cooldown() time.Duration {
+	if r.CooldownMinutes <= 0 { return defaultRuleCooldown }
+	return time.Duration(r.CooldownMinutes) * time.Minute
+}
+
+func (r RemediationRule) maxPerDay() int {
+	if r.MaxPerDay <= 0 { return defaultRuleMaxPerDay }
+	return r.MaxPerDay
+}
+
+func (r RemediationRule) balanceFilters() []string {
+	if len(r.BalanceFilters) == 0 { return defaultRuleBalanceFilters }
+	return r.BalanceFilters
+}
+
+func (c RuleCondition) holds(v float64) bool {
+	switch c.Op {
+	case ">": return v > c.Value
+	case ">=": return v >= c.Value
+	case "<": return v < c.Value
+	case "<=": return v <= c.Value
+	}
+	return false
+}
+
+func (c RuleCondition) String() string {
+	return fmt.Sprintf("%s %s %g", c.Metric, c.Op, c.Value)
+}
+
+func validateRules(rules []RemediationRule) error {
+	seen := map[string]bool{}
+	for _, r := range rules {
+		if r.ID == "" || strings.ContainsAny(r.ID, " /") { return fmt.Errorf("rule id %q must be set and contain no spaces or slashes", r.ID) }
+		if seen[r.ID] { return fmt.Errorf("duplicate rule id %q", r.ID) }
+		seen[r.ID] = true
+		if _, ok := ruleMetrics[r.When.Metric]; !ok { return fmt.Errorf("rule %s: unknown metric %q", r.ID, r.When.Metric) }
+		if !ruleOps[r.When.Op] { return fmt.Errorf("rule %s: op must be >, >=, < or <=", r.ID) }
+		if len(r.Actions) == 0 { return fmt.Errorf("rule %s: no actions", r.ID) }
+		for _, a := range r.Actions {
+			if !ruleActions[a] { return fmt.Errorf("rule %s: unknown action %q", r.ID, a) }
+		}
+		for _, f := range r.BalanceFilters {
+			if len(f) < 4 || f[0] != '-' || !strings.ContainsRune("dms", rune(f[1])) || strings.ContainsAny(f, " \t") {
+				return fmt.Errorf("rule %s: invalid balance filter %q, e.g. -dusage=20", r.ID, f)
+			}
+		}
+		if r.CooldownMinutes < 0 || r.MaxPerDay < 0 { return fmt.Errorf("rule %s: values must not be negative", r.ID) }
+	}
+	return nil
+}
+
+// gatherRuleInputs returns the current value of every metric that has one:
+// scrub counts only for a scrub not evaluated before, counter increases
+// only from the second check on.
+func gatherRuleInputs(path string) map[string]float64 {
+	inputs := map[string]float64{}
+	var scrub *ScrubResult
+	var scrubID int64
+	state.mu.Lock()
+	for _, e := range state.History {
+		if e.Result == nil || e.Result.Scrub == nil || strings.HasSuffix(e.Status, "...") { continue }
+		scrub, scrubID = e.Result.Scrub, e.ID
+		break
+	}
+	state.mu.Unlock()
+
+	out, _ := exec.Command("btrfs", "device", "stats", path).CombinedOutput()
+	counters := map[string]uint64{}
+	for _, devCounters := range parseDeviceStats(string(out)) {
+		for name, v := range devCounters { counters[name] += v }
+	}
+
+	rulesEval.mu.Lock()
+	if scrub != nil && scrubID != rulesEval.lastScrub {
+		// The scrub logged before the first check is only the baseline.
+		if rulesEval.counters != nil {
+			inputs["scrub_errors"], inputs["scrub_corrected"], inputs["scrub_uncorrectable"] = float64(scrub.Errors), float64(scrub.Corrected), float64(scrub.Uncorrectable)
+		}
+		rulesEval.lastScrub = scrubID
+	}
+	if rulesEval.counters != nil && len(counters) > 0 {
+		for name, v := range counters {
+			// Counters only go down when reset with device stats -z.
+			if prev, ok := rulesEval.counters[name]; ok && v >= prev { inputs[name+"_increase"] = float64(v - prev) }
+		}
+	}
+	if len(counters) > 0 || rulesEval.counters == nil { rulesEval.counters = counters }
+	rulesEval.mu.Unlock()
+
+	if usage, err := getFilesystemUsage(path); err == nil && usage.Total > 0 {
+		inputs["unallocated_percent"] = float64(usage.DeviceUnallocated) * 100 / float64(usage.Total)
+		inputs["free_percent"] = float64(usage.Free) * 100 / float64(usage.Total)
+		for _, c := range usage.Chunks {
+			if c.Type == "Metadata" && c.Size > 0 { inputs["metadata_percent"] = float64(c.Used) * 100 / float64(c.Size) }
+		}
+	}
+	return inputs
+}
+
+// evaluateRules fires every enabled rule whose condition holds; called by
+// the health watchdog after each check.
+func evaluateRules() {
+	state.mu.Lock()
+	rules := state.Config.Rules
+	path := state.Config.TargetDrive
+	state.mu.Unlock()
+	if path == "" || len(rules) == 0 { return }
+	inputs := gatherRuleInputs(path)
+	now := time.Now()
+	for _, r := range rules {
+		if !r.Enabled { continue }
+		if v, ok := inputs[r.When.Metric]; ok && r.When.holds(v) { fireRule(r, path, v, now) }
+	}
+}
+
+// recentFirings returns when rule acted in the 24 hours before now, oldest
+// first, dropping older ones. Called with state.mu held.
+func recentFirings(rule string, now time.Time) []time.Time {
+	var times []time.Time
+	var kept []string
+	for _, s := range state.RuleFirings[rule] {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil || now.Sub(t) >= 24*time.Hour { continue }
+		times, kept = append(times, t), append(kept, s)
+	}
+	if len(kept) == 0 { delete(state.RuleFirings, rule) } else { state.RuleFirings[rule] = kept }
+	return times
+}
+
+func fireRule(r RemediationRule, path string, v float64, now time.Time) {
+	state.mu.Lock()
+	if state.RuleFirings == nil { state.RuleFirings = map[string][]string{} }
+	firings := recentFirings(r.ID, now)
+	if n := len(firings); n > 0 && now.Sub(firings[n-1]) < r.cooldown() {
+		state.mu.Unlock()
+		return
+	}
+	spent := len(firings) >= r.maxPerDay()
+	if !spent { state.RuleFirings[r.ID] = append(state.RuleFirings[r.ID], now.UTC().Format(time.RFC3339)) }
+	held := state.BalanceHold != nil
+	saveState()
+	state.mu.Unlock()
+
+	lines := []string{fmt.Sprintf("%s (is %.4g)", r.When, v)}
+	status, notifyAction := "Success", false
+	for _, a := range r.Actions {
+		if a == "notify" {
+			notifyAction = true
+			continue
+		}
+		if spent {
+			lines = append(lines, fmt.Sprintf("⏭️ %s: the error budget of %d actions per day is spent", a, r.maxPerDay()))
+			status = "Warning"
+			continue
+		}
+		switch a {
+		case "pause_balance":
+			state.mu.Lock()
+			if state.BalanceHold == nil {
+				state.BalanceHold = &BalanceHold{Rule: r.ID, Reason: lines[0], Since: now.UTC().Format(time.RFC3339)}
+				saveState()
+			}
+			state.mu.Unlock()
+			held = true
+			lines = append(lines, "✋ Scheduled balances are held until the hold is released")
+			if balanceBusy(path) == "running" {
+				runCommandAsync("BALANCE PAUSE", "⏸️", path, "btrfs", "balance", "pause", path)
+				lines = append(lines, "⏸️ Paused the running balance")
+			}
+		case "balance":
+			switch {
+			case held: lines, status = append(lines, "⏭️ balance: balances are held"), "Warning"
+			case balanceBusy(path) != "": lines = append(lines, "⏭️ balance: a balance is already "+balanceBusy(path))
+			case deviceOpRunning(path) != "": lines, status = append(lines, "⏭️ balance: a "+deviceOpRunning(path)+" is running"), "Warning"
+			case lockedFor(path) != nil: lines, status = append(lines, "⏭️ balance: "+lockedFor(path).message()), "Warning"
+			default:
+				args := balanceStartArgs(BalancePreset{Filters: r.balanceFilters()}, path)
+				runCommandAsync("RULE BALANCE", "⚖️", path, "btrfs", args...)
+				lines = append(lines, "⚖️ Started "+formatCommand("btrfs", args...))
+			}
+		}
+	}
+	msg := strings.Join(lines, "\n")
+	printDockerLog("RULES", "Rule %s fired: %s", r.ID, strings.Join(lines, "; "))
+	logHistory("RULE", "🤖", path+" ➡️ "+r.ID, status, msg)
+	if notifyAction { go notify(newNotification(EventRule, "Rule "+r.ID+" fired", fmt.Sprintf("%s:\n%s", path, msg))) }
+}
+
+// balanceHeld returns the hold on scheduled balances, if any.
+func balanceHeld() *BalanceHold {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.BalanceHold
+}
+
+// --- Handlers ---
+
+func handleGetRules(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	state.mu.Lock()
+	rules := state.Config.Rules
+	if rules == nil { rules = []RemediationRule{} }
+	budgets := map[string]int{}
+	for _, rule := range rules {
+		n := 0
+		for _, s := range state.RuleFirings[rule.ID] {
+			if t, err := time.Parse(time.RFC3339, s); err == nil && now.Sub(t) < 24*time.Hour { n++ }
+		}
+		budgets[rule.ID] = rule.maxPerDay() - n
+	}
+	hold := state.BalanceHold
+	state.mu.Unlock()
+	metrics := make([]string, 0, len(ruleMetrics))
+	for m := range ruleMetrics { metrics = append(metrics, m) }
+	sort.Strings(metrics)
+	json.NewEncoder(w).Encode(map[string]interface{}{"rules": rules, "budget_left": budgets, "balance_hold": hold, "metrics": metrics})
+}
+
+// handlePutRules replaces the rules.
+func handlePutRules(w http.ResponseWriter, r *http.Request) {
+	var rules []RemediationRule
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), 400)
+		return
+	}
+	state.mu.Lock()
+	cfg := state.Config
+	state.mu.Unlock()
+	cfg.Rules = rules
+	if err := validateConfig(cfg); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	applyConfig(cfg, "rules change")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// handleReleaseBalanceHold lets scheduled balances run again.
+func handleReleaseBalanceHold(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	hold := state.BalanceHold
+	state.BalanceHold = nil
+	saveState()
+	state.mu.Unlock()
+	if hold == nil {
+		http.Error(w, "Scheduled balances are not held", 404)
+		return
+	}
+	logHistory("RULE", "🤖", "balance hold ➡️ "+hold.Rule, "Success", "Released the hold on scheduled balances set "+hold.Since+": "+hold.Reason)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "released"})
+}
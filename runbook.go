@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Replace Runbook ---
+// Walks through replacing a failing disk step by step. The runbook and the
+// outcome of every step are checkpointed in state.json, so after a restart it
+// continues with the step it was in; every step is written so that running
+// it again after an interruption is safe. A failed step stops the runbook
+// until it is resumed (retrying that step) or aborted.
+//
+// With a replacement at least as large as the old disk, `btrfs replace`
+// copies onto it directly. A smaller one is added first and the old disk is
+// removed afterwards, which moves its data onto the remaining devices.
+
+type RunbookStep struct {
+	Name     string `json:"name"`
+	Title    string `json:"title"`
+	Status   string `json:"status"` // pending, running, done, skipped, failed
+	Started  string `json:"started,omitempty"`
+	Finished string `json:"finished,omitempty"`
+	Output   string `json:"output,omitempty"`
+}
+
+type ReplaceRunbook struct {
+	ID       string        `json:"id"`
+	Path     string        `json:"path"`
+	Source   Device        `json:"source"`
+	Target   string        `json:"target"`
+	Force    bool          `json:"force"`
+	Strategy string        `json:"strategy"` // replace, add-remove
+	Status   string        `json:"status"`   // running, failed, aborted, done
+	Current  int           `json:"current"`  // index of the step being run or to run next
+	Steps    []RunbookStep `json:"steps"`
+	Error    string        `json:"error,omitempty"`
+	Created  string        `json:"created"`
+	Updated  string        `json:"updated"`
+}
+
+var runbookStrategies = map[string][]string{
+	"replace":    {"smart", "prepare", "replace", "monitor", "verify", "scrub"},
+	"add-remove": {"smart", "prepare", "add", "remove_old", "scrub"},
+}
+
+var runbookTitles = map[string]string{
+	"smart":      "Check SMART health of the old device",
+	"prepare":    "Check the replacement device",
+	"replace":    "Start btrfs replace",
+	"monitor":    "Wait for the replace to finish",
+	"verify":     "Verify the old device is gone",
+	"add":        "Add the replacement device",
+	"remove_old": "Remove the old device (moves its data)",
+	"scrub":      "Scrub to verify all data",
+}
+
+// runbookStepFunc runs one step. progress replaces the live output shown in
+// the history while the step runs; the returned text is kept with the step.
+type runbookStepFunc func(rb ReplaceRunbook, progress func(string)) (out string, skipped bool, err error)
+
+var runbookSteps = map[string]runbookStepFunc{
+	"smart":      runbookSmart,
+	"prepare":    runbookPrepare,
+	"replace":    runbookReplace,
+	"monitor":    runbookMonitor,
+	"verify":     runbookVerify,
+	"add":        runbookAdd,
+	"remove_old": runbookRemoveOld,
+	"scrub":      runbookScrub,
+}
+
+// runbookRunner makes sure only one goroutine drives the runbook.
+var runbookRunner sync.Mutex
+
+const runbookOutputLimit = 4000
+
+func runbookActive() bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.Runbook != nil && state.Runbook.Status == "running"
+}
+
+// blockDeviceSize reads the size of a block device from sysfs.
+func blockDeviceSize(dev string) (uint64, bool) {
+	resolved, err := filepath.EvalSymlinks(dev)
+	if err != nil { return 0, false }
+	data, err := os.ReadFile(filepath.Join("/sys/class/block", filepath.Base(resolved), "size"))
+	if err != nil { return 0, false }
+	sectors, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil { return 0, false }
+	return sectors * 512, true
+}
+
+func (rb ReplaceRunbook) sourceRef() string {
+	if rb.Source.Missing { return "missing" }
+	return strconv.FormatUint(rb.Source.DevID, 10)
+}
+
+func (rb ReplaceRunbook) visualPath() string {
+	return fmt.Sprintf("%s (devid %d) ➡️ %s", rb.Source.Path, rb.Source.DevID, rb.Target)
+}
+
+// runbookCommand runs a btrfs command as part of the runbook, registered so a
+// shutdown can suspend it and tell it apart from a real failure.
+func runbookCommand(args ...string) (string, error) {
+	id := time.Now().UnixNano()
+	trackCommand(id, "btrfs", args, nil)
+	defer untrackCommand(id)
+	out, err := exec.Command("btrfs", args...).CombinedOutput()
+	return string(out), err
+}
+
+// --- Steps ---
+
+func runbookSmart(rb ReplaceRunbook, progress func(string)) (string, bool, error) {
+	if rb.Source.Missing { return "The old device is missing; nothing to check.", true, nil }
+	if _, err := exec.LookPath("smartctl"); err != nil { return "smartctl is not installed; skipping the SMART check.", true, nil }
+	out, err := exec.Command("smartctl", "-H", "-A", rb.Source.Path).CombinedOutput()
+	// smartctl's exit status is a bit mask; bit 3 means the disk is failing.
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode()&8 != 0 {
+		return string(out) + "\n⚠️ SMART reports the disk as failing.", false, nil
+	}
+	return string(out), false, nil
+}
+
+func runbookPrepare(rb ReplaceRunbook, progress func(string)) (string, bool, error) {
+	devices, err := listDevices(rb.Path)
+	if err != nil { return "", false, err }
+	for _, d := range devices {
+		if d.Path == rb.Target { return rb.Target + " already belongs to the filesystem (resumed run).", false, nil }
+	}
+	if _, err := findDevice(rb.sourceRef(), devices); err != nil { return "", false, err }
+	if err := checkNewDevice(rb.Target, devices); err != nil { return "", false, err }
+	size, _ := blockDeviceSize(rb.Target)
+	return fmt.Sprintf("%s is a block device of %s, not part of the filesystem.", rb.Target, formatBytes(size)), false, nil
+}
+
+func runbookReplace(rb ReplaceRunbook, progress func(string)) (string, bool, error) {
+	if status, _, err := replaceStatus(rb.Path); err == nil && status != nil && status.State == "running" {
+		return "A replace is already running (resumed run).", false, nil
+	}
+	devices, err := listDevices(rb.Path)
+	if err != nil { return "", false, err }
+	for _, d := range devices {
+		if d.DevID == rb.Source.DevID && d.Path == rb.Target { return "The replace already finished (resumed run).", false, nil }
+	}
+	args := []string{"replace", "start", "-r"}
+	if rb.Force { args = append(args, "-f") }
+	args = append(args, strconv.FormatUint(rb.Source.DevID, 10), rb.Target, rb.Path)
+	out, err := exec.Command("btrfs", args...).CombinedOutput()
+	if err != nil { return string(out), false, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out))) }
+	return formatCommand("btrfs", args...) + "\n" + string(out), false, nil
+}
+
+func runbookMonitor(rb ReplaceRunbook, progress func(string)) (string, bool, error) {
+	for {
+		status, out, err := replaceStatus(rb.Path)
+		if err != nil { return out, false, err }
+		if status == nil { return out, false, fmt.Errorf("cannot read the replace status") }
+		progress(strings.TrimSpace(out))
+		switch status.State {
+		case "finished":
+			if status.WriteErrors > 0 { return out, false, fmt.Errorf("replace finished with %d write errors", status.WriteErrors) }
+			return out, false, nil
+		case "canceled", "never":
+			return out, false, fmt.Errorf("replace %s", status.State)
+		}
+		// "suspended" replaces continue once the filesystem is mounted again.
+		if runbookAborted(rb.ID) { return out, false, fmt.Errorf("aborted; the replace keeps running in the kernel") }
+		time.Sleep(replacePollInterval)
+	}
+}
+
+func runbookVerify(rb ReplaceRunbook, progress func(string)) (string, bool, error) {
+	devices, err := listDevices(rb.Path)
+	if err != nil { return "", false, err }
+	var list strings.Builder
+	found := false
+	for _, d := range devices {
+		fmt.Fprintf(&list, "devid %d %s\n", d.DevID, d.Path)
+		if d.DevID == rb.Source.DevID && d.Path == rb.Target { found = true }
+		if !rb.Source.Missing && d.Path == rb.Source.Path { return list.String(), false, fmt.Errorf("%s is still part of the filesystem", rb.Source.Path) }
+	}
+	if !found { return list.String(), false, fmt.Errorf("%s did not take over devid %d", rb.Target, rb.Source.DevID) }
+	return list.String(), false, nil
+}
+
+func runbookAdd(rb ReplaceRunbook, progress func(string)) (string, bool, error) {
+	devices, err := listDevices(rb.Path)
+	if err != nil { return "", false, err }
+	for _, d := range devices {
+		if d.Path == rb.Target { return rb.Target + " was already added (resumed run).", false, nil }
+	}
+	args := []string{"device", "add"}
+	if rb.Force { args = append(args, "-f") }
+	args = append(args, rb.Target, rb.Path)
+	out, err := runbookCommand(args...)
+	if err != nil { return out, false, fmt.Errorf("%v: %s", err, strings.TrimSpace(out)) }
+	return formatCommand("btrfs", args...) + "\n" + out, false, nil
+}
+
+func runbookRemoveOld(rb ReplaceRunbook, progress func(string)) (string, bool, error) {
+	devices, err := listDevices(rb.Path)
+	if err != nil { return "", false, err }
+	if _, err := findDevice(rb.sourceRef(), devices); err != nil { return "The old device was already removed (resumed run).", false, nil }
+	progress(fmt.Sprintf("Moving %s of data off devid %d, this can take hours...", formatBytes(rb.Source.Used), rb.Source.DevID))
+	args := []string{"device", "remove", rb.sourceRef(), rb.Path}
+	out, err := runbookCommand(args...)
+	if err != nil { return out, false, fmt.Errorf("%v: %s", err, strings.TrimSpace(out)) }
+	return formatCommand("btrfs", args...) + "\n" + out, false, nil
+}
+
+func runbookScrub(rb ReplaceRunbook, progress func(string)) (string, bool, error) {
+	progress("Scrubbing " + rb.Path + "...")
+	out, err := runbookCommand(scrubStartArgs(rb.Path)...)
+	if err != nil { return out, false, fmt.Errorf("%v: %s", err, strings.TrimSpace(out)) }
+	if s := parseScrub(out); s != nil && s.Uncorrectable > 0 {
+		return out, false, fmt.Errorf("scrub found %d uncorrectable errors", s.Uncorrectable)
+	}
+	return out, false, nil
+}
+
+// --- Driver ---
+
+func runbookAborted(id string) bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.Runbook != nil && state.Runbook.ID == id && state.Runbook.Status == "aborted"
+}
+
+// checkpointRunbook persists rb and reports whether it was aborted in the
+// meantime, in which case the abort wins.
+func checkpointRunbook(rb *ReplaceRunbook) bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.Runbook != nil && state.Runbook.ID == rb.ID && state.Runbook.Status == "aborted" { rb.Status = "aborted" }
+	rb.Updated = time.Now().Format(time.RFC3339)
+	c := *rb
+	c.Steps = append([]RunbookStep(nil), rb.Steps...)
+	state.Runbook = &c
+	saveState()
+	return rb.Status == "aborted"
+}
+
+func truncateOutput(s string) string {
+	if len(s) > runbookOutputLimit { return "…" + s[len(s)-runbookOutputLimit:] }
+	return s
+}
+
+// runRunbook drives the current runbook from its current step to the end or
+// the first failure.
+func runRunbook(intro string) {
+	if !runbookRunner.TryLock() { return }
+	defer runbookRunner.Unlock()
+
+	state.mu.Lock()
+	if state.Runbook == nil || state.Runbook.Status != "running" {
+		state.mu.Unlock()
+		return
+	}
+	rb := *state.Runbook
+	rb.Steps = append([]RunbookStep(nil), rb.Steps...)
+	state.mu.Unlock()
+
+	start := time.Now()
+	var log strings.Builder
+	log.WriteString(intro + "\n\n")
+	id := startHistory("REPLACE RUNBOOK", "🧭", rb.visualPath(), log.String())
+	finish := func(status string) {
+		updateHistory(id, func(e *LogEntry) {
+			e.Status = status
+			e.Output = log.String()
+			e.Duration = time.Since(start).Round(time.Second).String()
+		})
+	}
+
+	for rb.Current < len(rb.Steps) {
+		step := &rb.Steps[rb.Current]
+		step.Status, step.Started, step.Finished = "running", time.Now().Format(time.RFC3339), ""
+		if checkpointRunbook(&rb) {
+			log.WriteString("Aborted.\n")
+			finish("Warning")
+			return
+		}
+		printDockerLog("RUNBOOK", "[%d/%d] %s", rb.Current+1, len(rb.Steps), step.Title)
+		fmt.Fprintf(&log, "[%d/%d] %s\n", rb.Current+1, len(rb.Steps), step.Title)
+		progress := func(s string) {
+			updateHistory(id, func(e *LogEntry) { e.Output = log.String() + s + "\n" })
+		}
+
+		out, skipped, err := runbookSteps[step.Name](rb, progress)
+		step.Output = truncateOutput(strings.TrimSpace(out))
+		step.Finished = time.Now().Format(time.RFC3339)
+		if err != nil && shuttingDown() {
+			// Leave the step "running" so it is picked up again on the
+			// next start.
+			printDockerLog("RUNBOOK", "Interrupted by shutdown during: %s", step.Title)
+			return
+		}
+		if err != nil {
+			step.Status, rb.Status, rb.Error = "failed", "failed", step.Title+": "+err.Error()
+			logError("RUNBOOK", "Step failed: %v", err)
+			fmt.Fprintf(&log, "    ❌ %v\n%s\n\nFix the problem and resume the runbook to retry this step, or abort it.\n", err, step.Output)
+			if checkpointRunbook(&rb) {
+				log.WriteString("Aborted.\n")
+				finish("Warning")
+				return
+			}
+			finish("Failed")
+			return
+		}
+		mark := "✅"
+		step.Status = "done"
+		if skipped { step.Status, mark = "skipped", "⏭️" }
+		fmt.Fprintf(&log, "    %s %s\n", mark, firstLine(step.Output))
+		rb.Current++
+		if checkpointRunbook(&rb) {
+			log.WriteString("Aborted.\n")
+			finish("Warning")
+			return
+		}
+		updateHistory(id, func(e *LogEntry) { e.Output = log.String() })
+	}
+
+	rb.Status = "done"
+	checkpointRunbook(&rb)
+	printDockerLog("RUNBOOK", "Replace of devid %d finished", rb.Source.DevID)
+	log.WriteString("\nAll steps completed.\n")
+	finish("Success")
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
+
+// resumeRunbook continues a runbook that was running when the app stopped.
+// It runs once at startup.
+func resumeRunbook() {
+	if !runbookActive() { return }
+	printDockerLog("RUNBOOK", "Resuming replace runbook after restart")
+	go runRunbook("Resumed after restart.")
+}
+
+// --- Handlers ---
+
+func handleGetRunbook(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	rb := state.Runbook
+	state.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"runbook": rb})
+}
+
+func handleStartRunbook(w http.ResponseWriter, r *http.Request) {
+	path, req, devices, ok := deviceRequest(w, r)
+	if !ok { return }
+	src, err := findDevice(req.Source, devices)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := checkNewDevice(req.Target, devices); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	strategy := req.Strategy
+	targetSize, known := blockDeviceSize(req.Target)
+	if strategy == "" {
+		strategy = "replace"
+		if known && targetSize < src.Size { strategy = "add-remove" }
+	}
+	names, ok := runbookStrategies[strategy]
+	if !ok {
+		http.Error(w, "strategy must be replace or add-remove", 400)
+		return
+	}
+
+	warnings := []string{fmt.Sprintf("everything on %s will be overwritten", req.Target)}
+	if strategy == "add-remove" {
+		warnings = append(warnings, fmt.Sprintf("%s is smaller than devid %d, so it is added and the old device removed afterwards; the other devices need room for its %s of data", req.Target, src.DevID, formatBytes(src.Used)))
+	}
+	steps := make([]RunbookStep, len(names))
+	titles := make([]string, len(names))
+	for i, n := range names {
+		steps[i] = RunbookStep{Name: n, Title: runbookTitles[n], Status: "pending"}
+		titles[i] = fmt.Sprintf("%d. %s", i+1, runbookTitles[n])
+	}
+	if !confirmDeviceOp(w, req, "runbook", req.Source, titles, warnings) { return }
+
+	now := time.Now()
+	state.mu.Lock()
+	if state.Runbook != nil && state.Runbook.Status == "running" {
+		state.mu.Unlock()
+		http.Error(w, "A runbook is already running", 409)
+		return
+	}
+	state.Runbook = &ReplaceRunbook{
+		ID: strconv.FormatInt(now.UnixNano(), 10), Path: path, Source: src, Target: req.Target, Force: req.Force,
+		Strategy: strategy, Status: "running", Steps: steps,
+		Created: now.Format(time.RFC3339), Updated: now.Format(time.RFC3339),
+	}
+	saveState()
+	rb := *state.Runbook
+	state.mu.Unlock()
+
+	go runRunbook(fmt.Sprintf("Replacing devid %d (%s) with %s using %s.", src.DevID, src.Path, req.Target, strategy))
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "runbook": rb})
+}
+
+// handleResumeRunbook retries the failed step.
+func handleResumeRunbook(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	rb := state.Runbook
+	if rb == nil || rb.Status != "failed" {
+		state.mu.Unlock()
+		http.Error(w, "No failed runbook to resume", 409)
+		return
+	}
+	rb.Status, rb.Error = "running", ""
+	saveState()
+	state.mu.Unlock()
+	go runRunbook("Resumed by user.")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok"})
+}
+
+// handleAbortRunbook stops the runbook after the command running right now;
+// a replace or device removal already under way continues in the kernel.
+func handleAbortRunbook(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	rb := state.Runbook
+	if rb == nil || (rb.Status != "running" && rb.Status != "failed") {
+		state.mu.Unlock()
+		http.Error(w, "No runbook to abort", 409)
+		return
+	}
+	rb.Status = "aborted"
+	saveState()
+	state.mu.Unlock()
+	logHistory("REPLACE RUNBOOK", "🧭", rb.visualPath(), "Warning", "Aborted by user. Any replace or device removal already running continues; cancel it from the Devices view if needed.")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "aborted"})
+}
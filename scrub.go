@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Scheduled Scrub Rotation ---
+// The scrub schedule can cover several filesystems. Each run starts the
+// least recently scrubbed ones (all of them, or per_run in rotation, e.g.
+// one per night), at most max_concurrent at a time and stagger_minutes
+// apart, so every pool gets scrubbed regularly without all of them
+// competing for I/O at once. With mode devices, a multi-device filesystem
+// is scrubbed one device after the other instead of all of its disks at
+// once; the log entry follows each device and adds their results up.
+
+type ScrubPlanConfig struct {
+	Targets        []string `json:"targets"`         // empty: the target drive
+	PerRun         int      `json:"per_run"`         // filesystems per run, 0 = all
+	MaxConcurrent  int      `json:"max_concurrent"`  // default 1
+	StaggerMinutes int      `json:"stagger_minutes"` // between two starts of a run
+	Mode           string   `json:"mode,omitempty"`  // filesystem (default) or devices
+}
+
+func (c ScrubPlanConfig) withDefaults() ScrubPlanConfig {
+	if c.MaxConcurrent <= 0 { c.MaxConcurrent = 1 }
+	return c
+}
+
+func (c ScrubPlanConfig) validate() error {
+	for _, t := range c.Targets {
+		if !filepath.IsAbs(t) { return fmt.Errorf("scrub target %q must be an absolute path", t) }
+	}
+	if c.PerRun < 0 || c.MaxConcurrent < 0 || c.StaggerMinutes < 0 {
+		return fmt.Errorf("scrub per_run, max_concurrent and stagger_minutes must not be negative")
+	}
+	if c.Mode != "" && c.Mode != "filesystem" && c.Mode != "devices" {
+		return fmt.Errorf("unknown scrub mode %q (filesystem or devices)", c.Mode)
+	}
+	return nil
+}
+
+// scrubRun keeps a run that is still working through its targets from
+// overlapping with the next one.
+var scrubRun sync.Mutex
+
+func scrubTargets(cfg Config) []string {
+	if len(cfg.ScrubPlan.Targets) == 0 {
+		if cfg.TargetDrive == "" { return nil }
+		return []string{cfg.TargetDrive}
+	}
+	seen := map[string]bool{}
+	var targets []string
+	for _, t := range cfg.ScrubPlan.Targets {
+		t = filepath.Clean(t)
+		if seen[t] { continue }
+		seen[t] = true
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// nextScrubTargets returns the targets of the next run, never scrubbed ones
+// first, then by the time of their last scheduled scrub. last maps a target
+// to that time in UTC RFC 3339, which sorts chronologically as a string.
+func nextScrubTargets(cfg Config, last map[string]string) []string {
+	targets := scrubTargets(cfg)
+	sort.SliceStable(targets, func(i, j int) bool { return last[targets[i]] < last[targets[j]] })
+	if n := cfg.ScrubPlan.PerRun; n > 0 && n < len(targets) { targets = targets[:n] }
+	return targets
+}
+
+func markScrubScheduled(path string, at time.Time) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.ScrubRotation == nil { state.ScrubRotation = make(map[string]string) }
+	state.ScrubRotation[path] = at.UTC().Format(time.RFC3339)
+	saveState()
+}
+
+// scrubRunning reports whether this app already runs a scrub on path.
+func scrubRunning(path string) bool {
+	runningCommands.mu.Lock()
+	defer runningCommands.mu.Unlock()
+	for _, c := range runningCommands.cmds {
+		if c.Name == "btrfs" && len(c.Args) > 2 && c.Args[0] == "scrub" && c.Args[1] == "start" && c.Args[len(c.Args)-1] == path { return true }
+	}
+	return false
+}
+
+func runScheduledScrubs(run *JobRun) {
+	if !scrubRun.TryLock() {
+		printDockerLog("SCRUB", "Scheduled scrubs of the previous run are still pending, skipping this run")
+		return
+	}
+	defer scrubRun.Unlock()
+
+	state.mu.Lock()
+	plan := state.Config.ScrubPlan.withDefaults()
+	targets := nextScrubTargets(state.Config, state.ScrubRotation)
+	state.mu.Unlock()
+	if len(targets) == 0 { return }
+	printDockerLog("SCRUB", "Scheduled scrubs: %v (at most %d at a time, %dm apart)", targets, plan.MaxConcurrent, plan.StaggerMinutes)
+
+	slots := make(chan struct{}, plan.MaxConcurrent)
+	var wg sync.WaitGroup
+	var lastStart time.Time
+	for _, p := range targets {
+		slots <- struct{}{}
+		if !lastStart.IsZero() { time.Sleep(time.Until(lastStart.Add(time.Duration(plan.StaggerMinutes) * time.Minute))) }
+		if shuttingDown() { break }
+		if op := scrubInProgress(p); op != nil {
+			printDockerLog("SCRUB", "%s, skipping", op.message())
+			<-slots
+			continue
+		}
+		lastStart = time.Now()
+		markScrubScheduled(p, lastStart)
+		id, done := startScrub("AUTO SCRUB", p, plan.Mode)
+		run.tag(id)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-done
+			<-slots
+		}()
+	}
+	wg.Wait()
+}
+
+// startScrub scrubs the filesystem at path as a whole, or with mode devices
+// one device after the other.
+func startScrub(opType, path, mode string) (int64, <-chan struct{}) {
+	if mode == "devices" { return startDeviceScrub(opType, path) }
+	return startCommand(opType, "🧹", path, "btrfs", scrubStartArgs(path)...)
+}
+
+// startDeviceScrub runs `btrfs scrub start -B` on each device of the
+// filesystem at path in turn, as one log entry. Missing devices are skipped;
+// a failed device doesn't stop the others, a kill or timeout does.
+func startDeviceScrub(opType, path string) (int64, <-chan struct{}) {
+	start := time.Now()
+	id := startHistory(opType, "🧹", path, "Scrub the devices of "+path+" one after the other")
+	ctx, cancel := commandContext(opType)
+	// Tracked with the filesystem, so scrubRunning sees it.
+	trackCommand(id, "btrfs", scrubStartArgs(path), cancel)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer untrackCommand(id)
+		defer cancel(nil)
+		result := &ScrubResult{Status: "finished"}
+		var lines []string
+		status := "Success"
+		// update publishes the progress so far; with final the outcome too.
+		update := func(final bool) {
+			r := *result
+			r.Devices = append([]DeviceScrub(nil), result.Devices...)
+			updateHistory(id, func(e *LogEntry) {
+				e.Output, e.Result = strings.Join(lines, "\n"), &OperationResult{Scrub: &r}
+				if !final { return }
+				e.Status, e.Duration = status, time.Since(start).Round(time.Millisecond).String()
+				if t, ok := terminationOf(ctx); ok {
+					e.Status, e.Termination = t.Status, t.Kind
+					e.Output += "\n\n" + t.Message
+				} else if shuttingDown() && result.Status != "finished" {
+					e.Status = interruptedStatus
+					e.Output += "\n\n⚠️ Interrupted: the web UI was stopped while this was running."
+				}
+			})
+		}
+
+		if err := toolMissing("btrfs"); err != nil {
+			logWarn(opType, "UNAVAILABLE: %v", err)
+			status, lines = "Failed", append(lines, fmt.Sprintf("Feature unavailable: %v", err))
+			update(true)
+			return
+		}
+		info, err := btrfsFS.FilesystemInfo(path)
+		if err != nil {
+			status, lines = "Failed", append(lines, "Cannot list the devices: "+err.Error())
+			update(true)
+			return
+		}
+		for _, d := range info.Devices {
+			s := DeviceScrub{Device: d.Path, DevID: d.DevID, State: "pending"}
+			if d.Missing { s.State = "skipped" }
+			result.Devices = append(result.Devices, s)
+		}
+		printDockerLog(opType, "STARTING: scrub of the %d devices of %s one by one", len(result.Devices), path)
+
+		for i := range result.Devices {
+			d := &result.Devices[i]
+			step := fmt.Sprintf("[%d/%d] devid %d %s", i+1, len(result.Devices), d.DevID, d.Device)
+			if d.State == "skipped" {
+				lines = append(lines, "⏭️ "+step+": missing, skipped")
+				continue
+			}
+			if shuttingDown() || ctx.Err() != nil {
+				d.State, result.Status = "skipped", "aborted"
+				continue
+			}
+			d.State = "running"
+			lines = append(lines, "▶️ "+step)
+			update(false)
+			printDockerLog(opType, "STARTING: %s", formatCommand("btrfs", scrubStartArgs(d.Device)...))
+
+			exited := make(chan struct{})
+			cmd := newManagedCommand(ctx, exited, "btrfs", scrubStartArgs(d.Device)...)
+			limits, release := prioritize(cmd, opType)
+			if limits != "" { updateHistory(id, func(e *LogEntry) { e.Limits = limits }) }
+			output, err := cmd.CombinedOutput()
+			release()
+			close(exited)
+			out := strings.TrimSpace(string(output))
+			if out != "" { lines = append(lines, out) }
+
+			d.Scrub = parseScrub(out)
+			addScrubResult(result, d.Scrub)
+			if err != nil {
+				d.State, d.Error, status = "failed", err.Error(), "Failed"
+				if ctx.Err() != nil || shuttingDown() { result.Status = "aborted" }
+				lines = append(lines, fmt.Sprintf("❌ %s: %v", step, err))
+				logError(opType, "ERROR: %s: %v", step, err)
+			} else {
+				d.State = "finished"
+				lines = append(lines, "✅ "+step)
+			}
+		}
+		result.Duration = time.Since(start).Round(time.Second).String()
+		if !shuttingDown() { attachCorruptFiles(&OperationResult{Scrub: result}, path) }
+		printDockerLog(opType, "FINISHED in %s", time.Since(start).Round(time.Millisecond))
+		update(true)
+	}()
+	return id, done
+}
+
+// addScrubResult adds the counts of a device's scrub to the total.
+func addScrubResult(total, r *ScrubResult) {
+	if r == nil { return }
+	total.BytesScrubbed += r.BytesScrubbed
+	total.Errors += r.Errors
+	total.Corrected += r.Corrected
+	total.Uncorrectable += r.Uncorrectable
+	for kind, n := range r.ErrorCounts {
+		if total.ErrorCounts == nil { total.ErrorCounts = map[string]uint64{} }
+		total.ErrorCounts[kind] += n
+	}
+}
+
+// scrubDevicePaths returns the devices a scrub device by device of path
+// runs on, in order.
+func scrubDevicePaths(path string) ([]string, error) {
+	info, err := btrfsFS.FilesystemInfo(path)
+	if err != nil { return nil, err }
+	var paths []string
+	for _, d := range info.Devices {
+		if !d.Missing { paths = append(paths, d.Path) }
+	}
+	return paths, nil
+}
+
+func previewScheduledScrubs(cfg Config) ([]PlannedOp, []string) {
+	state.mu.Lock()
+	targets := nextScrubTargets(cfg, state.ScrubRotation)
+	state.mu.Unlock()
+	if len(targets) == 0 { return previewTargetCommand("", "", scrubStartArgs) }
+
+	plan := cfg.ScrubPlan.withDefaults()
+	var ops []PlannedOp
+	var warnings []string
+	for i, p := range targets {
+		desc := "Scrub " + p
+		if i > 0 { desc += fmt.Sprintf(" (at most %d at a time, %dm after the previous start)", plan.MaxConcurrent, plan.StaggerMinutes) }
+		o, w := previewTargetCommand(p, desc, scrubStartArgs)
+		if plan.Mode == "devices" && len(o) > 0 {
+			if devices, err := scrubDevicePaths(p); err != nil {
+				w = append(w, fmt.Sprintf("cannot list the devices of %s: %v", p, err))
+			} else {
+				o = nil
+				for j, d := range devices {
+					o = append(o, PlannedOp{Description: fmt.Sprintf("%s, device %d of %d", desc, j+1, len(devices)), Command: formatCommand("btrfs", scrubStartArgs(d)...)})
+				}
+			}
+		}
+		ops = append(ops, o...)
+		warnings = append(warnings, w...)
+	}
+	return ops, warnings
+}
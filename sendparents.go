@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// --- Send Parents ---
+// The archive tier (archive.go) and encrypted streams (streams.go) send each
+// snapshot incrementally against the one sent before it, which has to still
+// be there. After each send the state records that snapshot as the parent of
+// the next one, by chain ("archive:<job>", "streams:<job>"). Retention and
+// purge leave send parents out of their plans and list them as held, and
+// deleting one by hand is refused. With break_chains=true they are deleted
+// anyway; the next archive send then goes against an older copy both sides
+// still have, or in full, and the next stream starts a new chain.
+
+func archiveChain(job SnapshotJob) string { return "archive:" + job.ID }
+func streamsChain(job SnapshotJob) string { return "streams:" + job.ID }
+
+// setSendParent records name as the parent of the next send of chain, or
+// with name "" that the next send is a full one.
+func setSendParent(job SnapshotJob, chain, name string) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if name == "" {
+		if _, ok := state.SendParents[chain]; !ok { return }
+		delete(state.SendParents, chain)
+	} else {
+		if state.SendParents == nil { state.SendParents = map[string]string{} }
+		state.SendParents[chain] = snapshotPath(job.Dest, name)
+	}
+	saveState()
+}
+
+// sendParentOf returns the chains path is the next send parent of.
+func sendParentOf(path string) []string {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	var chains []string
+	for chain, p := range state.SendParents {
+		if p == path { chains = append(chains, chain) }
+	}
+	return chains
+}
+
+// describeChains reads "archive:home" as "the next archive send of job home".
+func describeChains(chains []string) string {
+	var parts []string
+	for _, c := range chains {
+		kind, job, _ := strings.Cut(c, ":")
+		parts = append(parts, fmt.Sprintf("the next %s send of job %s", kind, job))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// holdSendParents takes the send parents out of plan, unless breakChains,
+// and describes what it held or is about to break.
+func holdSendParents(plan []PlannedDelete, breakChains bool) ([]PlannedDelete, []PlannedDelete, []string) {
+	kept := []PlannedDelete{}
+	var held []PlannedDelete
+	var warnings []string
+	for _, p := range plan {
+		if len(p.SendParentOf) == 0 {
+			kept = append(kept, p)
+			continue
+		}
+		if breakChains {
+			kept = append(kept, p)
+			warnings = append(warnings, fmt.Sprintf("%s/%s is the parent of %s; deleting it breaks the incremental chain", p.Job, p.Name, describeChains(p.SendParentOf)))
+			continue
+		}
+		held = append(held, p)
+		warnings = append(warnings, fmt.Sprintf("Keeping %s/%s, the parent of %s (break_chains=true deletes it anyway)", p.Job, p.Name, describeChains(p.SendParentOf)))
+	}
+	return kept, held, warnings
+}
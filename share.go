@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- Temporary Access Links ---
+// A share link is a URL under /share/ whose query is signed with a key kept
+// in the state directory. It grants read-only access to exactly one resource
+// until it expires. Rotating the key revokes every outstanding link.
+
+const (
+	shareKeyFile    = "share.key"
+	shareDefaultTTL = 24 * time.Hour
+	shareMaxTTL     = 7 * 24 * time.Hour
+)
+
+var shareKey struct {
+	mu  sync.Mutex
+	key []byte
+}
+
+// shareSigningKey loads the signing key, creating it on first use.
+func shareSigningKey() ([]byte, error) {
+	shareKey.mu.Lock()
+	defer shareKey.mu.Unlock()
+	if shareKey.key != nil { return shareKey.key, nil }
+
+	path := filepath.Join(stateDir, shareKeyFile)
+	if data, err := os.ReadFile(path); err == nil {
+		if key, err := hex.DecodeString(string(data)); err == nil && len(key) >= 32 {
+			shareKey.key = key
+			return key, nil
+		}
+	}
+	return newShareKey(path)
+}
+
+// newShareKey writes a fresh key; the caller holds shareKey.mu.
+func newShareKey(path string) ([]byte, error) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key)), 0600); err != nil { return nil, err }
+	shareKey.key = key
+	return key, nil
+}
+
+func rotateShareKey() error {
+	shareKey.mu.Lock()
+	defer shareKey.mu.Unlock()
+	_, err := newShareKey(filepath.Join(stateDir, shareKeyFile))
+	return err
+}
+
+// shareSignature covers the resource and every query parameter except sig,
+// so no part of a link can be changed without invalidating it.
+func shareSignature(key []byte, resource string, q url.Values) string {
+	q = cloneValues(q)
+	q.Del("sig")
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(resource + "?" + q.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func cloneValues(q url.Values) url.Values {
+	c := url.Values{}
+	for k, v := range q { c[k] = append([]string(nil), v...) }
+	return c
+}
+
+func signShareURL(resource string, q url.Values, expires time.Time) (string, error) {
+	key, err := shareSigningKey()
+	if err != nil { return "", err }
+	q.Set("exp", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("sig", shareSignature(key, resource, q))
+	return "/share/" + resource + "?" + q.Encode(), nil
+}
+
+// verifyShare checks the signature and expiry of a /share/ request.
+func verifyShare(r *http.Request, resource string) error {
+	key, err := shareSigningKey()
+	if err != nil { return err }
+	q := r.URL.Query()
+	want := shareSignature(key, resource, q)
+	if !hmac.Equal([]byte(want), []byte(q.Get("sig"))) { return fmt.Errorf("invalid link") }
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil || time.Now().Unix() > exp { return fmt.Errorf("link expired") }
+	return nil
+}
+
+// sharedFilePath resolves a file inside a snapshot; only regular files can be
+// shared.
+func sharedFilePath(jobID, snapshot, rel string) (string, error) {
+	job, err := findSnapshotJob(jobID)
+	if err != nil { return "", err }
+	root, err := snapshotRoot(job, snapshot)
+	if err != nil { return "", err }
+	path, err := resolveInside(root, rel)
+	if err != nil { return "", err }
+	info, err := os.Stat(path)
+	if err != nil { return "", err }
+	if !info.Mode().IsRegular() { return "", fmt.Errorf("only regular files can be shared") }
+	return path, nil
+}
+
+// --- Handlers ---
+
+type ShareRequest struct {
+	Resource string `json:"resource"` // "file" or "status"
+	Job      string `json:"job"`
+	Snapshot string `json:"snapshot"`
+	Path     string `json:"path"` // file path inside the snapshot
+	TTL      string `json:"ttl"`  // e.g. 1h, defaults to 24h, at most 7 days
+}
+
+func handleCreateShare(w http.ResponseWriter, r *http.Request) {
+	var req ShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), 400)
+		return
+	}
+	ttl := shareDefaultTTL
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 || d > shareMaxTTL {
+			http.Error(w, "ttl must be a duration between 1s and 168h", 400)
+			return
+		}
+		ttl = d
+	}
+
+	q := url.Values{}
+	visualPath := "Status page"
+	switch req.Resource {
+	case "file":
+		path, err := sharedFilePath(req.Job, req.Snapshot, req.Path)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		q.Set("job", req.Job)
+		q.Set("snapshot", req.Snapshot)
+		q.Set("path", req.Path)
+		visualPath = path
+	case "status":
+	default:
+		http.Error(w, "resource must be file or status", 400)
+		return
+	}
+
+	expires := time.Now().Add(ttl)
+	link, err := signShareURL(req.Resource, q, expires)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	logHistory("SHARE LINK", "🔗", visualPath, "Success", "Read-only link valid until "+expires.Format(time.RFC3339))
+	json.NewEncoder(w).Encode(map[string]interface{}{"url": link, "expires": expires.Format(time.RFC3339)})
+}
+
+func handleRevokeShares(w http.ResponseWriter, r *http.Request) {
+	if err := rotateShareKey(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	logHistory("SHARE REVOKE", "🔗", "All links", "Success", "Signing key rotated; every existing share link is now invalid")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok"})
+}
+
+func handleSharedFile(w http.ResponseWriter, r *http.Request) {
+	if err := verifyShare(r, "file"); err != nil {
+		http.Error(w, err.Error(), 403)
+		return
+	}
+	q := r.URL.Query()
+	path, err := sharedFilePath(q.Get("job"), q.Get("snapshot"), q.Get("path"))
+	if err != nil {
+		http.Error(w, "File no longer available", 404)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "File no longer available", 404)
+		return
+	}
+	defer f.Close()
+	info, _ := f.Stat()
+	printDockerLog("SHARE", "Serving %s to %s", path, r.RemoteAddr)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), f)
+}
+
+var shareStatusPage = template.Must(template.New("status").Funcs(template.FuncMap{"bytes": formatBytes}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>BTRFS Status</title>
+<style>body{font-family:system-ui,sans-serif;max-width:800px;margin:20px auto;padding:0 10px;color:#333}
+table{width:100%;border-collapse:collapse}td,th{text-align:left;padding:4px;border-bottom:1px solid #e5e7eb}
+.Failed,.critical{color:#dc2626}.Success,.ok{color:#16a34a}.warning{color:#92400e}</style></head><body>
+<h1>🍃 BTRFS Status</h1>
+<p>Generated {{.Now}}</p>
+{{with .Usage}}<h2>💾 {{.Path}}</h2>
+<p>{{bytes .Used}} used of {{bytes .Total}}, {{bytes .Free}} free (estimated), {{bytes .DeviceUnallocated}} unallocated</p>
+{{else}}<p>Filesystem usage unavailable{{with $.UsageError}}: {{.}}{{end}}</p>{{end}}
+{{with .Health}}<h2>🩺 Health: {{.Status}}</h2>
+<ul>{{range .Checks}}<li class="{{.Status}}">{{.Name}}: {{.Message}}</li>{{end}}</ul>{{end}}
+<h2>📜 Recent Operations</h2>
+<table><tr><th>Time</th><th>Operation</th><th>Status</th><th>Duration</th></tr>
+{{range .History}}<tr><td>{{.LocalTime}}</td><td>{{.Emoji}} {{.Type}}</td><td class="{{.Status}}">{{.Status}}</td><td>{{.Duration}}</td></tr>
+{{end}}</table>
+</body></html>`))
+
+// handleSharedStatus renders a read-only health view. It deliberately leaves
+// out command output and paths other than the target drive.
+func handleSharedStatus(w http.ResponseWriter, r *http.Request) {
+	if err := verifyShare(r, "status"); err != nil {
+		http.Error(w, err.Error(), 403)
+		return
+	}
+	state.mu.Lock()
+	path := state.Config.TargetDrive
+	history := append([]LogEntry(nil), state.History...)
+	state.mu.Unlock()
+	if len(history) > 20 { history = history[:20] }
+
+	data := struct {
+		Now        string
+		Usage      *FilesystemUsage
+		UsageError string
+		Health     *HealthReport
+		History    []LogEntry
+	}{Now: time.Now().Format(time.RFC1123), History: history}
+	health.mu.Lock()
+	data.Health = health.report
+	health.mu.Unlock()
+	if path != "" {
+		usage, err := getFilesystemUsage(path)
+		if err != nil { data.UsageError = err.Error() }
+		data.Usage = usage
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	shareStatusPage.Execute(w, data)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// --- Snapshot Diff ---
+// What changed between two snapshots of a job, from the metadata-only send
+// stream of `btrfs send --no-data -p <from> <to>`: the commands that would
+// turn <from> into <to>, reduced to created, modified, deleted and renamed
+// paths.
+
+type SnapshotDiff struct {
+	From      string        `json:"from"`
+	To        string        `json:"to"`
+	Created   []string      `json:"created"`
+	Modified  []string      `json:"modified"`
+	Deleted   []string      `json:"deleted"`
+	Renamed   []RenamedPath `json:"renamed"`
+	Truncated bool          `json:"truncated,omitempty"` // stopped after maxDiffPaths
+}
+
+type RenamedPath struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+const maxDiffPaths = 50000
+
+// Send stream commands and attributes (see btrfs-progs send.h).
+const (
+	sendCmdMkfile       = 3
+	sendCmdMkdir        = 4
+	sendCmdMknod        = 5
+	sendCmdMkfifo       = 6
+	sendCmdMksock       = 7
+	sendCmdSymlink      = 8
+	sendCmdRename       = 9
+	sendCmdLink         = 10
+	sendCmdUnlink       = 11
+	sendCmdRmdir        = 12
+	sendCmdSetXattr     = 13
+	sendCmdRemoveXattr  = 14
+	sendCmdWrite        = 15
+	sendCmdClone        = 16
+	sendCmdTruncate     = 17
+	sendCmdChmod        = 18
+	sendCmdChown        = 19
+	sendCmdEnd          = 21
+	sendCmdUpdateExtent = 22
+
+	sendAttrPath   = 15
+	sendAttrPathTo = 16
+)
+
+const sendStreamMagic = "btrfs-stream\x00"
+
+// Entries being created, deleted or moved out of the way get temporary
+// top-level names like o257-12-0 until they reach their final place.
+var orphanName = regexp.MustCompile(`^o[0-9]+-[0-9]+-[0-9]+(/|$)`)
+
+// diffTracker follows the paths of a send stream. Keys are current paths;
+// origin maps renamed pre-existing entries to where they were in <from>.
+type diffTracker struct {
+	created  map[string]bool
+	modified map[string]bool
+	origin   map[string]string
+	deleted  map[string]bool
+}
+
+func newDiffTracker() *diffTracker {
+	return &diffTracker{created: map[string]bool{}, modified: map[string]bool{}, origin: map[string]string{}, deleted: map[string]bool{}}
+}
+
+func (t *diffTracker) size() int { return len(t.created) + len(t.modified) + len(t.origin) + len(t.deleted) }
+
+// under reports whether p is key or below it.
+func under(p, key string) bool { return p == key || strings.HasPrefix(p, key+"/") }
+
+// isCreated reports whether p or one of its parents is new in <to>.
+func (t *diffTracker) isCreated(p string) bool {
+	for q := p; ; {
+		if t.created[q] { return true }
+		i := strings.LastIndex(q, "/")
+		if i < 0 { return false }
+		q = q[:i]
+	}
+}
+
+// originOf returns where p was in <from>, following renames of p or its parents.
+func (t *diffTracker) originOf(p string) string {
+	for q := p; ; {
+		if o, ok := t.origin[q]; ok { return o + p[len(q):] }
+		i := strings.LastIndex(q, "/")
+		if i < 0 { return p }
+		q = q[:i]
+	}
+}
+
+func rekey[V any](m map[string]V, from, to string) {
+	for k, v := range m {
+		if under(k, from) {
+			delete(m, k)
+			m[to+k[len(from):]] = v
+		}
+	}
+}
+
+func (t *diffTracker) rename(from, to string) {
+	if !t.isCreated(from) {
+		if _, ok := t.origin[from]; !ok { t.origin[from] = t.originOf(from) }
+	}
+	rekey(t.created, from, to)
+	rekey(t.modified, from, to)
+	rekey(t.origin, from, to)
+}
+
+func (t *diffTracker) modify(p string) {
+	if !t.isCreated(p) { t.modified[p] = true }
+}
+
+func (t *diffTracker) remove(p string) {
+	if !t.isCreated(p) { t.deleted[t.originOf(p)] = true }
+	delete(t.created, p)
+	delete(t.modified, p)
+	delete(t.origin, p)
+}
+
+func (t *diffTracker) result(from, to string) *SnapshotDiff {
+	d := &SnapshotDiff{From: from, To: to, Created: []string{}, Modified: []string{}, Deleted: []string{}, Renamed: []RenamedPath{}}
+	for p := range t.created {
+		if orphanName.MatchString(p) { continue }
+		// Deleted and created again under the same name: replaced.
+		if t.deleted[p] {
+			delete(t.deleted, p)
+			t.modified[p] = true
+			continue
+		}
+		d.Created = append(d.Created, p)
+	}
+	for p := range t.modified {
+		if !orphanName.MatchString(p) { d.Modified = append(d.Modified, p) }
+	}
+	for p := range t.deleted { d.Deleted = append(d.Deleted, p) }
+	for p, o := range t.origin {
+		if p != o && !orphanName.MatchString(p) { d.Renamed = append(d.Renamed, RenamedPath{From: o, To: p}) }
+	}
+	sort.Strings(d.Created)
+	sort.Strings(d.Modified)
+	sort.Strings(d.Deleted)
+	sort.Slice(d.Renamed, func(i, j int) bool { return d.Renamed[i].To < d.Renamed[j].To })
+	return d
+}
+
+// parseSendStream applies the commands of a send stream to t until the end
+// command, or until limit paths are tracked (returning false).
+func parseSendStream(r io.Reader, t *diffTracker, limit int) (bool, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(sendStreamMagic)+4)
+	if _, err := io.ReadFull(br, header); err != nil { return false, fmt.Errorf("reading stream header: %v", err) }
+	if string(header[:len(sendStreamMagic)]) != sendStreamMagic { return false, fmt.Errorf("not a btrfs send stream") }
+
+	cmdHeader := make([]byte, 10) // le32 length, le16 command, le32 crc
+	for {
+		if _, err := io.ReadFull(br, cmdHeader); err != nil {
+			if err == io.EOF { return true, nil }
+			return false, fmt.Errorf("reading command: %v", err)
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(cmdHeader[0:4]))
+		if _, err := io.ReadFull(br, payload); err != nil { return false, fmt.Errorf("reading command: %v", err) }
+		cmd := binary.LittleEndian.Uint16(cmdHeader[4:6])
+		if cmd == sendCmdEnd { return true, nil }
+
+		attrs := map[uint16]string{}
+		for len(payload) >= 4 {
+			typ, n := binary.LittleEndian.Uint16(payload[0:2]), int(binary.LittleEndian.Uint16(payload[2:4]))
+			if 4+n > len(payload) { break }
+			if typ == sendAttrPath || typ == sendAttrPathTo { attrs[typ] = string(payload[4 : 4+n]) }
+			payload = payload[4+n:]
+		}
+		path := attrs[sendAttrPath]
+		switch cmd {
+		case sendCmdMkfile, sendCmdMkdir, sendCmdMknod, sendCmdMkfifo, sendCmdMksock, sendCmdSymlink, sendCmdLink:
+			t.created[path] = true
+		case sendCmdRename:
+			t.rename(path, attrs[sendAttrPathTo])
+		case sendCmdUnlink, sendCmdRmdir:
+			t.remove(path)
+		case sendCmdWrite, sendCmdClone, sendCmdTruncate, sendCmdUpdateExtent, sendCmdChmod, sendCmdChown, sendCmdSetXattr, sendCmdRemoveXattr:
+			t.modify(path)
+		}
+		if t.size() > limit { return false, nil }
+	}
+}
+
+// diffSnapshots compares two read-only snapshots of the same filesystem.
+func diffSnapshots(fromPath, toPath string) (*SnapshotDiff, error) {
+	cmd := exec.Command("btrfs", "send", "--no-data", "-q", "-p", fromPath, toPath)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil { return nil, err }
+	if err := cmd.Start(); err != nil { return nil, err }
+
+	t := newDiffTracker()
+	complete, parseErr := parseSendStream(stdout, t, maxDiffPaths)
+	if !complete || parseErr != nil { cmd.Process.Kill() }
+	waitErr := cmd.Wait()
+	if parseErr != nil { return nil, fmt.Errorf("%v %s", parseErr, strings.TrimSpace(stderr.String())) }
+	if complete && waitErr != nil { return nil, fmt.Errorf("btrfs send: %v: %s", waitErr, strings.TrimSpace(stderr.String())) }
+
+	d := t.result(filepath.Base(fromPath), filepath.Base(toPath))
+	d.Truncated = !complete
+	return d, nil
+}
+
+// handleSnapshotDiff lists what changed from snapshot ?from= to ?to= of ?job=.
+func handleSnapshotDiff(w http.ResponseWriter, r *http.Request) {
+	job, err := jobFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if job.Writable {
+		http.Error(w, "Snapshots of a writable job can't be compared, btrfs send needs read-only snapshots", 400)
+		return
+	}
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if from == "" || to == "" || from == to {
+		http.Error(w, "from and to must name two different snapshots", 400)
+		return
+	}
+	var paths []string
+	for _, name := range []string{from, to} {
+		p, err := snapshotRoot(job, name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: %v", name, err), 400)
+			return
+		}
+		if _, err := os.Stat(p); err != nil {
+			http.Error(w, fmt.Sprintf("snapshot %s not found", name), 404)
+			return
+		}
+		paths = append(paths, p)
+	}
+	d, err := diffSnapshots(paths[0], paths[1])
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(d)
+}
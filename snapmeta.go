@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// --- Snapshot Descriptions and Tags ---
+// A manual snapshot can carry a description ("before NC 29 upgrade") and
+// tags. They are kept in the state by snapshot path, like pins, shown in the
+// snapshot list and dropped when the snapshot is deleted. Retention can
+// treat tagged snapshots apart: a tag rule takes the snapshots with its tag
+// out of the job's policy and applies its own (the first matching rule
+// wins), e.g. keep the last three "upgrade" snapshots whatever the hourly
+// ones do.
+
+type SnapshotMeta struct {
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// TagRetention is the retention of the snapshots tagged Tag: Mode count or
+// time as for the job, or keep for all of them.
+type TagRetention struct {
+	Tag   string `json:"tag"`
+	Mode  string `json:"mode"`
+	Value int    `json:"value,omitempty"`
+	Unit  string `json:"unit,omitempty"`
+}
+
+const (
+	maxSnapshotTags        = 10
+	maxSnapshotDescription = 500
+)
+
+func (m *SnapshotMeta) normalize() error {
+	m.Description = strings.TrimSpace(m.Description)
+	if len(m.Description) > maxSnapshotDescription { return fmt.Errorf("description must be at most %d characters", maxSnapshotDescription) }
+	seen := map[string]bool{}
+	var tags []string
+	for _, t := range m.Tags {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[t] { continue }
+		if len(t) > 64 || strings.ContainsAny(t, ",\n") { return fmt.Errorf("tag %q must be one line of at most 64 characters without commas", t) }
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	if len(tags) > maxSnapshotTags { return fmt.Errorf("at most %d tags", maxSnapshotTags) }
+	m.Tags = tags
+	return nil
+}
+
+func (m SnapshotMeta) empty() bool { return m.Description == "" && len(m.Tags) == 0 }
+
+func (m SnapshotMeta) hasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag { return true }
+	}
+	return false
+}
+
+func (t TagRetention) validate() error {
+	if strings.TrimSpace(t.Tag) == "" { return fmt.Errorf("tag rules need a tag") }
+	if t.Mode == "keep" { return nil }
+	return RetentionConfig{Enabled: true, Mode: t.Mode, Value: t.Value, Unit: t.Unit}.validate()
+}
+
+func snapshotMeta(job SnapshotJob, name string) SnapshotMeta {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.SnapshotMeta[snapshotPath(job.Dest, name)]
+}
+
+// recordSnapshotMeta stores meta for the snapshot at path.
+func recordSnapshotMeta(path string, meta SnapshotMeta) {
+	if meta.empty() { return }
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.SnapshotMeta == nil { state.SnapshotMeta = map[string]SnapshotMeta{} }
+	state.SnapshotMeta[path] = meta
+	saveState()
+}
+
+// forgetSnapshotMeta drops the metadata of a deleted snapshot.
+func forgetSnapshotMeta(path string) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if _, ok := state.SnapshotMeta[path]; !ok { return }
+	delete(state.SnapshotMeta, path)
+	saveState()
+}
+
+// selectJobRetentionDeletes is selectRetentionDeletes with the job's tag
+// rules: snaps (newest first) with a ruled tag are kept or pruned by their
+// rule, the rest by the job's policy.
+func selectJobRetentionDeletes(job SnapshotJob, snaps []SnapInfo, now time.Time) []SnapInfo {
+	cfg := job.Retention
+	if len(cfg.Tags) == 0 { return selectRetentionDeletes(snaps, cfg, now) }
+	state.mu.Lock()
+	groups := make([][]SnapInfo, len(cfg.Tags))
+	var rest []SnapInfo
+	for _, s := range snaps {
+		meta := state.SnapshotMeta[snapshotPath(job.Dest, s.Name)]
+		ruled := false
+		for i, t := range cfg.Tags {
+			if meta.hasTag(t.Tag) {
+				groups[i] = append(groups[i], s)
+				ruled = true
+				break
+			}
+		}
+		if !ruled { rest = append(rest, s) }
+	}
+	state.mu.Unlock()
+
+	deletes := selectRetentionDeletes(rest, cfg, now)
+	for i, t := range cfg.Tags {
+		if t.Mode == "keep" { continue }
+		deletes = append(deletes, selectRetentionDeletes(groups[i], RetentionConfig{Enabled: true, Mode: t.Mode, Value: t.Value, Unit: t.Unit}, now)...)
+	}
+	return deletes
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Snapshot Naming ---
+// Snapshots are named Prefix + the job's name template, a strftime-like
+// pattern expanded at snapshot time. Retention and receive verification
+// parse names back through the same template, so after it changes, the
+// snapshots named the old way are no longer managed by the job.
+//
+//	%Y %y %m %d %j   year, 2-digit year, month, day, day of the year
+//	%H %M %S         hour, minute, second
+//	%b %Z %z         month name (Jan), zone name (UTC), zone offset (+0100)
+//	%s %%            unix time, a literal %
+//	{hostname} {job} the host name and the job ID
+
+// defaultNameTemplate spells the original fixed layout, 02-01-2006-15-04-MST.
+const defaultNameTemplate = "%d-%m-%Y-%H-%M-%Z"
+
+var nameVerbs = map[byte]struct{ layout, pattern string }{
+	'Y': {"2006", `[0-9]{4}`},
+	'y': {"06", `[0-9]{2}`},
+	'm': {"01", `[0-9]{2}`},
+	'd': {"02", `[0-9]{2}`},
+	'j': {"002", `[0-9]{3}`},
+	'H': {"15", `[0-9]{2}`},
+	'M': {"04", `[0-9]{2}`},
+	'S': {"05", `[0-9]{2}`},
+	'b': {"Jan", `[A-Z][a-z]{2}`},
+	'Z': {"MST", `[A-Za-z]{3,5}|[+-][0-9]{2,4}`},
+	'z': {"-0700", `[+-][0-9]{4}`},
+	's': {"", `[0-9]+`},
+}
+
+// namePart is literal text, or a time field when verb is set.
+type namePart struct {
+	literal string
+	verb    byte
+}
+
+type snapshotNaming struct {
+	parts []namePart
+	re    *regexp.Regexp
+	zoned bool // the name carries its zone, otherwise it is local time
+}
+
+func compileNameTemplate(tmpl, jobID, hostname string) (*snapshotNaming, error) {
+	n := &snapshotNaming{}
+	var lit strings.Builder
+	flush := func() {
+		if lit.Len() > 0 { n.parts = append(n.parts, namePart{literal: lit.String()}) }
+		lit.Reset()
+	}
+	for i := 0; i < len(tmpl); i++ {
+		switch {
+		case strings.HasPrefix(tmpl[i:], "{hostname}"):
+			lit.WriteString(hostname)
+			i += len("{hostname}") - 1
+		case strings.HasPrefix(tmpl[i:], "{job}"):
+			lit.WriteString(jobID)
+			i += len("{job}") - 1
+		case tmpl[i] != '%':
+			lit.WriteByte(tmpl[i])
+		case i+1 == len(tmpl):
+			return nil, fmt.Errorf("template ends with a lone %%")
+		case tmpl[i+1] == '%':
+			lit.WriteByte('%')
+			i++
+		default:
+			v := tmpl[i+1]
+			if _, ok := nameVerbs[v]; !ok { return nil, fmt.Errorf("unknown token %%%c", v) }
+			flush()
+			n.parts = append(n.parts, namePart{verb: v})
+			n.zoned = n.zoned || v == 'Z' || v == 'z' || v == 's'
+			i++
+		}
+	}
+	flush()
+
+	var re strings.Builder
+	re.WriteString("^")
+	for _, p := range n.parts {
+		if p.verb == 0 {
+			re.WriteString(regexp.QuoteMeta(p.literal))
+		} else {
+			re.WriteString("(" + nameVerbs[p.verb].pattern + ")")
+		}
+	}
+	re.WriteString("$")
+	var err error
+	n.re, err = regexp.Compile(re.String())
+	return n, err
+}
+
+func (n *snapshotNaming) has(verbs string) bool {
+	for _, p := range n.parts {
+		if p.verb != 0 && strings.IndexByte(verbs, p.verb) >= 0 { return true }
+	}
+	return false
+}
+
+// validate makes sure names tell the snapshot's date and stay in the
+// destination directory.
+func (n *snapshotNaming) validate() error {
+	for _, p := range n.parts {
+		if strings.Contains(p.literal, "/") { return fmt.Errorf("name template must not contain '/'") }
+	}
+	if n.has("s") { return nil }
+	if !n.has("Yy") || !(n.has("j") || (n.has("m") || n.has("b")) && n.has("d")) {
+		return fmt.Errorf("name template needs the date: %%Y or %%y with %%m and %%d (or %%j), or %%s")
+	}
+	return nil
+}
+
+func (n *snapshotNaming) format(t time.Time) string {
+	var b strings.Builder
+	for _, p := range n.parts {
+		switch p.verb {
+		case 0: b.WriteString(p.literal)
+		case 's': b.WriteString(strconv.FormatInt(t.Unix(), 10))
+		default: b.WriteString(t.Format(nameVerbs[p.verb].layout))
+		}
+	}
+	return b.String()
+}
+
+func (n *snapshotNaming) parse(name string) (time.Time, bool) {
+	m := n.re.FindStringSubmatch(name)
+	if m == nil { return time.Time{}, false }
+	var layout, value []string
+	i := 1
+	for _, p := range n.parts {
+		if p.verb == 0 { continue }
+		if p.verb == 's' {
+			sec, err := strconv.ParseInt(m[i], 10, 64)
+			return time.Unix(sec, 0), err == nil
+		}
+		layout, value = append(layout, nameVerbs[p.verb].layout), append(value, m[i])
+		i++
+	}
+	var t time.Time
+	var err error
+	if n.zoned {
+		t, err = time.Parse(strings.Join(layout, " "), strings.Join(value, " "))
+	} else {
+		t, err = time.ParseInLocation(strings.Join(layout, " "), strings.Join(value, " "), time.Local)
+	}
+	return t, err == nil
+}
+
+var namingCache sync.Map // template + job ID + hostname -> *snapshotNaming
+
+// naming returns the job's compiled name template (Prefix excluded).
+func (j SnapshotJob) naming() (*snapshotNaming, error) {
+	tmpl := j.nameTemplate()
+	hostname, _ := os.Hostname()
+	key := tmpl + "\x00" + j.ID + "\x00" + hostname
+	if n, ok := namingCache.Load(key); ok { return n.(*snapshotNaming), nil }
+	n, err := compileNameTemplate(tmpl, j.ID, hostname)
+	if err != nil { return nil, err }
+	namingCache.Store(key, n)
+	return n, nil
+}
+
+func (j SnapshotJob) nameTemplate() string {
+	if j.NameTemplate == "" { return defaultNameTemplate }
+	return j.NameTemplate
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Snapshot Sizes ---
+// With snapshot_sizes enabled, quotas are switched on for the filesystems
+// holding the snapshot destinations and `qgroup show` is refreshed
+// periodically, so the snapshot list can show how much each snapshot
+// references and how much it holds exclusively, which is what deleting it
+// would free. Quotas cost some write performance, hence opt-in.
+
+type SnapshotSizesConfig struct {
+	Enabled        bool `json:"enabled"`
+	RefreshMinutes int  `json:"refresh_minutes,omitempty"` // default 60
+}
+
+const defaultSizeRefresh = 60 * time.Minute
+
+var snapshotSizes = struct {
+	mu         sync.Mutex
+	refreshed  map[string]time.Time // destination -> last qgroup refresh
+	quotaTried map[string]bool      // destinations quotas were enabled for
+}{refreshed: map[string]time.Time{}, quotaTried: map[string]bool{}}
+
+func (c SnapshotSizesConfig) interval() time.Duration {
+	if c.RefreshMinutes <= 0 { return defaultSizeRefresh }
+	return time.Duration(c.RefreshMinutes) * time.Minute
+}
+
+// sizeDestinations are the distinct snapshot and archive destinations.
+func sizeDestinations(cfg Config) []string {
+	seen := map[string]bool{}
+	var dests []string
+	for _, j := range cfg.SnapshotJobs {
+		for _, d := range []string{j.Dest, j.Archive.Dest} {
+			if d = filepath.Clean(d); d != "." && !seen[d] && (d == filepath.Clean(j.Dest) || j.Archive.Enabled) {
+				seen[d], dests = true, append(dests, d)
+			}
+		}
+	}
+	return dests
+}
+
+// refreshSnapshotSizes refreshes the qgroups of dest, enabling quotas the
+// first time they turn out to be off.
+func refreshSnapshotSizes(dest string) {
+	report := refreshQgroups(dest)
+	if report.Error == "" || !strings.Contains(strings.ToLower(report.Error), "quota") { return }
+	snapshotSizes.mu.Lock()
+	tried := snapshotSizes.quotaTried[dest]
+	snapshotSizes.quotaTried[dest] = true
+	snapshotSizes.mu.Unlock()
+	if tried { return }
+	printDockerLog("QUOTA", "Enabling quotas on %s for snapshot sizes", dest)
+	_, done := startCommand("QUOTA ENABLE", "📏", dest, "btrfs", "quota", "enable", dest)
+	<-done
+	refreshQgroups(dest)
+}
+
+// runSnapshotSizeRefresher refreshes each destination once per interval
+// while snapshot_sizes is enabled.
+func runSnapshotSizeRefresher() {
+	for ; ; time.Sleep(time.Minute) {
+		state.mu.Lock()
+		cfg := state.Config
+		state.mu.Unlock()
+		if !cfg.SnapshotSizes.Enabled || shuttingDown() { continue }
+		for _, dest := range sizeDestinations(cfg) {
+			snapshotSizes.mu.Lock()
+			due := time.Since(snapshotSizes.refreshed[dest]) >= cfg.SnapshotSizes.interval()
+			if due { snapshotSizes.refreshed[dest] = time.Now() }
+			snapshotSizes.mu.Unlock()
+			if due { refreshSnapshotSizes(dest) }
+		}
+	}
+}
+
+// annotateSnapshotSizes fills in the sizes of the snapshots in dest from
+// the cached qgroups.
+func annotateSnapshotSizes(dest string, list []SnapshotItem) {
+	state.mu.Lock()
+	enabled := state.Config.SnapshotSizes.Enabled
+	report := state.qgroups[filepath.Clean(dest)]
+	state.mu.Unlock()
+	if !enabled || report == nil || len(report.Qgroups) == 0 { return }
+	groups := map[uint64]Qgroup{}
+	for _, g := range report.Qgroups {
+		if g.Level == 0 { groups[g.SubvolID] = g }
+	}
+	for i := range list {
+		id, err := btrfsFS.SubvolumeID(snapshotPath(dest, list[i].Name))
+		if err != nil { continue }
+		if g, ok := groups[id]; ok {
+			list[i].Referenced, list[i].Exclusive = &g.Referenced, &g.Exclusive
+			list[i].SizesUpdated = report.Updated
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// --- Snapshot Creation Times ---
+// Names carry local time with a zone abbreviation, which only parses to the
+// right instant in the zone the snapshot was taken in: after a TZ change or
+// around DST they come out an hour or more off. The time of every snapshot
+// this app takes is therefore also recorded in UTC in a sidecar file in the
+// destination. Names are only parsed for snapshots without an entry (taken
+// before the sidecar existed, received, or made by other tools).
+
+const snapshotTimesFile = ".snapshot-times.json"
+
+var snapshotTimesMu sync.Mutex
+
+func loadSnapshotTimes(dest string) map[string]time.Time {
+	times := map[string]time.Time{}
+	data, err := os.ReadFile(filepath.Join(dest, snapshotTimesFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &times); err != nil { logWarn("SNAPSHOT", "Ignoring %s in %s: %v", snapshotTimesFile, dest, err) }
+	}
+	return times
+}
+
+// recordSnapshotTime stores when dest/name was taken and drops entries of
+// snapshots that no longer exist.
+func recordSnapshotTime(dest, name string, t time.Time) {
+	snapshotTimesMu.Lock()
+	defer snapshotTimesMu.Unlock()
+
+	times := loadSnapshotTimes(dest)
+	for n := range times {
+		if _, err := os.Lstat(snapshotPath(dest, n)); os.IsNotExist(err) { delete(times, n) }
+	}
+	times[name] = t.UTC()
+
+	data, _ := json.MarshalIndent(times, "", "  ")
+	if err := writeFileAtomic(filepath.Join(dest, snapshotTimesFile), data, 0644); err != nil {
+		logWarn("SNAPSHOT", "Cannot record creation time of %s: %v", name, err)
+	}
+}
+
+// snapshotTime reports whether name belongs to the job and when it was
+// taken, preferring the recorded time over the one in the name.
+func (j SnapshotJob) snapshotTime(name string, times map[string]time.Time) (time.Time, bool) {
+	t, ok := j.parseSnapshotTime(name)
+	if !ok { return t, false }
+	if recorded, found := times[name]; found { return recorded, true }
+	return t, true
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// --- Web UI State Backups ---
+// Optionally keep the app's own state on a btrfs subvolume and snapshot it
+// before every config change. The backups are exposed as a built-in snapshot
+// job, so listing, browsing, restore and rollback work exactly like they do
+// for user data (?job=webui-state).
+
+type StateBackupConfig struct {
+	Enabled bool `json:"enabled"`
+	Keep    int  `json:"keep"`
+}
+
+const (
+	stateJobID      = "webui-state"
+	stateSubvolName = "state"
+	stateSnapsName  = ".state-snapshots"
+)
+
+// stateFile is where saveState writes; it moves into the state subvolume
+// once one exists.
+var stateFile = filepath.Join(stateDir, "state.json")
+
+func stateSubvolume() string { return filepath.Join(stateDir, stateSubvolName) }
+
+// locateStateFile prefers the state subvolume when it already holds state.
+func locateStateFile() {
+	p := filepath.Join(stateSubvolume(), "state.json")
+	if _, err := os.Stat(p); err == nil {
+		stateFile = p
+	}
+}
+
+func stateBackupJob(cfg StateBackupConfig) SnapshotJob {
+	keep := cfg.Keep
+	if keep <= 0 { keep = 10 }
+	return SnapshotJob{
+		ID:        stateJobID,
+		Name:      "Web UI State",
+		Source:    stateSubvolume(),
+		Dest:      filepath.Join(stateDir, stateSnapsName),
+		Retention: RetentionConfig{Enabled: true, Mode: "count", Value: keep, Unit: "days"},
+	}
+}
+
+// ensureStateSubvolume converts the flat state file into a subvolume layout
+// when backups are enabled. Failures (e.g. the state directory is not on
+// btrfs) leave the flat file in place.
+func ensureStateSubvolume() {
+	state.mu.Lock()
+	enabled := state.Config.StateBackup.Enabled
+	state.mu.Unlock()
+	if !enabled { return }
+
+	sub := stateSubvolume()
+	if _, err := os.Stat(sub); err != nil {
+		if err := btrfsFS.CreateSubvolume(sub); err != nil {
+			logWarn("STATE", "Cannot create state subvolume %s: %v", sub, err)
+			return
+		}
+		printDockerLog("STATE", "Created state subvolume %s", sub)
+	}
+
+	target := filepath.Join(sub, "state.json")
+	if stateFile != target {
+		if err := os.Rename(stateFile, target); err != nil && !os.IsNotExist(err) {
+			logWarn("STATE", "Cannot move state into subvolume: %v", err)
+			return
+		}
+		state.mu.Lock()
+		stateFile = target
+		saveState()
+		state.mu.Unlock()
+	}
+}
+
+// backupStateBeforeChange snapshots the state subvolume and applies the
+// mini-retention. Must be called without state.mu held.
+func backupStateBeforeChange(reason string) {
+	// The snapshot must hold what was saved so far.
+	flushState()
+	state.mu.Lock()
+	cfg := state.Config.StateBackup
+	file := stateFile
+	state.mu.Unlock()
+	if !cfg.Enabled || filepath.Dir(file) != stateSubvolume() { return }
+
+	job := stateBackupJob(cfg)
+	os.MkdirAll(job.Dest, 0755)
+	now := time.Now()
+	name := job.snapshotName(now)
+	target := snapshotPath(job.Dest, name)
+	// Names have minute resolution; the first backup of a burst of edits
+	// already holds the state from before all of them.
+	if _, err := os.Stat(target); err == nil { return }
+	out, err := exec.Command("btrfs", snapshotArgs(job.Source, target, true)...).CombinedOutput()
+	if err != nil {
+		logError("STATE", "State backup failed: %v %s", err, out)
+		logHistory("STATE BACKUP", "💾", job.Dest, "Failed", string(out)+"\nError: "+err.Error())
+		return
+	}
+	recordSnapshotTime(job.Dest, name, now)
+	printDockerLog("STATE", "Backed up state as %s before %s", name, reason)
+	enforceRetention(job, nil)
+}
+
+// reloadConfigFromDisk re-reads only the config from the state file, used
+// after the state subvolume was rolled back. History stays as it is in
+// memory so the rollback itself remains visible. With --config the config
+// is not part of the state and a rollback leaves it alone.
+func reloadConfigFromDisk() {
+	if configFile != "" { return }
+	data, err := os.ReadFile(stateFile)
+	if err != nil { return }
+	var loaded AppState
+	if json.Unmarshal(data, &loaded) != nil { return }
+	state.mu.Lock()
+	// The open store keeps serving history, so keep the driver it belongs to.
+	loaded.Config.Storage = state.Config.Storage
+	state.Config = loaded.Config
+	setAppTimezone(loaded.Config)
+	state.mu.Unlock()
+	printDockerLog("STATE", "Reloaded config from %s", stateFile)
+	go refreshSchedules()
+	go restartKernelWatcher()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// --- State Directory ---
+// Everything the app keeps for itself (state.json, history, metrics, the
+// audit log, keys and certificates) lives in one directory, set with
+// --state-dir or $STATE_DIR. The container image sets /data. Elsewhere it
+// defaults to /var/lib/btrfs-webui for root and $XDG_DATA_HOME/btrfs-webui
+// for other users, and state left in /data by earlier versions, which had
+// that path built in, is moved over on the first start.
+
+const legacyStateDir = "/data"
+
+var stateDir = legacyStateDir
+
+// legacyStateEntries are what earlier versions kept in /data.
+var legacyStateEntries = []string{
+	"state.json", stateSubvolName, stateSnapsName,
+	"history.json", "metrics.jsonl", "audit.jsonl",
+	"btrfs-manager.db", "btrfs-manager.db-wal", "btrfs-manager.db-shm", "btrfs-manager.bolt",
+	shareKeyFile, tlsDirName, acmeDirName,
+}
+
+func defaultStateDir() string {
+	if os.Geteuid() != 0 {
+		if d := os.Getenv("XDG_DATA_HOME"); d != "" { return filepath.Join(d, "btrfs-webui") }
+		if home, err := os.UserHomeDir(); err == nil { return filepath.Join(home, ".local", "share", "btrfs-webui") }
+	}
+	return "/var/lib/btrfs-webui"
+}
+
+// hasState reports whether dir holds a state file, flat or in the state
+// subvolume.
+func hasState(dir string) bool {
+	for _, p := range []string{filepath.Join(dir, "state.json"), filepath.Join(dir, stateSubvolName, "state.json")} {
+		if _, err := os.Stat(p); err == nil { return true }
+	}
+	return false
+}
+
+// setStateDir points the state file and the default store at dir, moving
+// the state over from /data first if dir has none yet.
+func setStateDir(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil { return err }
+	if err := os.MkdirAll(dir, 0700); err != nil { return fmt.Errorf("state directory: %v", err) }
+	if dir != legacyStateDir && !hasState(dir) && hasState(legacyStateDir) {
+		if err := migrateStateDir(legacyStateDir, dir); err != nil { return fmt.Errorf("moving the state from %s to %s: %v", legacyStateDir, dir, err) }
+	}
+	stateDir = dir
+	stateFile = filepath.Join(dir, "state.json")
+	store = newJSONStore(dir)
+	return nil
+}
+
+// migrateStateDir moves the known entries from one state directory to
+// another. Across filesystems they are copied and the originals are left
+// in place; the state subvolume and its snapshots can't be copied as such,
+// so only the state file in it is, and enabled state backups start over in
+// the new directory.
+func migrateStateDir(from, to string) error {
+	moved, copied := 0, false
+	for _, name := range legacyStateEntries {
+		src, dst := filepath.Join(from, name), filepath.Join(to, name)
+		if _, err := os.Lstat(src); err != nil { continue }
+		err := os.Rename(src, dst)
+		if errors.Is(err, syscall.EXDEV) {
+			switch name {
+			case stateSnapsName:
+				printDockerLog("STATE", "State backups in %s stay where they are", src)
+				continue
+			case stateSubvolName:
+				src, dst = filepath.Join(src, "state.json"), filepath.Join(to, "state.json")
+			}
+			var out []byte
+			if out, err = exec.Command("cp", "-a", src, dst).CombinedOutput(); err != nil { err = fmt.Errorf("%v %s", err, out) }
+			copied = true
+		}
+		if err != nil { return fmt.Errorf("%s: %v", name, err) }
+		moved++
+	}
+	printDockerLog("STATE", "Moved %d entries of the state from %s to %s", moved, from, to)
+	if copied { printDockerLog("STATE", "%s is on another filesystem: the entries were copied, the originals can be removed", to) }
+	return nil
+}
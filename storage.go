@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// --- Storage Drivers ---
+// History, metrics and the audit log go through a Store so busy installs
+// can use a real database. The config itself always stays in state.json: it
+// is small, easy to edit by hand and is what the state backups snapshot.
+
+type StorageConfig struct {
+	Driver string `json:"driver"` // json (default), sqlite, bbolt
+	Path   string `json:"path"`   // optional database file (directory for json), defaults under the state directory
+}
+
+type MetricSample struct {
+	Name   string    `json:"name"`
+	Target string    `json:"target"`
+	Time   time.Time `json:"time"`
+	Value  float64   `json:"value"`
+}
+
+type Store interface {
+	LoadHistory() ([]LogEntry, error)
+	SaveHistory(history []LogEntry) error
+	AppendMetrics(samples ...MetricSample) error
+	// QueryMetrics returns samples since the given time, oldest first. An
+	// empty name or target matches all.
+	QueryMetrics(name, target string, since time.Time) ([]MetricSample, error)
+	PruneMetrics(before time.Time) error
+	AppendAudit(e AuditEntry) error
+	// QueryAudit returns the audit entries since the given time, oldest
+	// first.
+	QueryAudit(since time.Time) ([]AuditEntry, error)
+	PruneAudit(before time.Time) error
+	Close() error
+}
+
+const metricsRetention = 90 * 24 * time.Hour
+
+var store Store = newJSONStore(stateDir)
+
+func openStore(cfg StorageConfig) (Store, error) {
+	switch cfg.Driver {
+	case "", "json":
+		dir := stateDir
+		if cfg.Path != "" { dir = cfg.Path }
+		return newJSONStore(dir), nil
+	case "sqlite":
+		path := cfg.Path
+		if path == "" { path = filepath.Join(stateDir, "btrfs-manager.db") }
+		return newSQLiteStore(path)
+	case "bbolt":
+		path := cfg.Path
+		if path == "" { path = filepath.Join(stateDir, "btrfs-manager.bolt") }
+		return newBoltStore(path)
+	}
+	return nil, fmt.Errorf("unknown storage driver %q", cfg.Driver)
+}
+
+// switchStore moves history, metrics and the audit log into a newly
+// configured store.
+// Caller must hold state.mu.
+func switchStore(cfg StorageConfig) error {
+	next, err := openStore(cfg)
+	if err != nil { return err }
+	if err := next.SaveHistory(state.History); err != nil {
+		next.Close()
+		return err
+	}
+	if samples, err := store.QueryMetrics("", "", time.Time{}); err == nil && len(samples) > 0 {
+		if err := next.AppendMetrics(samples...); err != nil {
+			next.Close()
+			return err
+		}
+	}
+	if entries, err := store.QueryAudit(time.Time{}); err == nil {
+		for _, e := range entries {
+			if err := next.AppendAudit(e); err != nil {
+				next.Close()
+				return err
+			}
+		}
+	}
+	store.Close()
+	store = next
+	printDockerLog("STORAGE", "Switched storage driver to %s", storageDriverName(cfg))
+	return nil
+}
+
+func storageDriverName(cfg StorageConfig) string {
+	if cfg.Driver == "" { return "json" }
+	return cfg.Driver
+}
+
+func sortMetrics(samples []MetricSample) {
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+}
+
+// recordMetrics stores samples and logs (rather than fails) on error.
+func recordMetrics(samples ...MetricSample) {
+	if err := store.AppendMetrics(samples...); err != nil {
+		logWarn("STORAGE", "Failed to record metrics: %v", err)
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := q.Get("name")
+	if name == "" {
+		http.Error(w, "name required", 400)
+		return
+	}
+	since := time.Now().Add(-24 * time.Hour)
+	if s := q.Get("since"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			http.Error(w, "Invalid since duration: "+err.Error(), 400)
+			return
+		}
+		since = time.Now().Add(-d)
+	}
+	samples, err := store.QueryMetrics(name, q.Get("target"), since)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if samples == nil { samples = []MetricSample{} }
+	json.NewEncoder(w).Encode(samples)
+}
+
+// --- JSON Driver ---
+// history.json holds the capped history, metrics.jsonl and audit.jsonl are
+// append-only.
+
+type jsonStore struct {
+	dir string
+}
+
+func newJSONStore(dir string) *jsonStore { return &jsonStore{dir: dir} }
+
+func (s *jsonStore) historyPath() string { return filepath.Join(s.dir, "history.json") }
+func (s *jsonStore) metricsPath() string { return filepath.Join(s.dir, "metrics.jsonl") }
+func (s *jsonStore) auditPath() string   { return filepath.Join(s.dir, "audit.jsonl") }
+
+func (s *jsonStore) LoadHistory() ([]LogEntry, error) {
+	data, err := os.ReadFile(s.historyPath())
+	if os.IsNotExist(err) { return nil, nil }
+	if err != nil { return nil, err }
+	var history []LogEntry
+	err = json.Unmarshal(data, &history)
+	return history, err
+}
+
+func (s *jsonStore) SaveHistory(history []LogEntry) error {
+	data, _ := json.MarshalIndent(history, "", "  ")
+	return writeFileAtomic(s.historyPath(), data, 0644)
+}
+
+func (s *jsonStore) AppendMetrics(samples ...MetricSample) error {
+	return writeMetricLines(s.metricsPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, samples)
+}
+
+func (s *jsonStore) QueryMetrics(name, target string, since time.Time) ([]MetricSample, error) {
+	var out []MetricSample
+	err := s.scanMetrics(func(m MetricSample) {
+		if (name == "" || m.Name == name) && (target == "" || m.Target == target) && !m.Time.Before(since) {
+			out = append(out, m)
+		}
+	})
+	return out, err
+}
+
+func (s *jsonStore) PruneMetrics(before time.Time) error {
+	var keep []MetricSample
+	pruned := false
+	err := s.scanMetrics(func(m MetricSample) {
+		if m.Time.Before(before) { pruned = true; return }
+		keep = append(keep, m)
+	})
+	if err != nil || !pruned { return err }
+	tmp := s.metricsPath() + ".tmp"
+	if err := writeMetricLines(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, keep); err != nil { return err }
+	return os.Rename(tmp, s.metricsPath())
+}
+
+func writeMetricLines(path string, flag int, samples []MetricSample) error {
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil { return err }
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	for _, m := range samples {
+		if err := enc.Encode(m); err != nil { return err }
+	}
+	return nil
+}
+
+func (s *jsonStore) scanMetrics(fn func(MetricSample)) error {
+	f, err := os.Open(s.metricsPath())
+	if os.IsNotExist(err) { return nil }
+	if err != nil { return err }
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var m MetricSample
+		if json.Unmarshal(sc.Bytes(), &m) == nil { fn(m) }
+	}
+	return sc.Err()
+}
+
+func (s *jsonStore) AppendAudit(e AuditEntry) error {
+	return writeAuditLines(s.auditPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, []AuditEntry{e})
+}
+
+func (s *jsonStore) QueryAudit(since time.Time) ([]AuditEntry, error) {
+	var out []AuditEntry
+	err := s.scanAudit(func(e AuditEntry) {
+		if !e.Time.Before(since) { out = append(out, e) }
+	})
+	return out, err
+}
+
+func (s *jsonStore) PruneAudit(before time.Time) error {
+	var keep []AuditEntry
+	pruned := false
+	err := s.scanAudit(func(e AuditEntry) {
+		if e.Time.Before(before) { pruned = true; return }
+		keep = append(keep, e)
+	})
+	if err != nil || !pruned { return err }
+	tmp := s.auditPath() + ".tmp"
+	if err := writeAuditLines(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, keep); err != nil { return err }
+	return os.Rename(tmp, s.auditPath())
+}
+
+func writeAuditLines(path string, flag int, entries []AuditEntry) error {
+	f, err := os.OpenFile(path, flag, 0600)
+	if err != nil { return err }
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil { return err }
+	}
+	return nil
+}
+
+func (s *jsonStore) scanAudit(fn func(AuditEntry)) error {
+	f, err := os.Open(s.auditPath())
+	if os.IsNotExist(err) { return nil }
+	if err != nil { return err }
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(sc.Bytes(), &e) == nil { fn(e) }
+	}
+	return sc.Err()
+}
+
+func (s *jsonStore) Close() error { return nil }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// --- bbolt Driver ---
+// Metric keys are name \x00 target \x00 big-endian nanoseconds, so a prefix
+// scan over one series is already in time order. Audit keys are big-endian
+// nanoseconds followed by the bucket sequence, for requests at the same time.
+
+var (
+	boltHistory = []byte("history")
+	boltMetrics = []byte("metrics")
+	boltAudit   = []byte("audit")
+)
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil { return nil, err }
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{boltHistory, boltMetrics, boltAudit} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil { return err }
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) LoadHistory() ([]LogEntry, error) {
+	var history []LogEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltHistory).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var e LogEntry
+			if json.Unmarshal(v, &e) == nil { history = append(history, e) }
+		}
+		return nil
+	})
+	return history, err
+}
+
+func (s *boltStore) SaveHistory(history []LogEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(boltHistory); err != nil { return err }
+		b, err := tx.CreateBucket(boltHistory)
+		if err != nil { return err }
+		for _, e := range history {
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, uint64(e.ID))
+			data, _ := json.Marshal(e)
+			if err := b.Put(key, data); err != nil { return err }
+		}
+		return nil
+	})
+}
+
+func boltMetricKey(m MetricSample) []byte {
+	key := append([]byte(m.Name+"\x00"+m.Target+"\x00"), make([]byte, 8)...)
+	binary.BigEndian.PutUint64(key[len(key)-8:], uint64(m.Time.UnixNano()))
+	return key
+}
+
+func (s *boltStore) AppendMetrics(samples ...MetricSample) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltMetrics)
+		for _, m := range samples {
+			val := make([]byte, 8)
+			binary.BigEndian.PutUint64(val, math.Float64bits(m.Value))
+			if err := b.Put(boltMetricKey(m), val); err != nil { return err }
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) eachMetric(tx *bolt.Tx, prefix []byte, fn func(m MetricSample, k []byte)) {
+	c := tx.Bucket(boltMetrics).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		parts := bytes.SplitN(k[:len(k)-8], []byte{0}, 2)
+		if len(parts) != 2 || len(v) != 8 { continue }
+		fn(MetricSample{
+			Name:   string(parts[0]),
+			Target: string(parts[1][:len(parts[1])-1]),
+			Time:   time.Unix(0, int64(binary.BigEndian.Uint64(k[len(k)-8:]))),
+			Value:  math.Float64frombits(binary.BigEndian.Uint64(v)),
+		}, k)
+	}
+}
+
+func (s *boltStore) QueryMetrics(name, target string, since time.Time) ([]MetricSample, error) {
+	var prefix []byte
+	if name != "" { prefix = []byte(name + "\x00") }
+	if name != "" && target != "" { prefix = []byte(name + "\x00" + target + "\x00") }
+
+	var out []MetricSample
+	err := s.db.View(func(tx *bolt.Tx) error {
+		s.eachMetric(tx, prefix, func(m MetricSample, _ []byte) {
+			if (target == "" || m.Target == target) && !m.Time.Before(since) { out = append(out, m) }
+		})
+		return nil
+	})
+	// Several series come back grouped by key; callers expect time order.
+	if name == "" || target == "" { sortMetrics(out) }
+	return out, err
+}
+
+func (s *boltStore) PruneMetrics(before time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var stale [][]byte
+		s.eachMetric(tx, nil, func(m MetricSample, k []byte) {
+			if m.Time.Before(before) { stale = append(stale, append([]byte(nil), k...)) }
+		})
+		b := tx.Bucket(boltMetrics)
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil { return err }
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) AppendAudit(e AuditEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltAudit)
+		seq, _ := b.NextSequence()
+		key := make([]byte, 16)
+		binary.BigEndian.PutUint64(key, uint64(e.Time.UnixNano()))
+		binary.BigEndian.PutUint64(key[8:], seq)
+		data, _ := json.Marshal(e)
+		return b.Put(key, data)
+	})
+}
+
+func (s *boltStore) QueryAudit(since time.Time) ([]AuditEntry, error) {
+	start := make([]byte, 8)
+	binary.BigEndian.PutUint64(start, uint64(max(since.UnixNano(), 0)))
+	var out []AuditEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltAudit).Cursor()
+		for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+			var e AuditEntry
+			if json.Unmarshal(v, &e) == nil { out = append(out, e) }
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (s *boltStore) PruneAudit(before time.Time) error {
+	end := make([]byte, 8)
+	binary.BigEndian.PutUint64(end, uint64(max(before.UnixNano(), 0)))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltAudit).Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.First() {
+			if err := c.Delete(); err != nil { return err }
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error { return s.db.Close() }
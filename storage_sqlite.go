@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// --- SQLite Driver ---
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS history (id INTEGER PRIMARY KEY, entry TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS metrics (name TEXT NOT NULL, target TEXT NOT NULL, ts INTEGER NOT NULL, value REAL NOT NULL);
+CREATE INDEX IF NOT EXISTS metrics_lookup ON metrics (name, target, ts);
+CREATE TABLE IF NOT EXISTS audit (ts INTEGER NOT NULL, entry TEXT NOT NULL);
+CREATE INDEX IF NOT EXISTS audit_time ON audit (ts);
+`
+
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil { return nil, err }
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) LoadHistory() ([]LogEntry, error) {
+	rows, err := s.db.Query("SELECT entry FROM history ORDER BY id DESC")
+	if err != nil { return nil, err }
+	defer rows.Close()
+	var history []LogEntry
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil { return nil, err }
+		var e LogEntry
+		if json.Unmarshal([]byte(data), &e) == nil { history = append(history, e) }
+	}
+	return history, rows.Err()
+}
+
+// SaveHistory replaces the table; the history is capped so this stays small.
+func (s *sqliteStore) SaveHistory(history []LogEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM history"); err != nil { return err }
+	for _, e := range history {
+		data, _ := json.Marshal(e)
+		if _, err := tx.Exec("INSERT OR REPLACE INTO history (id, entry) VALUES (?, ?)", e.ID, string(data)); err != nil { return err }
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) AppendMetrics(samples ...MetricSample) error {
+	tx, err := s.db.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+	for _, m := range samples {
+		if _, err := tx.Exec("INSERT INTO metrics (name, target, ts, value) VALUES (?, ?, ?, ?)", m.Name, m.Target, m.Time.UnixNano(), m.Value); err != nil { return err }
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) QueryMetrics(name, target string, since time.Time) ([]MetricSample, error) {
+	rows, err := s.db.Query(`SELECT name, target, ts, value FROM metrics
+		WHERE (? = '' OR name = ?) AND (? = '' OR target = ?) AND ts >= ? ORDER BY ts`,
+		name, name, target, target, since.UnixNano())
+	if err != nil { return nil, err }
+	defer rows.Close()
+	var out []MetricSample
+	for rows.Next() {
+		var m MetricSample
+		var ts int64
+		if err := rows.Scan(&m.Name, &m.Target, &ts, &m.Value); err != nil { return nil, err }
+		m.Time = time.Unix(0, ts)
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) PruneMetrics(before time.Time) error {
+	_, err := s.db.Exec("DELETE FROM metrics WHERE ts < ?", before.UnixNano())
+	return err
+}
+
+func (s *sqliteStore) AppendAudit(e AuditEntry) error {
+	data, _ := json.Marshal(e)
+	_, err := s.db.Exec("INSERT INTO audit (ts, entry) VALUES (?, ?)", e.Time.UnixNano(), string(data))
+	return err
+}
+
+func (s *sqliteStore) QueryAudit(since time.Time) ([]AuditEntry, error) {
+	rows, err := s.db.Query("SELECT entry FROM audit WHERE ts >= ? ORDER BY ts, rowid", since.UnixNano())
+	if err != nil { return nil, err }
+	defer rows.Close()
+	var out []AuditEntry
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil { return nil, err }
+		var e AuditEntry
+		if json.Unmarshal([]byte(data), &e) == nil { out = append(out, e) }
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) PruneAudit(before time.Time) error {
+	_, err := s.db.Exec("DELETE FROM audit WHERE ts < ?", before.UnixNano())
+	return err
+}
+
+func (s *sqliteStore) Close() error { return s.db.Close() }
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Encrypted Send Streams ---
+// For a destination that shouldn't see the data (a cloud VM, a friend's
+// NAS), a job can store its snapshots as `btrfs send` streams encrypted with
+// age or gpg, in a directory that is e.g. an sshfs or NFS mount of it, or
+// straight in object storage through rclone (see streamstore.go). A full stream starts a chain and each later snapshot is sent
+// incrementally against the one before, until full_every incrementals or the
+// parent snapshot no longer being there start the next chain. catalog.json
+// next to the streams records every stream with its parent, the source UUID
+// and the SHA-256 of the encrypted file; it is not encrypted and holds the
+// snapshot names. A restore decrypts the chain up to a snapshot, full stream
+// first, into `btrfs receive`; it can also read a remote no job here points
+// at, to bring a lost machine back. The private key never has to be on this
+// machine until then.
+
+type StreamConfig struct {
+	Enabled      bool           `json:"enabled"`
+	Dest         string         `json:"dest"`                    // directory for the stream files
+	Remote       string         `json:"remote,omitempty"`        // rclone remote instead of dest, e.g. s3:bucket/home
+	RcloneConfig string         `json:"rclone_config,omitempty"` // rclone.conf, default rclone's own
+	ChunkMiB     int            `json:"chunk_mib,omitempty"`     // object size on a remote, default 1024
+	Encryption   string         `json:"encryption"`              // age (default) or gpg
+	Recipients   []string       `json:"recipients"`              // age public keys or recipient files, gpg key IDs
+	FullEvery    int            `json:"full_every,omitempty"`    // incrementals before the next full stream, default 30
+	KeepChains   int            `json:"keep_chains,omitempty"`   // chains kept, default 2
+	Schedule     ScheduleConfig `json:"schedule"`
+	Transfer     TransferConfig `json:"transfer"` // see transfer.go
+}
+
+type StreamCatalog struct {
+	Job     string       `json:"job"`
+	Streams []StreamFile `json:"streams"` // oldest first
+}
+
+type StreamFile struct {
+	Name    string `json:"name"`             // the snapshot
+	Parent  string `json:"parent,omitempty"` // empty: a full stream, the start of a chain
+	File    string `json:"file"`
+	UUID    string `json:"uuid"` // of the source snapshot, the restored copy's Received UUID
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"` // of the encrypted file
+	Chunks  int    `json:"chunks,omitempty"` // objects on a remote, File.000 on
+	Created string `json:"created"`
+}
+
+type StreamResult struct {
+	Sent    []StreamFile `json:"sent,omitempty"`
+	Deleted []string     `json:"deleted,omitempty"` // stream files of expired chains
+	Failed  string       `json:"failed,omitempty"`  // the snapshot that could not be sent or restored
+}
+
+type StreamRestoreRequest struct {
+	Job      string `json:"job"`
+	Snapshot string `json:"snapshot"` // default the newest in the catalog
+	Target   string `json:"target"`   // directory on a btrfs filesystem to receive into
+	Identity string `json:"identity"` // age identity file; gpg uses the keyring
+	// Without a job: where the streams are, for a restore onto a new machine.
+	Dest         string `json:"dest,omitempty"`
+	Remote       string `json:"remote,omitempty"`
+	RcloneConfig string `json:"rclone_config,omitempty"`
+	Encryption   string `json:"encryption,omitempty"`
+}
+
+const (
+	streamCatalogFile       = "catalog.json"
+	defaultStreamFullEvery  = 30
+	defaultStreamKeepChains = 2
+)
+
+var streamRuns = struct {
+	mu      sync.Mutex
+	running map[string]bool
+}{running: map[string]bool{}}
+
+func (c StreamConfig) encryption() string {
+	if c.Encryption == "" { return "age" }
+	return c.Encryption
+}
+
+func (c StreamConfig) fullEvery() int {
+	if c.FullEvery <= 0 { return defaultStreamFullEvery }
+	return c.FullEvery
+}
+
+func (c StreamConfig) keepChains() int {
+	if c.KeepChains <= 0 { return defaultStreamKeepChains }
+	return c.KeepChains
+}
+
+func validateStreams(j SnapshotJob) error {
+	s := j.Streams
+	if !s.Enabled { return nil }
+	if err := validateStreamLocation(s); err != nil { return err }
+	if j.Writable { return fmt.Errorf("writable snapshots can't be sent, a writable job can't store streams") }
+	if e := s.encryption(); e != "age" && e != "gpg" { return fmt.Errorf("streams encryption must be age or gpg") }
+	if len(s.Recipients) == 0 { return fmt.Errorf("streams need at least one recipient to encrypt to") }
+	if s.FullEvery < 0 || s.KeepChains < 0 || s.ChunkMiB < 0 { return fmt.Errorf("streams: values must not be negative") }
+	if err := validateWindows(s.Schedule.Windows); err != nil { return fmt.Errorf("streams schedule: %v", err) }
+	if err := validateTransfer(s.Transfer); err != nil { return fmt.Errorf("streams %v", err) }
+	if s.Schedule.Enabled {
+		if _, err := parseSchedule(s.Schedule); err != nil { return fmt.Errorf("invalid streams schedule %q: %v", scheduleSpec(s.Schedule), err) }
+	}
+	return nil
+}
+
+// validateStreamLocation checks that exactly one of dest and remote is set.
+func validateStreamLocation(s StreamConfig) error {
+	switch {
+	case s.Remote != "" && s.Dest != "": return fmt.Errorf("streams go to dest or remote, not both")
+	case s.Remote != "":
+		if !strings.Contains(s.Remote, ":") || strings.HasPrefix(s.Remote, "-") { return fmt.Errorf("streams remote must be an rclone remote like s3:bucket/path") }
+		if s.RcloneConfig != "" && !filepath.IsAbs(s.RcloneConfig) { return fmt.Errorf("streams rclone_config must be an absolute path") }
+	case !filepath.IsAbs(s.Dest): return fmt.Errorf("streams dest must be an absolute path")
+	}
+	return nil
+}
+
+func encryptCommand(c StreamConfig) (string, []string) {
+	if c.encryption() == "gpg" {
+		args := []string{"--batch", "--yes", "--trust-model", "always", "--encrypt"}
+		for _, r := range c.Recipients { args = append(args, "-r", r) }
+		return "gpg", args
+	}
+	args := []string{"--encrypt"}
+	for _, r := range c.Recipients {
+		// A path names a recipients file, as with age -R.
+		if filepath.IsAbs(r) { args = append(args, "-R", r) } else { args = append(args, "-r", r) }
+	}
+	return "age", args
+}
+
+func decryptCommand(c StreamConfig, identity string) (string, []string) {
+	if c.encryption() == "gpg" { return "gpg", []string{"--batch", "--decrypt"} }
+	return "age", []string{"--decrypt", "-i", identity}
+}
+
+func streamFileName(c StreamConfig, name string) string {
+	return name + ".btrfs." + c.encryption()
+}
+
+// loadStreamCatalog reads the catalog of the streams at cfg. It sits with
+// the streams, where whoever has the destination can change it, so an entry
+// whose file is not the stream file of its snapshot is refused rather than
+// opened or deleted.
+func loadStreamCatalog(cfg StreamConfig) (*StreamCatalog, error) {
+	c := &StreamCatalog{Streams: []StreamFile{}}
+	data, err := cfg.store().readCatalog()
+	if err != nil { return nil, err }
+	if data == nil { return c, nil }
+	if err := json.Unmarshal(data, c); err != nil { return nil, fmt.Errorf("%s: %v", streamCatalogFile, err) }
+	for _, s := range c.Streams {
+		if s.Name == "" || s.Name == "." || s.Name == ".." || s.Name != filepath.Base(s.Name) {
+			return nil, fmt.Errorf("%s: invalid snapshot name %q", streamCatalogFile, s.Name)
+		}
+		if s.File != streamFileName(cfg, s.Name) {
+			return nil, fmt.Errorf("%s: %s: the file %q is not %q", streamCatalogFile, s.Name, s.File, streamFileName(cfg, s.Name))
+		}
+	}
+	return c, nil
+}
+
+func saveStreamCatalog(store streamStore, c *StreamCatalog) error {
+	data, _ := json.MarshalIndent(c, "", "  ")
+	return store.writeCatalog(data)
+}
+
+func (c *StreamCatalog) find(name string) (StreamFile, bool) {
+	for _, s := range c.Streams {
+		if s.Name == name { return s, true }
+	}
+	return StreamFile{}, false
+}
+
+// chain returns the streams to receive for name, the full stream first.
+func (c *StreamCatalog) chain(name string) ([]StreamFile, error) {
+	var chain []StreamFile
+	seen := map[string]bool{}
+	for name != "" {
+		if seen[name] { return nil, fmt.Errorf("the chain of %s loops back to itself in the catalog", name) }
+		seen[name] = true
+		s, ok := c.find(name)
+		if !ok { return nil, fmt.Errorf("the stream of %s is not in the catalog, the chain is broken", name) }
+		chain = append([]StreamFile{s}, chain...)
+		name = s.Parent
+	}
+	return chain, nil
+}
+
+// chains groups the catalog into chains, oldest first.
+func (c *StreamCatalog) chains() [][]StreamFile {
+	var chains [][]StreamFile
+	for _, s := range c.Streams {
+		if s.Parent == "" || len(chains) == 0 {
+			chains = append(chains, []StreamFile{s})
+			continue
+		}
+		chains[len(chains)-1] = append(chains[len(chains)-1], s)
+	}
+	return chains
+}
+
+// pendingStreams returns the snapshots to send, oldest first, and the
+// parent of the first one, "" for a full stream.
+func pendingStreams(job SnapshotJob, cat *StreamCatalog) ([]SnapInfo, string, error) {
+	snaps, err := listManagedSnapshots(job)
+	if err != nil { return nil, "", err }
+	parent := ""
+	var pending []SnapInfo
+	for _, s := range snaps {
+		if _, ok := cat.find(s.Name); ok {
+			parent = s.Name
+			break
+		}
+		pending = append([]SnapInfo{s}, pending...)
+	}
+	return pending, parent, nil
+}
+
+// nextParent returns parent if the next stream can be incremental against
+// it: it is the end of the newest chain, still exists and the chain is not
+// full_every long yet.
+func nextParent(job SnapshotJob, cat *StreamCatalog, parent string) string {
+	chains := cat.chains()
+	if parent == "" || len(chains) == 0 { return "" }
+	last := chains[len(chains)-1]
+	if last[len(last)-1].Name != parent || len(last)-1 >= job.Streams.fullEvery() { return "" }
+	if _, err := os.Stat(snapshotPath(job.Dest, parent)); err != nil { return "" }
+	return parent
+}
+
+// pipeCommands runs a | b and returns the errors of both.
+func pipeCommands(a, b *exec.Cmd) (error, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil { return err, nil }
+	a.Stdout, b.Stdin = pw, pr
+	err = a.Start()
+	if err == nil {
+		err = b.Start()
+		if err != nil { a.Process.Kill() }
+	}
+	pw.Close()
+	pr.Close()
+	if err != nil {
+		a.Wait()
+		return err, nil
+	}
+	berr := b.Wait()
+	return a.Wait(), berr
+}
+
+// sendEncrypted writes `btrfs send sendArgs | <encrypt>` to file in the
+// store, within the transfer limits, and returns it with its size, SHA-256
+// and chunks filled in, the output and the priority applied.
+func sendEncrypted(ctx context.Context, cfg StreamConfig, sendArgs []string, file string, report func(transferProgress)) (StreamFile, string, string, error) {
+	exited := make(chan struct{})
+	defer close(exited)
+	name, args := encryptCommand(cfg)
+	send := newManagedCommand(ctx, exited, "btrfs", sendArgs...)
+	enc := newManagedCommand(ctx, exited, name, args...)
+	limits, release := prioritize(send, "STREAM SEND")
+	defer release()
+
+	sf := StreamFile{File: file}
+	sw, err := cfg.store().create(ctx, file)
+	if err != nil { return sf, "", limits, err }
+	h := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(sw, h)}
+	var out bytes.Buffer
+	send.Stderr, enc.Stdout, enc.Stderr = &out, counter, &out
+	_, serr, eerr := pipeTransfer(ctx, cfg.Transfer, send, enc, report)
+	o := strings.TrimSpace(out.String())
+	if serr != nil || eerr != nil {
+		sw.abort()
+		if serr != nil { return sf, o, limits, fmt.Errorf("send: %v", serr) }
+		return sf, o, limits, fmt.Errorf("%s: %v", name, eerr)
+	}
+	if sf.Chunks, err = sw.commit(); err != nil {
+		sw.abort()
+		return sf, o, limits, err
+	}
+	sf.Size, sf.SHA256 = counter.n, hex.EncodeToString(h.Sum(nil))
+	return sf, o, limits, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// runStreams sends the job's new snapshots as encrypted streams and drops
+// the chains beyond keep_chains.
+func runStreams(job SnapshotJob, run *JobRun) {
+	streamRuns.mu.Lock()
+	if streamRuns.running[job.ID] {
+		streamRuns.mu.Unlock()
+		printDockerLog("STREAMS", "Job %s is still sending streams, skipping this run", job.ID)
+		return
+	}
+	streamRuns.running[job.ID] = true
+	streamRuns.mu.Unlock()
+	defer func() {
+		streamRuns.mu.Lock()
+		delete(streamRuns.running, job.ID)
+		streamRuns.mu.Unlock()
+	}()
+
+	cfg := job.Streams
+	start := time.Now()
+	store := cfg.store()
+	visualPath := fmt.Sprintf("%s ➡️ %s [%s]", job.Dest, store, cfg.encryption())
+	id := startHistory("STREAM SEND", "🔐", visualPath, "Sending encrypted streams to "+store.String())
+	run.tag(id)
+	ctx, cancel := commandContext("STREAM SEND")
+	defer cancel(nil)
+	trackCommand(id, "btrfs", []string{"send", job.Dest}, cancel)
+	defer untrackCommand(id)
+
+	result := &StreamResult{}
+	var lines []string
+	status := "Success"
+	defer func() {
+		updateHistory(id, func(e *LogEntry) {
+			e.Status, e.Result = status, &OperationResult{Stream: result}
+			e.Duration = time.Since(start).Round(time.Millisecond).String()
+			e.Output = strings.Join(lines, "\n")
+			if t, ok := terminationOf(ctx); ok {
+				e.Status, e.Termination = t.Status, t.Kind
+				e.Output += "\n\n" + t.Message
+			}
+		})
+	}()
+
+	encName, _ := encryptCommand(cfg)
+	_, err := exec.LookPath(encName)
+	if err == nil { err = store.check() }
+	var cat *StreamCatalog
+	if err == nil { cat, err = loadStreamCatalog(cfg) }
+	var pending []SnapInfo
+	var parent string
+	if err == nil { pending, parent, err = pendingStreams(job, cat) }
+	if err != nil {
+		status, lines = "Failed", append(lines, err.Error())
+		return
+	}
+	cat.Job = job.ID
+	if len(pending) == 0 { lines = append(lines, "Nothing to send, the newest snapshot has a stream.") }
+
+	for _, s := range pending {
+		if shuttingDown() || ctx.Err() != nil { break }
+		parent = nextParent(job, cat, parent)
+		info, err := showSubvolume(snapshotPath(job.Dest, s.Name))
+		if err != nil {
+			status, result.Failed = "Failed", s.Name
+			lines = append(lines, fmt.Sprintf("❌ %s: %v", s.Name, err))
+			break
+		}
+		file := streamFileName(cfg, s.Name)
+		sendArgs := archiveSendArgs(job, parent, s.Name)
+		printDockerLog("STREAMS", "Sending %s (parent: %s) to %s as %s", s.Name, parent, store, file)
+		sendStart := time.Now()
+		sf, out, limits, err := sendEncrypted(ctx, cfg, sendArgs, file, transferReporter(id, &lines, s.Name))
+		if limits != "" { updateHistory(id, func(e *LogEntry) { e.Limits = limits }) }
+		if out != "" { lines = append(lines, out) }
+		if err != nil {
+			status, result.Failed = "Failed", s.Name
+			lines = append(lines, fmt.Sprintf("❌ %s: %v", s.Name, err))
+			break
+		}
+		sf.Name, sf.Parent, sf.UUID, sf.Created = s.Name, parent, info["UUID"], time.Now().UTC().Format(time.RFC3339)
+		cat.Streams = append(cat.Streams, sf)
+		if err := saveStreamCatalog(store, cat); err != nil {
+			status, result.Failed = "Failed", s.Name
+			lines = append(lines, fmt.Sprintf("❌ %s: writing the catalog: %v", s.Name, err))
+			break
+		}
+		result.Sent = append(result.Sent, sf)
+		kind := "full"
+		if parent != "" { kind = "incremental from " + parent }
+		if sf.Chunks > 0 { kind += fmt.Sprintf(", %d objects", sf.Chunks) }
+		lines = append(lines, fmt.Sprintf("✅ %s (%s), %s", s.Name, kind, transferSummary(sf.Size, time.Since(sendStart))))
+		parent = s.Name
+		setSendParent(job, streamsChain(job), nextParent(job, cat, parent))
+	}
+
+	if chains := cat.chains(); len(chains) > cfg.keepChains() {
+		expired := chains[:len(chains)-cfg.keepChains()]
+		keep := []StreamFile{}
+		for _, c := range chains[len(chains)-cfg.keepChains():] { keep = append(keep, c...) }
+		cat.Streams = keep
+		if err := saveStreamCatalog(store, cat); err != nil {
+			lines = append(lines, fmt.Sprintf("⚠️ Writing the catalog: %v", err))
+			return
+		}
+		for _, c := range expired {
+			for _, s := range c {
+				if err := store.remove(s); err != nil { lines = append(lines, fmt.Sprintf("⚠️ Deleting %s: %v", s.File, err)); continue }
+				result.Deleted = append(result.Deleted, s.File)
+			}
+		}
+		lines = append(lines, fmt.Sprintf("🗑️ Deleted %d expired chains (%d streams), keeping %d", len(expired), len(result.Deleted), cfg.keepChains()))
+	}
+}
+
+// restoreStreams receives the chain up to req.Snapshot from the streams at
+// cfg into req.Target. Snapshots of the chain already received there are
+// skipped.
+func restoreStreams(cfg StreamConfig, cat *StreamCatalog, req StreamRestoreRequest, id int64) {
+	store := cfg.store()
+	start := time.Now()
+	ctx, cancel := commandContext("STREAM RESTORE")
+	defer cancel(nil)
+	trackCommand(id, "btrfs", []string{"receive", req.Target}, cancel)
+	defer untrackCommand(id)
+
+	result := &StreamResult{}
+	var lines []string
+	status := "Success"
+	defer func() {
+		updateHistory(id, func(e *LogEntry) {
+			e.Status, e.Result = status, &OperationResult{Stream: result}
+			e.Duration = time.Since(start).Round(time.Millisecond).String()
+			e.Output = strings.Join(lines, "\n")
+			if t, ok := terminationOf(ctx); ok {
+				e.Status, e.Termination = t.Status, t.Kind
+				e.Output += "\n\n" + t.Message
+			}
+		})
+	}()
+	fail := func(name string, err error) {
+		status, result.Failed = "Failed", name
+		lines = append(lines, fmt.Sprintf("❌ %s: %v", name, err))
+	}
+
+	chain, err := cat.chain(req.Snapshot)
+	if err != nil {
+		fail(req.Snapshot, err)
+		return
+	}
+	for _, s := range chain {
+		if ctx.Err() != nil { break }
+		dest := snapshotPath(req.Target, s.Name)
+		if info, err := showSubvolume(dest); err == nil && info["Received UUID"] == s.UUID {
+			lines = append(lines, fmt.Sprintf("⏭️ %s is already there", s.Name))
+			continue
+		}
+		f, err := store.open(ctx, s)
+		if err != nil {
+			fail(s.Name, err)
+			return
+		}
+		// The stream is checked while it is read, so a remote one is only
+		// downloaded once; a copy received from a stream that doesn't match
+		// the catalog is deleted again below.
+		h := sha256.New()
+		exited := make(chan struct{})
+		name, args := decryptCommand(cfg, req.Identity)
+		dec := newManagedCommand(ctx, exited, name, args...)
+		recv := newManagedCommand(ctx, exited, "btrfs", "receive", req.Target)
+		var out bytes.Buffer
+		dec.Stdin, dec.Stderr, recv.Stdout, recv.Stderr = io.TeeReader(f, h), &out, &out, &out
+		derr, rerr := pipeCommands(dec, recv)
+		close(exited)
+		f.Close()
+		if o := strings.TrimSpace(out.String()); o != "" { lines = append(lines, o) }
+		switch {
+		case derr != nil: err = fmt.Errorf("%s: %v", name, derr)
+		case rerr != nil: err = fmt.Errorf("receive: %v", rerr)
+		case hex.EncodeToString(h.Sum(nil)) != s.SHA256: err = fmt.Errorf("%s does not match its checksum in the catalog", s.File)
+		default:
+			if info, ierr := showSubvolume(dest); ierr != nil || info["Received UUID"] != s.UUID { err = fmt.Errorf("receive: the received copy's Received UUID does not match %s", s.UUID) }
+		}
+		if err != nil {
+			if _, lerr := os.Lstat(dest); lerr == nil { btrfsFS.DeleteSubvolume(dest) }
+			fail(s.Name, err)
+			return
+		}
+		result.Sent = append(result.Sent, s)
+		lines = append(lines, fmt.Sprintf("✅ %s received, Received UUID %s verified", s.Name, s.UUID))
+	}
+}
+
+func previewStreams(job SnapshotJob) ([]PlannedOp, []string) {
+	cfg := job.Streams
+	if job.Dest == "" { return nil, []string{"snapshot destination not set: job will do nothing"} }
+	var warnings []string
+	name, args := encryptCommand(cfg)
+	if _, err := exec.LookPath(name); err != nil { warnings = append(warnings, name+" is not installed") }
+	store := cfg.store()
+	if cfg.Remote != "" {
+		if err := store.check(); err != nil { return nil, append(warnings, "rclone is not installed") }
+	}
+	cat, err := loadStreamCatalog(cfg)
+	if err != nil { return nil, append(warnings, err.Error()) }
+	pending, parent, err := pendingStreams(job, cat)
+	if err != nil { return nil, append(warnings, "cannot list snapshots: "+err.Error()) }
+	if len(pending) == 0 { return nil, append(warnings, "nothing to send yet") }
+	var ops []PlannedOp
+	for _, s := range pending {
+		parent = nextParent(job, cat, parent)
+		desc := "Send " + s.Name + " as a full encrypted stream"
+		if parent != "" { desc = "Send " + s.Name + " as an encrypted stream incremental from " + parent }
+		if d := cfg.Transfer.describe(); d != "" { desc += " (" + d + ")" }
+		ops = append(ops, PlannedOp{Description: desc, Command: formatCommand("btrfs", archiveSendArgs(job, parent, s.Name)...) + " | " + formatCommand(name, args...) + " " + store.describeWrite(streamFileName(cfg, s.Name))})
+		// Later ones depend on this one, which isn't in the catalog yet.
+		cat.Streams = append(cat.Streams, StreamFile{Name: s.Name, Parent: parent})
+		parent = s.Name
+	}
+	return ops, warnings
+}
+
+// --- Handlers ---
+
+func streamJobFromRequest(w http.ResponseWriter, id string) (SnapshotJob, bool) {
+	job, err := findSnapshotJob(id)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return job, false
+	}
+	if !job.Streams.Enabled {
+		http.Error(w, "Encrypted streams are not enabled for this job", 400)
+		return job, false
+	}
+	return job, true
+}
+
+// handleActionStreams starts a stream run of ?job=.
+func handleActionStreams(w http.ResponseWriter, r *http.Request) {
+	job, ok := streamJobFromRequest(w, r.URL.Query().Get("job"))
+	if !ok { return }
+	go func() {
+		run := newJobRun("streams:"+job.ID, "manual")
+		runStreams(job, run)
+		run.finish()
+	}()
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "triggered", "message": "Stream run initiated"})
+}
+
+// handleListStreams returns the catalog of ?job= as chains, oldest first.
+func handleListStreams(w http.ResponseWriter, r *http.Request) {
+	job, ok := streamJobFromRequest(w, r.URL.Query().Get("job"))
+	if !ok { return }
+	writeStreamChains(w, job.ID, job.Streams)
+}
+
+// handleBrowseStreams returns the catalog in ?dest= or ?remote= (with
+// ?rclone_config=), which no job has to point at, e.g. to pick a snapshot
+// to restore on a new machine.
+func handleBrowseStreams(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	cfg := StreamConfig{Dest: q.Get("dest"), Remote: q.Get("remote"), RcloneConfig: q.Get("rclone_config")}
+	if err := validateStreamLocation(cfg); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	writeStreamChains(w, "", cfg)
+}
+
+func writeStreamChains(w http.ResponseWriter, jobID string, cfg StreamConfig) {
+	cat, err := loadStreamCatalog(cfg)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if jobID == "" { jobID = cat.Job }
+	encryption := cfg.encryption()
+	if cfg.Encryption == "" && len(cat.Streams) > 0 && strings.HasSuffix(cat.Streams[0].File, ".gpg") { encryption = "gpg" }
+	chains := cat.chains()
+	if chains == nil { chains = [][]StreamFile{} }
+	json.NewEncoder(w).Encode(map[string]interface{}{"job": jobID, "dest": cfg.location(), "encryption": encryption, "chains": chains})
+}
+
+// restoreSource is where the streams of req are: the job's, or the dest or
+// remote in the request.
+func restoreSource(w http.ResponseWriter, req StreamRestoreRequest) (StreamConfig, bool) {
+	if req.Job != "" {
+		job, ok := streamJobFromRequest(w, req.Job)
+		return job.Streams, ok
+	}
+	cfg := StreamConfig{Dest: req.Dest, Remote: req.Remote, RcloneConfig: req.RcloneConfig, Encryption: req.Encryption}
+	if cfg.Dest == "" && cfg.Remote == "" {
+		http.Error(w, "job, or the dest or remote the streams are in, is required", 400)
+		return cfg, false
+	}
+	if err := validateStreamLocation(cfg); err != nil {
+		http.Error(w, err.Error(), 400)
+		return cfg, false
+	}
+	if e := cfg.encryption(); e != "age" && e != "gpg" {
+		http.Error(w, "encryption must be age or gpg", 400)
+		return cfg, false
+	}
+	if err := cfg.store().check(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return cfg, false
+	}
+	return cfg, true
+}
+
+// handleStreamRestore receives the chain of a snapshot into a directory,
+// running in the background like the other long operations.
+func handleStreamRestore(w http.ResponseWriter, r *http.Request) {
+	var req StreamRestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), 400)
+		return
+	}
+	cfg, ok := restoreSource(w, req)
+	if !ok { return }
+	if !filepath.IsAbs(req.Target) {
+		http.Error(w, "target must be an absolute path", 400)
+		return
+	}
+	if fi, err := os.Stat(req.Target); err != nil || !fi.IsDir() {
+		http.Error(w, "target must be an existing directory on a btrfs filesystem", 400)
+		return
+	}
+	if cfg.encryption() == "age" && req.Identity == "" {
+		http.Error(w, "identity (the age identity file) is required", 400)
+		return
+	}
+	cat, err := loadStreamCatalog(cfg)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if req.Snapshot == "" {
+		if len(cat.Streams) == 0 { http.Error(w, "The catalog is empty", 404); return }
+		req.Snapshot = cat.Streams[len(cat.Streams)-1].Name
+	}
+	if _, ok := cat.find(req.Snapshot); !ok {
+		http.Error(w, "No stream of "+req.Snapshot+" in the catalog", 404)
+		return
+	}
+	id := startHistory("STREAM RESTORE", "📥", fmt.Sprintf("%s ➡️ %s", req.Snapshot, req.Target), "Restoring from "+cfg.location())
+	go restoreStreams(cfg, cat, req, id)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
+}
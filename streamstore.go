@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// --- Stream Stores ---
+// Encrypted streams (streams.go) go to a directory, or with streams.remote
+// to an rclone remote (S3 and compatible stores, B2, SFTP, anything rclone
+// speaks, e.g. "s3:bucket/btrfs/home" or a connection string like
+// ":s3,provider=AWS,env_auth:bucket/home"). On a remote each stream is cut
+// into objects of chunk_mib (file.000, file.001, ...), uploaded one after
+// the other with `rclone rcat`, so no single upload grows beyond what the
+// provider takes and a stream never has to be on local disk first. The
+// catalog sits next to them as catalog.json, as in a directory. Restores
+// read the objects back in order with `rclone cat`.
+
+type streamStore interface {
+	String() string
+	check() error // before a run: the directory can be made, rclone is there
+	readCatalog() ([]byte, error) // nil without a catalog yet
+	writeCatalog(data []byte) error
+	create(ctx context.Context, file string) (streamWriter, error)
+	open(ctx context.Context, s StreamFile) (io.ReadCloser, error)
+	remove(s StreamFile) error
+	describeWrite(file string) string // for previews, e.g. "> /mnt/x/file"
+}
+
+// streamWriter takes one stream; nothing is in place under its name until
+// commit returned, and abort removes what was written so far.
+type streamWriter interface {
+	io.Writer
+	commit() (chunks int, err error)
+	abort()
+}
+
+const defaultStreamChunkMiB = 1024
+
+func (c StreamConfig) store() streamStore {
+	if c.Remote != "" {
+		chunk := c.ChunkMiB
+		if chunk <= 0 { chunk = defaultStreamChunkMiB }
+		return rcloneStore{remote: c.Remote, config: c.RcloneConfig, chunk: int64(chunk) << 20}
+	}
+	return dirStore(c.Dest)
+}
+
+// location is where the job's streams go, for messages.
+func (c StreamConfig) location() string {
+	if c.Remote != "" { return c.Remote }
+	return c.Dest
+}
+
+// --- Directory ---
+
+type dirStore string
+
+func (d dirStore) String() string { return string(d) }
+
+func (d dirStore) check() error { return os.MkdirAll(string(d), 0755) }
+
+func (d dirStore) readCatalog() ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(string(d), streamCatalogFile))
+	if os.IsNotExist(err) { return nil, nil }
+	return data, err
+}
+
+func (d dirStore) writeCatalog(data []byte) error {
+	return writeFileAtomic(filepath.Join(string(d), streamCatalogFile), data, 0644)
+}
+
+type dirWriter struct {
+	*os.File
+	path string
+}
+
+func (d dirStore) create(_ context.Context, file string) (streamWriter, error) {
+	path := filepath.Join(string(d), file)
+	f, err := os.Create(path + ".partial")
+	if err != nil { return nil, err }
+	return &dirWriter{f, path}, nil
+}
+
+func (w *dirWriter) commit() (int, error) {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.path + ".partial")
+		return 0, err
+	}
+	if err := os.Rename(w.path+".partial", w.path); err != nil {
+		os.Remove(w.path + ".partial")
+		return 0, err
+	}
+	return 0, nil
+}
+
+func (w *dirWriter) abort() {
+	w.File.Close()
+	os.Remove(w.path + ".partial")
+}
+
+func (d dirStore) open(_ context.Context, s StreamFile) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), s.File))
+}
+
+func (d dirStore) remove(s StreamFile) error {
+	err := os.Remove(filepath.Join(string(d), s.File))
+	if os.IsNotExist(err) { return nil }
+	return err
+}
+
+func (d dirStore) describeWrite(file string) string { return "> " + filepath.Join(string(d), file) }
+
+// --- rclone ---
+
+type rcloneStore struct {
+	remote string
+	config string // rclone.conf, default rclone's own
+	chunk  int64  // bytes per object
+}
+
+func (s rcloneStore) String() string { return s.remote }
+
+func (s rcloneStore) check() error {
+	_, err := exec.LookPath("rclone")
+	return err
+}
+
+// path joins file to the remote, which may end in ":" or "/".
+func (s rcloneStore) path(file string) string {
+	if strings.HasSuffix(s.remote, ":") || strings.HasSuffix(s.remote, "/") { return s.remote + file }
+	return s.remote + "/" + file
+}
+
+func (s rcloneStore) args(args ...string) []string {
+	if s.config != "" { args = append([]string{"--config", s.config}, args...) }
+	return args
+}
+
+func chunkName(file string, i int) string { return fmt.Sprintf("%s.%03d", file, i) }
+
+func (s rcloneStore) readCatalog() ([]byte, error) {
+	var out, stderr bytes.Buffer
+	cmd := exec.Command("rclone", s.args("cat", s.path(streamCatalogFile))...)
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+	err := cmd.Run()
+	if err == nil { return out.Bytes(), nil }
+	// rclone exits with 3 for a missing directory and 4 for a missing file;
+	// cat also prints "not found" for a missing object with some backends.
+	if ee, ok := err.(*exec.ExitError); ok && (ee.ExitCode() == 3 || ee.ExitCode() == 4) { return nil, nil }
+	if strings.Contains(stderr.String(), "not found") { return nil, nil }
+	return nil, fmt.Errorf("rclone cat %s: %v: %s", streamCatalogFile, err, strings.TrimSpace(stderr.String()))
+}
+
+func (s rcloneStore) writeCatalog(data []byte) error {
+	cmd := exec.Command("rclone", s.args("rcat", s.path(streamCatalogFile))...)
+	cmd.Stdin = bytes.NewReader(data)
+	if out, err := cmd.CombinedOutput(); err != nil { return fmt.Errorf("rclone rcat %s: %v: %s", streamCatalogFile, err, strings.TrimSpace(string(out))) }
+	return nil
+}
+
+// rcloneWriter uploads a stream as chunk-sized objects, one rclone rcat
+// after the other.
+type rcloneWriter struct {
+	s      rcloneStore
+	ctx    context.Context
+	file   string
+	chunks int   // objects started
+	n      int64 // bytes in the current one
+	cmd    *exec.Cmd
+	exited chan struct{}
+	in     io.WriteCloser
+	out    bytes.Buffer
+}
+
+// stopRclone kills an rclone cut off midway, with anything it started.
+func stopRclone(cmd *exec.Cmd, exited chan struct{}) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	cmd.Wait()
+	close(exited)
+}
+
+func (s rcloneStore) create(ctx context.Context, file string) (streamWriter, error) {
+	return &rcloneWriter{s: s, ctx: ctx, file: file}, nil
+}
+
+func (w *rcloneWriter) start() error {
+	w.exited = make(chan struct{})
+	w.cmd = newManagedCommand(w.ctx, w.exited, "rclone", w.s.args("rcat", w.s.path(chunkName(w.file, w.chunks)))...)
+	w.cmd.Stdout, w.cmd.Stderr = &w.out, &w.out
+	var err error
+	if w.in, err = w.cmd.StdinPipe(); err != nil {
+		w.cmd = nil
+		return err
+	}
+	if err := w.cmd.Start(); err != nil {
+		w.cmd = nil
+		return err
+	}
+	w.chunks++
+	w.n = 0
+	return nil
+}
+
+// finish closes the current object; rclone uploads its rest and exits.
+func (w *rcloneWriter) finish() error {
+	if w.cmd == nil { return nil }
+	w.in.Close()
+	err := w.cmd.Wait()
+	close(w.exited)
+	w.cmd = nil
+	if err != nil { return fmt.Errorf("rclone rcat %s: %v: %s", chunkName(w.file, w.chunks-1), err, strings.TrimSpace(w.out.String())) }
+	return nil
+}
+
+func (w *rcloneWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.cmd == nil {
+			if err := w.start(); err != nil { return written, err }
+		}
+		part := p
+		if rest := w.s.chunk - w.n; int64(len(part)) > rest { part = part[:rest] }
+		n, err := w.in.Write(part)
+		written, w.n, p = written+n, w.n+int64(n), p[n:]
+		if err != nil {
+			w.finish()
+			return written, err
+		}
+		if w.n >= w.s.chunk {
+			if err := w.finish(); err != nil { return written, err }
+		}
+	}
+	return written, nil
+}
+
+func (w *rcloneWriter) commit() (int, error) {
+	// An empty stream still gets its one (empty) object.
+	if w.chunks == 0 {
+		if err := w.start(); err != nil { return 0, err }
+	}
+	if err := w.finish(); err != nil { return 0, err }
+	return w.chunks, nil
+}
+
+func (w *rcloneWriter) abort() {
+	if w.cmd != nil {
+		stopRclone(w.cmd, w.exited)
+		w.cmd = nil
+	}
+	w.s.remove(StreamFile{File: w.file, Chunks: w.chunks})
+}
+
+// rcloneReader reads the objects of a stream in order.
+type rcloneReader struct {
+	s      rcloneStore
+	ctx    context.Context
+	sf     StreamFile
+	next   int
+	cmd    *exec.Cmd
+	exited chan struct{}
+	out    io.ReadCloser
+	stderr bytes.Buffer
+}
+
+func (s rcloneStore) open(ctx context.Context, sf StreamFile) (io.ReadCloser, error) {
+	return &rcloneReader{s: s, ctx: ctx, sf: sf}, nil
+}
+
+func (r *rcloneReader) Read(p []byte) (int, error) {
+	for {
+		if r.cmd == nil {
+			if r.next >= max(r.sf.Chunks, 1) { return 0, io.EOF }
+			r.exited = make(chan struct{})
+			r.cmd = newManagedCommand(r.ctx, r.exited, "rclone", r.s.args("cat", r.s.path(chunkName(r.sf.File, r.next)))...)
+			r.stderr.Reset()
+			r.cmd.Stderr = &r.stderr
+			var err error
+			if r.out, err = r.cmd.StdoutPipe(); err != nil {
+				r.cmd = nil
+				return 0, err
+			}
+			if err := r.cmd.Start(); err != nil {
+				r.cmd = nil
+				return 0, err
+			}
+			r.next++
+		}
+		n, err := r.out.Read(p)
+		if err == io.EOF {
+			werr := r.cmd.Wait()
+			close(r.exited)
+			r.cmd = nil
+			if werr != nil { return n, fmt.Errorf("rclone cat %s: %v: %s", chunkName(r.sf.File, r.next-1), werr, strings.TrimSpace(r.stderr.String())) }
+			if n > 0 { return n, nil }
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *rcloneReader) Close() error {
+	if r.cmd != nil {
+		stopRclone(r.cmd, r.exited)
+		r.cmd = nil
+	}
+	return nil
+}
+
+func (s rcloneStore) remove(sf StreamFile) error {
+	var errs []string
+	for i := 0; i < max(sf.Chunks, 1); i++ {
+		out, err := exec.Command("rclone", s.args("deletefile", s.path(chunkName(sf.File, i)))...).CombinedOutput()
+		if err != nil && !strings.Contains(string(out), "not found") { errs = append(errs, strings.TrimSpace(string(out))) }
+	}
+	if len(errs) > 0 { return fmt.Errorf("rclone deletefile: %s", strings.Join(errs, "; ")) }
+	return nil
+}
+
+func (s rcloneStore) describeWrite(file string) string {
+	return fmt.Sprintf("| rclone rcat %s (%d MiB objects)", s.path(chunkName(file, 0)), s.chunk>>20)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// --- Subvolume Management ---
+
+type Subvolume struct {
+	ID           uint64 `json:"id"`
+	Gen          uint64 `json:"gen"`
+	CGen         uint64 `json:"cgen"`
+	Parent       uint64 `json:"parent"`
+	TopLevel     uint64 `json:"top_level"`
+	UUID         string `json:"uuid"`
+	ParentUUID   string `json:"parent_uuid"`
+	ReceivedUUID string `json:"received_uuid"`
+	Path         string `json:"path"` // relative to the filesystem root
+	ReadOnly     bool   `json:"readonly"`
+	Default      bool   `json:"default"`
+}
+
+// parseSubvolumeList reads lines like
+// "ID 257 gen 12 cgen 11 parent 5 top level 5 parent_uuid - received_uuid - uuid 1a2b... path snaps/a".
+// Fields depend on the flags used, so it goes by key rather than position.
+func parseSubvolumeList(out string) []Subvolume {
+	subvols := []Subvolume{}
+	for _, line := range strings.Split(out, "\n") {
+		head, path, ok := strings.Cut(line, " path ")
+		f := strings.Fields(head)
+		if !ok || len(f) < 2 || f[0] != "ID" { continue }
+		s := Subvolume{Path: path}
+		for i := 0; i+1 < len(f); i++ {
+			key, val := f[i], f[i+1]
+			if key == "top" && val == "level" && i+2 < len(f) {
+				s.TopLevel, _ = strconv.ParseUint(f[i+2], 10, 64)
+				i += 2
+				continue
+			}
+			if val == "-" { val = "" }
+			switch key {
+			case "ID": s.ID, _ = strconv.ParseUint(val, 10, 64)
+			case "gen": s.Gen, _ = strconv.ParseUint(val, 10, 64)
+			case "cgen": s.CGen, _ = strconv.ParseUint(val, 10, 64)
+			case "parent": s.Parent, _ = strconv.ParseUint(val, 10, 64)
+			case "uuid": s.UUID = val
+			case "parent_uuid": s.ParentUUID = val
+			case "received_uuid": s.ReceivedUUID = val
+			default: continue
+			}
+			i++
+		}
+		subvols = append(subvols, s)
+	}
+	return subvols
+}
+
+// showSubvolume returns the "Key: value" lines of `subvolume show`, e.g.
+// "Subvolume ID", "Received UUID" or "Flags".
+func showSubvolume(path string) (map[string]string, error) {
+	out, err := exec.Command("btrfs", "subvolume", "show", path).CombinedOutput()
+	if err != nil { return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out))) }
+	fields := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(line), ":"); ok {
+			fields[k] = strings.TrimSpace(v)
+		}
+	}
+	return fields, nil
+}
+
+// checkSubvolumeDeletable refuses subvolumes that are (or contain) mount
+// points, are the default subvolume, or back a snapshot job.
+func checkSubvolumeDeletable(path string) error {
+	if path == "/" { return fmt.Errorf("refusing to delete the root filesystem") }
+	if mounts, err := readMounts(); err == nil {
+		for _, m := range mounts {
+			if m.Path == path || strings.HasPrefix(m.Path, path+"/") {
+				return fmt.Errorf("%s is mounted; unmount it first", m.Path)
+			}
+		}
+	}
+
+	state.mu.Lock()
+	jobs := append([]SnapshotJob(nil), state.Config.SnapshotJobs...)
+	if state.Config.StateBackup.Enabled { jobs = append(jobs, stateBackupJob(state.Config.StateBackup)) }
+	state.mu.Unlock()
+	for _, j := range jobs {
+		if filepath.Clean(j.Source) == path {
+			return fmt.Errorf("%s is the source of snapshot job %q", path, j.Name)
+		}
+	}
+
+	id, err := btrfsFS.SubvolumeID(path)
+	if err != nil { return err }
+	if id == 5 { return fmt.Errorf("refusing to delete the top-level subvolume") }
+	if def, err := btrfsFS.DefaultSubvolumeID(path); err == nil && def == id {
+		return fmt.Errorf("%s is the default subvolume; set another default first", path)
+	}
+	return nil
+}
+
+// --- Subvolume Graph ---
+// Snapshots point to their origin by parent UUID, and received subvolumes to
+// the one they were sent from by received UUID. The graph turns those into
+// edges between subvolume IDs, so a client can draw the lineage of every
+// subvolume and its snapshots.
+
+type SubvolumeNode struct {
+	Subvolume
+	Snapshot bool `json:"snapshot"`         // has a parent UUID
+	Orphan   bool `json:"orphan,omitempty"` // its origin is not on the filesystem (any more)
+}
+
+// SubvolumeEdge runs from the origin From to To, a snapshot of it (taken at
+// generation CGen, when the origin is at Gen now) or a copy received from it.
+type SubvolumeEdge struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+	Kind string `json:"kind"` // snapshot or received
+	Gen  uint64 `json:"gen"`  // of From
+	CGen uint64 `json:"cgen"` // of To
+}
+
+type SubvolumeGraph struct {
+	Nodes []SubvolumeNode `json:"nodes"`
+	Edges []SubvolumeEdge `json:"edges"`
+	Roots []uint64        `json:"roots"` // nodes without an origin on the filesystem
+}
+
+func buildSubvolumeGraph(subvols []Subvolume) SubvolumeGraph {
+	byUUID := map[string]Subvolume{}
+	for _, s := range subvols {
+		if s.UUID != "" { byUUID[s.UUID] = s }
+	}
+	g := SubvolumeGraph{Nodes: []SubvolumeNode{}, Edges: []SubvolumeEdge{}, Roots: []uint64{}}
+	for _, s := range subvols {
+		n := SubvolumeNode{Subvolume: s, Snapshot: s.ParentUUID != ""}
+		origin := false
+		if p, ok := byUUID[s.ParentUUID]; ok && s.ParentUUID != "" {
+			g.Edges = append(g.Edges, SubvolumeEdge{From: p.ID, To: s.ID, Kind: "snapshot", Gen: p.Gen, CGen: s.CGen})
+			origin = true
+		}
+		if p, ok := byUUID[s.ReceivedUUID]; ok && s.ReceivedUUID != "" && p.ID != s.ID {
+			g.Edges = append(g.Edges, SubvolumeEdge{From: p.ID, To: s.ID, Kind: "received", Gen: p.Gen, CGen: s.CGen})
+			origin = true
+		}
+		n.Orphan = n.Snapshot && !origin
+		if !origin { g.Roots = append(g.Roots, s.ID) }
+		g.Nodes = append(g.Nodes, n)
+	}
+	return g
+}
+
+// --- Handlers ---
+
+func handleListSubvolumes(w http.ResponseWriter, r *http.Request) {
+	path := fsPathFromRequest(r)
+	if path == "" { http.Error(w, "Target drive not set", 400); return }
+	subvols, err := btrfsFS.ListSubvolumes(path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(subvols)
+}
+
+// handleSubvolumeGraph returns the subvolumes of the filesystem as a
+// lineage graph.
+func handleSubvolumeGraph(w http.ResponseWriter, r *http.Request) {
+	path := fsPathFromRequest(r)
+	if path == "" { http.Error(w, "Target drive not set", 400); return }
+	subvols, err := btrfsFS.ListSubvolumes(path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(buildSubvolumeGraph(subvols))
+}
+
+func subvolumePathFromRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req struct {
+		Path string `json:"path"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	if req.Path == "" { req.Path = r.URL.Query().Get("path") }
+	if !filepath.IsAbs(req.Path) {
+		http.Error(w, "absolute path required", 400)
+		return "", false
+	}
+	return filepath.Clean(req.Path), true
+}
+
+func handleCreateSubvolume(w http.ResponseWriter, r *http.Request) {
+	path, ok := subvolumePathFromRequest(w, r)
+	if !ok { return }
+	if err := btrfsFS.CreateSubvolume(path); err != nil {
+		logHistory("SUBVOL CREATE", "🗂️", path, "Failed", "Error: "+err.Error())
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	logHistory("SUBVOL CREATE", "🗂️", path, "Success", fmt.Sprintf("Create subvolume '%s'", path))
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "created", "path": path})
+}
+
+func handleDeleteSubvolume(w http.ResponseWriter, r *http.Request) {
+	path, ok := subvolumePathFromRequest(w, r)
+	if !ok { return }
+	if refuseLocked(w, path) { return }
+	if err := checkSubvolumeDeletable(path); err != nil {
+		http.Error(w, err.Error(), 409)
+		return
+	}
+	id, _ := startBtrfsOp("SUBVOL DELETE", "🗑️", path, fmt.Sprintf("Delete subvolume '%s'", path), func() (*OperationResult, error) { return nil, btrfsFS.DeleteSubvolume(path) })
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
+}
+
+func handleSetDefaultSubvolume(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID   uint64 `json:"id"`
+		Path string `json:"path"` // filesystem mount, defaults to the target drive
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == 0 {
+		http.Error(w, "id required", 400)
+		return
+	}
+	if req.Path == "" {
+		state.mu.Lock()
+		req.Path = state.Config.TargetDrive
+		state.mu.Unlock()
+	}
+	if req.Path == "" { http.Error(w, "Target drive not set", 400); return }
+
+	id := strconv.FormatUint(req.ID, 10)
+	out, err := exec.Command("btrfs", "subvolume", "set-default", id, req.Path).CombinedOutput()
+	visualPath := fmt.Sprintf("%s ➡️ ID %s", req.Path, id)
+	if err != nil {
+		logHistory("SUBVOL DEFAULT", "⭐", visualPath, "Failed", string(out)+"\nError: "+err.Error())
+		http.Error(w, strings.TrimSpace(string(out)), 500)
+		return
+	}
+	logHistory("SUBVOL DEFAULT", "⭐", visualPath, "Success", string(out))
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok"})
+}
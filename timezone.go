@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Timezones and Display ---
+// The installation runs in one timezone (timezone, an IANA name like
+// Europe/Berlin; empty keeps the server's): cron schedules fire in it, and
+// windows, blackouts and the times in messages and reports are in it. A
+// cron schedule can have its own timezone. Snapshot names keep the server's
+// time, so a change doesn't rename what retention and the boot menu go by.
+// Log entries store their time as RFC 3339 UTC and are formatted where they
+// are shown; GET /api/config tells the UI which timezone and locale to
+// format them with.
+
+type DisplaySettings struct {
+	Timezone string `json:"timezone,omitempty"` // IANA name in effect, "" if unknown
+	Locale   string `json:"locale,omitempty"`   // BCP 47, "": the browser's
+}
+
+// displayLayout is how times are written into messages.
+const displayLayout = "02-01-2006 15:04 MST"
+
+var localeRe = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+var appTZ = struct {
+	sync.RWMutex
+	name string
+	loc  *time.Location
+}{loc: time.Local}
+
+func appLocation() *time.Location {
+	appTZ.RLock()
+	defer appTZ.RUnlock()
+	return appTZ.loc
+}
+
+// localTime is t in the installation's timezone.
+func localTime(t time.Time) time.Time { return t.In(appLocation()) }
+
+// setAppTimezone switches to the timezone in cfg, after it was loaded or
+// changed; an unknown one keeps the server's.
+func setAppTimezone(cfg Config) {
+	loc := time.Local
+	if cfg.Timezone != "" {
+		l, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			logWarn("SYSTEM", "Unknown timezone %q, using the server's: %v", cfg.Timezone, err)
+			cfg.Timezone = ""
+		} else {
+			loc = l
+		}
+	}
+	appTZ.Lock()
+	defer appTZ.Unlock()
+	appTZ.name, appTZ.loc = cfg.Timezone, loc
+}
+
+// scheduleTimezone is the timezone cron schedule s fires in, "" for the
+// server's.
+func scheduleTimezone(s ScheduleConfig) string {
+	if s.Timezone != "" { return s.Timezone }
+	appTZ.RLock()
+	defer appTZ.RUnlock()
+	return appTZ.name
+}
+
+// serverTimezone names the server's own timezone from $TZ or
+// /etc/localtime, "" if neither tells.
+func serverTimezone() string {
+	if tz := strings.TrimPrefix(os.Getenv("TZ"), ":"); tz != "" { return tz }
+	if target, err := os.Readlink("/etc/localtime"); err == nil {
+		if _, name, ok := strings.Cut(target, "zoneinfo/"); ok { return name }
+	}
+	if time.Local.String() == "UTC" { return "UTC" }
+	return ""
+}
+
+func displaySettings(cfg Config) DisplaySettings {
+	d := DisplaySettings{Timezone: cfg.Timezone, Locale: cfg.Locale}
+	if d.Timezone == "" { d.Timezone = serverTimezone() }
+	return d
+}
+
+func validateTimezones(cfg Config) error {
+	if cfg.Timezone != "" {
+		if _, err := time.LoadLocation(cfg.Timezone); err != nil { return fmt.Errorf("timezone: %v", err) }
+	}
+	if cfg.Locale != "" && !localeRe.MatchString(cfg.Locale) { return fmt.Errorf("locale %q is not a language tag like en-GB", cfg.Locale) }
+	for _, job := range scheduledJobs(cfg) {
+		if job.Schedule.Timezone == "" { continue }
+		if _, err := time.LoadLocation(job.Schedule.Timezone); err != nil { return fmt.Errorf("%s schedule timezone: %v", job.Name, err) }
+	}
+	return nil
+}
+
+// migrateTimestamps rewrites entries logged before timestamps were RFC 3339
+// UTC; their ID is the time they were logged.
+func migrateTimestamps(history []LogEntry) {
+	for i := range history {
+		if _, err := time.Parse(time.RFC3339, history[i].Timestamp); err != nil {
+			history[i].Timestamp = entryTime(history[i]).UTC().Format(time.RFC3339)
+		}
+	}
+}
+
+// LocalTime formats when e was logged for the server-rendered pages.
+func (e LogEntry) LocalTime() string { return localTime(entryTime(e)).Format(displayLayout) }
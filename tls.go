@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// --- HTTPS ---
+// The API runs btrfs as root, so outside a trusted network it should not be
+// served over plain HTTP. --tls serves HTTPS with the certificate from
+// --tls-cert/--tls-key, or with a self-signed one generated into the state
+// directory on the first start. --acme-domain gets certificates from Let's
+// Encrypt instead, for a server reachable under that name on port 443.
+
+type TLSOptions struct {
+	Enabled     bool
+	Cert, Key   string
+	ACMEDomains []string
+	ACMEEmail   string
+	ACMEHTTP    string // address for HTTP-01 challenges and the redirect to HTTPS, e.g. :80
+}
+
+const (
+	tlsDirName         = "tls"
+	acmeDirName        = "acme"
+	selfSignedValidity = 10 * 365 * 24 * time.Hour
+)
+
+// tlsFlag prefers the flag, then the environment variable, like
+// listenAddress does.
+func tlsFlag(flagVal, env string) string {
+	if flagVal != "" { return flagVal }
+	return os.Getenv(env)
+}
+
+func envEnabled(env string) bool {
+	switch strings.ToLower(os.Getenv(env)) {
+	case "1", "true", "yes", "on": return true
+	}
+	return false
+}
+
+func splitDomains(s string) []string {
+	var domains []string
+	for _, d := range strings.Split(s, ",") {
+		if d = strings.TrimSpace(d); d != "" { domains = append(domains, d) }
+	}
+	return domains
+}
+
+// enabledTLS reports whether HTTPS is on; cert files or ACME domains turn it
+// on by themselves.
+func (o TLSOptions) enabledTLS() bool { return o.Enabled || o.Cert != "" || o.ACMEDomains != nil }
+
+// tlsConfig returns the TLS config to serve with and a description for the
+// startup log, or nil for plain HTTP.
+func tlsConfig(o TLSOptions) (*tls.Config, string, error) {
+	if !o.enabledTLS() { return nil, "", nil }
+	switch {
+	case o.ACMEDomains != nil:
+		if o.Cert != "" { return nil, "", fmt.Errorf("--tls-cert and --acme-domain are mutually exclusive") }
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(o.ACMEDomains...),
+			Cache:      autocert.DirCache(filepath.Join(stateDir, acmeDirName)),
+			Email:      o.ACMEEmail,
+		}
+		if o.ACMEHTTP != "" {
+			go func() {
+				err := http.ListenAndServe(o.ACMEHTTP, m.HTTPHandler(nil))
+				logWarn("SYSTEM", "ACME HTTP listener on %s stopped: %v", o.ACMEHTTP, err)
+			}()
+		}
+		return m.TLSConfig(), "Let's Encrypt certificate for " + strings.Join(o.ACMEDomains, ", "), nil
+	case o.Cert != "" || o.Key != "":
+		if o.Cert == "" || o.Key == "" { return nil, "", fmt.Errorf("--tls-cert and --tls-key must be set together") }
+		c := &certFiles{cert: o.Cert, key: o.Key}
+		if _, err := c.get(nil); err != nil { return nil, "", err }
+		return &tls.Config{GetCertificate: c.get, MinVersion: tls.VersionTLS12}, "certificate " + o.Cert, nil
+	}
+	dir := filepath.Join(stateDir, tlsDirName)
+	c := &certFiles{cert: filepath.Join(dir, "cert.pem"), key: filepath.Join(dir, "key.pem")}
+	if _, err := os.Stat(c.cert); os.IsNotExist(err) {
+		if err := generateSelfSigned(c.cert, c.key); err != nil { return nil, "", fmt.Errorf("self-signed certificate: %v", err) }
+	}
+	cert, err := c.get(nil)
+	if err != nil { return nil, "", err }
+	sum := sha256.Sum256(cert.Certificate[0])
+	return &tls.Config{GetCertificate: c.get, MinVersion: tls.VersionTLS12}, fmt.Sprintf("self-signed certificate %s (SHA-256 %X)", c.cert, sum), nil
+}
+
+// certFiles reloads a certificate and key whenever the certificate file
+// changes, so renewals by certbot and the like are picked up without a
+// restart.
+type certFiles struct {
+	cert, key string
+	mu        sync.Mutex
+	loaded    *tls.Certificate
+	modTime   time.Time
+}
+
+func (c *certFiles) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info, err := os.Stat(c.cert)
+	if err != nil {
+		if c.loaded != nil { return c.loaded, nil }
+		return nil, err
+	}
+	if c.loaded != nil && info.ModTime().Equal(c.modTime) { return c.loaded, nil }
+	cert, err := tls.LoadX509KeyPair(c.cert, c.key)
+	if err != nil {
+		// Mid-renewal the key may not match yet; keep serving the old pair.
+		if c.loaded != nil { return c.loaded, nil }
+		return nil, err
+	}
+	if c.loaded != nil { printDockerLog("SYSTEM", "Reloaded TLS certificate %s", c.cert) }
+	c.loaded, c.modTime = &cert, info.ModTime()
+	return c.loaded, nil
+}
+
+// generateSelfSigned writes an ECDSA certificate for the host name,
+// localhost and the host's addresses.
+func generateSelfSigned(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil { return err }
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil { return err }
+	host, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host, Organization: []string{"BTRFS Manager"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host != "" && host != "localhost" { tmpl.DNSNames = append(tmpl.DNSNames, host) }
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ip, ok := a.(*net.IPNet); ok && !ip.IP.IsLoopback() && !ip.IP.IsLinkLocalUnicast() { tmpl.IPAddresses = append(tmpl.IPAddresses, ip.IP) }
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil { return err }
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil { return err }
+
+	if err := os.MkdirAll(filepath.Dir(certPath), 0700); err != nil { return err }
+	if err := writeFileAtomic(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil { return err }
+	if err := writeFileAtomic(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil { return err }
+	printDockerLog("SYSTEM", "Generated a self-signed certificate in %s", filepath.Dir(certPath))
+	return nil
+}
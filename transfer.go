@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// --- Transfer Limits ---
+// Sends to the archive tier and encrypted stream sends go through a copy
+// loop here instead of a plain pipe, so each destination can be held to a
+// bandwidth (rate_limit_kib, a token bucket with a second's worth of
+// burst), given a memory buffer like mbuffer's so a bursty `btrfs send`
+// keeps a steady consumer busy (buffer_mib), and limited to transfer
+// windows: outside them the copy stops, `btrfs send` blocks on the full
+// pipe, and it goes on where it was when the next window opens. That is
+// separate from the schedule's windows, which decide when a run may start.
+// While copying, the bytes so far and the current speed are written to the
+// run's log entry every transferReportInterval.
+
+type TransferConfig struct {
+	RateLimitKiB int          `json:"rate_limit_kib,omitempty"` // KiB/s, 0: unlimited
+	BufferMiB    int          `json:"buffer_mib,omitempty"`     // memory buffer between the two ends
+	Windows      []TimeWindow `json:"windows,omitempty"`        // the copy pauses outside these
+}
+
+type transferProgress struct {
+	Bytes  int64
+	Rate   float64 // bytes/s since the last report
+	Paused string  // why the copy is waiting
+}
+
+const (
+	transferChunk          = 64 << 10
+	defaultTransferBuffer  = 16 // chunks
+	transferReportInterval = 5 * time.Second
+)
+
+func (p transferProgress) String() string {
+	s := formatBytes(uint64(p.Bytes)) + " sent"
+	if p.Paused != "" { return s + ", paused " + p.Paused }
+	return s + ", " + formatBytes(uint64(p.Rate)) + "/s"
+}
+
+// describe lists the limits for previews, "" if there are none.
+func (t TransferConfig) describe() string {
+	var parts []string
+	if t.RateLimitKiB > 0 { parts = append(parts, "at most "+formatBytes(uint64(t.RateLimitKiB)<<10)+"/s") }
+	if t.BufferMiB > 0 { parts = append(parts, fmt.Sprintf("%d MiB buffer", t.BufferMiB)) }
+	if len(t.Windows) > 0 { parts = append(parts, "in its transfer windows") }
+	return strings.Join(parts, ", ")
+}
+
+func (t TransferConfig) bufferChunks() int {
+	if t.BufferMiB <= 0 { return defaultTransferBuffer }
+	return t.BufferMiB << 20 / transferChunk
+}
+
+func validateTransfer(t TransferConfig) error {
+	if t.RateLimitKiB < 0 || t.BufferMiB < 0 { return fmt.Errorf("transfer: values must not be negative") }
+	if t.BufferMiB > 4096 { return fmt.Errorf("transfer: buffer_mib is at most 4096") }
+	if err := validateWindows(t.Windows); err != nil { return fmt.Errorf("transfer windows: %v", err) }
+	return nil
+}
+
+// transferSummary describes a finished copy, e.g. "12.0 MiB in 3s, 4.0 MiB/s".
+func transferSummary(n int64, d time.Duration) string {
+	d = d.Round(time.Second)
+	if d < time.Second { return formatBytes(uint64(n)) }
+	return fmt.Sprintf("%s in %v, %s/s", formatBytes(uint64(n)), d, formatBytes(uint64(float64(n)/d.Seconds())))
+}
+
+// transferReporter shows the progress of sending name below the lines of
+// log entry id so far.
+func transferReporter(id int64, lines *[]string, name string) func(transferProgress) {
+	return func(p transferProgress) {
+		output := strings.Join(append(append([]string(nil), *lines...), "⏳ "+name+": "+p.String()), "\n")
+		updateHistory(id, func(e *LogEntry) { e.Output = output })
+	}
+}
+
+// pipeTransfer runs a | b with the data copied through copyTransfer and
+// returns the bytes copied and the errors of both. As with a plain pipe,
+// one end failing ends the other: a failed write closes a's stdout.
+func pipeTransfer(ctx context.Context, t TransferConfig, a, b *exec.Cmd, report func(transferProgress)) (int64, error, error) {
+	ar, aw, err := os.Pipe()
+	if err != nil { return 0, err, nil }
+	br, bw, err := os.Pipe()
+	if err != nil {
+		ar.Close()
+		aw.Close()
+		return 0, err, nil
+	}
+	a.Stdout, b.Stdin = aw, br
+	err = a.Start()
+	if err == nil {
+		err = b.Start()
+		if err != nil {
+			a.Process.Kill()
+			a.Wait()
+		}
+	}
+	aw.Close()
+	br.Close()
+	if err != nil {
+		ar.Close()
+		bw.Close()
+		return 0, err, nil
+	}
+	copied := make(chan int64, 1)
+	go func() {
+		n := copyTransfer(ctx, t, bw, ar, report)
+		bw.Close()
+		ar.Close()
+		copied <- n
+	}()
+	berr := b.Wait()
+	aerr := a.Wait()
+	return <-copied, aerr, berr
+}
+
+// copyTransfer copies src to dst within the limits of t until src ends,
+// dst fails or ctx is done, and returns the bytes written.
+func copyTransfer(ctx context.Context, t TransferConfig, dst io.Writer, src io.Reader, report func(transferProgress)) int64 {
+	chunks := make(chan []byte, t.bufferChunks())
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, transferChunk)
+			n, err := src.Read(buf)
+			if n > 0 {
+				select {
+				case chunks <- buf[:n]:
+				case <-stop: return
+				}
+			}
+			if err != nil { return }
+		}
+	}()
+
+	rate := float64(t.RateLimitKiB) * 1024
+	var total, reported int64
+	bucketStart, bucketSent := time.Now(), int64(0)
+	lastReport := time.Now()
+	sleep := func(d time.Duration) bool {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done(): return false
+		case <-timer.C: return true
+		}
+	}
+	for buf := range chunks {
+		if now := time.Now(); len(t.Windows) > 0 && blockedBy(t.Windows, nil, now) != "" {
+			at, ok := nextAllowed(t.Windows, nil, now)
+			if !ok { return total }
+			if report != nil { report(transferProgress{Bytes: total, Paused: "outside its transfer windows until " + localTime(at).Format(displayLayout)}) }
+			if !sleep(time.Until(at)) { return total }
+			bucketStart, bucketSent = time.Now(), 0
+			lastReport, reported = time.Now(), total
+		}
+		if _, err := dst.Write(buf); err != nil { return total }
+		total += int64(len(buf))
+		if rate > 0 {
+			bucketSent += int64(len(buf))
+			ahead := time.Duration(float64(bucketSent)/rate*float64(time.Second)) - time.Since(bucketStart)
+			// Idle time isn't saved up beyond a second's worth of burst.
+			if ahead < -time.Second { bucketStart, bucketSent = time.Now().Add(-time.Second), 0 }
+			if ahead > 0 && !sleep(ahead) { return total }
+		}
+		if since := time.Since(lastReport); report != nil && since >= transferReportInterval {
+			report(transferProgress{Bytes: total, Rate: float64(total-reported) / since.Seconds()})
+			lastReport, reported = time.Now(), total
+		}
+	}
+	return total
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Snapshot Trash ---
+// With the trash enabled, deleting a snapshot by hand or purging a job only
+// renames the snapshots into .trash/ in the job's destination, as
+// <name>@<unix time of deletion>. A reaper deletes them once the grace
+// period is over; until then they can be restored under their name. The
+// entry names carry all there is to know, so the trash keeps no state of its
+// own, and a changed grace period applies to what is already in it.
+// Retention still deletes at once: it runs to free space, which the trash
+// would hold back.
+
+type TrashConfig struct {
+	Enabled    bool `json:"enabled"`
+	GraceHours int  `json:"grace_hours,omitempty"` // before the reaper deletes, default 24
+}
+
+// TrashedSnapshot is a snapshot waiting in the trash.
+type TrashedSnapshot struct {
+	Job     string `json:"job"`
+	Name    string `json:"name"`  // it is restored under
+	Entry   string `json:"entry"` // its name in the trash
+	Path    string `json:"path"`
+	Deleted string `json:"deleted"` // RFC 3339
+	Expires string `json:"expires"` // when the reaper deletes it
+}
+
+const (
+	trashDirName      = ".trash"
+	defaultTrashGrace = 24 * time.Hour
+	trashReapInterval = 10 * time.Minute
+)
+
+func (c TrashConfig) validate() error {
+	if c.GraceHours < 0 { return fmt.Errorf("grace_hours must not be negative") }
+	return nil
+}
+
+func (c TrashConfig) grace() time.Duration {
+	if c.GraceHours > 0 { return time.Duration(c.GraceHours) * time.Hour }
+	return defaultTrashGrace
+}
+
+func trashConfig() TrashConfig {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.Config.Trash
+}
+
+func trashDir(dest string) string {
+	return filepath.Join(dest, trashDirName)
+}
+
+// parseTrashEntry splits an entry like "home-2026-10-01_0300@1791000000"
+// into the snapshot name and when it was trashed.
+func parseTrashEntry(entry string) (string, time.Time, bool) {
+	i := strings.LastIndex(entry, "@")
+	if i <= 0 { return "", time.Time{}, false }
+	sec, err := strconv.ParseInt(entry[i+1:], 10, 64)
+	if err != nil { return "", time.Time{}, false }
+	return entry[:i], time.Unix(sec, 0), true
+}
+
+// trashEntryPath resolves an entry to its directory in the trash of dest,
+// rejecting anything that escapes it.
+func trashEntryPath(dest, entry string) (string, error) {
+	dir := trashDir(dest)
+	path := filepath.Join(dir, entry)
+	if _, _, ok := parseTrashEntry(entry); !ok || filepath.Dir(path) != dir {
+		return "", fmt.Errorf("invalid trash entry")
+	}
+	return path, nil
+}
+
+// trashSnapshot renames the snapshot name of dest into the trash and returns
+// its entry. Its recorded creation time goes along, for a restore.
+func trashSnapshot(dest, name string) (string, error) {
+	dir := trashDir(dest)
+	if err := os.MkdirAll(dir, 0755); err != nil { return "", err }
+	// The same name trashed twice within a second, after a restore, gets the
+	// next second.
+	var entry string
+	for t := time.Now().Unix(); ; t++ {
+		entry = fmt.Sprintf("%s@%d", name, t)
+		if _, err := os.Lstat(filepath.Join(dir, entry)); os.IsNotExist(err) { break }
+	}
+	if err := os.Rename(snapshotPath(dest, name), filepath.Join(dir, entry)); err != nil { return "", err }
+	if t, ok := loadSnapshotTimes(dest)[name]; ok { recordSnapshotTime(dir, entry, t) }
+	return entry, nil
+}
+
+// moveToTrash trashes the snapshot name of job and logs it.
+func moveToTrash(job SnapshotJob, name string) (TrashedSnapshot, error) {
+	path := snapshotPath(job.Dest, name)
+	entry, err := trashSnapshot(job.Dest, name)
+	if err != nil {
+		logHistory("TRASH", "🗑️", path, "Failed", "Error: "+err.Error())
+		return TrashedSnapshot{}, err
+	}
+	grace := trashConfig().grace()
+	now := time.Now()
+	logHistory("TRASH", "🗑️", path, "Success", fmt.Sprintf("Moved to the trash as '%s'; deleted for good after %dh", entry, int(grace.Hours())))
+	return TrashedSnapshot{
+		Job:     job.ID,
+		Name:    name,
+		Entry:   entry,
+		Path:    filepath.Join(trashDir(job.Dest), entry),
+		Deleted: now.UTC().Format(time.RFC3339),
+		Expires: now.Add(grace).UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// trashPlanned is deletePlanned for the trash: the snapshots of plan are
+// renamed into the trash of their destination.
+func trashPlanned(opType string, plan []PlannedDelete) *PruneResult {
+	result := &PruneResult{Planned: len(plan), Deleted: []string{}}
+	for _, p := range plan {
+		printDockerLog(opType, "Moving to the trash: %s", p.Path)
+		if _, err := trashSnapshot(filepath.Dir(p.Path), p.Name); err == nil {
+			result.Deleted = append(result.Deleted, p.Name)
+		} else {
+			logError(opType, "Failed to move %s to the trash: %v", p.Path, err)
+			result.Failed = append(result.Failed, p.Name)
+		}
+	}
+	return result
+}
+
+// restoreTrashed renames entry back into dest under its snapshot name.
+func restoreTrashed(dest, entry string) (string, error) {
+	from, err := trashEntryPath(dest, entry)
+	if err != nil { return "", err }
+	if _, err := os.Lstat(from); err != nil { return "", err }
+	name, _, _ := parseTrashEntry(entry)
+	to := snapshotPath(dest, name)
+	// Rename would replace an empty directory of the same name.
+	if _, err := os.Lstat(to); err == nil { return "", os.ErrExist }
+	if err := os.Rename(from, to); err != nil { return "", err }
+	if t, ok := loadSnapshotTimes(trashDir(dest))[entry]; ok { recordSnapshotTime(dest, name, t) }
+	return name, nil
+}
+
+// listTrash returns the job's snapshots in the trash, most recently
+// trashed first.
+func listTrash(job SnapshotJob, grace time.Duration) []TrashedSnapshot {
+	list := []TrashedSnapshot{}
+	if job.Dest == "" { return list }
+	entries, _ := os.ReadDir(trashDir(job.Dest))
+	for _, e := range entries {
+		name, deleted, ok := parseTrashEntry(e.Name())
+		// Jobs sharing a destination share the trash too.
+		if !e.IsDir() || !ok || !(strings.HasPrefix(name, job.Prefix) || job.adopted(name)) { continue }
+		list = append(list, TrashedSnapshot{
+			Job:     job.ID,
+			Name:    name,
+			Entry:   e.Name(),
+			Path:    filepath.Join(trashDir(job.Dest), e.Name()),
+			Deleted: deleted.UTC().Format(time.RFC3339),
+			Expires: deleted.Add(grace).UTC().Format(time.RFC3339),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Deleted > list[j].Deleted })
+	return list
+}
+
+// deleteTrashed deletes entries from the trash of dest for good and reports
+// the snapshot names deleted.
+func deleteTrashed(opType, dest string, entries []string) *PruneResult {
+	result := &PruneResult{Planned: len(entries), Deleted: []string{}}
+	for _, entry := range entries {
+		name, _, _ := parseTrashEntry(entry)
+		path := filepath.Join(trashDir(dest), entry)
+		printDockerLog(opType, "Deleting: %s", path)
+		if err := deleteSnapshotTree(path); err != nil {
+			logError(opType, "Failed to delete %s: %v", path, err)
+			result.Failed = append(result.Failed, name)
+			continue
+		}
+		// A snapshot restored or taken under the name since keeps its metadata.
+		if _, err := os.Lstat(snapshotPath(dest, name)); os.IsNotExist(err) { forgetSnapshotMeta(snapshotPath(dest, name)) }
+		result.Deleted = append(result.Deleted, name)
+	}
+	return result
+}
+
+// --- Reaper ---
+
+func runTrashReaper() {
+	for ; ; time.Sleep(trashReapInterval) {
+		if shuttingDown() { return }
+		reapTrash(time.Now())
+	}
+}
+
+// reapTrash deletes what has been in the trash of any destination for
+// longer than the grace period. Trash on a locked filesystem waits for the
+// lock to be released.
+func reapTrash(now time.Time) {
+	state.mu.Lock()
+	grace := state.Config.Trash.grace()
+	jobs := append([]SnapshotJob(nil), state.Config.SnapshotJobs...)
+	if state.Config.StateBackup.Enabled { jobs = append(jobs, stateBackupJob(state.Config.StateBackup)) }
+	state.mu.Unlock()
+
+	seen := map[string]bool{}
+	for _, job := range jobs {
+		if job.Dest == "" || seen[job.Dest] { continue }
+		seen[job.Dest] = true
+		entries, err := os.ReadDir(trashDir(job.Dest))
+		if err != nil { continue }
+		var expired []string
+		for _, e := range entries {
+			if _, deleted, ok := parseTrashEntry(e.Name()); ok && e.IsDir() && now.Sub(deleted) >= grace { expired = append(expired, e.Name()) }
+		}
+		if len(expired) == 0 { continue }
+		if l := lockedFor(job.Dest); l != nil {
+			appLog.Debug(fmt.Sprintf("Not emptying the trash of %s: %s", job.Dest, l.message()), "op", "TRASH REAP")
+			continue
+		}
+		result := deleteTrashed("TRASH REAP", job.Dest, expired)
+		logHistoryResult("TRASH REAP", "🗑️", trashDir(job.Dest), prunedStatus(result),
+			fmt.Sprintf("Deleted %d snapshots after %dh in the trash", len(result.Deleted), int(grace.Hours())), &OperationResult{Prune: result})
+	}
+}
+
+// --- Handlers ---
+
+// handleListTrash lists the snapshots in the trash of the job given by
+// ?job=, or of every job.
+func handleListTrash(w http.ResponseWriter, r *http.Request) {
+	jobs, err := jobsFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	cfg := trashConfig()
+	list := []TrashedSnapshot{}
+	for _, job := range jobs { list = append(list, listTrash(job, cfg.grace())...) }
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":     cfg.Enabled,
+		"grace_hours": int(cfg.grace().Hours()),
+		"snapshots":   list,
+	})
+}
+
+// handleRestoreTrash renames ?entry= back into the job's destination.
+func handleRestoreTrash(w http.ResponseWriter, r *http.Request) {
+	job, err := jobFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if job.Dest == "" {
+		http.Error(w, "Destination not configured", 400)
+		return
+	}
+	entry := r.URL.Query().Get("entry")
+	if _, err := trashEntryPath(job.Dest, entry); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	name, err := restoreTrashed(job.Dest, entry)
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, "Not in the trash", 404)
+		return
+	case os.IsExist(err):
+		http.Error(w, "A snapshot with that name exists; delete or rename it first", 409)
+		return
+	case err != nil:
+		logHistory("TRASH RESTORE", "♻️", filepath.Join(trashDir(job.Dest), entry), "Failed", "Error: "+err.Error())
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	path := snapshotPath(job.Dest, name)
+	logHistory("TRASH RESTORE", "♻️", path, "Success", fmt.Sprintf("Restored '%s' from the trash", name))
+	if job.Boot.Enabled { go refreshBootMenu(job) }
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "restored", "name": name, "path": path})
+}
+
+// handleEmptyTrash deletes ?entry= from the job's trash for good, or the
+// whole trash of the job without it.
+func handleEmptyTrash(w http.ResponseWriter, r *http.Request) {
+	job, err := jobFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if job.Dest == "" {
+		http.Error(w, "Destination not configured", 400)
+		return
+	}
+	var entries []string
+	if entry := r.URL.Query().Get("entry"); entry != "" {
+		path, err := trashEntryPath(job.Dest, entry)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if _, err := os.Lstat(path); err != nil {
+			http.Error(w, "Not in the trash", 404)
+			return
+		}
+		entries = []string{entry}
+	} else {
+		for _, t := range listTrash(job, trashConfig().grace()) { entries = append(entries, t.Entry) }
+	}
+	if len(entries) == 0 {
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "empty"})
+		return
+	}
+	if refuseLocked(w, job.Dest) { return }
+	dir := trashDir(job.Dest)
+	id, _ := startBtrfsOp("TRASH EMPTY", "🗑️", dir, fmt.Sprintf("Delete %d snapshot(s) from '%s'", len(entries), dir), func() (*OperationResult, error) {
+		result := deleteTrashed("TRASH EMPTY", job.Dest, entries)
+		var err error
+		if len(result.Failed) > 0 { err = fmt.Errorf("%d of %d could not be deleted", len(result.Failed), len(entries)) }
+		return &OperationResult{Prune: result}, err
+	})
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "triggered", "id": id})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// --- Trim ---
+// `fstrim -v` tells the SSDs (or thin volumes) under the target drive which
+// blocks are free, on trim_sched or with Trim ✂️. It runs on the mount the
+// target drive is on, which covers every device of the filesystem. A
+// filesystem mounted with discard (discard=async is the default on SSDs
+// since Linux 6.2) trims as it goes and needs no schedule; the preview says
+// so, and names devices that don't take discards at all.
+
+type TrimResult struct {
+	Mount   string `json:"mount"`
+	Trimmed uint64 `json:"trimmed"` // bytes
+}
+
+// util-linux: "/mnt/data: 1.2 GiB (1288490188 bytes) trimmed", with -a
+// "... trimmed on /dev/sda1"; busybox: "/mnt/data: 1288490188 bytes trimmed".
+var fstrimLineRe = regexp.MustCompile(`^(.+?): (?:.*\()?(\d+) bytes\)? trimmed`)
+
+func parseFstrim(out string) *TrimResult {
+	for _, line := range strings.Split(out, "\n") {
+		m := fstrimLineRe.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil { continue }
+		n, _ := strconv.ParseUint(m[2], 10, 64)
+		return &TrimResult{Mount: m[1], Trimmed: n}
+	}
+	return nil
+}
+
+// trimMount is the mount point fstrim runs on for path.
+func trimMount(path string) (Mount, error) {
+	m, ok := mountOf(path)
+	if !ok { return m, fmt.Errorf("cannot find the mount of %s", path) }
+	if m.FSType != "btrfs" { return m, fmt.Errorf("%s is on a %s mount, not btrfs", path, m.FSType) }
+	return m, nil
+}
+
+// trimWarnings describes why trimming m is unnecessary or won't do anything.
+func trimWarnings(m Mount) []string {
+	var warnings []string
+	for _, opt := range strings.Split(m.Options, ",") {
+		if opt == "discard" || strings.HasPrefix(opt, "discard=") {
+			warnings = append(warnings, fmt.Sprintf("%s is mounted with %s and trims continuously; a scheduled trim adds little", m.Path, opt))
+		}
+	}
+	devices, err := listDevices(m.Path)
+	if err != nil { return warnings }
+	for _, d := range devices {
+		if d.Missing { continue }
+		real, err := filepath.EvalSymlinks(d.Path)
+		if err != nil { continue }
+		// A partition's queue settings are those of its disk.
+		queue := filepath.Join("/sys/class/block", filepath.Base(real), "queue")
+		if _, err := os.Stat(queue); err != nil { queue = filepath.Join("/sys/class/block", filepath.Base(real), "..", "queue") }
+		data, err := os.ReadFile(filepath.Join(queue, "discard_max_bytes"))
+		if err == nil && strings.TrimSpace(string(data)) == "0" { warnings = append(warnings, fmt.Sprintf("%s does not support discard, trimming skips it", d.Path)) }
+	}
+	return warnings
+}
+
+func runTrim(opType, path string) (int64, error) {
+	m, err := trimMount(path)
+	if err != nil { return 0, err }
+	return runCommandAsync(opType, "✂️", m.Path, "fstrim", "-v", m.Path), nil
+}
+
+func runScheduledTrim(run *JobRun) {
+	state.mu.Lock()
+	path := state.Config.TargetDrive
+	state.mu.Unlock()
+	if path == "" { return }
+	id, err := runTrim("AUTO TRIM", path)
+	if err != nil {
+		logHistoryJob("trim", "AUTO TRIM", "✂️", path, "Failed", err.Error())
+		return
+	}
+	run.tag(id)
+}
+
+func previewTrim(cfg Config) ([]PlannedOp, []string) {
+	if cfg.TargetDrive == "" { return nil, []string{"target drive not set: job will do nothing"} }
+	var warnings []string
+	if _, err := exec.LookPath("fstrim"); err != nil { warnings = append(warnings, "fstrim is not installed") }
+	m, err := trimMount(cfg.TargetDrive)
+	if err != nil { return nil, append(warnings, err.Error()) }
+	warnings = append(warnings, trimWarnings(m)...)
+	return []PlannedOp{{Description: "Trim the free space of " + m.Path, Command: formatCommand("fstrim", "-v", m.Path)}}, warnings
+}
+
+// handleActionTrim trims the filesystem of the target drive or ?path=.
+func handleActionTrim(w http.ResponseWriter, r *http.Request) {
+	if !requireFeature(w, "trim") { return }
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	id, err := runTrim("TRIM", path)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": id})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Unclean Shutdown Detection ---
+// The state records that the app is running, the boot it runs in and the
+// device error counters of its filesystems. If the next start finds the
+// running flag still set after a reboot, the system went down without
+// stopping the app (a crash or power loss), and counters that grew in the
+// meantime point at trouble too. Either is recorded in the activity log and,
+// with unclean_scrub enabled, the affected filesystems are scrubbed.
+
+type UncleanScrubConfig struct {
+	Enabled bool     `json:"enabled"`
+	Targets []string `json:"targets"` // empty: the scrub targets
+}
+
+// ShutdownState is persisted in state.json.
+type ShutdownState struct {
+	Running bool   `json:"running"` // cleared by a clean shutdown
+	BootID  string `json:"boot_id,omitempty"`
+	// DeviceStats are the `btrfs device stats` counters per filesystem and
+	// device, as of the last start or clean shutdown.
+	DeviceStats map[string]map[string]map[string]uint64 `json:"device_stats,omitempty"`
+}
+
+const bootIDFile = "/proc/sys/kernel/random/boot_id"
+
+func (c UncleanScrubConfig) validate() error {
+	for _, t := range c.Targets {
+		if !filepath.IsAbs(t) { return fmt.Errorf("unclean_scrub target %q must be an absolute path", t) }
+	}
+	return nil
+}
+
+func uncleanTargets(cfg Config) []string {
+	if len(cfg.UncleanScrub.Targets) == 0 { return scrubTargets(cfg) }
+	var targets []string
+	for _, t := range cfg.UncleanScrub.Targets { targets = append(targets, filepath.Clean(t)) }
+	return targets
+}
+
+func currentBootID() string {
+	data, _ := os.ReadFile(bootIDFile)
+	return strings.TrimSpace(string(data))
+}
+
+// watchedFilesystems are the filesystems whose counters are tracked: the
+// scrub targets and the unclean_scrub targets.
+func watchedFilesystems(cfg Config) []string {
+	seen := map[string]bool{}
+	var list []string
+	for _, p := range append(scrubTargets(cfg), uncleanTargets(cfg)...) {
+		if !seen[p] { seen[p], list = true, append(list, p) }
+	}
+	return list
+}
+
+// readDeviceStats reads the counters of every watched filesystem; ones that
+// cannot be read are left out. device stats exits non-zero when any counter
+// is set, so only the output is looked at.
+func readDeviceStats(paths []string) map[string]map[string]map[string]uint64 {
+	all := map[string]map[string]map[string]uint64{}
+	for _, p := range paths {
+		out, _ := exec.Command("btrfs", "device", "stats", p).CombinedOutput()
+		if stats := parseDeviceStats(string(out)); len(stats) > 0 { all[p] = stats }
+	}
+	return all
+}
+
+// statsGrowth lists the counters that grew from before to now, e.g.
+// "/dev/sdb write_io_errs +3". Counters that were reset are ignored.
+func statsGrowth(before, now map[string]map[string]uint64) []string {
+	var grown []string
+	for dev, counters := range now {
+		for name, v := range counters {
+			if old, ok := before[dev][name]; ok && v > old { grown = append(grown, fmt.Sprintf("%s %s +%d", dev, name, v-old)) }
+		}
+	}
+	sort.Strings(grown)
+	return grown
+}
+
+// checkUncleanShutdown runs once at startup, after reconcileOperations, and
+// marks the app as running until the next clean shutdown.
+func checkUncleanShutdown() {
+	state.mu.Lock()
+	prev := state.Shutdown
+	cfg := state.Config
+	state.mu.Unlock()
+
+	bootID := currentBootID()
+	stats := readDeviceStats(watchedFilesystems(cfg))
+	state.mu.Lock()
+	state.Shutdown = &ShutdownState{Running: true, BootID: bootID, DeviceStats: stats}
+	saveState()
+	state.mu.Unlock()
+	if prev == nil { return } // first start with detection
+
+	// Without a boot ID a leftover running flag may as well be a power loss.
+	hostDown := prev.Running && (bootID == "" || prev.BootID == "" || bootID != prev.BootID)
+	if prev.Running && !hostDown {
+		logHistory("UNCLEAN SHUTDOWN", "⚡", "web UI", "Warning", "The web UI exited without shutting down (crash or kill); the system kept running, so the filesystems are not affected.")
+	}
+
+	uncleanSet := map[string]bool{}
+	for _, p := range uncleanTargets(cfg) { uncleanSet[p] = true }
+	var toScrub []string
+	for _, p := range watchedFilesystems(cfg) {
+		var reasons []string
+		if hostDown { reasons = append(reasons, "The system went down without stopping the web UI (crash or power loss).") }
+		if grown := statsGrowth(prev.DeviceStats[p], stats[p]); len(grown) > 0 {
+			reasons = append(reasons, "Device error counters grew since the last run: "+strings.Join(grown, ", ")+".")
+		}
+		if len(reasons) == 0 { continue }
+
+		action := "Automatic scrub is off (unclean_scrub)."
+		switch {
+		case !uncleanSet[p]: action = "Not an unclean_scrub target: not scrubbed."
+		case !cfg.UncleanScrub.Enabled:
+		case scrubRunning(p): action = "A scrub is already running."
+		default:
+			action = "Starting a scrub."
+			toScrub = append(toScrub, p)
+		}
+		printDockerLog("SCRUB", "Unclean shutdown check for %s: %s %s", p, strings.Join(reasons, " "), action)
+		logHistory("UNCLEAN SHUTDOWN", "⚡", p, "Warning", strings.Join(reasons, "\n")+"\n\n"+action)
+	}
+	if len(toScrub) > 0 { go runUncleanScrubs(toScrub) }
+}
+
+// runUncleanScrubs scrubs one filesystem after the other, so a power loss
+// does not turn into all pools competing for I/O at once.
+func runUncleanScrubs(targets []string) {
+	for _, p := range targets {
+		if shuttingDown() { return }
+		if scrubInProgress(p) != nil { continue }
+		markScrubScheduled(p, time.Now())
+		state.mu.Lock()
+		mode := state.Config.ScrubPlan.Mode
+		state.mu.Unlock()
+		_, done := startScrub("UNCLEAN SCRUB", p, mode)
+		<-done
+	}
+}
+
+// recordCleanShutdown clears the running flag and refreshes the counters,
+// before the state is written for the last time.
+func recordCleanShutdown() {
+	state.mu.Lock()
+	cfg := state.Config
+	state.mu.Unlock()
+	stats := readDeviceStats(watchedFilesystems(cfg))
+	state.mu.Lock()
+	state.Shutdown = &ShutdownState{Running: false, BootID: currentBootID(), DeviceStats: stats}
+	saveState()
+	state.mu.Unlock()
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// --- Filesystem Usage ---
+
+type ChunkUsage struct {
+	Type    string            `json:"type"`
+	Profile string            `json:"profile"`
+	Size    uint64            `json:"size"`
+	Used    uint64            `json:"used"`
+	Devices map[string]uint64 `json:"devices,omitempty"`
+}
+
+type FilesystemUsage struct {
+	Path              string            `json:"path"`
+	Total             uint64            `json:"total"`
+	Used              uint64            `json:"used"`
+	Free              uint64            `json:"free"`
+	FreeMin           uint64            `json:"free_min"`
+	DeviceAllocated   uint64            `json:"device_allocated"`
+	DeviceUnallocated uint64            `json:"device_unallocated"`
+	DeviceMissing     uint64            `json:"device_missing"`
+	DataRatio         float64           `json:"data_ratio"`
+	MetadataRatio     float64           `json:"metadata_ratio"`
+	GlobalReserve     uint64            `json:"global_reserve"`
+	GlobalReserveUsed uint64            `json:"global_reserve_used"`
+	Chunks            []ChunkUsage      `json:"chunks"`
+	Unallocated       map[string]uint64 `json:"unallocated"`
+}
+
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	if !requireFeature(w, "usage") { return }
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		state.mu.Lock()
+		path = state.Config.TargetDrive
+		state.mu.Unlock()
+	}
+	if path == "" {
+		http.Error(w, "Target drive not set", 400)
+		return
+	}
+
+	usage, err := getFilesystemUsage(path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(usage)
+}
+
+// getFilesystemUsage combines `btrfs filesystem usage -b` (overall numbers and
+// per-device placement) with `btrfs filesystem df -b` (per chunk type totals,
+// which is also the only source for GlobalReserve on older btrfs-progs).
+func getFilesystemUsage(path string) (*FilesystemUsage, error) {
+	out, err := exec.Command("btrfs", "filesystem", "usage", "-b", path).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("btrfs filesystem usage: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	usage := parseFilesystemUsage(string(out))
+	usage.Path = path
+
+	out, err = exec.Command("btrfs", "filesystem", "df", "-b", path).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("btrfs filesystem df: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	mergeFilesystemDF(usage, string(out))
+	return usage, nil
+}
+
+func parseFilesystemUsage(out string) *FilesystemUsage {
+	usage := &FilesystemUsage{Unallocated: make(map[string]uint64)}
+	var chunk *ChunkUsage
+	section := ""
+
+	for _, line := range strings.Split(out, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		indented := line[0] == ' ' || line[0] == '\t'
+
+		if !indented {
+			chunk = nil
+			switch {
+			case trimmed == "Overall:":
+				section = "overall"
+			case trimmed == "Unallocated:":
+				section = "unallocated"
+			case strings.Contains(trimmed, ","):
+				// e.g. "Data,RAID1: Size:1073741824, Used:0 (0.00%)"
+				section = "chunk"
+				head, rest, _ := strings.Cut(trimmed, ":")
+				typ, profile, _ := strings.Cut(head, ",")
+				usage.Chunks = append(usage.Chunks, ChunkUsage{
+					Type:    typ,
+					Profile: profile,
+					Size:    parseKeyedNumber(rest, "Size:"),
+					Used:    parseKeyedNumber(rest, "Used:"),
+					Devices: make(map[string]uint64),
+				})
+				chunk = &usage.Chunks[len(usage.Chunks)-1]
+			default:
+				section = ""
+			}
+			continue
+		}
+
+		switch section {
+		case "overall":
+			key, val, ok := strings.Cut(trimmed, ":")
+			if !ok {
+				continue
+			}
+			fields := strings.Fields(val)
+			if len(fields) == 0 {
+				continue
+			}
+			n, _ := strconv.ParseUint(fields[0], 10, 64)
+			switch key {
+			case "Device size":
+				usage.Total = n
+			case "Device allocated":
+				usage.DeviceAllocated = n
+			case "Device unallocated":
+				usage.DeviceUnallocated = n
+			case "Device missing":
+				usage.DeviceMissing = n
+			case "Used":
+				usage.Used = n
+			case "Free (estimated)":
+				usage.Free = n
+				usage.FreeMin = parseKeyedNumber(val, "(min:")
+			case "Data ratio":
+				usage.DataRatio, _ = strconv.ParseFloat(fields[0], 64)
+			case "Metadata ratio":
+				usage.MetadataRatio, _ = strconv.ParseFloat(fields[0], 64)
+			case "Global reserve":
+				usage.GlobalReserve = n
+				usage.GlobalReserveUsed = parseKeyedNumber(val, "(used:")
+			}
+		case "chunk", "unallocated":
+			fields := strings.Fields(trimmed)
+			if len(fields) < 2 {
+				continue
+			}
+			n, err := strconv.ParseUint(fields[len(fields)-1], 10, 64)
+			if err != nil {
+				continue
+			}
+			dev := strings.Join(fields[:len(fields)-1], " ")
+			if section == "unallocated" {
+				usage.Unallocated[dev] = n
+			} else if chunk != nil {
+				chunk.Devices[dev] = n
+			}
+		}
+	}
+	return usage
+}
+
+// mergeFilesystemDF fills in chunk types that `filesystem usage` did not
+// report (GlobalReserve is df-only) and backfills sizes when usage output was
+// truncated, e.g. when run without root on some btrfs-progs versions.
+func mergeFilesystemDF(usage *FilesystemUsage, out string) {
+	for _, line := range strings.Split(out, "\n") {
+		// e.g. "Metadata, DUP: total=536870912, used=196608"
+		head, rest, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		typ, profile, _ := strings.Cut(head, ",")
+		typ = strings.TrimSpace(typ)
+		profile = strings.TrimSpace(profile)
+		total := parseKeyedNumber(rest, "total=")
+		used := parseKeyedNumber(rest, "used=")
+
+		if typ == "GlobalReserve" {
+			if usage.GlobalReserve == 0 {
+				usage.GlobalReserve = total
+				usage.GlobalReserveUsed = used
+			}
+			continue
+		}
+
+		found := false
+		for i := range usage.Chunks {
+			c := &usage.Chunks[i]
+			if c.Type == typ && strings.EqualFold(c.Profile, profile) {
+				if c.Size == 0 {
+					c.Size = total
+					c.Used = used
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			usage.Chunks = append(usage.Chunks, ChunkUsage{Type: typ, Profile: profile, Size: total, Used: used})
+		}
+	}
+}
+
+// parseKeyedNumber returns the integer following key in s, e.g.
+// parseKeyedNumber("Size:1024, Used:0", "Used:") == 0.
+func parseKeyedNumber(s, key string) uint64 {
+	_, after, ok := strings.Cut(s, key)
+	if !ok {
+		return 0
+	}
+	after = strings.TrimSpace(after)
+	end := strings.IndexFunc(after, func(r rune) bool { return r < '0' || r > '9' })
+	if end == -1 {
+		end = len(after)
+	}
+	n, _ := strconv.ParseUint(after[:end], 10, 64)
+	return n
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Usage History ---
+// The space monitor samples the target drive every usage_sample_minutes
+// into the metrics store (fs_*_bytes). The usage history averages those
+// samples into buckets for charts and projects, from the trend over the
+// range, when the filesystem fills up.
+
+const defaultUsageSampleMinutes = 5
+
+// maxUsagePoints bounds range/resolution so a chart stays drawable.
+const maxUsagePoints = 2000
+
+type UsagePoint struct {
+	Time        time.Time `json:"time"` // start of the bucket
+	Total       uint64    `json:"total"`
+	Used        uint64    `json:"used"`
+	Free        uint64    `json:"free"`
+	Unallocated uint64    `json:"unallocated"`
+}
+
+type UsageHistory struct {
+	Path       string       `json:"path"`
+	Range      string       `json:"range"`
+	Resolution string       `json:"resolution"`
+	Points     []UsagePoint `json:"points"`
+	// Trends over the range per day, and when used space reaches the total
+	// and unallocated space runs out if they continue; empty when not.
+	UsedPerDay        float64 `json:"used_per_day"`
+	UnallocatedPerDay float64 `json:"unallocated_per_day"`
+	FullAt            string  `json:"full_at,omitempty"`
+	UnallocatedGoneAt string  `json:"unallocated_gone_at,omitempty"`
+}
+
+var usageMetrics = map[string]func(*UsagePoint) *uint64{
+	"fs_total_bytes":       func(p *UsagePoint) *uint64 { return &p.Total },
+	"fs_used_bytes":        func(p *UsagePoint) *uint64 { return &p.Used },
+	"fs_free_bytes":        func(p *UsagePoint) *uint64 { return &p.Free },
+	"fs_unallocated_bytes": func(p *UsagePoint) *uint64 { return &p.Unallocated },
+}
+
+func usageSampleInterval() time.Duration {
+	state.mu.Lock()
+	minutes := state.Config.UsageSampleMinutes
+	state.mu.Unlock()
+	if minutes <= 0 { minutes = defaultUsageSampleMinutes }
+	return time.Duration(minutes) * time.Minute
+}
+
+// parseSpan reads a duration that may also be given in days or weeks
+// (7d, 2w) on top of what time.ParseDuration accepts.
+func parseSpan(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			v, err := strconv.ParseFloat(n, 64)
+			if err != nil || v <= 0 { return 0, fmt.Errorf("invalid duration %q", s) }
+			return time.Duration(v * float64(unit)), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 { return 0, fmt.Errorf("invalid duration %q", s) }
+	return d, nil
+}
+
+// usageHistory averages the samples of path since now-span into buckets of
+// resolution, oldest first. Buckets without samples are left out.
+func usageHistory(path string, span, resolution time.Duration, now time.Time) ([]UsagePoint, *trend, *trend, error) {
+	samples, err := store.QueryMetrics("", path, now.Add(-span))
+	if err != nil { return nil, nil, nil, err }
+
+	type bucket struct {
+		sums   map[string]float64
+		counts map[string]int
+	}
+	var order []int64
+	buckets := map[int64]*bucket{}
+	used, unalloc := &trend{}, &trend{}
+	for _, s := range samples {
+		if usageMetrics[s.Name] == nil { continue }
+		switch s.Name {
+		case "fs_used_bytes": used.add(s.Time, s.Value)
+		case "fs_unallocated_bytes": unalloc.add(s.Time, s.Value)
+		}
+		key := s.Time.Truncate(resolution).Unix()
+		b, ok := buckets[key]
+		if !ok {
+			b = &bucket{sums: map[string]float64{}, counts: map[string]int{}}
+			buckets[key] = b
+			order = append(order, key)
+		}
+		b.sums[s.Name] += s.Value
+		b.counts[s.Name]++
+	}
+
+	points := []UsagePoint{}
+	for _, key := range order {
+		b := buckets[key]
+		p := UsagePoint{Time: time.Unix(key, 0).UTC()}
+		for name, field := range usageMetrics {
+			if b.counts[name] > 0 { *field(&p) = uint64(b.sums[name] / float64(b.counts[name])) }
+		}
+		points = append(points, p)
+	}
+	return points, used, unalloc, nil
+}
+
+// trend is a least-squares line through (time, value) samples.
+type trend struct {
+	n, sx, sy, sxx, sxy float64
+	first, last         time.Time
+}
+
+func (t *trend) add(at time.Time, v float64) {
+	if t.n == 0 { t.first = at }
+	t.last = at
+	x := at.Sub(t.first).Hours() / 24
+	t.n++
+	t.sx, t.sy, t.sxx, t.sxy = t.sx+x, t.sy+v, t.sxx+x*x, t.sxy+x*v
+}
+
+// perDay is the slope; samples less than an hour apart tell nothing.
+func (t *trend) perDay() (float64, bool) {
+	d := t.n*t.sxx - t.sx*t.sx
+	if t.n < 2 || d == 0 || t.last.Sub(t.first) < time.Hour { return 0, false }
+	return (t.n*t.sxy - t.sx*t.sy) / d, true
+}
+
+// reaches returns when the trend line crosses target, if it is heading there.
+func (t *trend) reaches(target float64) (time.Time, bool) {
+	slope, ok := t.perDay()
+	if !ok || slope == 0 { return time.Time{}, false }
+	current := (t.sy-slope*t.sx)/t.n + slope*t.last.Sub(t.first).Hours()/24
+	days := (target - current) / slope
+	if days < 0 || days > 100*365 { return time.Time{}, false }
+	return t.last.Add(time.Duration(days * 24 * float64(time.Hour))), true
+}
+
+// handleUsageHistory returns ?range= (default 7d) of usage samples of
+// ?path= (default: target drive) averaged per ?resolution= (default 1h).
+func handleUsageHistory(w http.ResponseWriter, r *http.Request) {
+	path, ok := targetPathFromRequest(w, r)
+	if !ok { return }
+	q := r.URL.Query()
+	rangeStr, resStr := q.Get("range"), q.Get("resolution")
+	if rangeStr == "" { rangeStr = "7d" }
+	if resStr == "" { resStr = "1h" }
+	span, err := parseSpan(rangeStr)
+	if err != nil {
+		http.Error(w, "range: "+err.Error(), 400)
+		return
+	}
+	resolution, err := parseSpan(resStr)
+	if err != nil {
+		http.Error(w, "resolution: "+err.Error(), 400)
+		return
+	}
+	if span > metricsRetention { span = metricsRetention }
+	if resolution < time.Minute || span/resolution > maxUsagePoints {
+		http.Error(w, fmt.Sprintf("resolution must be at least 1m and range/resolution at most %d points", maxUsagePoints), 400)
+		return
+	}
+
+	points, used, unalloc, err := usageHistory(path, span, resolution, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	h := UsageHistory{Path: path, Range: rangeStr, Resolution: resStr, Points: points}
+	h.UsedPerDay, _ = used.perDay()
+	h.UnallocatedPerDay, _ = unalloc.perDay()
+	if len(points) > 0 {
+		if at, ok := used.reaches(float64(points[len(points)-1].Total)); ok { h.FullAt = at.Format(time.RFC3339) }
+		if at, ok := unalloc.reaches(0); ok { h.UnallocatedGoneAt = at.Format(time.RFC3339) }
+	}
+	json.NewEncoder(w).Encode(h)
+}
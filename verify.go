@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// --- Snapshot Verification ---
+// A verify run reads a random sample of the files in a snapshot, so a bad
+// sector under a snapshot that restores depend on shows up before the
+// restore does. Files are opened with O_DIRECT: pages already in the cache
+// (shared with the live subvolume) are not checked again, while a direct
+// read comes from the disk and btrfs verifies the data checksums, failing
+// with EIO on a mismatch it cannot repair from another copy.
+
+type VerifyConfig struct {
+	Schedule      ScheduleConfig `json:"schedule"`
+	Pick          string         `json:"pick,omitempty"`           // snapshot to verify when scheduled: newest (default), oldest or random
+	SamplePercent int            `json:"sample_percent,omitempty"` // of the files; 0: defaultVerifyPercent
+	MaxFiles      int            `json:"max_files,omitempty"`      // 0: defaultVerifyFiles
+	MaxMiB        uint64         `json:"max_mib,omitempty"`        // stop after reading this much; 0: no limit
+}
+
+type VerifyResult struct {
+	Snapshot   string           `json:"snapshot"`
+	Files      int              `json:"files"`   // regular files in the snapshot
+	Sampled    int              `json:"sampled"` // files picked to be read
+	Read       int              `json:"read"`    // files read, up to sampled
+	Bytes      uint64           `json:"bytes"`
+	Buffered   int              `json:"buffered,omitempty"` // read through the page cache, O_DIRECT was refused
+	Unreadable []UnreadableFile `json:"unreadable"`
+}
+
+type UnreadableFile struct {
+	Path  string `json:"path"` // relative to the snapshot
+	Error string `json:"error"`
+}
+
+const (
+	defaultVerifyPercent = 10
+	defaultVerifyFiles   = 1000
+	verifyBufferSize     = 1 << 20
+)
+
+// verifyRuns keeps two verify runs of a job from competing for the disk.
+var verifyRuns = struct {
+	mu      sync.Mutex
+	running map[string]bool
+}{running: map[string]bool{}}
+
+func validateVerify(v VerifyConfig) error {
+	switch v.Pick {
+	case "", "newest", "oldest", "random":
+	default:
+		return fmt.Errorf("verify pick must be newest, oldest or random")
+	}
+	if v.SamplePercent < 0 || v.SamplePercent > 100 { return fmt.Errorf("verify sample_percent must be between 0 and 100") }
+	if v.MaxFiles < 0 { return fmt.Errorf("verify max_files must not be negative") }
+	if err := validateWindows(v.Schedule.Windows); err != nil { return fmt.Errorf("verify schedule: %v", err) }
+	if v.Schedule.Enabled {
+		if _, err := parseSchedule(v.Schedule); err != nil { return fmt.Errorf("invalid verify schedule %q: %v", scheduleSpec(v.Schedule), err) }
+	}
+	return nil
+}
+
+func (v VerifyConfig) percent() int {
+	if v.SamplePercent == 0 { return defaultVerifyPercent }
+	return v.SamplePercent
+}
+
+func (v VerifyConfig) maxFiles() int {
+	if v.MaxFiles == 0 { return defaultVerifyFiles }
+	return v.MaxFiles
+}
+
+// pickVerifySnapshot chooses the snapshot a scheduled run verifies.
+func pickVerifySnapshot(job SnapshotJob) (string, error) {
+	snaps, err := listManagedSnapshots(job)
+	if err != nil { return "", err }
+	if len(snaps) == 0 { return "", fmt.Errorf("job %s has no snapshots", job.ID) }
+	switch job.Verify.Pick {
+	case "oldest":
+		return snaps[len(snaps)-1].Name, nil
+	case "random":
+		return snaps[rand.IntN(len(snaps))].Name, nil
+	}
+	return snaps[0].Name, nil
+}
+
+// sampleFiles walks root and returns up to max of its regular files, each
+// picked with percent chance; past max, reservoir sampling keeps the pick
+// uniform over the whole snapshot. A snapshot with files always gets one
+// read. It also returns the number of files.
+func sampleFiles(root string, percent, max int, stop func() bool) ([]string, int, error) {
+	var sample []string
+	var any string
+	files, picked := 0, 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if stop() { return filepath.SkipAll }
+		if err != nil || !d.Type().IsRegular() { return nil }
+		files++
+		if rand.IntN(files) == 0 { any = path }
+		if percent < 100 && rand.IntN(100) >= percent { return nil }
+		picked++
+		if len(sample) < max {
+			sample = append(sample, path)
+		} else if i := rand.IntN(picked); i < max {
+			sample[i] = path
+		}
+		return nil
+	})
+	if len(sample) == 0 && any != "" { sample = []string{any} }
+	return sample, files, err
+}
+
+// readFile reads path to the end into buf, which must be page aligned for
+// O_DIRECT, and reports whether it had to go through the page cache.
+func readFile(path string, buf []byte, stop func() bool) (int64, bool, error) {
+	buffered := false
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECT, 0)
+	if errors.Is(err, syscall.EINVAL) {
+		buffered = true
+		f, err = os.Open(path)
+	}
+	if err != nil { return 0, buffered, err }
+	defer f.Close()
+	var total int64
+	for !stop() {
+		n, err := f.Read(buf)
+		total += int64(n)
+		if err == io.EOF { return total, buffered, nil }
+		if errors.Is(err, syscall.EINVAL) && !buffered {
+			// Inline and some compressed extents refuse direct reads.
+			f.Close()
+			if f, err = os.Open(path); err != nil { return total, true, err }
+			if _, err = f.Seek(total, io.SeekStart); err != nil { return total, true, err }
+			buffered = true
+			continue
+		}
+		if err != nil { return total, buffered, err }
+	}
+	return total, buffered, nil
+}
+
+// runVerify reads a sample of the files in the job's snapshot name.
+func runVerify(job SnapshotJob, name string, run *JobRun) {
+	verifyRuns.mu.Lock()
+	if verifyRuns.running[job.ID] {
+		verifyRuns.mu.Unlock()
+		printDockerLog("VERIFY", "A snapshot of job %s is still being verified, skipping this run", job.ID)
+		return
+	}
+	verifyRuns.running[job.ID] = true
+	verifyRuns.mu.Unlock()
+	defer func() {
+		verifyRuns.mu.Lock()
+		delete(verifyRuns.running, job.ID)
+		verifyRuns.mu.Unlock()
+	}()
+
+	start := time.Now()
+	v := job.Verify
+	root := snapshotPath(job.Dest, name)
+	id := startHistory("VERIFY", "🔎", root, fmt.Sprintf("Reading %d%% of the files, at most %d", v.percent(), v.maxFiles()))
+	run.tag(id)
+	ctx, cancel := commandContext("VERIFY")
+	defer cancel(nil)
+	trackCommand(id, "verify", []string{root}, cancel)
+	defer untrackCommand(id)
+	stop := func() bool { return shuttingDown() || ctx.Err() != nil }
+
+	result := &VerifyResult{Snapshot: name, Unreadable: []UnreadableFile{}}
+	var lines []string
+	status := "Success"
+	defer func() {
+		updateHistory(id, func(e *LogEntry) {
+			e.Status, e.Result = status, &OperationResult{Verify: result}
+			e.Duration = time.Since(start).Round(time.Millisecond).String()
+			e.Output = strings.Join(lines, "\n")
+			if t, ok := terminationOf(ctx); ok {
+				e.Status, e.Termination = t.Status, t.Kind
+				e.Output += "\n\n" + t.Message
+			}
+		})
+	}()
+
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		status, lines = "Failed", append(lines, fmt.Sprintf("Snapshot %s not found", root))
+		return
+	}
+	sample, files, err := sampleFiles(root, v.percent(), v.maxFiles(), stop)
+	result.Files, result.Sampled = files, len(sample)
+	if err != nil {
+		status, lines = "Failed", append(lines, err.Error())
+		return
+	}
+	buf, err := syscall.Mmap(-1, 0, verifyBufferSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		status, lines = "Failed", append(lines, "allocating the read buffer: "+err.Error())
+		return
+	}
+	defer syscall.Munmap(buf)
+
+	limit := v.MaxMiB << 20
+	for _, path := range sample {
+		if stop() { break }
+		if limit > 0 && result.Bytes >= limit {
+			lines = append(lines, fmt.Sprintf("Stopped after %d MiB (max_mib).", v.MaxMiB))
+			break
+		}
+		n, buffered, err := readFile(path, buf, stop)
+		result.Bytes += uint64(n)
+		if buffered { result.Buffered++ }
+		rel, _ := filepath.Rel(root, path)
+		if err != nil {
+			result.Unreadable = append(result.Unreadable, UnreadableFile{Path: rel, Error: err.Error()})
+			lines = append(lines, fmt.Sprintf("❌ %s: %v", rel, err))
+			continue
+		}
+		result.Read++
+	}
+	lines = append([]string{fmt.Sprintf("Read %d of %d files (%s) in %s.", result.Read, files, formatBytes(result.Bytes), name)}, lines...)
+	if len(result.Unreadable) > 0 {
+		status = "Failed"
+		lines = append(lines, fmt.Sprintf("%d files could not be read; a scrub shows whether the damage is repairable.", len(result.Unreadable)))
+	}
+}
+
+func previewVerify(job SnapshotJob) ([]PlannedOp, []string) {
+	if job.Dest == "" { return nil, []string{"snapshot destination not set: job will do nothing"} }
+	snaps, err := listManagedSnapshots(job)
+	if err != nil { return nil, []string{"cannot list snapshots: " + err.Error()} }
+	if len(snaps) == 0 { return nil, []string{"no snapshots to verify yet"} }
+	pick := job.Verify.Pick
+	if pick == "" { pick = "newest" }
+	desc := fmt.Sprintf("Read %d%% of the files (at most %d) of the %s snapshot", job.Verify.percent(), job.Verify.maxFiles(), pick)
+	if pick != "random" {
+		name, _ := pickVerifySnapshot(job)
+		desc += ", " + name
+	}
+	return []PlannedOp{{Description: desc}}, nil
+}
+
+// handleActionVerify starts a verify run of ?snapshot= in ?job=, by default
+// of the snapshot the job's verify schedule would pick.
+func handleActionVerify(w http.ResponseWriter, r *http.Request) {
+	job, err := jobFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	name := r.URL.Query().Get("snapshot")
+	if name == "" {
+		if name, err = pickVerifySnapshot(job); err != nil { http.Error(w, err.Error(), 400); return }
+	} else if _, err := snapshotRoot(job, name); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	go func() {
+		run := newJobRun("verify:"+job.ID, "manual")
+		runVerify(job, name, run)
+		run.finish()
+	}()
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "triggered", "message": "Verifying " + name, "snapshot": name})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Version & Update Check ---
+// The update check only detects new GitHub releases and fetches their notes;
+// installing them is left to the user (e.g. pulling a new image).
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+const defaultUpdateRepo = "hkcfs/btrfs-webui"
+
+type UpdateCheckConfig struct {
+	Enabled bool   `json:"enabled"`
+	Repo    string `json:"repo"` // GitHub owner/name, defaults to hkcfs/btrfs-webui
+}
+
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+type ReleaseInfo struct {
+	Tag       string `json:"tag"`
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	Notes     string `json:"notes"`
+	Published string `json:"published"`
+}
+
+type UpdateStatus struct {
+	Checked   string       `json:"checked,omitempty"`
+	Latest    *ReleaseInfo `json:"latest,omitempty"`
+	Available bool         `json:"available"`
+	Error     string       `json:"error,omitempty"`
+}
+
+var updateCheck = struct {
+	mu       sync.Mutex
+	status   UpdateStatus
+	notified string // release tag a notification was already sent for
+}{}
+
+var updateClient = &http.Client{Timeout: 15 * time.Second}
+
+// buildInfo combines the linked version with the VCS stamp Go embeds when
+// building from a git checkout.
+func buildInfo() BuildInfo {
+	b := BuildInfo{Version: version, GoVersion: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok { return b }
+	if b.Version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" { b.Version = info.Main.Version }
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			b.Commit = s.Value
+			if len(b.Commit) > 12 { b.Commit = b.Commit[:12] }
+		case "vcs.time": b.BuildTime = s.Value
+		case "vcs.modified": b.Modified = s.Value == "true"
+		}
+	}
+	return b
+}
+
+func fetchLatestRelease(repo string) (*ReleaseInfo, error) {
+	req, err := http.NewRequest("GET", "https://api.github.com/repos/"+repo+"/releases/latest", nil)
+	if err != nil { return nil, err }
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", "btrfs-manager/"+version)
+	resp, err := updateClient.Do(req)
+	if err != nil { return nil, err }
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 { return nil, fmt.Errorf("GitHub returned %s", resp.Status) }
+
+	var rel struct {
+		TagName     string `json:"tag_name"`
+		Name        string `json:"name"`
+		HTMLURL     string `json:"html_url"`
+		Body        string `json:"body"`
+		PublishedAt string `json:"published_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&rel); err != nil { return nil, err }
+	return &ReleaseInfo{Tag: rel.TagName, Name: rel.Name, URL: rel.HTMLURL, Notes: rel.Body, Published: rel.PublishedAt}, nil
+}
+
+// parseVersion reads "v1.2.3" (pre-release and build suffixes ignored).
+func parseVersion(v string) ([3]int, bool) {
+	var out [3]int
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	v, _, _ = strings.Cut(v, "-")
+	v, _, _ = strings.Cut(v, "+")
+	parts := strings.Split(v, ".")
+	if len(parts) == 0 || len(parts) > 3 { return out, false }
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil { return out, false }
+		out[i] = n
+	}
+	return out, true
+}
+
+// newerVersion reports whether latest is newer than current. Builds without
+// a release version (e.g. "dev") never count as outdated.
+func newerVersion(latest, current string) bool {
+	l, ok1 := parseVersion(latest)
+	c, ok2 := parseVersion(current)
+	if !ok1 || !ok2 { return false }
+	for i := range l {
+		if l[i] != c[i] { return l[i] > c[i] }
+	}
+	return false
+}
+
+func checkForUpdate() UpdateStatus {
+	state.mu.Lock()
+	repo := state.Config.UpdateCheck.Repo
+	state.mu.Unlock()
+	if repo == "" { repo = defaultUpdateRepo }
+
+	status := UpdateStatus{Checked: time.Now().Format(time.RFC3339)}
+	rel, err := fetchLatestRelease(repo)
+	if err != nil {
+		status.Error = err.Error()
+		logWarn("UPDATE", "Update check failed: %v", err)
+	} else {
+		status.Latest = rel
+		status.Available = newerVersion(rel.Tag, buildInfo().Version)
+	}
+
+	updateCheck.mu.Lock()
+	defer updateCheck.mu.Unlock()
+	updateCheck.status = status
+	if status.Available && updateCheck.notified != rel.Tag {
+		updateCheck.notified = rel.Tag
+		printDockerLog("UPDATE", "New version available: %s", rel.Tag)
+		notes := rel.Notes
+		if len(notes) > 1500 { notes = notes[:1500] + "…" }
+		go notify(newNotification(EventUpdateAvailable, "New version available: "+rel.Tag,
+			fmt.Sprintf("BTRFS Manager %s is available (running %s).\n%s\n\n%s", rel.Tag, buildInfo().Version, rel.URL, notes)))
+	}
+	return status
+}
+
+// runUpdateChecker checks once a day while the update check is enabled.
+func runUpdateChecker(interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		state.mu.Lock()
+		enabled := state.Config.UpdateCheck.Enabled
+		state.mu.Unlock()
+		if enabled { checkForUpdate() }
+	}
+}
+
+// handleVersion reports the build. ?check=1 queries GitHub right away, even
+// with the periodic check disabled.
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	var status UpdateStatus
+	if r.URL.Query().Get("check") == "1" {
+		status = checkForUpdate()
+	} else {
+		updateCheck.mu.Lock()
+		status = updateCheck.status
+		updateCheck.mu.Unlock()
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"build": buildInfo(), "update": status})
+}
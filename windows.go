@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Maintenance Windows ---
+// A schedule can be limited to time windows, and global blackout periods
+// keep every scheduled job out. A job firing outside is deferred to the next
+// minute it may run instead of being skipped; fires while it waits fold into
+// that one deferred run.
+
+// TimeWindow is a daily span in the installation's timezone. End before Start runs past
+// midnight; the part after midnight belongs to the day it started on.
+type TimeWindow struct {
+	Days  []string `json:"days,omitempty"` // mon, tue, ... sun; empty: every day
+	Start string   `json:"start"`          // HH:MM
+	End   string   `json:"end"`            // HH:MM, 24:00 for end of day
+}
+
+// Blackout is either a recurring window or, with From and To, a one-off
+// period (RFC 3339 or "2006-01-02 15:04" in the installation's timezone).
+type Blackout struct {
+	Name string `json:"name,omitempty"`
+	TimeWindow
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// maxDeferral is how far ahead an allowed time is looked for.
+const maxDeferral = 14 * 24 * time.Hour
+
+var weekdays = map[string]time.Weekday{"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday}
+
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, err1 := strconv.Atoi(h)
+	min, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || min < 0 || min > 59 || hour*60+min > 24*60 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return hour*60 + min, nil
+}
+
+func (w TimeWindow) validate() error {
+	for _, d := range w.Days {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok { return fmt.Errorf("unknown day %q", d) }
+	}
+	if _, err := parseClock(w.Start); err != nil { return err }
+	_, err := parseClock(w.End)
+	return err
+}
+
+func (w TimeWindow) onDay(d time.Weekday) bool {
+	if len(w.Days) == 0 { return true }
+	for _, name := range w.Days {
+		if weekdays[strings.ToLower(name)] == d { return true }
+	}
+	return false
+}
+
+func (w TimeWindow) contains(t time.Time) bool {
+	t = localTime(t)
+	start, _ := parseClock(w.Start)
+	end, _ := parseClock(w.End)
+	m := t.Hour()*60 + t.Minute()
+	switch {
+	case start == end: return w.onDay(t.Weekday())
+	case start < end: return w.onDay(t.Weekday()) && m >= start && m < end
+	default: return (m >= start && w.onDay(t.Weekday())) || (m < end && w.onDay(t.AddDate(0, 0, -1).Weekday()))
+	}
+}
+
+func parseBlackoutTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil { return t, nil }
+	return time.ParseInLocation("2006-01-02 15:04", s, appLocation())
+}
+
+func (b Blackout) oneOff() bool { return b.From != "" || b.To != "" }
+
+func (b Blackout) validate() error {
+	if !b.oneOff() { return b.TimeWindow.validate() }
+	from, err := parseBlackoutTime(b.From)
+	if err != nil { return fmt.Errorf("invalid from %q", b.From) }
+	to, err := parseBlackoutTime(b.To)
+	if err != nil { return fmt.Errorf("invalid to %q", b.To) }
+	if !to.After(from) { return fmt.Errorf("to must be after from") }
+	return nil
+}
+
+func (b Blackout) contains(t time.Time) bool {
+	if !b.oneOff() { return b.TimeWindow.contains(t) }
+	from, _ := parseBlackoutTime(b.From)
+	to, _ := parseBlackoutTime(b.To)
+	return !t.Before(from) && t.Before(to)
+}
+
+func validateWindows(windows []TimeWindow) error {
+	for i, w := range windows {
+		if err := w.validate(); err != nil { return fmt.Errorf("window %d: %v", i+1, err) }
+	}
+	return nil
+}
+
+func validateBlackouts(blackouts []Blackout) error {
+	for i, b := range blackouts {
+		if err := b.validate(); err != nil { return fmt.Errorf("blackout %d: %v", i+1, err) }
+	}
+	return nil
+}
+
+// blockedBy tells why a job may not run at t, or "" if it may.
+func blockedBy(windows []TimeWindow, blackouts []Blackout, t time.Time) string {
+	for _, b := range blackouts {
+		if !b.contains(t) { continue }
+		if b.Name != "" { return "during blackout " + b.Name }
+		return "during a blackout period"
+	}
+	if len(windows) == 0 { return "" }
+	for _, w := range windows {
+		if w.contains(t) { return "" }
+	}
+	return "outside its maintenance windows"
+}
+
+// nextAllowed returns t, or the first minute after it where the job may run.
+func nextAllowed(windows []TimeWindow, blackouts []Blackout, t time.Time) (time.Time, bool) {
+	if blockedBy(windows, blackouts, t) == "" { return t, true }
+	for at := t.Truncate(time.Minute).Add(time.Minute); at.Sub(t) <= maxDeferral; at = at.Add(time.Minute) {
+		if blockedBy(windows, blackouts, at) == "" { return at, true }
+	}
+	return time.Time{}, false
+}
+
+var deferrals = struct {
+	mu      sync.Mutex
+	pending map[string]time.Time
+}{pending: map[string]time.Time{}}
+
+// runWindowed runs the scheduled job name now if its windows and the
+// blackouts allow it, or defers it and records that in the history.
+func runWindowed(name, trigger string, run func(*JobRun)) {
+	state.mu.Lock()
+	_, registered := state.cronIDs[name]
+	var job scheduledJob
+	for _, j := range scheduledJobs(state.Config) {
+		if j.Name == name { job = j }
+	}
+	windows := job.Schedule.Windows
+	blackouts := state.Config.Blackouts
+	state.mu.Unlock()
+	if !registered { return } // unscheduled while deferred
+
+	now := time.Now()
+	if alreadyCaughtUp(name, job, now) {
+		printDockerLog("SCHEDULER", "%s fired, but a catch-up run already covered it", name)
+		return
+	}
+	state.mu.Lock()
+	cfg := state.Config
+	state.mu.Unlock()
+	if skipLocked(cfg, name) { return }
+	reason := blockedBy(windows, blackouts, now)
+	if reason == "" {
+		cancelRetry(name)
+		recordLastRun(name, now)
+		go func() {
+			r := newJobRun(name, trigger)
+			run(r)
+			r.finish()
+		}()
+		return
+	}
+
+	deferrals.mu.Lock()
+	defer deferrals.mu.Unlock()
+	if at, ok := deferrals.pending[name]; ok {
+		printDockerLog("SCHEDULER", "%s fired %s, already deferred to %s", name, reason, at.Format(time.RFC3339))
+		return
+	}
+	at, ok := nextAllowed(windows, blackouts, now)
+	if !ok {
+		logHistoryJob(name, "DEFERRED", "⏸️", name, "Failed", fmt.Sprintf("Fired %s with no allowed time in the next %d days: skipped.", reason, int(maxDeferral.Hours()/24)))
+		return
+	}
+	deferrals.pending[name] = at
+	time.AfterFunc(time.Until(at), func() {
+		deferrals.mu.Lock()
+		delete(deferrals.pending, name)
+		deferrals.mu.Unlock()
+		runWindowed(name, trigger, run)
+	})
+	logHistoryJob(name, "DEFERRED", "⏸️", name, "Deferred", fmt.Sprintf("Fired %s: deferred to %s.", reason, localTime(at).Format(displayLayout)))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// --- WebSocket ---
+// /ws pushes the live updates entry by entry instead of as whole pages: on
+// connecting a client gets the newest page of the history ("history"), then
+// every new or changed log entry ("entry"), the start and end of job runs
+// ("job", see JobEvent), kernel events ("kernel") and "cleared" when the
+// log was cleared. Each message is a JSON text frame {"event", "data"}. A
+// client that fell behind and lost events gets a fresh "history" page to
+// start over from. The access key is checked as for any request (the
+// browser sends its cookie), and browsers may only connect from the app's
+// own origin.
+
+const wsWriteTimeout = 10 * time.Second
+
+type wsMessage struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	websocket.Server{Handshake: checkWebSocketOrigin, Handler: serveWebSocket}.ServeHTTP(w, r)
+}
+
+// checkWebSocketOrigin refuses pages of other sites than this one and
+// access.trusted_origins; clients that aren't browsers send no Origin.
+func checkWebSocketOrigin(cfg *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" { return nil }
+	u, err := url.Parse(origin)
+	if err != nil { return fmt.Errorf("WebSocket from another origin: %s", origin) }
+	state.mu.Lock()
+	trusted := slices.Contains(state.Config.Access.TrustedOrigins, origin)
+	state.mu.Unlock()
+	if u.Host != r.Host && !trusted { return fmt.Errorf("WebSocket from another origin: %s", origin) }
+	cfg.Origin = u
+	return nil
+}
+
+// newestHistoryJSON is the newest page of the history, as the dashboard
+// first shows it.
+func newestHistoryJSON() []byte {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	page := state.History
+	if len(page) > historyPageSize { page = page[:historyPageSize] }
+	data, _ := json.Marshal(page)
+	return data
+}
+
+func serveWebSocket(ws *websocket.Conn) {
+	defer ws.Close()
+	ch, unsubscribe := hub.Subscribe()
+	defer unsubscribe()
+
+	// Nothing is read from the client; the read only ends when it goes away.
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, ws)
+		close(gone)
+	}()
+	send := func(event string, data []byte) bool {
+		ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return websocket.JSON.Send(ws, wsMessage{Event: event, Data: data}) == nil
+	}
+
+	if !send("history", newestHistoryJSON()) { return }
+	keepalive := time.NewTicker(25 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-gone:
+			return
+		case <-keepalive.C:
+			if !send("ping", nil) { return }
+		case ev := <-ch:
+			// The throttled pages are for /api/events; here entries come one by one.
+			if ev.Name == "history" { continue }
+			if !send(ev.Name, ev.Data) { return }
+			if hub.Lost(ch) && !send("history", newestHistoryJSON()) { return }
+		}
+	}
+}